@@ -3,9 +3,15 @@
 # OpenClaw Backup — Admin CLI
 #
 # Usage:
-#   bash admin.sh list [pending|active|suspended]   — list agents
+#   bash admin.sh list [pending|active|suspended|rejected] — list agents
 #   bash admin.sh approve <agent_id>                — approve a pending agent
 #   bash admin.sh suspend <agent_id>                — suspend an agent
+#   bash admin.sh reject <agent_id> <reason>        — reject a pending agent
+#   bash admin.sh ban <kind> <value> [reason]       — ban a fingerprint, cidr or hostname
+#   bash admin.sh bans                              — list bans
+#   bash admin.sh unban <ban_id>                    — remove a ban
+#   bash admin.sh recovery-code <agent_id>          — issue a token recovery code
+#   bash admin.sh transfer <from_id> <to_id> [copy] — move (or copy) backups to another agent
 #
 set -euo pipefail
 
@@ -28,14 +34,40 @@ admin_curl() {
     curl "${args[@]}" "$@"
 }
 
+# admin_list <url> <field> — follow next_cursor through every page of a list
+# endpoint and print the entries of <field> as one JSON array.
+admin_list() {
+    local url="$1" field="$2" sep="?" cursor="" resp all="[]"
+    [[ "$url" == *"?"* ]] && sep="&"
+    while :; do
+        resp=$(admin_curl "$url${cursor:+${sep}cursor=$cursor}")
+        echo "$resp" | jq -e --arg f "$field" 'has($f)' >/dev/null \
+            || die "Failed to list $field: $(echo "$resp" | jq -r '.error // "unknown"')"
+        all=$(jq -n --argjson a "$all" --argjson r "$resp" --arg f "$field" '$a + $r[$f]')
+        cursor=$(echo "$resp" | jq -r '.next_cursor // empty')
+        [[ -n "$cursor" ]] || break
+    done
+    echo "$all"
+}
+
 usage() {
     cat <<EOF
 Usage: bash admin.sh <command> [args]
 
 Commands:
-  list [status]       List agents (optional: pending, active, suspended)
+  list [status]       List agents (optional: pending, active, suspended, rejected)
   approve <agent_id>  Approve a pending agent
   suspend <agent_id>  Suspend an agent
+  reject <agent_id> <reason>
+                      Reject a pending agent (the agent sees the reason)
+  ban <fingerprint|cidr|hostname> <value> [reason]
+                      Refuse future registrations that match
+  bans                List bans
+  unban <ban_id>      Remove a ban
+  recovery-code <agent_id>
+                      Issue a single-use code to recover a lost agent token
+  transfer <from_id> <to_id> [move|copy]
+                      Move or copy backups to another agent (re-run to resume)
 
 Environment:
   OPENCLAW_BACKUP_URL  Service URL (default: https://agentbackup.zenithstudio.app)
@@ -56,7 +88,7 @@ cmd_list() {
     fi
 
     local resp
-    resp=$(admin_curl "$url")
+    resp=$(admin_list "$url" agents)
 
     local count
     count=$(echo "$resp" | jq 'length')
@@ -110,6 +142,114 @@ cmd_suspend() {
     fi
 }
 
+cmd_reject() {
+    local agent_id="${1:-}" reason="${2:-}"
+    [[ -n "$agent_id" && -n "$reason" ]] || die "Usage: admin.sh reject <agent_id> <reason>"
+
+    local resp
+    resp=$(admin_curl -X POST \
+        -H "Content-Type: application/json" \
+        -d "$(jq -n --arg reason "$reason" '{reason: $reason}')" \
+        "$BACKUP_SERVICE_URL/v1/admin/agents/$agent_id/reject")
+
+    local status
+    status=$(echo "$resp" | jq -r '.status // .error // "unknown"')
+
+    if [[ "$status" == "rejected" ]]; then
+        ok "Agent $agent_id rejected"
+    else
+        die "Failed to reject $agent_id: $status"
+    fi
+}
+
+cmd_ban() {
+    local kind="${1:-}" value="${2:-}" reason="${3:-}"
+    [[ -n "$kind" && -n "$value" ]] || die "Usage: admin.sh ban <fingerprint|cidr|hostname> <value> [reason]"
+
+    local resp
+    resp=$(admin_curl -X POST \
+        -H "Content-Type: application/json" \
+        -d "$(jq -n --arg kind "$kind" --arg value "$value" --arg reason "$reason" '{kind: $kind, value: $value, reason: $reason}')" \
+        "$BACKUP_SERVICE_URL/v1/admin/bans")
+
+    local id
+    id=$(echo "$resp" | jq -r '.id // empty')
+    [[ -n "$id" ]] || die "Failed to create ban: $(echo "$resp" | jq -r '.error // "unknown"')"
+
+    ok "Banned $kind $(echo "$resp" | jq -r '.value') ($id)"
+}
+
+cmd_bans() {
+    local resp
+    resp=$(admin_list "$BACKUP_SERVICE_URL/v1/admin/bans" bans)
+
+    if [[ "$(echo "$resp" | jq 'length')" == "0" ]]; then
+        info "No bans"
+        return
+    fi
+
+    echo "$resp" | jq -r '
+        ["BAN_ID", "KIND", "VALUE", "REASON", "CREATED"],
+        (.[] | [.id, .kind, .value, (.reason // ""), .created_at]) |
+        @tsv
+    ' | column -t -s $'\t'
+}
+
+cmd_unban() {
+    local ban_id="${1:-}"
+    [[ -n "$ban_id" ]] || die "Usage: admin.sh unban <ban_id>"
+
+    local resp
+    resp=$(admin_curl -X DELETE "$BACKUP_SERVICE_URL/v1/admin/bans/$ban_id")
+
+    if [[ "$(echo "$resp" | jq -r '.deleted // empty')" == "$ban_id" ]]; then
+        ok "Ban $ban_id removed"
+    else
+        die "Failed to remove $ban_id: $(echo "$resp" | jq -r '.error // "unknown"')"
+    fi
+}
+
+cmd_recovery_code() {
+    local agent_id="${1:-}"
+    [[ -n "$agent_id" ]] || die "Usage: admin.sh recovery-code <agent_id>"
+
+    local resp
+    resp=$(admin_curl -X POST "$BACKUP_SERVICE_URL/v1/admin/agents/$agent_id/recovery-code")
+
+    local code
+    code=$(echo "$resp" | jq -r '.recovery_code // empty')
+
+    if [[ -z "$code" ]]; then
+        die "Failed to issue recovery code for $agent_id: $(echo "$resp" | jq -r '.error // "unknown"')"
+    fi
+
+    ok "Recovery code for $agent_id (expires $(echo "$resp" | jq -r '.expires_at')):"
+    echo ""
+    echo "  $code"
+    echo ""
+    info "On the new machine: OPENCLAW_BACKUP_RECOVERY_CODE=$code bash setup.sh"
+}
+
+cmd_transfer() {
+    local from_id="${1:-}" to_id="${2:-}" mode="${3:-move}"
+    [[ -n "$from_id" && -n "$to_id" ]] || die "Usage: admin.sh transfer <from_id> <to_id> [move|copy]"
+
+    local resp
+    resp=$(admin_curl -X POST \
+        -H "Content-Type: application/json" \
+        -d "$(jq -n --arg to "$to_id" --arg mode "$mode" '{target_agent_id: $to, mode: $mode}')" \
+        "$BACKUP_SERVICE_URL/v1/admin/agents/$from_id/transfer")
+
+    local status
+    status=$(echo "$resp" | jq -r '.status // .error // "unknown"')
+
+    if [[ "$status" == "completed" ]]; then
+        ok "Transferred $(echo "$resp" | jq -r '.total_count') backup(s) $from_id -> $to_id ($mode)"
+    else
+        die "Transfer $from_id -> $to_id failed: $status"
+    fi
+}
+
 # ---------------------------------------------------------------------------
 # Main
 # ---------------------------------------------------------------------------
@@ -119,5 +259,11 @@ case "$1" in
     list)    cmd_list "${2:-}" ;;
     approve) cmd_approve "${2:-}" ;;
     suspend) cmd_suspend "${2:-}" ;;
+    reject)  cmd_reject "${2:-}" "${3:-}" ;;
+    ban)     cmd_ban "${2:-}" "${3:-}" "${4:-}" ;;
+    bans)    cmd_bans ;;
+    unban)   cmd_unban "${2:-}" ;;
+    recovery-code) cmd_recovery_code "${2:-}" ;;
+    transfer) cmd_transfer "${2:-}" "${3:-}" "${4:-}" ;;
     *)       usage ;;
 esac
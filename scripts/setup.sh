@@ -218,8 +218,33 @@ MACHINE_FINGERPRINT="$(printf '%s:%s:%s' "$AGENT_HOSTNAME" "$AGENT_OS" "$(whoami
 # ---------------------------------------------------------------------------
 # Register with backup service
 # ---------------------------------------------------------------------------
+RECOVERY_CODE="${OPENCLAW_BACKUP_RECOVERY_CODE:-}"
+
 if [[ -f "$STATE_DIR/agent.token" ]]; then
     info "Agent already registered, skipping registration"
+elif [[ -n "$RECOVERY_CODE" ]]; then
+    info "Recovering existing agent with recovery code..."
+
+    RECOVER_RESPONSE=$(curl -sf -X POST \
+        -H "Content-Type: application/json" \
+        -d "$(jq -n --arg code "$RECOVERY_CODE" '{recovery_code: $code}')" \
+        "$BACKUP_SERVICE_URL/v1/agents/recover" 2>&1) \
+        || die "Recovery failed. The code may be invalid, used or expired — ask an admin for a new one."
+
+    AGENT_ID=$(echo "$RECOVER_RESPONSE" | jq -r '.agent_id // empty')
+    AGENT_TOKEN=$(echo "$RECOVER_RESPONSE" | jq -r '.token // empty')
+    AGENT_STATUS=$(echo "$RECOVER_RESPONSE" | jq -r '.status // "active"')
+
+    [[ -n "$AGENT_ID" ]]    || die "Recovery response missing agent_id"
+    [[ -n "$AGENT_TOKEN" ]] || die "Recovery response missing token"
+
+    echo "$AGENT_TOKEN" > "$STATE_DIR/agent.token"
+    chmod 600 "$STATE_DIR/agent.token"
+
+    echo "$AGENT_ID" > "$STATE_DIR/agent.id"
+    echo "$AGENT_STATUS" > "$STATE_DIR/agent.status"
+
+    ok "Recovered agent $AGENT_ID (status: $AGENT_STATUS)"
 else
     info "Registering with backup service at $BACKUP_SERVICE_URL ..."
 
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Auto-approval rules
+// ---------------------------------------------------------------------------
+//
+// Register evaluates the rules in priority order for registrations that do
+// not carry an invite code (an invite code's grants always win). The first
+// rule whose conditions all match decides: it can approve the agent, assign a
+// plan, or both. Its ID is stored on the agent as approval_rule.
+
+// matchApprovalRule returns the first rule matching the registration, or nil.
+func (h *Handlers) matchApprovalRule(ctx context.Context, req *RegisterRequest, ip string) (*ApprovalRule, error) {
+	rules, err := h.store.ListApprovalRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if ruleMatches(&rules[i], req, ip) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func ruleMatches(rule *ApprovalRule, req *RegisterRequest, ip string) bool {
+	if len(rule.SourceCIDRs) > 0 {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return false
+		}
+		inRange := false
+		for _, cidr := range rule.SourceCIDRs {
+			if _, ipnet, err := net.ParseCIDR(cidr); err == nil && ipnet.Contains(addr) {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	if rule.HostnameRegex != "" {
+		re, err := regexp.Compile(rule.HostnameRegex)
+		if err != nil || !re.MatchString(req.Hostname) {
+			return false
+		}
+	}
+
+	if rule.OS != "" && !strings.EqualFold(rule.OS, req.OS) {
+		return false
+	}
+	if rule.Arch != "" && !strings.EqualFold(rule.Arch, req.Arch) {
+		return false
+	}
+
+	if rule.MinVersion != "" || rule.MaxVersion != "" {
+		if req.OpenClawVersion == "" {
+			return false
+		}
+		if rule.MinVersion != "" && compareVersions(req.OpenClawVersion, rule.MinVersion) < 0 {
+			return false
+		}
+		if rule.MaxVersion != "" && compareVersions(req.OpenClawVersion, rule.MaxVersion) > 0 {
+			return false
+		}
+	}
+
+	if len(rule.Fingerprints) > 0 {
+		allowed := false
+		for _, fp := range rule.Fingerprints {
+			if req.Fingerprint != "" && strings.EqualFold(fp, req.Fingerprint) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareVersions compares dotted version strings such as "1.4.2" or
+// "v2.0", numerically per component. Missing components count as zero and
+// anything after a "-" or "+" (pre-release, build metadata) is ignored.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+type ApprovalRuleRequest struct {
+	Name          string   `json:"name"`
+	Priority      int      `json:"priority"`
+	SourceCIDRs   []string `json:"source_cidrs"`
+	HostnameRegex string   `json:"hostname_regex"`
+	OS            string   `json:"os"`
+	Arch          string   `json:"arch"`
+	MinVersion    string   `json:"min_version"`
+	MaxVersion    string   `json:"max_version"`
+	Fingerprints  []string `json:"fingerprints"`
+	Approve       bool     `json:"approve"`
+	Plan          string   `json:"plan"`
+}
+
+type ApprovalRuleResponse struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name,omitempty"`
+	Priority      int      `json:"priority"`
+	SourceCIDRs   []string `json:"source_cidrs,omitempty"`
+	HostnameRegex string   `json:"hostname_regex,omitempty"`
+	OS            string   `json:"os,omitempty"`
+	Arch          string   `json:"arch,omitempty"`
+	MinVersion    string   `json:"min_version,omitempty"`
+	MaxVersion    string   `json:"max_version,omitempty"`
+	Fingerprints  []string `json:"fingerprints,omitempty"`
+	Approve       bool     `json:"approve"`
+	Plan          string   `json:"plan,omitempty"`
+	CreatedAt     string   `json:"created_at"`
+}
+
+func approvalRuleToResponse(r ApprovalRule) ApprovalRuleResponse {
+	return ApprovalRuleResponse{
+		ID:            r.ID,
+		Name:          r.Name,
+		Priority:      r.Priority,
+		SourceCIDRs:   r.SourceCIDRs,
+		HostnameRegex: r.HostnameRegex,
+		OS:            r.OS,
+		Arch:          r.Arch,
+		MinVersion:    r.MinVersion,
+		MaxVersion:    r.MaxVersion,
+		Fingerprints:  r.Fingerprints,
+		Approve:       r.Approve,
+		Plan:          r.Plan,
+		CreatedAt:     r.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/approval-rules
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminCreateApprovalRule(w http.ResponseWriter, r *http.Request) {
+	var req ApprovalRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Approve && req.Plan == "" {
+		jsonError(w, "a rule must approve, assign a plan, or both", http.StatusBadRequest)
+		return
+	}
+	if req.Plan != "" {
+		if _, ok := h.config.Plans[req.Plan]; !ok {
+			jsonError(w, fmt.Sprintf("unknown plan %q", req.Plan), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.SourceCIDRs) == 0 && req.HostnameRegex == "" && req.OS == "" && req.Arch == "" &&
+		req.MinVersion == "" && req.MaxVersion == "" && len(req.Fingerprints) == 0 {
+		jsonError(w, "a rule needs at least one condition", http.StatusBadRequest)
+		return
+	}
+
+	var cidrs []string
+	for _, c := range req.SourceCIDRs {
+		v, ok := normalizeBanValue("cidr", c)
+		if !ok {
+			jsonError(w, fmt.Sprintf("invalid CIDR %q", c), http.StatusBadRequest)
+			return
+		}
+		cidrs = append(cidrs, v)
+	}
+	if req.HostnameRegex != "" {
+		if _, err := regexp.Compile(req.HostnameRegex); err != nil {
+			jsonError(w, "invalid hostname_regex: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.MinVersion != "" && req.MaxVersion != "" && compareVersions(req.MinVersion, req.MaxVersion) > 0 {
+		jsonError(w, "min_version must not be greater than max_version", http.StatusBadRequest)
+		return
+	}
+	var fingerprints []string
+	for _, fp := range req.Fingerprints {
+		if fp = strings.TrimSpace(fp); fp != "" {
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+
+	id, err := GenerateRuleID()
+	if err != nil {
+		internalError(w, r, "generate rule ID", err)
+		return
+	}
+
+	rule := &ApprovalRule{
+		ID:            id,
+		Name:          strings.TrimSpace(req.Name),
+		Priority:      req.Priority,
+		SourceCIDRs:   cidrs,
+		HostnameRegex: req.HostnameRegex,
+		OS:            strings.TrimSpace(req.OS),
+		Arch:          strings.TrimSpace(req.Arch),
+		MinVersion:    strings.TrimSpace(req.MinVersion),
+		MaxVersion:    strings.TrimSpace(req.MaxVersion),
+		Fingerprints:  fingerprints,
+		Approve:       req.Approve,
+		Plan:          req.Plan,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := h.store.CreateApprovalRule(r.Context(), rule); err != nil {
+		internalError(w, r, "create approval rule", err)
+		return
+	}
+
+	logger(r.Context()).Info("admin created approval rule", "rule_id", rule.ID, "name", rule.Name, "approve", rule.Approve, "plan", rule.Plan)
+	h.audit(r, "approval_rule.create", "", "approval_rule:"+rule.ID, nil, approvalRuleToResponse(*rule))
+	jsonResponse(w, http.StatusCreated, approvalRuleToResponse(*rule))
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/approval-rules
+// ---------------------------------------------------------------------------
+
+type ListApprovalRulesResponse struct {
+	ApprovalRules []ApprovalRuleResponse `json:"approval_rules"`
+	NextCursor    string                 `json:"next_cursor,omitempty"`
+}
+
+func (h *Handlers) AdminListApprovalRules(w http.ResponseWriter, r *http.Request) {
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	rules, err := h.store.ListApprovalRules(r.Context())
+	if err != nil {
+		internalError(w, r, "list approval rules", err)
+		return
+	}
+	start, end, next, err := offsetPage(len(rules), page)
+	if err != nil {
+		internalError(w, r, "list approval rules", err)
+		return
+	}
+
+	resp := make([]ApprovalRuleResponse, 0, end-start)
+	for _, rule := range rules[start:end] {
+		resp = append(resp, approvalRuleToResponse(rule))
+	}
+	jsonResponse(w, http.StatusOK, ListApprovalRulesResponse{ApprovalRules: resp, NextCursor: next})
+}
+
+// ---------------------------------------------------------------------------
+// DELETE /v1/admin/approval-rules/{id}
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminDeleteApprovalRule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "rule id required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.DeleteApprovalRule(r.Context(), id); err != nil {
+		logger(r.Context()).Error("delete approval rule", "rule_id", id, "err", err)
+		jsonError(w, "approval rule not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin deleted approval rule", "rule_id", id)
+	h.audit(r, "approval_rule.delete", "", "approval_rule:"+id, nil, nil)
+	jsonResponse(w, http.StatusOK, map[string]string{"deleted": id})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Audit log
+// ---------------------------------------------------------------------------
+//
+// Security-relevant actions (status changes, token rotations and recoveries,
+// backup deletions, invite codes, bans, rules and org keys) append an
+// AuditEvent to the DataStore recording who did what to which object, from
+// where, and the state before and after. Events are never modified; they are
+// dropped once AuditRetentionDays have passed.
+
+// audit appends an event for the action taken by request r. before and after
+// are stored as JSON; nil means no state. The action has already happened
+// when audit is called, so failures are logged rather than returned.
+func (h *Handlers) audit(r *http.Request, action, agentID, target string, before, after any) {
+	id, err := GenerateAuditID()
+	if err != nil {
+		logger(r.Context()).Error("generate audit ID", "err", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	e := &AuditEvent{
+		ID:        id,
+		Action:    action,
+		Actor:     auditActor(r),
+		AgentID:   agentID,
+		Target:    target,
+		IP:        clientIP(r),
+		Before:    auditState(before),
+		After:     auditState(after),
+		CreatedAt: now,
+	}
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		e.RequestID = info.ID
+	}
+	if h.config.AuditRetentionDays > 0 {
+		expires := now.AddDate(0, 0, h.config.AuditRetentionDays)
+		e.ExpiresAt = &expires
+	}
+
+	if err := h.store.AppendAuditEvent(r.Context(), e); err != nil {
+		logger(r.Context()).Error("append audit event", "action", action, "target", target, "err", err)
+	}
+}
+
+// auditActor identifies the caller of r: an admin key, an authenticated
+// agent, or "anonymous" for public endpoints such as registration.
+func auditActor(r *http.Request) string {
+	if info := requestInfoFromContext(r.Context()); info != nil && info.Admin != "" {
+		return "admin:" + info.Admin
+	}
+	if agent := AgentFromContext(r.Context()); agent != nil {
+		return "agent:" + agent.ID
+	}
+	return "anonymous"
+}
+
+func auditState(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// agentState is the part of an agent recorded around status and org changes.
+func agentState(a *Agent) map[string]string {
+	if a == nil {
+		return nil
+	}
+	state := map[string]string{"status": a.Status}
+	if a.StatusReason != "" {
+		state["reason"] = a.StatusReason
+	}
+	if a.OrgID != "" {
+		state["org_id"] = a.OrgID
+	}
+	return state
+}
+
+// backupState is the part of a backup recorded around deletions.
+func backupState(b *Backup) map[string]any {
+	return map[string]any{
+		"encrypted_bytes":  b.EncryptedBytes,
+		"encrypted_sha256": b.EncryptedSHA256,
+	}
+}
+
+type AuditEventResponse struct {
+	ID        string          `json:"id"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	AgentID   string          `json:"agent_id,omitempty"`
+	Target    string          `json:"target,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt string          `json:"created_at"`
+}
+
+type ListAuditEventsResponse struct {
+	Events     []AuditEventResponse `json:"events"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+func auditEventToResponse(e AuditEvent) AuditEventResponse {
+	return AuditEventResponse{
+		ID:        e.ID,
+		Action:    e.Action,
+		Actor:     e.Actor,
+		AgentID:   e.AgentID,
+		Target:    e.Target,
+		IP:        e.IP,
+		RequestID: e.RequestID,
+		Before:    e.Before,
+		After:     e.After,
+		CreatedAt: e.CreatedAt.Format(time.RFC3339Nano),
+	}
+}
+
+// parseAuditFilter reads the since, cursor and limit query parameters
+// shared by the audit endpoints. since accepts RFC 3339 or a duration back
+// from now ("24h").
+func parseAuditFilter(r *http.Request) (AuditFilter, string) {
+	var f AuditFilter
+	var msg string
+	if f.Page, msg = parsePage(r); msg != "" {
+		return f, msg
+	}
+
+	if v := r.URL.Query().Get("since"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			f.Since = t
+		} else if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			f.Since = time.Now().UTC().Add(-d)
+		} else {
+			return f, "since must be an RFC 3339 time or a duration such as 24h"
+		}
+	}
+	return f, ""
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/audit
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	f, msg := parseAuditFilter(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	f.AgentID = r.URL.Query().Get("agent")
+	f.Action = r.URL.Query().Get("action")
+
+	events, next, err := h.store.ListAuditEvents(r.Context(), f)
+	if err != nil {
+		internalError(w, r, "list audit events", err)
+		return
+	}
+
+	resp := make([]AuditEventResponse, len(events))
+	for i, e := range events {
+		resp[i] = auditEventToResponse(e)
+	}
+	jsonResponse(w, http.StatusOK, ListAuditEventsResponse{Events: resp, NextCursor: next})
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/agents/me/audit
+// ---------------------------------------------------------------------------
+
+// AgentAuditEvents returns the caller's own trail. Admin identities and
+// addresses are not shown to agents.
+func (h *Handlers) AgentAuditEvents(w http.ResponseWriter, r *http.Request) {
+	agent := AgentFromContext(r.Context())
+
+	f, msg := parseAuditFilter(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	f.AgentID = agent.ID
+	f.Action = r.URL.Query().Get("action")
+
+	events, next, err := h.store.ListAuditEvents(r.Context(), f)
+	if err != nil {
+		internalError(w, r, "list audit events", err)
+		return
+	}
+
+	resp := make([]AuditEventResponse, len(events))
+	for i, e := range events {
+		if strings.HasPrefix(e.Actor, "admin:") {
+			e.Actor = "admin"
+			e.IP = ""
+		}
+		resp[i] = auditEventToResponse(e)
+	}
+	jsonResponse(w, http.StatusOK, ListAuditEventsResponse{Events: resp, NextCursor: next})
+}
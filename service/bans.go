@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Registration ban list
+// ---------------------------------------------------------------------------
+//
+// Bans are checked by Register before an agent, token or invite redemption is
+// created. A ban matches on one of:
+//   - fingerprint: the machine_fingerprint sent at registration (exact, case-insensitive)
+//   - cidr:        the client IP; a bare address is stored as a /32, and IPv6
+//                  bans are widened to at least their /64 (see clientKey)
+//   - hostname:    a shell-style pattern such as "*.spam.example" (case-insensitive)
+
+// matchBan returns the first ban matching the registration, or nil.
+func (h *Handlers) matchBan(ctx context.Context, fingerprint, ip, hostname string) (*Ban, error) {
+	bans, err := h.store.ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.ParseIP(ip)
+	for i := range bans {
+		b := &bans[i]
+		switch b.Kind {
+		case "fingerprint":
+			if fingerprint != "" && strings.EqualFold(b.Value, fingerprint) {
+				return b, nil
+			}
+		case "cidr":
+			_, ipnet, err := net.ParseCIDR(b.Value)
+			if err == nil && addr != nil && banNetwork(ipnet).Contains(addr) {
+				return b, nil
+			}
+		case "hostname":
+			if hostname != "" && matchHostname(b.Value, hostname) {
+				return b, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// normalizeBanValue validates a ban value for its kind and returns the form
+// that is stored.
+func normalizeBanValue(kind, value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", false
+	}
+	switch kind {
+	case "fingerprint":
+		return value, true
+	case "cidr":
+		if ip := net.ParseIP(value); ip != nil {
+			if ip.To4() != nil {
+				return ip.String() + "/32", true
+			}
+			value = ip.String() + "/128"
+		}
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", false
+		}
+		return banNetwork(ipnet).String(), true
+	case "hostname":
+		if _, err := path.Match(value, ""); err != nil {
+			return "", false
+		}
+		return strings.ToLower(value), true
+	}
+	return "", false
+}
+
+// banNetwork widens IPv6 networks narrower than /64 to their /64, matching
+// how clients are grouped for rate limiting.
+func banNetwork(ipnet *net.IPNet) *net.IPNet {
+	if ipnet.IP.To4() != nil {
+		return ipnet
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > 64 {
+		mask := net.CIDRMask(64, 128)
+		return &net.IPNet{IP: ipnet.IP.Mask(mask), Mask: mask}
+	}
+	return ipnet
+}
+
+type CreateBanRequest struct {
+	Kind   string `json:"kind"` // "fingerprint", "cidr" or "hostname"
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+type BanResponse struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Value     string `json:"value"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+func banToResponse(b Ban) BanResponse {
+	return BanResponse{
+		ID:        b.ID,
+		Kind:      b.Kind,
+		Value:     b.Value,
+		Reason:    b.Reason,
+		CreatedAt: b.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/bans
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminCreateBan(w http.ResponseWriter, r *http.Request) {
+	var req CreateBanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	kind := strings.ToLower(strings.TrimSpace(req.Kind))
+	if kind != "fingerprint" && kind != "cidr" && kind != "hostname" {
+		jsonError(w, "kind must be \"fingerprint\", \"cidr\" or \"hostname\"", http.StatusBadRequest)
+		return
+	}
+	value, ok := normalizeBanValue(kind, req.Value)
+	if !ok {
+		jsonError(w, "invalid value for "+kind+" ban", http.StatusBadRequest)
+		return
+	}
+	if len(req.Reason) > 500 {
+		jsonError(w, "reason must be 500 characters or less", http.StatusBadRequest)
+		return
+	}
+
+	id, err := GenerateBanID()
+	if err != nil {
+		internalError(w, r, "generate ban ID", err)
+		return
+	}
+
+	b := &Ban{
+		ID:        id,
+		Kind:      kind,
+		Value:     value,
+		Reason:    strings.TrimSpace(req.Reason),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := h.store.CreateBan(r.Context(), b); err != nil {
+		internalError(w, r, "create ban", err)
+		return
+	}
+
+	logger(r.Context()).Info("admin created ban", "ban_id", b.ID, "kind", b.Kind, "value", b.Value)
+	h.audit(r, "ban.create", "", "ban:"+b.ID, nil, banToResponse(*b))
+	jsonResponse(w, http.StatusCreated, banToResponse(*b))
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/bans
+// ---------------------------------------------------------------------------
+
+type ListBansResponse struct {
+	Bans       []BanResponse `json:"bans"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+func (h *Handlers) AdminListBans(w http.ResponseWriter, r *http.Request) {
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	bans, err := h.store.ListBans(r.Context())
+	if err != nil {
+		internalError(w, r, "list bans", err)
+		return
+	}
+	start, end, next, err := offsetPage(len(bans), page)
+	if err != nil {
+		internalError(w, r, "list bans", err)
+		return
+	}
+
+	resp := make([]BanResponse, 0, end-start)
+	for _, b := range bans[start:end] {
+		resp = append(resp, banToResponse(b))
+	}
+	jsonResponse(w, http.StatusOK, ListBansResponse{Bans: resp, NextCursor: next})
+}
+
+// ---------------------------------------------------------------------------
+// DELETE /v1/admin/bans/{id}
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminDeleteBan(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "ban id required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.DeleteBan(r.Context(), id); err != nil {
+		logger(r.Context()).Error("delete ban", "ban_id", id, "err", err)
+		jsonError(w, "ban not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin deleted ban", "ban_id", id)
+	h.audit(r, "ban.delete", "", "ban:"+id, nil, nil)
+	jsonResponse(w, http.StatusOK, map[string]string{"deleted": id})
+}
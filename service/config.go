@@ -1,25 +1,52 @@
 package main
 
 import (
+	"log/slog"
+	"net"
+	"net/mail"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	// Server
-	ListenAddr string
+	ListenAddr  string
+	LogFormat   string // "json" (default) or "text"
+	LogLevel    string // "debug", "info" (default), "warn" or "error"
+	MetricsAddr string // separate listener for /metrics; empty serves it on ListenAddr behind the admin key
 
-	// Store mode: "sqlite" or "dynamo"
-	StoreMode string
+	// Time allowed for each dependency check of /readyz
+	ReadinessTimeout time.Duration
+
+	// OpenTelemetry tracing over OTLP/HTTP. An empty endpoint disables it.
+	OTLPEndpoint     string  // collector base URL, e.g. http://localhost:4318
+	TraceServiceName string  // service.name resource attribute
+	TraceSampleRatio float64 // fraction of new traces sampled; inbound sampling decisions are honoured
+
+	// Reverse proxies allowed to set X-Forwarded-For / X-Real-IP. Ignored on
+	// Lambda, where API Gateway's sourceIp is used.
+	TrustedProxies []*net.IPNet
+
+	// Store mode: "sqlite", "postgres" or "dynamo"
+	StoreMode    string
+	StoreTimeout time.Duration // bound on each store call; 0 = only the caller's deadline
 
 	// SQLite (local dev)
 	DatabasePath string
 
+	// PostgreSQL (self-hosted)
+	DatabaseURL string
+
 	// DynamoDB (Lambda)
-	DynamoEndpoint    string
-	DynamoAgentsTable string
-	DynamoBackupsTable string
+	DynamoEndpoint         string
+	DynamoAgentsTable      string
+	DynamoBackupsTable     string
+	DynamoRedemptionsTable string
+	DynamoRateLimitsTable  string
+	DynamoAuditTable       string
+	DynamoDeliveriesTable  string
 
 	// S3-compatible storage
 	S3Endpoint       string
@@ -36,6 +63,15 @@ type Config struct {
 	// API key for admin endpoints (empty = disabled, for local dev)
 	AdminAPIKey string
 
+	// Plans granted via invite codes. The default plan always exists and
+	// uses DefaultQuotaBytes.
+	DefaultPlan string
+	Plans       map[string]Plan
+
+	// Invite code format
+	InviteCodePrefix string // upper-cased, up to 16 of A-Z and 0-9 (default "ZNTH")
+	InviteCodeLength int    // random characters after the prefix, 6 to 32 (default 8)
+
 	// Limits
 	DefaultQuotaBytes      int64
 	RegisterRateLimit      int   // requests per minute per IP
@@ -44,10 +80,43 @@ type Config struct {
 	MaxBackupsPerAgent     int   // max backups to keep per agent (default 7)
 	MaxPendingAgents       int   // max pending registrations (default 100)
 	PresignExpiry          time.Duration
+	RecoveryCodeTTLHours   int // hours an admin-issued recovery code stays valid (default 24)
+
+	// Rate limiting. RegisterRateLimit applies on top of IPRateLimit for
+	// registration and recovery.
+	RateLimitBackend string // "memory" or "store" (default "store" on Lambda)
+	IPRateLimit      RateLimitPolicy
+	AgentRateLimit   RateLimitPolicy
+
+	// Stale-agent detection. An active agent is flagged when its newest
+	// backup is older than its threshold: the agent's own, else its plan's,
+	// else StaleAfterHours.
+	StaleAfterHours    int           // default threshold; 0 = only plan and agent thresholds apply
+	StaleCheckInterval time.Duration // how often the HTTP server runs the check; 0 = never
+
+	// Webhook delivery. A failed attempt is retried after WebhookRetryBase,
+	// doubling each time, until WebhookMaxAttempts have been made.
+	WebhookMaxAttempts  int
+	WebhookRetryBase    time.Duration
+	WebhookTimeout      time.Duration
+	QuotaWarningPercent int // quota.near_limit fires when usage crosses this (0 disables)
+
+	// Email notifications over SMTP. An empty SMTPHost disables email.
+	// Admins hear about pending registrations as they happen ("immediate")
+	// or once a day ("digest").
+	SMTPHost       string
+	SMTPPort       int
+	SMTPUsername   string
+	SMTPPassword   string
+	SMTPFrom       string
+	SMTPTimeout    time.Duration
+	AdminEmails    []string
+	AdminEmailMode string // "digest" (default), "immediate" or "off"
 
 	// Retention (free tier defaults)
-	RetentionDays    int
-	DeleteGraceHours int // hours before soft-deleted backups are purged (default 72)
+	RetentionDays      int
+	AuditRetentionDays int // audit events are kept this long; 0 = forever
+	DeleteGraceHours   int // hours before soft-deleted backups are purged (default 72)
 }
 
 func LoadConfig() *Config {
@@ -57,31 +126,82 @@ func LoadConfig() *Config {
 		storeMode = "dynamo"
 	}
 
+	defaultQuota := envInt64("DEFAULT_QUOTA_BYTES", 500*1024*1024) // 500 MB
+	defaultPlan := envOr("DEFAULT_PLAN", "free")
+
+	rateLimitBackend := "memory"
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		rateLimitBackend = "store"
+	}
+
 	return &Config{
-		ListenAddr:         envOr("LISTEN_ADDR", ":8080"),
-		StoreMode:          storeMode,
-		DatabasePath:       envOr("DATABASE_PATH", "./backup.db"),
-		DynamoEndpoint:     envOr("DYNAMO_ENDPOINT", ""),
-		DynamoAgentsTable:  envOr("DYNAMO_AGENTS_TABLE", "openclaw-backup-agents"),
-		DynamoBackupsTable: envOr("DYNAMO_BACKUPS_TABLE", "openclaw-backup-backups"),
-		S3Endpoint:         envOr("S3_ENDPOINT", ""),
-		S3PublicEndpoint:   envOr("S3_PUBLIC_ENDPOINT", ""),
-		S3Region:           envOr("S3_REGION", "us-east-1"),
-		S3Bucket:           envOr("S3_BUCKET", "openclaw-backups"),
-		S3AccessKey:        envOr("S3_ACCESS_KEY", ""),
-		S3SecretKey:        envOr("S3_SECRET_KEY", ""),
-		S3ForcePathStyle:   envOr("S3_FORCE_PATH_STYLE", "false") == "true",
-		TokenSecret:        envOr("TOKEN_SECRET", "change-me-in-production"),
-		AdminAPIKey:        os.Getenv("ADMIN_API_KEY"),
-		DefaultQuotaBytes:      envInt64("DEFAULT_QUOTA_BYTES", 500*1024*1024), // 500 MB
+		DefaultPlan:            defaultPlan,
+		Plans:                  parsePlans(os.Getenv("PLANS"), defaultPlan, defaultQuota),
+		InviteCodePrefix:       parseInviteCodePrefix(os.Getenv("INVITE_CODE_PREFIX")),
+		InviteCodeLength:       parseInviteCodeLength(os.Getenv("INVITE_CODE_LENGTH")),
+		ListenAddr:             envOr("LISTEN_ADDR", ":8080"),
+		MetricsAddr:            os.Getenv("METRICS_ADDR"),
+		ReadinessTimeout:       time.Duration(envInt64("READINESS_TIMEOUT_SECONDS", 2)) * time.Second,
+		LogFormat:              envOr("LOG_FORMAT", "json"),
+		LogLevel:               envOr("LOG_LEVEL", "info"),
+		OTLPEndpoint:           os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		TraceServiceName:       envOr("OTEL_SERVICE_NAME", "openclaw-backup-service"),
+		TraceSampleRatio:       envFloat64("TRACE_SAMPLE_RATIO", 1),
+		TrustedProxies:         parseCIDRs("TRUSTED_PROXIES", os.Getenv("TRUSTED_PROXIES")),
+		StoreMode:              storeMode,
+		StoreTimeout:           time.Duration(envInt64("STORE_TIMEOUT_SECONDS", 10)) * time.Second,
+		DatabasePath:           envOr("DATABASE_PATH", "./backup.db"),
+		DatabaseURL:            os.Getenv("DATABASE_URL"),
+		DynamoEndpoint:         envOr("DYNAMO_ENDPOINT", ""),
+		DynamoAgentsTable:      envOr("DYNAMO_AGENTS_TABLE", "openclaw-backup-agents"),
+		DynamoBackupsTable:     envOr("DYNAMO_BACKUPS_TABLE", "openclaw-backup-backups"),
+		DynamoRedemptionsTable: envOr("DYNAMO_REDEMPTIONS_TABLE", "openclaw-backup-invite-redemptions"),
+		DynamoRateLimitsTable:  envOr("DYNAMO_RATE_LIMITS_TABLE", "openclaw-backup-rate-limits"),
+		DynamoAuditTable:       envOr("DYNAMO_AUDIT_TABLE", "openclaw-backup-audit"),
+		DynamoDeliveriesTable:  envOr("DYNAMO_WEBHOOK_DELIVERIES_TABLE", "openclaw-backup-webhook-deliveries"),
+		S3Endpoint:             envOr("S3_ENDPOINT", ""),
+		S3PublicEndpoint:       envOr("S3_PUBLIC_ENDPOINT", ""),
+		S3Region:               envOr("S3_REGION", "us-east-1"),
+		S3Bucket:               envOr("S3_BUCKET", "openclaw-backups"),
+		S3AccessKey:            envOr("S3_ACCESS_KEY", ""),
+		S3SecretKey:            envOr("S3_SECRET_KEY", ""),
+		S3ForcePathStyle:       envOr("S3_FORCE_PATH_STYLE", "false") == "true",
+		TokenSecret:            envOr("TOKEN_SECRET", "change-me-in-production"),
+		AdminAPIKey:            os.Getenv("ADMIN_API_KEY"),
+		DefaultQuotaBytes:      defaultQuota,
 		RegisterRateLimit:      int(envInt64("REGISTER_RATE_LIMIT", 10)),
+		RateLimitBackend:       envOr("RATE_LIMIT_BACKEND", rateLimitBackend),
+		IPRateLimit: RateLimitPolicy{
+			PerMinute: int(envInt64("IP_RATE_LIMIT", 300)),
+			Burst:     int(envInt64("IP_RATE_LIMIT_BURST", 0)),
+		},
+		AgentRateLimit: RateLimitPolicy{
+			PerMinute: int(envInt64("AGENT_RATE_LIMIT", 60)),
+			Burst:     int(envInt64("AGENT_RATE_LIMIT_BURST", 0)),
+		},
 		MaxUploadBytes:         envInt64("MAX_UPLOAD_BYTES", 5*1024*1024), // 5 MB
 		MinBackupIntervalHours: int(envInt64("MIN_BACKUP_INTERVAL_HOURS", 12)),
 		MaxBackupsPerAgent:     int(envInt64("MAX_BACKUPS_PER_AGENT", 7)),
 		MaxPendingAgents:       int(envInt64("MAX_PENDING_AGENTS", 100)),
 		PresignExpiry:          time.Duration(envInt64("PRESIGN_EXPIRY_SECONDS", 900)) * time.Second,
+		RecoveryCodeTTLHours:   int(envInt64("RECOVERY_CODE_TTL_HOURS", 24)),
 		RetentionDays:          int(envInt64("RETENTION_DAYS", 7)),
+		AuditRetentionDays:     int(envInt64("AUDIT_RETENTION_DAYS", 365)),
 		DeleteGraceHours:       int(envInt64("DELETE_GRACE_HOURS", 72)),
+		StaleAfterHours:        int(envInt64("STALE_AFTER_HOURS", 48)),
+		StaleCheckInterval:     time.Duration(envInt64("STALE_CHECK_INTERVAL_MINUTES", 60)) * time.Minute,
+		WebhookMaxAttempts:     int(envInt64("WEBHOOK_MAX_ATTEMPTS", 8)),
+		WebhookRetryBase:       time.Duration(envInt64("WEBHOOK_RETRY_BASE_SECONDS", 30)) * time.Second,
+		WebhookTimeout:         time.Duration(envInt64("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second,
+		QuotaWarningPercent:    int(envInt64("QUOTA_WARNING_PERCENT", 90)),
+		SMTPHost:               os.Getenv("SMTP_HOST"),
+		SMTPPort:               int(envInt64("SMTP_PORT", 587)),
+		SMTPUsername:           os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:           os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:               envOr("SMTP_FROM", "openclaw-backup@localhost"),
+		SMTPTimeout:            time.Duration(envInt64("SMTP_TIMEOUT_SECONDS", 10)) * time.Second,
+		AdminEmails:            parseEmails("ADMIN_EMAILS", os.Getenv("ADMIN_EMAILS")),
+		AdminEmailMode:         envOr("ADMIN_EMAIL_MODE", "digest"),
 	}
 }
 
@@ -104,6 +224,165 @@ func envInt64(key string, fallback int64) int64 {
 	return n
 }
 
+func envFloat64(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs or bare addresses.
+// Malformed entries are skipped with a warning naming the variable.
+func parseCIDRs(name, spec string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			slog.Warn("ignoring malformed entry", "var", name, "entry", entry)
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// parseEmails parses a comma-separated list of email addresses. Malformed
+// entries are skipped with a warning naming the variable.
+func parseEmails(name, spec string) []string {
+	var addrs []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(entry)
+		if err != nil {
+			slog.Warn("ignoring malformed entry", "var", name, "entry", entry)
+			continue
+		}
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs
+}
+
+// Invite code format defaults and the bounds of INVITE_CODE_LENGTH and of
+// the length an admin may ask for.
+const (
+	defaultInviteCodePrefix = "ZNTH"
+	defaultInviteCodeLength = 8
+	minInviteCodeLength     = 6
+	maxInviteCodeLength     = 32
+)
+
+// parseInviteCodePrefix upper-cases INVITE_CODE_PREFIX. An unset or
+// malformed prefix falls back to the default, the latter with a warning.
+func parseInviteCodePrefix(spec string) string {
+	prefix := strings.ToUpper(strings.TrimSpace(spec))
+	if prefix == "" {
+		return defaultInviteCodePrefix
+	}
+	if !validInviteCodePrefix(prefix) {
+		slog.Warn("ignoring malformed value", "var", "INVITE_CODE_PREFIX", "value", spec)
+		return defaultInviteCodePrefix
+	}
+	return prefix
+}
+
+// parseInviteCodeLength parses INVITE_CODE_LENGTH. An unset or out of range
+// length falls back to the default, the latter with a warning.
+func parseInviteCodeLength(spec string) int {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return defaultInviteCodeLength
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < minInviteCodeLength || n > maxInviteCodeLength {
+		slog.Warn("ignoring malformed value", "var", "INVITE_CODE_LENGTH", "value", spec)
+		return defaultInviteCodeLength
+	}
+	return n
+}
+
+// Plan describes the limits attached to a named plan.
+type Plan struct {
+	Name            string
+	QuotaBytes      int64
+	StaleAfterHours int // 0 = use StaleAfterHours
+}
+
+// parsePlans parses PLANS, a comma-separated list of
+// "name:quota_bytes[:stale_after_hours]" entries such as
+// "pro:10737418240:24,team:53687091200". Malformed entries are skipped with
+// a warning.
+func parsePlans(spec, defaultPlan string, defaultQuota int64) map[string]Plan {
+	plans := map[string]Plan{
+		defaultPlan: {Name: defaultPlan, QuotaBytes: defaultQuota},
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, ":")
+		quota, stale, hasStale := strings.Cut(rest, ":")
+		n, err := strconv.ParseInt(quota, 10, 64)
+		if !ok || name == "" || err != nil || n <= 0 {
+			slog.Warn("ignoring malformed entry", "var", "PLANS", "entry", entry)
+			continue
+		}
+		plan := Plan{Name: name, QuotaBytes: n}
+		if hasStale {
+			hours, err := strconv.Atoi(stale)
+			if err != nil || hours <= 0 {
+				slog.Warn("ignoring malformed entry", "var", "PLANS", "entry", entry)
+				continue
+			}
+			plan.StaleAfterHours = hours
+		}
+		plans[name] = plan
+	}
+	return plans
+}
+
+// PlanQuota returns the quota for a plan, falling back to DefaultQuotaBytes
+// for unknown or empty plan names.
+func (c *Config) PlanQuota(name string) int64 {
+	if p, ok := c.Plans[name]; ok {
+		return p.QuotaBytes
+	}
+	return c.DefaultQuotaBytes
+}
+
+// StaleThreshold returns how long agent a may go without a backup before it
+// is flagged stale. Zero means a is never flagged.
+func (c *Config) StaleThreshold(a *Agent) time.Duration {
+	hours := c.StaleAfterHours
+	if p, ok := c.Plans[a.Plan]; ok && p.StaleAfterHours > 0 {
+		hours = p.StaleAfterHours
+	}
+	if a.StaleAfterHours > 0 {
+		hours = a.StaleAfterHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
 // IsLambda returns true if running inside AWS Lambda.
 func (c *Config) IsLambda() bool {
 	return os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != ""
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Email notifications
+// ---------------------------------------------------------------------------
+//
+// EmailNotifier mails an agent's owner, at the agent's ContactEmail, about
+// the events in ownerEmails unless they opted out of the event type. Admins
+// (AdminEmails) get each pending registration as it happens when
+// AdminEmailMode is "immediate", or one digest a day listing all of them in
+// "digest" mode. Mail goes out over SMTP; any catch-all server, such as the
+// Mailpit container in docker-compose, works for local testing. A failed
+// send is logged, not retried.
+
+const emailDigestInterval = 24 * time.Hour
+
+// Mailer sends one plain-text email.
+type Mailer interface {
+	Send(ctx context.Context, to []string, subject, body string) error
+}
+
+// smtpMailer sends mail through one SMTP server, upgrading to TLS with
+// STARTTLS when the server offers it (port 465 uses TLS from the start).
+type smtpMailer struct {
+	host        string
+	addr        string
+	from        string
+	username    string
+	password    string
+	timeout     time.Duration
+	implicitTLS bool
+}
+
+func NewSMTPMailer(cfg *Config) Mailer {
+	return &smtpMailer{
+		host:        cfg.SMTPHost,
+		addr:        net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+		from:        cfg.SMTPFrom,
+		username:    cfg.SMTPUsername,
+		password:    cfg.SMTPPassword,
+		timeout:     cfg.SMTPTimeout,
+		implicitTLS: cfg.SMTPPort == 465,
+	}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to []string, subject, body string) error {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if m.implicitTLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: m.host})
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !m.implicitTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	// smtp.PlainAuth refuses to send credentials over an unencrypted
+	// connection to anything but localhost.
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("rcpt %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildEmail(m.from, to, subject, body, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildEmail formats a plain-text message. The subject may contain agent
+// names, so it is collapsed to one line and MIME-encoded when it is not
+// printable ASCII.
+func buildEmail(from string, to []string, subject, body string, now time.Time) []byte {
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	for _, line := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+		b.WriteString(strings.TrimRight(line, "\r"))
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// ---------------------------------------------------------------------------
+// Templates
+// ---------------------------------------------------------------------------
+
+// emailContent is what owner and admin templates are rendered with.
+type emailContent struct {
+	Agent *Agent
+	Event Event
+	Data  map[string]any
+}
+
+// digestContent is what pendingDigestEmail is rendered with.
+type digestContent struct {
+	Agents []Agent
+}
+
+type emailTemplate struct {
+	name    string
+	subject *template.Template
+	body    *template.Template
+}
+
+func newEmailTemplate(name, subject, body string) emailTemplate {
+	funcs := template.FuncMap{"bytes": formatBytes}
+	return emailTemplate{
+		name:    name,
+		subject: template.Must(template.New(name).Funcs(funcs).Parse(subject)),
+		body:    template.Must(template.New(name).Funcs(funcs).Parse(body)),
+	}
+}
+
+func (t emailTemplate) render(data any) (subject, body string, err error) {
+	var s, b strings.Builder
+	if err := t.subject.Execute(&s, data); err != nil {
+		return "", "", err
+	}
+	if err := t.body.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	return s.String(), b.String(), nil
+}
+
+// ownerFooter ends every email to an agent's owner.
+const ownerFooter = `
+--
+You receive this email because {{.Agent.ContactEmail}} is the contact address
+of agent {{.Agent.ID}}. To stop emails like this one, add "{{.Event.Type}}" to
+email_opt_outs with PATCH /v1/agents/me.
+`
+
+// ownerEmails are the events mailed to an agent's owner, by type.
+var ownerEmails = map[string]emailTemplate{
+	EventAgentApproved: newEmailTemplate(EventAgentApproved,
+		`Backups for {{.Agent.Name}} are approved`,
+		`Your agent {{.Agent.Name}}{{with .Agent.Hostname}} on {{.}}{{end}} has been approved
+and can now upload backups.
+`+ownerFooter),
+
+	EventAgentRejected: newEmailTemplate(EventAgentRejected,
+		`Registration of {{.Agent.Name}} was rejected`,
+		`The registration of your agent {{.Agent.Name}}{{with .Agent.Hostname}} on {{.}}{{end}} was rejected:
+
+  {{.Data.reason}}
+
+It cannot upload backups. Contact your administrator if this is a mistake.
+`+ownerFooter),
+
+	EventQuotaNearLimit: newEmailTemplate(EventQuotaNearLimit,
+		`{{.Agent.Name}} has used {{.Data.percent}}% of its backup quota`,
+		`Your agent {{.Agent.Name}} is using {{bytes .Data.used_bytes}} of its {{bytes .Data.quota_bytes}} quota.
+Uploads are refused once the quota is full. Delete old backups or ask for a
+larger plan.
+`+ownerFooter),
+
+	EventAgentStale: newEmailTemplate(EventAgentStale,
+		`{{.Agent.Name}} has stopped backing up`,
+		`Your agent {{.Agent.Name}}{{with .Agent.Hostname}} on {{.}}{{end}} has not backed up in over {{.Data.threshold_hours}} hours.
+Last backup: {{or .Data.last_backup_at "never"}}
+
+Check that the machine is on and that its backup schedule is still installed.
+`+ownerFooter),
+
+	EventAgentRecovered: newEmailTemplate(EventAgentRecovered,
+		`{{.Agent.Name}} is backing up again`,
+		`Your agent {{.Agent.Name}}{{with .Agent.Hostname}} on {{.}}{{end}} backed up at {{.Data.last_backup_at}}
+after being flagged stale at {{.Data.stale_since}}.
+`+ownerFooter),
+
+	EventBackupDeleted: newEmailTemplate(EventBackupDeleted,
+		`Backup {{.Data.timestamp}} of {{.Agent.Name}} was deleted`,
+		`The backup {{.Data.timestamp}} ({{bytes .Data.encrypted_bytes}}) of your agent {{.Agent.Name}} was deleted.
+It can be restored until {{.Data.can_undelete_until}}, after which it is purged.
+
+If you did not delete it, rotate the agent's token.
+`+ownerFooter),
+}
+
+// adminPendingEmail tells admins about one pending registration.
+var adminPendingEmail = newEmailTemplate("admin.pending",
+	`Agent {{.Agent.Name}} is awaiting approval`,
+	`A new agent is awaiting approval:
+
+  {{.Agent.Name}} ({{.Agent.ID}})
+  host {{or .Agent.Hostname "-"}}, {{or .Agent.OS "?"}}/{{or .Agent.Arch "?"}}, openclaw {{or .Agent.OpenClawVersion "?"}}
+
+Approve it with POST /v1/admin/agents/{{.Agent.ID}}/approve or reject it with
+POST /v1/admin/agents/{{.Agent.ID}}/reject.
+`)
+
+// pendingDigestEmail lists every pending registration for admins.
+var pendingDigestEmail = newEmailTemplate("admin.pending_digest",
+	`{{len .Agents}} agent registration{{if ne (len .Agents) 1}}s{{end}} awaiting approval`,
+	`{{len .Agents}} agent registration{{if ne (len .Agents) 1}}s are{{else}} is{{end}} awaiting approval:
+{{range .Agents}}
+  {{.Name}} ({{.ID}})
+  host {{or .Hostname "-"}}, {{or .OS "?"}}/{{or .Arch "?"}}, openclaw {{or .OpenClawVersion "?"}}, registered {{.CreatedAt.Format "2006-01-02 15:04"}} UTC
+{{end}}
+Approve with POST /v1/admin/agents/{id}/approve or reject with
+POST /v1/admin/agents/{id}/reject.
+`)
+
+// formatBytes renders a byte count from event data for people.
+func formatBytes(v any) string {
+	var n float64
+	switch v := v.(type) {
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case float64:
+		n = v
+	default:
+		return fmt.Sprint(v)
+	}
+	units := []string{"bytes", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// ---------------------------------------------------------------------------
+// Notifier
+// ---------------------------------------------------------------------------
+
+type EmailNotifier struct {
+	store          DataStore
+	mailer         Mailer
+	adminEmails    []string
+	immediateAdmin bool // mail admins each pending registration
+	async          bool // send in the background rather than before Notify returns
+
+	wg sync.WaitGroup
+}
+
+func NewEmailNotifier(store DataStore, mailer Mailer, cfg *Config) *EmailNotifier {
+	return &EmailNotifier{
+		store:          store,
+		mailer:         mailer,
+		adminEmails:    cfg.AdminEmails,
+		immediateAdmin: cfg.AdminEmailMode == "immediate",
+		// A Lambda instance may be frozen once the response is returned,
+		// so mail is sent before the request completes there.
+		async: !cfg.IsLambda(),
+	}
+}
+
+// Notify mails the agent's owner and, for pending registrations in
+// immediate mode, the admins.
+func (n *EmailNotifier) Notify(ctx context.Context, e Event) {
+	_, owner := ownerEmails[e.Type]
+	admin := e.Type == EventAgentPending && n.immediateAdmin && len(n.adminEmails) > 0
+	if !owner && !admin {
+		return
+	}
+	if !n.async {
+		n.send(ctx, e, owner, admin)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.send(ctx, e, owner, admin)
+	}()
+}
+
+func (n *EmailNotifier) send(ctx context.Context, e Event, owner, admin bool) {
+	agent, err := n.store.GetAgent(ctx, e.AgentID)
+	if err != nil {
+		logger(ctx).Error("get agent for email", "agent_id", e.AgentID, "event_id", e.ID, "err", err)
+		return
+	}
+	if agent == nil {
+		return
+	}
+
+	content := emailContent{Agent: agent, Event: e, Data: e.Data}
+	if owner && agent.ContactEmail != "" && !slices.Contains(agent.EmailOptOuts, e.Type) {
+		n.mail(ctx, ownerEmails[e.Type], content, []string{agent.ContactEmail})
+	}
+	if admin {
+		n.mail(ctx, adminPendingEmail, content, n.adminEmails)
+	}
+}
+
+func (n *EmailNotifier) mail(ctx context.Context, t emailTemplate, data any, to []string) {
+	subject, body, err := t.render(data)
+	if err != nil {
+		logger(ctx).Error("render email", "template", t.name, "err", err)
+		return
+	}
+	if err := n.mailer.Send(ctx, to, subject, body); err != nil {
+		logger(ctx).Error("send email", "template", t.name, "err", err)
+		return
+	}
+	logger(ctx).Info("sent email", "template", t.name, "recipients", len(to))
+}
+
+// Wait waits, until ctx is done, for emails being sent.
+func (n *EmailNotifier) Wait(ctx context.Context) error {
+	return waitGroup(ctx, &n.wg)
+}
+
+// ---------------------------------------------------------------------------
+// Pending-registration digest
+// ---------------------------------------------------------------------------
+
+// pendingDigestEnabled reports whether admins get the daily digest.
+func pendingDigestEnabled(cfg *Config) bool {
+	return cfg.SMTPHost != "" && cfg.AdminEmailMode == "digest" && len(cfg.AdminEmails) > 0
+}
+
+// sendPendingDigest mails admins one list of every pending registration and
+// returns how many there were. Nothing is sent when none are pending.
+func sendPendingDigest(ctx context.Context, store DataStore, mailer Mailer, cfg *Config) (int, error) {
+	pending, _, err := store.ListAgents(ctx, AgentFilter{Status: "pending"})
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	subject, body, err := pendingDigestEmail.render(digestContent{Agents: pending})
+	if err != nil {
+		return 0, err
+	}
+	return len(pending), mailer.Send(ctx, cfg.AdminEmails, subject, body)
+}
+
+// runPendingDigests runs sendPendingDigest every interval until ctx is done.
+func runPendingDigests(ctx context.Context, store DataStore, mailer Mailer, cfg *Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := sendPendingDigest(ctx, store, mailer, cfg)
+			if err != nil {
+				slog.Error("pending digest", "err", err)
+				continue
+			}
+			slog.Info("pending digest", "pending", n)
+		}
+	}
+}
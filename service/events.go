@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Notification events
+// ---------------------------------------------------------------------------
+//
+// Events report what happens to agents and their backups to whoever wants
+// to react: registrations, approvals, backups, quota and staleness. They are
+// handed to a Notifier, which decides where they go (the log, webhooks,
+// email); delivery never fails the caller.
+
+const (
+	EventAgentRegistered = "agent.registered" // any new registration
+	EventAgentPending    = "agent.pending"    // a registration awaits approval
+	EventAgentApproved   = "agent.approved"   // an admin approved a pending agent
+	EventAgentRejected   = "agent.rejected"   // an admin rejected a pending agent
+	EventBackupCommitted = "backup.committed" // a backup was recorded and its upload URLs issued
+	EventBackupDeleted   = "backup.deleted"   // an agent deleted a backup
+	EventQuotaNearLimit  = "quota.near_limit" // usage crossed QuotaWarningPercent
+	EventAgentStale      = "agent.stale"      // an active agent stopped backing up
+	EventAgentRecovered  = "agent.recovered"  // a stale agent backed up again
+)
+
+// eventTypes lists every event type, for validating subscriptions.
+var eventTypes = []string{
+	EventAgentRegistered, EventAgentPending, EventAgentApproved, EventAgentRejected,
+	EventBackupCommitted, EventBackupDeleted, EventQuotaNearLimit, EventAgentStale,
+	EventAgentRecovered,
+}
+
+// Event is one notification. Data carries type-specific details.
+type Event struct {
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	AgentID string         `json:"agent_id,omitempty"`
+	Time    time.Time      `json:"time"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+// Notifier delivers events.
+type Notifier interface {
+	Notify(ctx context.Context, e Event)
+}
+
+// newEvent fills in the ID and time of an event of type typ.
+func newEvent(typ, agentID string, data map[string]any) Event {
+	id, _ := GenerateEventID()
+	return Event{ID: id, Type: typ, AgentID: agentID, Time: time.Now().UTC(), Data: data}
+}
+
+// notify sends an event about agentID for request r. Without a notifier,
+// events are only logged.
+func (h *Handlers) notify(r *http.Request, typ, agentID string, data map[string]any) {
+	n := h.notifier
+	if n == nil {
+		n = logNotifier{}
+	}
+	n.Notify(r.Context(), newEvent(typ, agentID, data))
+}
+
+// multiNotifier hands each event to several notifiers in turn.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(ctx context.Context, e Event) {
+	for _, n := range m {
+		n.Notify(ctx, e)
+	}
+}
+
+// logNotifier writes events to the log. It is the default notifier.
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, e Event) {
+	logger(ctx).Info("event", "event_id", e.ID, "type", e.Type, "agent_id", e.AgentID, "data", e.Data)
+}
+
+// waitGroup waits for wg until ctx is done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
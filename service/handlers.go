@@ -3,18 +3,24 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"net/http"
+	"net/mail"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Handlers struct {
-	store  DataStore
-	s3     *S3Client
-	config *Config
+	store    DataStore
+	s3       *S3Client
+	config   *Config
+	metrics  *Metrics // nil disables recording
+	notifier Notifier // nil only logs events
 }
 
 // ---------------------------------------------------------------------------
@@ -38,6 +44,7 @@ type RegisterResponse struct {
 	Token        string `json:"token"`
 	Status       string `json:"status"`
 	QuotaMB      int64  `json:"quota_mb"`
+	Plan         string `json:"plan,omitempty"`
 	BackupPrefix string `json:"backup_prefix"`
 }
 
@@ -53,9 +60,19 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse banned machines before anything is created
+	if ban, err := h.matchBan(r.Context(), req.Fingerprint, clientIP(r), req.Hostname); err != nil {
+		internalError(w, r, "check bans", err)
+		return
+	} else if ban != nil {
+		logger(r.Context()).Info("refused registration: matched ban", "agent_name", req.AgentName, "ip", clientIP(r), "ban_id", ban.ID, "ban_kind", ban.Kind, "ban_value", ban.Value)
+		jsonError(w, "registration not allowed", http.StatusForbidden)
+		return
+	}
+
 	// Check pending agent cap
 	if h.config.MaxPendingAgents > 0 {
-		pendingCount, err := h.store.CountAgentsByStatus("pending")
+		pendingCount, err := h.store.CountAgentsByStatus(r.Context(), "pending")
 		if err == nil && pendingCount >= h.config.MaxPendingAgents {
 			jsonError(w, "registration temporarily unavailable, too many pending agents", http.StatusServiceUnavailable)
 			return
@@ -65,32 +82,87 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 
 	agentID, err := GenerateAgentID()
 	if err != nil {
-		log.Printf("ERROR: generate agent ID: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "generate agent ID", err)
 		return
 	}
 
 	token, tokenHash, err := GenerateToken()
 	if err != nil {
-		log.Printf("ERROR: generate token: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "generate token", err)
 		return
 	}
 
-	// Determine status based on invite code
+	// Determine status, plan and quota based on invite code
 	status := "pending"
+	plan := h.config.DefaultPlan
+	quota := h.config.PlanQuota(plan)
+	var tags []string
+	var orgID string
 	if req.InviteCode != "" {
-		valid, err := h.store.UseInviteCode(req.InviteCode)
+		ic, err := h.store.GetInviteCode(r.Context(), req.InviteCode)
+		if err != nil {
+			internalError(w, r, "get invite code", err)
+			return
+		}
+		if ic == nil {
+			jsonError(w, "invalid or expired invite code", http.StatusBadRequest)
+			return
+		}
+		if ic.HostnamePattern != "" && !matchHostname(ic.HostnamePattern, req.Hostname) {
+			jsonError(w, "invite code is not valid for this hostname", http.StatusBadRequest)
+			return
+		}
+
+		valid, err := h.store.UseInviteCode(r.Context(), req.InviteCode)
 		if err != nil {
-			log.Printf("ERROR: use invite code: %v", err)
-			jsonError(w, "internal error", http.StatusInternalServerError)
+			internalError(w, r, "use invite code", err)
 			return
 		}
 		if !valid {
 			jsonError(w, "invalid or expired invite code", http.StatusBadRequest)
 			return
 		}
+
+		// Recorded before the agent exists: revoking the code suspends
+		// agents through their redemption, so an agent without one must
+		// not be created
+		redemption := &InviteRedemption{Code: req.InviteCode, AgentID: agentID, IP: clientIP(r)}
+		if err := h.store.RecordInviteRedemption(r.Context(), redemption); err != nil {
+			internalError(w, r, "record invite redemption", err, "invite_code", req.InviteCode, "agent_id", agentID)
+			return
+		}
 		status = "active"
+
+		// Apply the code's grants: an explicit quota beats the plan's quota
+		if ic.Plan != "" {
+			plan = ic.Plan
+			quota = h.config.PlanQuota(plan)
+		}
+		if ic.QuotaBytes > 0 {
+			quota = ic.QuotaBytes
+		}
+		tags = ic.Tags
+		orgID = ic.OrgID
+	}
+
+	// Without an invite code, the first matching auto-approval rule decides
+	var approvalRuleID string
+	if req.InviteCode == "" {
+		rule, err := h.matchApprovalRule(r.Context(), &req, clientIP(r))
+		if err != nil {
+			// Fail closed to "pending": an admin can still approve by hand
+			logger(r.Context()).Warn("evaluate approval rules", "err", err)
+		}
+		if rule != nil {
+			approvalRuleID = rule.ID
+			if rule.Approve {
+				status = "active"
+			}
+			if rule.Plan != "" {
+				plan = rule.Plan
+				quota = h.config.PlanQuota(plan)
+			}
+		}
 	}
 
 	agent := &Agent{
@@ -104,26 +176,107 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 		EncryptTool:     req.EncryptTool,
 		PublicKey:       req.PublicKey,
 		Status:          status,
-		QuotaBytes:      h.config.DefaultQuotaBytes,
+		QuotaBytes:      quota,
+		Plan:            plan,
+		Tags:            tags,
+		ApprovalRuleID:  approvalRuleID,
+		OrgID:           orgID,
 	}
 
-	if err := h.store.CreateAgent(agent, tokenHash); err != nil {
-		log.Printf("ERROR: create agent: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	if err := h.store.CreateAgent(r.Context(), agent, tokenHash); err != nil {
+		internalError(w, r, "create agent", err)
 		return
 	}
 
-	log.Printf("registered agent %s (%s) from %s status=%s", agentID, req.AgentName, req.Hostname, status)
+	if approvalRuleID != "" {
+		logger(r.Context()).Info("registered agent", "agent_id", agentID, "agent_name", req.AgentName, "hostname", req.Hostname, "status", status, "rule_id", approvalRuleID)
+	} else {
+		logger(r.Context()).Info("registered agent", "agent_id", agentID, "agent_name", req.AgentName, "hostname", req.Hostname, "status", status)
+	}
+	h.metrics.registered(status)
+
+	registered := map[string]string{"status": status, "plan": plan}
+	if req.InviteCode != "" {
+		registered["invite_code"] = req.InviteCode
+	}
+	if approvalRuleID != "" {
+		registered["approval_rule_id"] = approvalRuleID
+	}
+	h.audit(r, "agent.register", agentID, "agent:"+agentID, nil, registered)
+
+	event := map[string]any{"name": req.AgentName, "hostname": req.Hostname, "status": status, "plan": plan}
+	h.notify(r, EventAgentRegistered, agentID, event)
+	if status == "pending" {
+		h.notify(r, EventAgentPending, agentID, event)
+	}
 
 	jsonResponse(w, http.StatusCreated, RegisterResponse{
 		AgentID:      agentID,
 		Token:        token,
 		Status:       status,
-		QuotaMB:      h.config.DefaultQuotaBytes / (1024 * 1024),
+		QuotaMB:      quota / (1024 * 1024),
+		Plan:         plan,
 		BackupPrefix: agentID + "/",
 	})
 }
 
+// ---------------------------------------------------------------------------
+// POST /v1/agents/recover
+// ---------------------------------------------------------------------------
+
+type RecoverRequest struct {
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RecoverResponse struct {
+	AgentID      string `json:"agent_id"`
+	Token        string `json:"token"`
+	Status       string `json:"status"`
+	BackupPrefix string `json:"backup_prefix"`
+}
+
+// Recover exchanges an admin-issued recovery code for a fresh token bound to
+// the existing agent. All previously issued tokens stop working.
+func (h *Handlers) Recover(w http.ResponseWriter, r *http.Request) {
+	var req RecoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.RecoveryCode))
+	if code == "" {
+		jsonError(w, "recovery_code is required", http.StatusBadRequest)
+		return
+	}
+
+	token, tokenHash, err := GenerateToken()
+	if err != nil {
+		internalError(w, r, "generate token", err)
+		return
+	}
+
+	agent, err := h.store.UseRecoveryCode(r.Context(), HashToken(code), tokenHash)
+	if err != nil {
+		internalError(w, r, "use recovery code", err)
+		return
+	}
+	if agent == nil {
+		jsonError(w, "invalid, used or expired recovery code", http.StatusBadRequest)
+		return
+	}
+
+	logger(r.Context()).Info("recovered agent", "agent_id", agent.ID, "name", agent.Name, "ip", clientIP(r))
+	h.audit(r, "agent.recover", agent.ID, "agent:"+agent.ID, nil, nil)
+
+	jsonResponse(w, http.StatusOK, RecoverResponse{
+		AgentID:      agent.ID,
+		Token:        token,
+		Status:       agent.Status,
+		BackupPrefix: agent.ID + "/",
+	})
+}
+
 // ---------------------------------------------------------------------------
 // POST /v1/backups/upload-url
 // ---------------------------------------------------------------------------
@@ -160,12 +313,14 @@ func (h *Handlers) UploadURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if h.config.MaxUploadBytes > 0 && req.EncryptedBytes > h.config.MaxUploadBytes {
+		h.metrics.uploadRejected("size")
 		jsonError(w, fmt.Sprintf("upload too large, max %d bytes", h.config.MaxUploadBytes), http.StatusBadRequest)
 		return
 	}
 
 	// Check quota
 	if agent.UsedBytes+req.EncryptedBytes > agent.QuotaBytes {
+		h.metrics.uploadRejected("quota")
 		jsonError(w, fmt.Sprintf("quota exceeded: used %d + new %d > quota %d bytes",
 			agent.UsedBytes, req.EncryptedBytes, agent.QuotaBytes), http.StatusForbidden)
 		return
@@ -173,18 +328,35 @@ func (h *Handlers) UploadURL(w http.ResponseWriter, r *http.Request) {
 
 	// Single upload can't exceed total quota
 	if req.EncryptedBytes > agent.QuotaBytes {
+		h.metrics.uploadRejected("quota")
 		jsonError(w, "upload exceeds total quota", http.StatusForbidden)
 		return
 	}
 
+	// Organization-wide pooled quota
+	if agent.OrgID != "" {
+		org, err := h.store.GetOrg(r.Context(), agent.OrgID)
+		if err != nil {
+			internalError(w, r, "get org", err, "org_id", agent.OrgID)
+			return
+		}
+		if org != nil && org.QuotaBytes > 0 && org.UsedBytes+req.EncryptedBytes > org.QuotaBytes {
+			h.metrics.uploadRejected("org_quota")
+			jsonError(w, fmt.Sprintf("organization quota exceeded: used %d + new %d > quota %d bytes",
+				org.UsedBytes, req.EncryptedBytes, org.QuotaBytes), http.StatusForbidden)
+			return
+		}
+	}
+
 	// Backup frequency limit
 	if h.config.MinBackupIntervalHours > 0 {
-		backups, err := h.store.ListBackups(agent.ID, 1)
+		backups, _, err := h.store.ListBackups(r.Context(), agent.ID, Page{Limit: 1})
 		if err == nil && len(backups) > 0 {
 			since := time.Since(backups[0].CreatedAt)
 			minInterval := time.Duration(h.config.MinBackupIntervalHours) * time.Hour
 			if since < minInterval {
 				next := backups[0].CreatedAt.Add(minInterval)
+				h.metrics.uploadRejected("frequency")
 				jsonError(w, fmt.Sprintf("too soon, next backup allowed after %s", next.Format(time.RFC3339)), http.StatusTooManyRequests)
 				return
 			}
@@ -215,7 +387,8 @@ func (h *Handlers) UploadURL(w http.ResponseWriter, r *http.Request) {
 			url, err = h.s3.PresignPut(r.Context(), key, contentType)
 		}
 		if err != nil {
-			log.Printf("ERROR: presign PUT %s: %v", key, err)
+			logger(r.Context()).Error("presign PUT", "key", key, "err", err)
+			h.metrics.uploadRejected("error")
 			jsonError(w, "failed to generate upload URL", http.StatusInternalServerError)
 			return
 		}
@@ -236,29 +409,68 @@ func (h *Handlers) UploadURL(w http.ResponseWriter, r *http.Request) {
 		ManifestS3Key:   manifestS3Key,
 	}
 
-	if err := h.store.CreateBackup(backup); err != nil {
-		log.Printf("ERROR: create backup record: %v", err)
-		jsonError(w, "failed to record backup", http.StatusInternalServerError)
+	if err := h.store.CreateBackup(r.Context(), backup); err != nil {
+		// Another upload took the room between the quota check above and here
+		if errors.Is(err, ErrQuotaExceeded) {
+			h.metrics.uploadRejected("quota")
+			jsonError(w, "quota exceeded", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, ErrOrgQuotaExceeded) {
+			h.metrics.uploadRejected("org_quota")
+			jsonError(w, "organization quota exceeded", http.StatusForbidden)
+			return
+		}
+		h.metrics.uploadRejected("error")
+		if !canceledError(w, r, "create backup record", err) {
+			logger(r.Context()).Error("create backup record", "err", err)
+			jsonError(w, "failed to record backup", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	// Auto-rotate: soft-delete oldest backups if over limit
 	if h.config.MaxBackupsPerAgent > 0 {
-		allBackups, err := h.store.ListBackups(agent.ID, 0)
+		allBackups, _, err := h.store.ListBackups(r.Context(), agent.ID, Page{})
 		if err == nil && len(allBackups) > h.config.MaxBackupsPerAgent {
 			for _, old := range allBackups[h.config.MaxBackupsPerAgent:] {
-				h.store.DeleteBackup(agent.ID, old.Timestamp)
+				h.store.DeleteBackup(r.Context(), agent.ID, old.Timestamp)
 			}
-			h.store.UpdateUsedBytes(agent.ID)
+			h.store.UpdateUsedBytes(r.Context(), agent.ID)
 		}
 	}
 
+	h.metrics.uploaded(req.EncryptedBytes)
+	h.notify(r, EventBackupCommitted, agent.ID, map[string]any{
+		"timestamp":        req.Timestamp,
+		"encrypted_bytes":  req.EncryptedBytes,
+		"encrypted_sha256": req.EncryptedSHA256,
+	})
+	h.notifyQuota(r, agent, agent.UsedBytes+req.EncryptedBytes)
+
 	jsonResponse(w, http.StatusOK, UploadURLResponse{
 		URLs:      urls,
 		ExpiresIn: int(h.config.PresignExpiry.Seconds()),
 	})
 }
 
+// notifyQuota sends quota.near_limit when a backup takes the agent's usage
+// from below QuotaWarningPercent of its quota to at or above it.
+func (h *Handlers) notifyQuota(r *http.Request, agent *Agent, used int64) {
+	if h.config.QuotaWarningPercent <= 0 || agent.QuotaBytes <= 0 {
+		return
+	}
+	limit := agent.QuotaBytes * int64(h.config.QuotaWarningPercent) / 100
+	if agent.UsedBytes >= limit || used < limit {
+		return
+	}
+	h.notify(r, EventQuotaNearLimit, agent.ID, map[string]any{
+		"used_bytes":  used,
+		"quota_bytes": agent.QuotaBytes,
+		"percent":     used * 100 / agent.QuotaBytes,
+	})
+}
+
 // ---------------------------------------------------------------------------
 // GET /v1/backups
 // ---------------------------------------------------------------------------
@@ -268,6 +480,7 @@ type ListBackupsResponse struct {
 	Count      int          `json:"count"`
 	UsedBytes  int64        `json:"used_bytes"`
 	QuotaBytes int64        `json:"quota_bytes"`
+	NextCursor string       `json:"next_cursor,omitempty"`
 }
 
 type BackupInfo struct {
@@ -282,17 +495,15 @@ func (h *Handlers) ListBackups(w http.ResponseWriter, r *http.Request) {
 	agent := AgentFromContext(r.Context())
 
 	countOnly := r.URL.Query().Get("count_only") == "true"
-	limit := 100
-	if l := r.URL.Query().Get("limit"); l != "" {
-		if n, err := strconv.Atoi(l); err == nil && n > 0 {
-			limit = n
-		}
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
 	}
 
-	count, usedBytes, err := h.store.CountBackups(agent.ID)
+	count, usedBytes, err := h.store.CountBackups(r.Context(), agent.ID)
 	if err != nil {
-		log.Printf("ERROR: count backups: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "count backups", err)
 		return
 	}
 
@@ -306,10 +517,9 @@ func (h *Handlers) ListBackups(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	backups, err := h.store.ListBackups(agent.ID, limit)
+	backups, next, err := h.store.ListBackups(r.Context(), agent.ID, page)
 	if err != nil {
-		log.Printf("ERROR: list backups: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "list backups", err)
 		return
 	}
 
@@ -329,6 +539,7 @@ func (h *Handlers) ListBackups(w http.ResponseWriter, r *http.Request) {
 		Count:      count,
 		UsedBytes:  usedBytes,
 		QuotaBytes: agent.QuotaBytes,
+		NextCursor: next,
 	})
 }
 
@@ -340,10 +551,9 @@ func (h *Handlers) GetBackup(w http.ResponseWriter, r *http.Request) {
 	agent := AgentFromContext(r.Context())
 	timestamp := r.PathValue("timestamp")
 
-	backup, err := h.store.GetBackup(agent.ID, timestamp)
+	backup, err := h.store.GetBackup(r.Context(), agent.ID, timestamp)
 	if err != nil {
-		log.Printf("ERROR: get backup: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "get backup", err)
 		return
 	}
 	if backup == nil {
@@ -387,10 +597,9 @@ func (h *Handlers) DownloadURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	backup, err := h.store.GetBackup(agent.ID, req.Timestamp)
+	backup, err := h.store.GetBackup(r.Context(), agent.ID, req.Timestamp)
 	if err != nil {
-		log.Printf("ERROR: get backup: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "get backup", err)
 		return
 	}
 	if backup == nil {
@@ -402,7 +611,7 @@ func (h *Handlers) DownloadURL(w http.ResponseWriter, r *http.Request) {
 
 	backupURL, err := h.s3.PresignGet(r.Context(), backup.S3Key)
 	if err != nil {
-		log.Printf("ERROR: presign GET backup: %v", err)
+		logger(r.Context()).Error("presign GET backup", "err", err)
 		jsonError(w, "failed to generate download URL", http.StatusInternalServerError)
 		return
 	}
@@ -410,7 +619,7 @@ func (h *Handlers) DownloadURL(w http.ResponseWriter, r *http.Request) {
 
 	manifestURL, err := h.s3.PresignGet(r.Context(), backup.ManifestS3Key)
 	if err != nil {
-		log.Printf("ERROR: presign GET manifest: %v", err)
+		logger(r.Context()).Error("presign GET manifest", "err", err)
 		jsonError(w, "failed to generate download URL", http.StatusInternalServerError)
 		return
 	}
@@ -430,10 +639,9 @@ func (h *Handlers) DeleteBackup(w http.ResponseWriter, r *http.Request) {
 	agent := AgentFromContext(r.Context())
 	timestamp := r.PathValue("timestamp")
 
-	backup, err := h.store.DeleteBackup(agent.ID, timestamp)
+	backup, err := h.store.DeleteBackup(r.Context(), agent.ID, timestamp)
 	if err != nil {
-		log.Printf("ERROR: delete backup: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "delete backup", err)
 		return
 	}
 	if backup == nil {
@@ -442,6 +650,13 @@ func (h *Handlers) DeleteBackup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	canUndeleteUntil := time.Now().UTC().Add(time.Duration(h.config.DeleteGraceHours) * time.Hour)
+	h.audit(r, "backup.delete", agent.ID, "backup:"+agent.ID+"/"+timestamp, backupState(backup),
+		map[string]string{"can_undelete_until": canUndeleteUntil.Format(time.RFC3339)})
+	h.notify(r, EventBackupDeleted, agent.ID, map[string]any{
+		"timestamp":          timestamp,
+		"encrypted_bytes":    backup.EncryptedBytes,
+		"can_undelete_until": canUndeleteUntil.Format(time.RFC3339),
+	})
 	jsonResponse(w, http.StatusOK, map[string]string{
 		"deleted":            timestamp,
 		"can_undelete_until": canUndeleteUntil.Format(time.RFC3339),
@@ -455,14 +670,28 @@ func (h *Handlers) DeleteBackup(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) DeleteAllBackups(w http.ResponseWriter, r *http.Request) {
 	agent := AgentFromContext(r.Context())
 
-	backups, err := h.store.DeleteAllBackups(agent.ID)
+	backups, err := h.store.DeleteAllBackups(r.Context(), agent.ID)
 	if err != nil {
-		log.Printf("ERROR: delete all backups: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "delete all backups", err)
 		return
 	}
 
 	canUndeleteUntil := time.Now().UTC().Add(time.Duration(h.config.DeleteGraceHours) * time.Hour)
+	timestamps := make([]string, len(backups))
+	for i, b := range backups {
+		timestamps[i] = b.Timestamp
+	}
+	h.audit(r, "backup.delete_all", agent.ID, "agent:"+agent.ID, nil, map[string]any{
+		"deleted":            timestamps,
+		"can_undelete_until": canUndeleteUntil.Format(time.RFC3339),
+	})
+	for _, b := range backups {
+		h.notify(r, EventBackupDeleted, agent.ID, map[string]any{
+			"timestamp":          b.Timestamp,
+			"encrypted_bytes":    b.EncryptedBytes,
+			"can_undelete_until": canUndeleteUntil.Format(time.RFC3339),
+		})
+	}
 	jsonResponse(w, http.StatusOK, map[string]interface{}{
 		"deleted_count":      len(backups),
 		"can_undelete_until": canUndeleteUntil.Format(time.RFC3339),
@@ -477,12 +706,13 @@ func (h *Handlers) UndeleteBackup(w http.ResponseWriter, r *http.Request) {
 	agent := AgentFromContext(r.Context())
 	timestamp := r.PathValue("timestamp")
 
-	err := h.store.UndeleteBackup(agent.ID, timestamp)
+	err := h.store.UndeleteBackup(r.Context(), agent.ID, timestamp)
 	if err != nil {
 		jsonError(w, "backup not found or not deleted", http.StatusNotFound)
 		return
 	}
 
+	h.audit(r, "backup.undelete", agent.ID, "backup:"+agent.ID+"/"+timestamp, nil, nil)
 	jsonResponse(w, http.StatusOK, map[string]string{"restored": timestamp})
 }
 
@@ -491,42 +721,58 @@ func (h *Handlers) UndeleteBackup(w http.ResponseWriter, r *http.Request) {
 // ---------------------------------------------------------------------------
 
 type AgentInfoResponse struct {
-	AgentID         string `json:"agent_id"`
-	Name            string `json:"name"`
-	Hostname        string `json:"hostname"`
-	OS              string `json:"os"`
-	Arch            string `json:"arch"`
-	OpenClawVersion string `json:"openclaw_version"`
-	EncryptTool     string `json:"encrypt_tool"`
-	Status          string `json:"status"`
-	QuotaBytes      int64  `json:"quota_bytes"`
-	UsedBytes       int64  `json:"used_bytes"`
-	CreatedAt       string `json:"created_at"`
+	AgentID         string   `json:"agent_id"`
+	Name            string   `json:"name"`
+	Hostname        string   `json:"hostname"`
+	OS              string   `json:"os"`
+	Arch            string   `json:"arch"`
+	OpenClawVersion string   `json:"openclaw_version"`
+	EncryptTool     string   `json:"encrypt_tool"`
+	Status          string   `json:"status"`
+	StatusReason    string   `json:"status_reason,omitempty"`
+	OrgID           string   `json:"org_id,omitempty"`
+	Plan            string   `json:"plan,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	QuotaBytes      int64    `json:"quota_bytes"`
+	UsedBytes       int64    `json:"used_bytes"`
+	ContactEmail    string   `json:"contact_email,omitempty"`
+	EmailOptOuts    []string `json:"email_opt_outs,omitempty"`
+	CreatedAt       string   `json:"created_at"`
+}
+
+func agentToInfoResponse(a *Agent) AgentInfoResponse {
+	return AgentInfoResponse{
+		AgentID:         a.ID,
+		Name:            a.Name,
+		Hostname:        a.Hostname,
+		OS:              a.OS,
+		Arch:            a.Arch,
+		OpenClawVersion: a.OpenClawVersion,
+		EncryptTool:     a.EncryptTool,
+		Status:          a.Status,
+		StatusReason:    a.StatusReason,
+		OrgID:           a.OrgID,
+		Plan:            a.Plan,
+		Tags:            a.Tags,
+		QuotaBytes:      a.QuotaBytes,
+		UsedBytes:       a.UsedBytes,
+		ContactEmail:    a.ContactEmail,
+		EmailOptOuts:    a.EmailOptOuts,
+		CreatedAt:       a.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
 }
 
 func (h *Handlers) AgentInfo(w http.ResponseWriter, r *http.Request) {
 	agent := AgentFromContext(r.Context())
 
 	// Refresh used bytes
-	h.store.UpdateUsedBytes(agent.ID)
-	updated, _ := h.store.GetAgent(agent.ID)
+	h.store.UpdateUsedBytes(r.Context(), agent.ID)
+	updated, _ := h.store.GetAgent(r.Context(), agent.ID)
 	if updated != nil {
 		agent = updated
 	}
 
-	jsonResponse(w, http.StatusOK, AgentInfoResponse{
-		AgentID:         agent.ID,
-		Name:            agent.Name,
-		Hostname:        agent.Hostname,
-		OS:              agent.OS,
-		Arch:            agent.Arch,
-		OpenClawVersion: agent.OpenClawVersion,
-		EncryptTool:     agent.EncryptTool,
-		Status:          agent.Status,
-		QuotaBytes:      agent.QuotaBytes,
-		UsedBytes:       agent.UsedBytes,
-		CreatedAt:       agent.CreatedAt.Format("2006-01-02T15:04:05Z"),
-	})
+	jsonResponse(w, http.StatusOK, agentToInfoResponse(agent))
 }
 
 // ---------------------------------------------------------------------------
@@ -542,18 +788,17 @@ func (h *Handlers) RotateToken(w http.ResponseWriter, r *http.Request) {
 
 	newToken, newHash, err := GenerateToken()
 	if err != nil {
-		log.Printf("ERROR: generate token: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "generate token", err)
 		return
 	}
 
-	if err := h.store.RotateAgentToken(agent.ID, newHash); err != nil {
-		log.Printf("ERROR: rotate token: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	if err := h.store.RotateAgentToken(r.Context(), agent.ID, newHash); err != nil {
+		internalError(w, r, "rotate token", err)
 		return
 	}
 
-	log.Printf("rotated token for agent %s", agent.ID)
+	logger(r.Context()).Info("rotated token", "agent_id", agent.ID)
+	h.audit(r, "agent.rotate_token", agent.ID, "agent:"+agent.ID, nil, nil)
 
 	jsonResponse(w, http.StatusOK, RotateTokenResponse{
 		Token: newToken,
@@ -564,8 +809,11 @@ func (h *Handlers) RotateToken(w http.ResponseWriter, r *http.Request) {
 // PATCH /v1/agents/me
 // ---------------------------------------------------------------------------
 
+// UpdateProfileRequest changes only the fields that are present.
 type UpdateProfileRequest struct {
-	Name string `json:"name"`
+	Name         *string   `json:"name"`
+	ContactEmail *string   `json:"contact_email"`  // "" stops all email
+	EmailOptOuts *[]string `json:"email_opt_outs"` // event types not to email; replaces the list
 }
 
 func (h *Handlers) UpdateProfile(w http.ResponseWriter, r *http.Request) {
@@ -576,46 +824,81 @@ func (h *Handlers) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "invalid JSON body", http.StatusBadRequest)
 		return
 	}
+	if req.Name == nil && req.ContactEmail == nil && req.EmailOptOuts == nil {
+		jsonError(w, "nothing to update", http.StatusBadRequest)
+		return
+	}
 
 	// Validate name
-	if req.Name == "" {
-		jsonError(w, "name is required", http.StatusBadRequest)
-		return
+	if req.Name != nil {
+		if *req.Name == "" {
+			jsonError(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if len(*req.Name) > 100 {
+			jsonError(w, "name must be 100 characters or less", http.StatusBadRequest)
+			return
+		}
 	}
-	if len(req.Name) > 100 {
-		jsonError(w, "name must be 100 characters or less", http.StatusBadRequest)
-		return
+
+	// Validate contact settings
+	email, optOuts := agent.ContactEmail, agent.EmailOptOuts
+	if req.ContactEmail != nil {
+		email = strings.TrimSpace(*req.ContactEmail)
+		if email != "" {
+			addr, err := mail.ParseAddress(email)
+			if err != nil || addr.Address != email || len(email) > 254 {
+				jsonError(w, "contact_email must be a plain email address", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if req.EmailOptOuts != nil {
+		optOuts = nil
+		for _, typ := range *req.EmailOptOuts {
+			if _, ok := ownerEmails[typ]; !ok {
+				jsonError(w, fmt.Sprintf("unknown email_opt_outs entry %q", typ), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(optOuts, typ) {
+				optOuts = append(optOuts, typ)
+			}
+		}
 	}
 
-	if err := h.store.UpdateAgentProfile(agent.ID, req.Name); err != nil {
-		log.Printf("ERROR: update profile: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
-		return
+	if req.Name != nil {
+		if err := h.store.UpdateAgentProfile(r.Context(), agent.ID, *req.Name); err != nil {
+			internalError(w, r, "update profile", err)
+			return
+		}
+	}
+	if req.ContactEmail != nil || req.EmailOptOuts != nil {
+		if err := h.store.SetAgentContact(r.Context(), agent.ID, email, optOuts); err != nil {
+			internalError(w, r, "set contact", err)
+			return
+		}
 	}
 
 	// Return updated agent info
-	updated, err := h.store.GetAgent(agent.ID)
+	updated, err := h.store.GetAgent(r.Context(), agent.ID)
 	if err != nil || updated == nil {
-		log.Printf("ERROR: get updated agent: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "get updated agent", err)
 		return
 	}
 
-	log.Printf("updated profile for agent %s: name=%s", agent.ID, req.Name)
+	logger(r.Context()).Info("updated profile", "agent_id", agent.ID, "name", updated.Name)
+	h.audit(r, "agent.update_profile", agent.ID, "agent:"+agent.ID, profileState(agent), profileState(updated))
 
-	jsonResponse(w, http.StatusOK, AgentInfoResponse{
-		AgentID:         updated.ID,
-		Name:            updated.Name,
-		Hostname:        updated.Hostname,
-		OS:              updated.OS,
-		Arch:            updated.Arch,
-		OpenClawVersion: updated.OpenClawVersion,
-		EncryptTool:     updated.EncryptTool,
-		Status:          updated.Status,
-		QuotaBytes:      updated.QuotaBytes,
-		UsedBytes:       updated.UsedBytes,
-		CreatedAt:       updated.CreatedAt.Format("2006-01-02T15:04:05Z"),
-	})
+	jsonResponse(w, http.StatusOK, agentToInfoResponse(updated))
+}
+
+// profileState is what the audit log records of an agent's profile.
+func profileState(a *Agent) map[string]any {
+	return map[string]any{
+		"name":           a.Name,
+		"contact_email":  a.ContactEmail,
+		"email_opt_outs": a.EmailOptOuts,
+	}
 }
 
 // ---------------------------------------------------------------------------
@@ -623,35 +906,71 @@ func (h *Handlers) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 // ---------------------------------------------------------------------------
 
 type AdminAgentInfo struct {
-	AgentID   string `json:"agent_id"`
-	Name      string `json:"name"`
-	Hostname  string `json:"hostname"`
-	Status    string `json:"status"`
-	CreatedAt string `json:"created_at"`
+	AgentID         string   `json:"agent_id"`
+	Name            string   `json:"name"`
+	Hostname        string   `json:"hostname"`
+	Status          string   `json:"status"`
+	Reason          string   `json:"status_reason,omitempty"`
+	Plan            string   `json:"plan,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	Rule            string   `json:"approval_rule,omitempty"`
+	OrgID           string   `json:"org_id,omitempty"`
+	StaleSince      string   `json:"stale_since,omitempty"`
+	StaleAfterHours int      `json:"stale_after_hours,omitempty"`
+	CreatedAt       string   `json:"created_at"`
+}
+
+type ListAgentsResponse struct {
+	Agents     []AdminAgentInfo `json:"agents"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
+// AdminListAgents lists agents newest first, a page at a time, optionally
+// filtered by ?status=, ?org_id= and ?stale=true. Org-scoped keys only ever
+// see their own organization.
 func (h *Handlers) AdminListAgents(w http.ResponseWriter, r *http.Request) {
-	status := r.URL.Query().Get("status")
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	filter := AgentFilter{
+		Status: r.URL.Query().Get("status"),
+		OrgID:  r.URL.Query().Get("org_id"),
+		Stale:  r.URL.Query().Get("stale") == "true",
+		Page:   page,
+	}
+	if scope := AdminScopeFromContext(r.Context()); scope != nil {
+		filter.OrgID = scope.OrgID
+	}
 
-	agents, err := h.store.ListAgents(status)
+	agents, next, err := h.store.ListAgents(r.Context(), filter)
 	if err != nil {
-		log.Printf("ERROR: list agents: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "list agents", err)
 		return
 	}
 
 	infos := make([]AdminAgentInfo, len(agents))
 	for i, a := range agents {
 		infos[i] = AdminAgentInfo{
-			AgentID:   a.ID,
-			Name:      a.Name,
-			Hostname:  a.Hostname,
-			Status:    a.Status,
-			CreatedAt: a.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			AgentID:         a.ID,
+			Name:            a.Name,
+			Hostname:        a.Hostname,
+			Status:          a.Status,
+			Reason:          a.StatusReason,
+			Plan:            a.Plan,
+			Tags:            a.Tags,
+			Rule:            a.ApprovalRuleID,
+			OrgID:           a.OrgID,
+			StaleAfterHours: a.StaleAfterHours,
+			CreatedAt:       a.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		}
+		if a.StaleSince != nil {
+			infos[i].StaleSince = a.StaleSince.Format("2006-01-02T15:04:05Z")
 		}
 	}
 
-	jsonResponse(w, http.StatusOK, infos)
+	jsonResponse(w, http.StatusOK, ListAgentsResponse{Agents: infos, NextCursor: next})
 }
 
 func (h *Handlers) AdminApproveAgent(w http.ResponseWriter, r *http.Request) {
@@ -660,14 +979,31 @@ func (h *Handlers) AdminApproveAgent(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "agent id required", http.StatusBadRequest)
 		return
 	}
+	if !h.agentInAdminScope(w, r, id) {
+		return
+	}
+
+	before, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return
+	}
+	if before == nil {
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
 
-	if err := h.store.UpdateAgentStatus(id, "active"); err != nil {
-		log.Printf("ERROR: approve agent %s: %v", id, err)
+	if err := h.store.UpdateAgentStatus(r.Context(), id, "active", ""); err != nil {
+		logger(r.Context()).Error("approve agent", "agent_id", id, "err", err)
 		jsonError(w, "agent not found", http.StatusNotFound)
 		return
 	}
 
-	log.Printf("admin approved agent %s", id)
+	logger(r.Context()).Info("admin approved agent", "agent_id", id)
+	h.audit(r, "agent.approve", id, "agent:"+id, agentState(before), map[string]string{"status": "active"})
+	if before.Status != "active" {
+		h.notify(r, EventAgentApproved, id, map[string]any{"name": before.Name, "hostname": before.Hostname, "previous_status": before.Status})
+	}
 	jsonResponse(w, http.StatusOK, map[string]string{"status": "active"})
 }
 
@@ -677,26 +1013,150 @@ func (h *Handlers) AdminSuspendAgent(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "agent id required", http.StatusBadRequest)
 		return
 	}
+	if !h.agentInAdminScope(w, r, id) {
+		return
+	}
 
-	if err := h.store.UpdateAgentStatus(id, "suspended"); err != nil {
-		log.Printf("ERROR: suspend agent %s: %v", id, err)
+	before, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return
+	}
+	if before == nil {
 		jsonError(w, "agent not found", http.StatusNotFound)
 		return
 	}
 
-	log.Printf("admin suspended agent %s", id)
+	if err := h.store.UpdateAgentStatus(r.Context(), id, "suspended", ""); err != nil {
+		logger(r.Context()).Error("suspend agent", "agent_id", id, "err", err)
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin suspended agent", "agent_id", id)
+	h.audit(r, "agent.suspend", id, "agent:"+id, agentState(before), map[string]string{"status": "suspended"})
 	jsonResponse(w, http.StatusOK, map[string]string{"status": "suspended"})
 }
 
+type RejectAgentRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AdminRejectAgent moves a pending agent to "rejected". Rejected agents no
+// longer count toward MaxPendingAgents and see the reason on /v1/agents/me.
+func (h *Handlers) AdminRejectAgent(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "agent id required", http.StatusBadRequest)
+		return
+	}
+
+	var req RejectAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		jsonError(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Reason) > 500 {
+		jsonError(w, "reason must be 500 characters or less", http.StatusBadRequest)
+		return
+	}
+
+	agent, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return
+	}
+	if agent == nil {
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+	if agent.Status != "pending" {
+		jsonError(w, fmt.Sprintf("only pending agents can be rejected (status is %s)", agent.Status), http.StatusConflict)
+		return
+	}
+
+	if err := h.store.UpdateAgentStatus(r.Context(), id, "rejected", req.Reason); err != nil {
+		internalError(w, r, "reject agent", err, "agent_id", id)
+		return
+	}
+
+	logger(r.Context()).Info("admin rejected agent", "agent_id", id, "reason", req.Reason)
+	h.audit(r, "agent.reject", id, "agent:"+id, agentState(agent), map[string]string{"status": "rejected", "reason": req.Reason})
+	h.notify(r, EventAgentRejected, id, map[string]any{"name": agent.Name, "hostname": agent.Hostname, "reason": req.Reason})
+	jsonResponse(w, http.StatusOK, map[string]string{"status": "rejected", "reason": req.Reason})
+}
+
+type RecoveryCodeResponse struct {
+	AgentID      string `json:"agent_id"`
+	RecoveryCode string `json:"recovery_code"`
+	ExpiresAt    string `json:"expires_at"`
+}
+
+func (h *Handlers) AdminCreateRecoveryCode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "agent id required", http.StatusBadRequest)
+		return
+	}
+
+	agent, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return
+	}
+	if agent == nil {
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+
+	code, codeHash, err := GenerateRecoveryCode()
+	if err != nil {
+		internalError(w, r, "generate recovery code", err)
+		return
+	}
+
+	ttl := time.Duration(h.config.RecoveryCodeTTLHours) * time.Hour
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	rc := &RecoveryCode{
+		CodeHash:  codeHash,
+		AgentID:   agent.ID,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+
+	if err := h.store.CreateRecoveryCode(r.Context(), rc); err != nil {
+		internalError(w, r, "create recovery code", err, "agent_id", id)
+		return
+	}
+
+	logger(r.Context()).Info("admin issued recovery code", "agent_id", id, "expires_at", rc.ExpiresAt.Format(time.RFC3339))
+	h.audit(r, "recovery_code.create", agent.ID, "agent:"+agent.ID, nil, map[string]string{"expires_at": rc.ExpiresAt.Format(time.RFC3339)})
+	jsonResponse(w, http.StatusCreated, RecoveryCodeResponse{
+		AgentID:      agent.ID,
+		RecoveryCode: code,
+		ExpiresAt:    rc.ExpiresAt.Format(time.RFC3339),
+	})
+}
+
 // ---------------------------------------------------------------------------
 // Admin invite code handlers
 // ---------------------------------------------------------------------------
 
-// generateInviteCode returns a code of the form "ZNTH-XXXXXXXX" where X is
-// a random uppercase alphanumeric character.
-func generateInviteCode() (string, error) {
+// maxInviteCodeBatch caps how many codes a single request may create.
+const maxInviteCodeBatch = 100
+
+// generateInviteCode returns a code of the form "<prefix>-XXXXXXXX" where X
+// is a random uppercase alphanumeric character. An empty prefix yields just
+// the random part.
+func generateInviteCode(prefix string, length int) (string, error) {
 	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 8)
+	b := make([]byte, length)
 	for i := range b {
 		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
 		if err != nil {
@@ -704,29 +1164,76 @@ func generateInviteCode() (string, error) {
 		}
 		b[i] = chars[n.Int64()]
 	}
-	return "ZNTH-" + string(b), nil
+	if prefix == "" {
+		return string(b), nil
+	}
+	return prefix + "-" + string(b), nil
+}
+
+// validInviteCodePrefix reports whether p contains only the characters
+// generateInviteCode itself produces.
+func validInviteCodePrefix(p string) bool {
+	if len(p) > 16 {
+		return false
+	}
+	for _, c := range p {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHostname reports whether hostname matches a shell-style pattern such
+// as "*.lab.example.com". Matching is case-insensitive.
+func matchHostname(pattern, hostname string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(hostname))
+	return err == nil && ok
 }
 
 type CreateInviteCodeRequest struct {
 	MaxUses        int `json:"max_uses"`
 	ExpiresInHours int `json:"expires_in_hours"`
+
+	// Batch and format. Prefix overrides INVITE_CODE_PREFIX when set; use
+	// "" explicitly for codes without a prefix.
+	Count  int     `json:"count"`
+	Prefix *string `json:"prefix"`
+	Length int     `json:"length"`
+
+	// Grants applied to agents registering with the code
+	Plan            string   `json:"plan"`
+	QuotaBytes      int64    `json:"quota_bytes"`
+	Tags            []string `json:"tags"`
+	HostnamePattern string   `json:"hostname_pattern"`
+	OrgID           string   `json:"org_id"`
 }
 
 type InviteCodeResponse struct {
-	Code      string  `json:"code"`
-	MaxUses   int     `json:"max_uses"`
-	UseCount  int     `json:"use_count"`
-	ExpiresAt *string `json:"expires_at,omitempty"`
-	CreatedAt string  `json:"created_at"`
-	RevokedAt *string `json:"revoked_at,omitempty"`
+	Code            string   `json:"code"`
+	MaxUses         int      `json:"max_uses"`
+	UseCount        int      `json:"use_count"`
+	Plan            string   `json:"plan,omitempty"`
+	QuotaBytes      int64    `json:"quota_bytes,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	HostnamePattern string   `json:"hostname_pattern,omitempty"`
+	OrgID           string   `json:"org_id,omitempty"`
+	ExpiresAt       *string  `json:"expires_at,omitempty"`
+	CreatedAt       string   `json:"created_at"`
+	RevokedAt       *string  `json:"revoked_at,omitempty"`
 }
 
 func inviteCodeToResponse(ic InviteCode) InviteCodeResponse {
 	resp := InviteCodeResponse{
-		Code:      ic.Code,
-		MaxUses:   ic.MaxUses,
-		UseCount:  ic.UseCount,
-		CreatedAt: ic.CreatedAt.Format(time.RFC3339),
+		Code:            ic.Code,
+		MaxUses:         ic.MaxUses,
+		UseCount:        ic.UseCount,
+		Plan:            ic.Plan,
+		QuotaBytes:      ic.QuotaBytes,
+		Tags:            ic.Tags,
+		HostnamePattern: ic.HostnamePattern,
+		OrgID:           ic.OrgID,
+		CreatedAt:       ic.CreatedAt.Format(time.RFC3339),
 	}
 	if ic.ExpiresAt != nil {
 		s := ic.ExpiresAt.Format(time.RFC3339)
@@ -739,6 +1246,9 @@ func inviteCodeToResponse(ic InviteCode) InviteCodeResponse {
 	return resp
 }
 
+// AdminCreateInviteCode creates one code, or a batch of identical-grant codes
+// when count is set. A single code is returned as an object and a batch,
+// created all or none, as {"invite_codes": [...]}.
 func (h *Handlers) AdminCreateInviteCode(w http.ResponseWriter, r *http.Request) {
 	var req CreateInviteCodeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -746,38 +1256,143 @@ func (h *Handlers) AdminCreateInviteCode(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	code, err := generateInviteCode()
-	if err != nil {
-		log.Printf("ERROR: generate invite code: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	count := req.Count
+	if count == 0 {
+		count = 1
+	}
+	if count < 1 || count > maxInviteCodeBatch {
+		jsonError(w, fmt.Sprintf("count must be between 1 and %d", maxInviteCodeBatch), http.StatusBadRequest)
+		return
+	}
+
+	prefix := h.config.InviteCodePrefix
+	if req.Prefix != nil {
+		prefix = strings.ToUpper(strings.TrimSpace(*req.Prefix))
+	}
+	if !validInviteCodePrefix(prefix) {
+		jsonError(w, "prefix must be up to 16 characters A-Z or 0-9", http.StatusBadRequest)
 		return
 	}
+	length := req.Length
+	if length == 0 {
+		length = h.config.InviteCodeLength
+	}
+	if length < minInviteCodeLength || length > maxInviteCodeLength {
+		jsonError(w, fmt.Sprintf("length must be between %d and %d", minInviteCodeLength, maxInviteCodeLength), http.StatusBadRequest)
+		return
+	}
+
+	if req.Plan != "" {
+		if _, ok := h.config.Plans[req.Plan]; !ok {
+			jsonError(w, fmt.Sprintf("unknown plan %q", req.Plan), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.QuotaBytes < 0 {
+		jsonError(w, "quota_bytes must not be negative", http.StatusBadRequest)
+		return
+	}
+	var tags []string
+	for _, t := range req.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if len(t) > 64 {
+			jsonError(w, "tags must be 64 characters or less", http.StatusBadRequest)
+			return
+		}
+		tags = append(tags, t)
+	}
+	if req.HostnamePattern != "" {
+		if _, err := path.Match(req.HostnamePattern, ""); err != nil {
+			jsonError(w, "invalid hostname_pattern", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.OrgID != "" {
+		org, err := h.store.GetOrg(r.Context(), req.OrgID)
+		if err != nil {
+			internalError(w, r, "get org", err, "org_id", req.OrgID)
+			return
+		}
+		if org == nil {
+			jsonError(w, "organization not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	codes := make([]*InviteCode, 0, count)
+	for i := 0; i < count; i++ {
+		code, err := generateInviteCode(prefix, length)
+		if err != nil {
+			internalError(w, r, "generate invite code", err)
+			return
+		}
+
+		ic := &InviteCode{
+			Code:            code,
+			MaxUses:         req.MaxUses,
+			Plan:            req.Plan,
+			QuotaBytes:      req.QuotaBytes,
+			Tags:            tags,
+			HostnamePattern: req.HostnamePattern,
+			OrgID:           req.OrgID,
+			CreatedAt:       now,
+		}
+		if req.ExpiresInHours > 0 {
+			exp := now.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+			ic.ExpiresAt = &exp
+		}
 
-	ic := &InviteCode{
-		Code:      code,
-		MaxUses:   req.MaxUses,
-		CreatedAt: time.Now().UTC(),
+		codes = append(codes, ic)
 	}
-	if req.ExpiresInHours > 0 {
-		exp := time.Now().UTC().Add(time.Duration(req.ExpiresInHours) * time.Hour)
-		ic.ExpiresAt = &exp
+
+	if req.Count == 0 {
+		if err := h.store.CreateInviteCode(r.Context(), codes[0]); err != nil {
+			internalError(w, r, "create invite code", err)
+			return
+		}
+		resp := inviteCodeToResponse(*codes[0])
+		h.audit(r, "invite_code.create", "", "invite_code:"+resp.Code, nil, resp)
+		logger(r.Context()).Info("admin created invite code", "code", resp.Code, "max_uses", req.MaxUses, "plan", req.Plan)
+		jsonResponse(w, http.StatusCreated, resp)
+		return
 	}
 
-	if err := h.store.CreateInviteCode(ic); err != nil {
-		log.Printf("ERROR: create invite code: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	if err := h.store.CreateInviteCodes(r.Context(), codes); err != nil {
+		internalError(w, r, "create invite codes", err, "count", count)
 		return
 	}
+	resp := CreateInviteCodesResponse{InviteCodes: make([]InviteCodeResponse, 0, count)}
+	for _, ic := range codes {
+		resp.InviteCodes = append(resp.InviteCodes, inviteCodeToResponse(*ic))
+		h.audit(r, "invite_code.create", "", "invite_code:"+ic.Code, nil, resp.InviteCodes[len(resp.InviteCodes)-1])
+	}
+	logger(r.Context()).Info("admin created invite codes", "count", count, "max_uses", req.MaxUses, "plan", req.Plan)
+	jsonResponse(w, http.StatusCreated, resp)
+}
 
-	log.Printf("admin created invite code %s (max_uses=%d)", code, req.MaxUses)
-	jsonResponse(w, http.StatusCreated, inviteCodeToResponse(*ic))
+type CreateInviteCodesResponse struct {
+	InviteCodes []InviteCodeResponse `json:"invite_codes"`
+}
+
+type ListInviteCodesResponse struct {
+	InviteCodes []InviteCodeResponse `json:"invite_codes"`
+	NextCursor  string               `json:"next_cursor,omitempty"`
 }
 
 func (h *Handlers) AdminListInviteCodes(w http.ResponseWriter, r *http.Request) {
-	codes, err := h.store.ListInviteCodes()
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	codes, next, err := h.store.ListInviteCodes(r.Context(), page)
 	if err != nil {
-		log.Printf("ERROR: list invite codes: %v", err)
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		internalError(w, r, "list invite codes", err)
 		return
 	}
 
@@ -785,38 +1400,209 @@ func (h *Handlers) AdminListInviteCodes(w http.ResponseWriter, r *http.Request)
 	for i, ic := range codes {
 		resp[i] = inviteCodeToResponse(ic)
 	}
+	jsonResponse(w, http.StatusOK, ListInviteCodesResponse{InviteCodes: resp, NextCursor: next})
+}
+
+type InviteRedemptionResponse struct {
+	AgentID    string `json:"agent_id"`
+	IP         string `json:"ip"`
+	RedeemedAt string `json:"redeemed_at"`
+}
+
+type InviteCodeDetailResponse struct {
+	InviteCodeResponse
+	Redemptions []InviteRedemptionResponse `json:"redemptions"`
+	NextCursor  string                     `json:"next_cursor,omitempty"` // of the redemptions
+}
+
+// AdminGetInviteCode returns a code with one page of its redemptions,
+// oldest first.
+func (h *Handlers) AdminGetInviteCode(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	if code == "" {
+		jsonError(w, "code required", http.StatusBadRequest)
+		return
+	}
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	ic, err := h.store.GetInviteCode(r.Context(), code)
+	if err != nil {
+		internalError(w, r, "get invite code", err, "code", code)
+		return
+	}
+	if ic == nil {
+		jsonError(w, "invite code not found", http.StatusNotFound)
+		return
+	}
+
+	redemptions, next, err := h.store.ListInviteRedemptions(r.Context(), code, page)
+	if err != nil {
+		internalError(w, r, "list redemptions", err, "code", code)
+		return
+	}
+
+	resp := InviteCodeDetailResponse{
+		InviteCodeResponse: inviteCodeToResponse(*ic),
+		Redemptions:        make([]InviteRedemptionResponse, len(redemptions)),
+		NextCursor:         next,
+	}
+	for i, rd := range redemptions {
+		resp.Redemptions[i] = InviteRedemptionResponse{
+			AgentID:    rd.AgentID,
+			IP:         rd.IP,
+			RedeemedAt: rd.RedeemedAt.Format(time.RFC3339),
+		}
+	}
 	jsonResponse(w, http.StatusOK, resp)
 }
 
+type RevokeInviteCodeResponse struct {
+	Revoked         string   `json:"revoked"`
+	SuspendedAgents []string `json:"suspended_agents,omitempty"`
+	FailedAgents    []string `json:"failed_agents,omitempty"`
+}
+
+// AdminRevokeInviteCode revokes a code. With ?suspend_agents=true it also
+// suspends every active or pending agent that registered with it, which is
+// the response to a leaked code; in that mode an already-revoked code is not
+// an error, so the cascade can be applied after a plain revoke, or re-run for
+// the agents listed in failed_agents.
 func (h *Handlers) AdminRevokeInviteCode(w http.ResponseWriter, r *http.Request) {
 	code := r.PathValue("code")
 	if code == "" {
 		jsonError(w, "code required", http.StatusBadRequest)
 		return
 	}
+	cascade := r.URL.Query().Get("suspend_agents") == "true"
 
-	if err := h.store.RevokeInviteCode(code); err != nil {
-		log.Printf("ERROR: revoke invite code %s: %v", code, err)
+	ic, err := h.store.GetInviteCode(r.Context(), code)
+	if err != nil {
+		internalError(w, r, "get invite code", err, "code", code)
+		return
+	}
+	if ic == nil || (ic.RevokedAt != nil && !cascade) {
 		jsonError(w, "invite code not found or already revoked", http.StatusNotFound)
 		return
 	}
 
-	log.Printf("admin revoked invite code %s", code)
-	jsonResponse(w, http.StatusOK, map[string]string{"revoked": code})
+	if ic.RevokedAt == nil {
+		if err := h.store.RevokeInviteCode(r.Context(), code); err != nil {
+			logger(r.Context()).Error("revoke invite code", "code", code, "err", err)
+			jsonError(w, "invite code not found or already revoked", http.StatusNotFound)
+			return
+		}
+		logger(r.Context()).Info("admin revoked invite code", "code", code)
+		h.audit(r, "invite_code.revoke", "", "invite_code:"+code, nil, nil)
+	}
+
+	resp := RevokeInviteCodeResponse{Revoked: code}
+	if cascade {
+		redemptions, _, err := h.store.ListInviteRedemptions(r.Context(), code, Page{})
+		if err != nil {
+			internalError(w, r, "list redemptions", err, "code", code)
+			return
+		}
+		reason := "registered with revoked invite code " + code
+		for _, rd := range redemptions {
+			// Rejected and already suspended agents keep their status and reason
+			before, err := h.store.GetAgent(r.Context(), rd.AgentID)
+			if err != nil {
+				logger(r.Context()).Error("get agent", "agent_id", rd.AgentID, "code", code, "err", err)
+				resp.FailedAgents = append(resp.FailedAgents, rd.AgentID)
+				continue
+			}
+			if before == nil || (before.Status != "active" && before.Status != "pending") {
+				continue
+			}
+			if err := h.store.UpdateAgentStatus(r.Context(), rd.AgentID, "suspended", reason); err != nil {
+				logger(r.Context()).Error("suspend agent", "agent_id", rd.AgentID, "code", code, "err", err)
+				resp.FailedAgents = append(resp.FailedAgents, rd.AgentID)
+				continue
+			}
+			resp.SuspendedAgents = append(resp.SuspendedAgents, rd.AgentID)
+			h.audit(r, "agent.suspend", rd.AgentID, "agent:"+rd.AgentID, agentState(before), map[string]string{"status": "suspended", "reason": reason})
+		}
+		logger(r.Context()).Info("admin suspended agents of revoked invite code", "suspended", len(resp.SuspendedAgents), "failed", len(resp.FailedAgents), "code", code)
+	}
+
+	jsonResponse(w, http.StatusOK, resp)
 }
 
 // ---------------------------------------------------------------------------
 // JSON helpers
 // ---------------------------------------------------------------------------
 
+// defaultPageSize and maxPageSize bound ?limit= on list endpoints.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// parsePage reads the ?cursor= and ?limit= parameters of a list endpoint.
+// limit defaults to defaultPageSize and may be at most maxPageSize. The
+// cursor is the next_cursor of the previous page, checked by the store.
+func parsePage(r *http.Request) (Page, string) {
+	p := Page{Cursor: r.URL.Query().Get("cursor"), Limit: defaultPageSize}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return p, "limit must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+		p.Limit = n
+	}
+	return p, ""
+}
+
 func jsonResponse(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
 
+// StatusClientClosedRequest is the non-standard status (from nginx) for a
+// request whose client went away before the response.
+const StatusClientClosedRequest = 499
+
+// internalError answers a request that failed on err. Store calls cut short
+// by their context are answered by canceledError and a cursor the store
+// rejected with a 400; anything else is logged with msg and attrs and
+// answered with a 500.
+func internalError(w http.ResponseWriter, r *http.Request, msg string, err error, attrs ...any) {
+	if canceledError(w, r, msg, err, attrs...) {
+		return
+	}
+	if errors.Is(err, ErrInvalidCursor) {
+		jsonError(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+	logger(r.Context()).Error(msg, append(attrs, "err", err)...)
+	jsonError(w, "internal error", http.StatusInternalServerError)
+}
+
+// canceledError answers and returns true if err is a store call cut short
+// by its context: 499 when the client went away, 503 when the call timed
+// out. Neither is a server fault, so neither is logged as an error.
+func canceledError(w http.ResponseWriter, r *http.Request, msg string, err error, attrs ...any) bool {
+	switch {
+	case errors.Is(err, ErrStoreCanceled):
+		logger(r.Context()).Info(msg, append(attrs, "err", err)...)
+		jsonError(w, "request canceled", StatusClientClosedRequest)
+	case errors.Is(err, ErrStoreTimeout):
+		logger(r.Context()).Warn(msg, append(attrs, "err", err)...)
+		w.Header().Set("Retry-After", "1")
+		jsonError(w, "request timed out, try again later", http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+	return true
+}
+
 func jsonError(w http.ResponseWriter, message string, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	json.NewEncoder(w).Encode(errorBody(w, message))
 }
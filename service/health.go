@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Liveness and readiness
+// ---------------------------------------------------------------------------
+//
+// /healthz only reports that the process is serving requests. /readyz checks
+// that the dependencies needed to do anything useful respond: a cheap read
+// from the store and a HeadBucket on S3, each bounded by ReadinessTimeout.
+// Failure details are logged; the response only says which check failed.
+
+// CheckResult is the outcome of one dependency check.
+type CheckResult struct {
+	Status    string `json:"status"` // "ok", "failed" or "timeout"
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"` // "ok" or "unavailable"
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Healthz is the liveness probe.
+func (h *Handlers) Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// Readyz is the readiness probe. It answers 503 if any check fails.
+func (h *Handlers) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"store": h.store.Ping,
+	}
+	if h.s3 != nil {
+		checks["s3"] = h.s3.HeadBucket
+	}
+
+	resp := ReadinessResponse{Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			result, err := runCheck(r.Context(), h.config.ReadinessTimeout, check)
+			if err != nil {
+				logger(r.Context()).Warn("readiness check failed", "check", name, "status", result.Status, "err", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = result
+			if result.Status != "ok" {
+				resp.Status = "unavailable"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, status, resp)
+}
+
+// runCheck runs check with a timeout. The check gets a context that expires
+// with the timeout, but is not waited for past it, in case it ignores the
+// context.
+func runCheck(ctx context.Context, timeout time.Duration, check func(context.Context) error) (CheckResult, error) {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := CheckResult{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result.Status = "timeout"
+	case err != nil:
+		result.Status = "failed"
+	}
+	return result, err
+}
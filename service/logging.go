@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/awslabs/aws-lambda-go-api-proxy/core"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------------------------------------------------------------------------
+// Structured logging
+// ---------------------------------------------------------------------------
+//
+// Logs are written with log/slog, as JSON by default. Every request gets an
+// ID — taken from the X-Request-ID header, else API Gateway's request ID,
+// else generated — that is echoed in the X-Request-ID response header,
+// included in error bodies, and attached to every line logged through
+// logger(ctx) while the request is served.
+
+const requestIDHeader = "X-Request-ID"
+
+const requestInfoContextKey contextKey = "request_info"
+
+// newLogger builds the process logger. format is "json" or "text"; level is
+// one of slog's level names ("debug", "info", "warn", "error").
+func newLogger(w io.Writer, format, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// requestInfo describes the request being served. LogRequests creates it;
+// middleware further down fills in the caller's identity as it learns it.
+type requestInfo struct {
+	ID      string
+	Route   string
+	TraceID string
+	AgentID string
+	Admin   string // "global:<key hash prefix>", "org:<org>/<key>" or "open" when admin auth is disabled
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+// logger returns the default logger annotated with the request ID, the
+// current trace and span IDs and, once authenticated, the agent ID of the
+// request in ctx.
+func logger(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if info := requestInfoFromContext(ctx); info != nil {
+		l = l.With("request_id", info.ID)
+		if info.AgentID != "" {
+			l = l.With("agent_id", info.AgentID)
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	return l
+}
+
+// requestID returns the caller's X-Request-ID if it is usable, else API
+// Gateway's request ID, else a fresh random ID.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	if gw, ok := core.GetAPIGatewayV2ContextFromContext(r.Context()); ok && gw.RequestID != "" {
+		return gw.RequestID
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts up to 128 characters of [A-Za-z0-9._:-], so that
+// caller-supplied IDs cannot inject anything into logs or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return strings.IndexFunc(id, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '.' || c == '_' || c == ':' || c == '-')
+	}) < 0
+}
+
+// errorBody is the JSON body of an error response: the message and, when
+// known, the request ID.
+func errorBody(w http.ResponseWriter, message string) map[string]string {
+	body := map[string]string{"error": message}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	return body
+}
@@ -2,52 +2,109 @@ package main
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
+	"go.opentelemetry.io/otel"
 )
 
 func main() {
 	cfg := LoadConfig()
+	slog.SetDefault(newLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel))
 
-	// Initialize store based on mode
-	var store DataStore
-	var err error
-
-	switch cfg.StoreMode {
-	case "dynamo":
-		store, err = NewDynamoStore(context.Background(), cfg)
-		if err != nil {
-			log.Fatalf("failed to create DynamoDB store: %v", err)
-		}
-	default:
-		store, err = NewSQLiteStore(cfg.DatabasePath)
-		if err != nil {
-			log.Fatalf("failed to open SQLite database: %v", err)
+	if len(os.Args) > 1 {
+		if ran, err := runCommand(context.Background(), cfg, os.Args[1], os.Args[2:]); ran {
+			if err != nil {
+				fatal(os.Args[1]+" failed", err)
+			}
+			return
 		}
 	}
+
+	store, err := openStore(context.Background(), cfg)
+	if err != nil {
+		fatal("failed to open store", err)
+	}
 	defer store.Close()
 
 	s3client, err := NewS3Client(context.Background(), cfg)
 	if err != nil {
-		log.Fatalf("failed to create S3 client: %v", err)
+		fatal("failed to create S3 client", err)
+	}
+
+	tracerProvider, err := newTracerProvider(context.Background(), cfg)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+	if tracerProvider != nil {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(tracePropagator)
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			slog.Warn("tracing export failed", "err", err)
+		}))
+		slog.Info("tracing enabled", "endpoint", cfg.OTLPEndpoint, "sample_ratio", cfg.TraceSampleRatio)
 	}
 
-	handler := buildHandler(store, s3client, cfg)
+	metrics := NewMetrics(store)
+	jobStore := wrapStore(store, cfg, metrics)
+	webhooks := NewWebhookDispatcher(jobStore, cfg)
+	notifier := multiNotifier{logNotifier{}, webhooks}
+	var mailer Mailer
+	var emails *EmailNotifier
+	if cfg.SMTPHost != "" {
+		mailer = NewSMTPMailer(cfg)
+		emails = NewEmailNotifier(jobStore, mailer, cfg)
+		notifier = append(notifier, emails)
+		slog.Info("email notifications enabled", "smtp_host", cfg.SMTPHost, "admin_email_mode", cfg.AdminEmailMode)
+	}
+	handler := buildHandler(store, s3client, cfg, metrics, notifier)
 
 	// Lambda mode: use the API Gateway v2 adapter
 	if cfg.IsLambda() {
-		log.Println("starting in Lambda mode")
-		lambda.Start(httpadapter.NewV2(handler).ProxyWithContext)
+		slog.Info("starting in Lambda mode")
+		proxy := httpadapter.NewV2(handler).ProxyWithContext
+		lambda.Start(func(ctx context.Context, payload json.RawMessage) (any, error) {
+			// The instance may be frozen as soon as the response is
+			// returned, so export each invocation's spans before returning.
+			if tracerProvider != nil {
+				defer tracerProvider.ForceFlush(ctx)
+			}
+			// EventBridge schedules invoke the function directly with the
+			// name of a job as input.
+			var scheduled struct {
+				Job string `json:"job"`
+			}
+			if json.Unmarshal(payload, &scheduled) == nil && scheduled.Job != "" {
+				return runScheduledJob(ctx, scheduled.Job, jobStore, cfg, notifier, webhooks, mailer)
+			}
+			var req events.APIGatewayV2HTTPRequest
+			if err := json.Unmarshal(payload, &req); err != nil {
+				return nil, err
+			}
+			return proxy(ctx, req)
+		})
 		return
 	}
 
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	if cfg.StaleCheckInterval > 0 {
+		go runStaleChecks(jobCtx, jobStore, cfg, notifier, cfg.StaleCheckInterval)
+	}
+	go runWebhookRetries(jobCtx, webhooks, time.Minute)
+	if pendingDigestEnabled(cfg) {
+		go runPendingDigests(jobCtx, jobStore, mailer, cfg, emailDigestInterval)
+	}
+
 	// HTTP server mode (local dev)
 	srv := &http.Server{
 		Addr:         cfg.ListenAddr,
@@ -57,66 +114,231 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// Metrics on their own listener, e.g. only reachable from the scraper
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.Handler())
+		metricsSrv = &http.Server{Addr: cfg.MetricsAddr, Handler: metricsMux, ReadTimeout: 10 * time.Second}
+		go func() {
+			slog.Info("metrics listening", "addr", cfg.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("metrics server", "err", err)
+			}
+		}()
+	}
+
 	// Graceful shutdown
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
-		log.Println("shutting down...")
+		slog.Info("shutting down")
+		stopJobs()
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutdownCancel()
 		srv.Shutdown(shutdownCtx)
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(shutdownCtx)
+		}
+		webhooks.Close(shutdownCtx)
+		if emails != nil {
+			emails.Wait(shutdownCtx)
+		}
+		if tracerProvider != nil {
+			tracerProvider.Shutdown(shutdownCtx)
+		}
 	}()
 
-	log.Printf("backup service listening on %s (store: %s)", cfg.ListenAddr, cfg.StoreMode)
+	slog.Info("backup service listening", "addr", cfg.ListenAddr, "store", cfg.StoreMode)
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("server error: %v", err)
+		fatal("server error", err)
 	}
 }
 
-func buildHandler(store DataStore, s3client *S3Client, cfg *Config) http.Handler {
+// runScheduledJob runs a job named in a scheduled Lambda invocation.
+func runScheduledJob(ctx context.Context, job string, store DataStore, cfg *Config, notifier Notifier, webhooks *WebhookDispatcher, mailer Mailer) (any, error) {
+	switch job {
+	case "stale-check":
+		result, err := checkStaleAgents(ctx, store, cfg, notifier, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("stale-agent check", "checked", result.Checked, "stale", result.Stale, "recovered", result.Recovered)
+		// Deliveries of the events just sent must finish before the
+		// instance is frozen.
+		return result, webhooks.Wait(ctx)
+	case "webhook-retry":
+		attempted, err := webhooks.RetryDue(ctx)
+		slog.Info("webhook retries", "attempted", attempted)
+		return map[string]int{"attempted": attempted}, err
+	case "email-digest":
+		if !pendingDigestEnabled(cfg) {
+			return map[string]int{"pending": 0}, nil
+		}
+		pending, err := sendPendingDigest(ctx, store, mailer, cfg)
+		slog.Info("pending digest", "pending", pending)
+		return map[string]int{"pending": pending}, err
+	default:
+		return nil, fmt.Errorf("unknown job %q", job)
+	}
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// runCommand runs the maintenance command name instead of the server. It
+// returns false if there is no such command.
+func runCommand(ctx context.Context, cfg *Config, name string, args []string) (bool, error) {
+	switch name {
+	case "migrate":
+		return true, runMigrateCommand(ctx, cfg, args, os.Stdout)
+	case "export":
+		return true, runExportCommand(ctx, cfg, args, os.Stdout, os.Stderr)
+	case "import":
+		return true, runImportCommand(ctx, cfg, args, os.Stdin, os.Stderr)
+	}
+	return false, nil
+}
+
+// openStore opens the store selected by cfg.StoreMode.
+func openStore(ctx context.Context, cfg *Config) (DataStore, error) {
+	switch cfg.StoreMode {
+	case "dynamo":
+		store, err := NewDynamoStore(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("create DynamoDB store: %w", err)
+		}
+		return store, nil
+	case "postgres":
+		store, err := NewPostgresStore(ctx, cfg.DatabaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("create PostgreSQL store: %w", err)
+		}
+		return store, nil
+	default:
+		store, err := NewSQLiteStore(cfg.DatabasePath)
+		if err != nil {
+			return nil, fmt.Errorf("open SQLite database: %w", err)
+		}
+		return store, nil
+	}
+}
+
+// wrapStore adds per-call timeouts, tracing and, when metrics is non-nil,
+// metrics to store.
+func wrapStore(store DataStore, cfg *Config, metrics *Metrics) DataStore {
+	return metrics.InstrumentStore(traceStore(withStoreTimeout(store, cfg.StoreTimeout)))
+}
+
+// buildHandler wires the routes. metrics may be nil to disable
+// instrumentation, and notifier nil to only log events.
+func buildHandler(store DataStore, s3client *S3Client, cfg *Config, metrics *Metrics, notifier Notifier) http.Handler {
+	// The limiter may live in the store, so pick it before wrapping the store
+	limiter := metrics.InstrumentLimiter(newRateLimiter(cfg, store))
+	store = wrapStore(store, cfg, metrics)
+	if s3client != nil {
+		s3client.metrics = metrics
+	}
+
 	h := &Handlers{
-		store:  store,
-		s3:     s3client,
-		config: cfg,
+		store:    store,
+		s3:       s3client,
+		config:   cfg,
+		metrics:  metrics,
+		notifier: notifier,
 	}
 
 	mux := http.NewServeMux()
 
+	// Every route is limited per client IP; authenticated routes are also
+	// limited per agent.
+	auth := func(next http.Handler) http.Handler {
+		return Auth(store, RateLimitAgent(limiter, cfg.AgentRateLimit, next))
+	}
+	registerLimit := RateLimitPolicy{PerMinute: cfg.RegisterRateLimit}
+
 	// Public (rate-limited, open registration)
-	mux.Handle("POST /v1/agents/register", RateLimit(cfg.RegisterRateLimit, http.HandlerFunc(h.Register)))
+	mux.Handle("POST /v1/agents/register", RateLimit(limiter, "register", registerLimit, traceHandler("Register", h.Register)))
+	mux.Handle("POST /v1/agents/recover", RateLimit(limiter, "register", registerLimit, traceHandler("Recover", h.Recover)))
 
 	// Authenticated + RequireActive (mutation endpoints)
-	mux.Handle("POST /v1/backups/upload-url", Auth(store, RequireActive(http.HandlerFunc(h.UploadURL))))
-	mux.Handle("DELETE /v1/backups", Auth(store, RequireActive(http.HandlerFunc(h.DeleteAllBackups))))
-	mux.Handle("DELETE /v1/backups/{timestamp}", Auth(store, RequireActive(http.HandlerFunc(h.DeleteBackup))))
-	mux.Handle("POST /v1/backups/{timestamp}/undelete", Auth(store, RequireActive(http.HandlerFunc(h.UndeleteBackup))))
+	mux.Handle("POST /v1/backups/upload-url", auth(RequireActive(traceHandler("UploadURL", h.UploadURL))))
+	mux.Handle("DELETE /v1/backups", auth(RequireActive(traceHandler("DeleteAllBackups", h.DeleteAllBackups))))
+	mux.Handle("DELETE /v1/backups/{timestamp}", auth(RequireActive(traceHandler("DeleteBackup", h.DeleteBackup))))
+	mux.Handle("POST /v1/backups/{timestamp}/undelete", auth(RequireActive(traceHandler("UndeleteBackup", h.UndeleteBackup))))
 
 	// Authenticated (read endpoints — pending/suspended agents can still use these)
-	mux.Handle("GET /v1/backups", Auth(store, http.HandlerFunc(h.ListBackups)))
-	mux.Handle("GET /v1/backups/{timestamp}", Auth(store, http.HandlerFunc(h.GetBackup)))
-	mux.Handle("POST /v1/backups/download-url", Auth(store, http.HandlerFunc(h.DownloadURL)))
+	mux.Handle("GET /v1/backups", auth(traceHandler("ListBackups", h.ListBackups)))
+	mux.Handle("GET /v1/backups/{timestamp}", auth(traceHandler("GetBackup", h.GetBackup)))
+	mux.Handle("POST /v1/backups/download-url", auth(traceHandler("DownloadURL", h.DownloadURL)))
 
 	// Agent management (auth-only, no active requirement)
-	mux.Handle("GET /v1/agents/me", Auth(store, http.HandlerFunc(h.AgentInfo)))
-	mux.Handle("PATCH /v1/agents/me", Auth(store, http.HandlerFunc(h.UpdateProfile)))
-	mux.Handle("POST /v1/agents/me/rotate-token", Auth(store, http.HandlerFunc(h.RotateToken)))
+	mux.Handle("GET /v1/agents/me", auth(traceHandler("AgentInfo", h.AgentInfo)))
+	mux.Handle("PATCH /v1/agents/me", auth(traceHandler("UpdateProfile", h.UpdateProfile)))
+	mux.Handle("POST /v1/agents/me/rotate-token", auth(traceHandler("RotateToken", h.RotateToken)))
+	mux.Handle("GET /v1/agents/me/audit", auth(traceHandler("AgentAuditEvents", h.AgentAuditEvents)))
+
+	// Admin endpoints (protected by X-API-Key header). Org-scoped keys may
+	// list, approve and suspend their own org's agents.
+	mux.Handle("GET /v1/admin/agents", OrgAdminAuth(cfg.AdminAPIKey, store, traceHandler("AdminListAgents", h.AdminListAgents)))
+	mux.Handle("POST /v1/admin/agents/{id}/approve", OrgAdminAuth(cfg.AdminAPIKey, store, traceHandler("AdminApproveAgent", h.AdminApproveAgent)))
+	mux.Handle("POST /v1/admin/agents/{id}/suspend", OrgAdminAuth(cfg.AdminAPIKey, store, traceHandler("AdminSuspendAgent", h.AdminSuspendAgent)))
+	mux.Handle("POST /v1/admin/agents/{id}/stale-threshold", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminSetStaleThreshold", h.AdminSetStaleThreshold)))
+	mux.Handle("POST /v1/admin/agents/{id}/org", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminSetAgentOrg", h.AdminSetAgentOrg)))
+	mux.Handle("POST /v1/admin/agents/{id}/reject", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminRejectAgent", h.AdminRejectAgent)))
+	mux.Handle("POST /v1/admin/agents/{id}/recovery-code", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateRecoveryCode", h.AdminCreateRecoveryCode)))
+	mux.Handle("POST /v1/admin/agents/{id}/transfer", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminTransferBackups", h.AdminTransferBackups)))
+	mux.Handle("GET /v1/admin/transfers/{id}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminGetTransfer", h.AdminGetTransfer)))
 
-	// Admin endpoints (protected by X-API-Key header)
-	mux.Handle("GET /v1/admin/agents", APIKeyAuth(cfg.AdminAPIKey, http.HandlerFunc(h.AdminListAgents)))
-	mux.Handle("POST /v1/admin/agents/{id}/approve", APIKeyAuth(cfg.AdminAPIKey, http.HandlerFunc(h.AdminApproveAgent)))
-	mux.Handle("POST /v1/admin/agents/{id}/suspend", APIKeyAuth(cfg.AdminAPIKey, http.HandlerFunc(h.AdminSuspendAgent)))
+	// Admin organization endpoints
+	mux.Handle("POST /v1/admin/orgs", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateOrg", h.AdminCreateOrg)))
+	mux.Handle("GET /v1/admin/orgs", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListOrgs", h.AdminListOrgs)))
+	mux.Handle("GET /v1/admin/orgs/{id}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminGetOrg", h.AdminGetOrg)))
+	mux.Handle("POST /v1/admin/orgs/{id}/keys", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateOrgAPIKey", h.AdminCreateOrgAPIKey)))
+	mux.Handle("GET /v1/admin/orgs/{id}/keys", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListOrgAPIKeys", h.AdminListOrgAPIKeys)))
+	mux.Handle("DELETE /v1/admin/orgs/{id}/keys/{key_id}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminDeleteOrgAPIKey", h.AdminDeleteOrgAPIKey)))
 
 	// Admin invite code endpoints
-	mux.Handle("POST /v1/admin/invite-codes", APIKeyAuth(cfg.AdminAPIKey, http.HandlerFunc(h.AdminCreateInviteCode)))
-	mux.Handle("GET /v1/admin/invite-codes", APIKeyAuth(cfg.AdminAPIKey, http.HandlerFunc(h.AdminListInviteCodes)))
-	mux.Handle("DELETE /v1/admin/invite-codes/{code}", APIKeyAuth(cfg.AdminAPIKey, http.HandlerFunc(h.AdminRevokeInviteCode)))
+	mux.Handle("POST /v1/admin/invite-codes", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateInviteCode", h.AdminCreateInviteCode)))
+	mux.Handle("GET /v1/admin/invite-codes", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListInviteCodes", h.AdminListInviteCodes)))
+	mux.Handle("GET /v1/admin/invite-codes/{code}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminGetInviteCode", h.AdminGetInviteCode)))
+	mux.Handle("DELETE /v1/admin/invite-codes/{code}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminRevokeInviteCode", h.AdminRevokeInviteCode)))
+
+	// Admin registration ban list
+	mux.Handle("POST /v1/admin/bans", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateBan", h.AdminCreateBan)))
+	mux.Handle("GET /v1/admin/bans", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListBans", h.AdminListBans)))
+	mux.Handle("DELETE /v1/admin/bans/{id}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminDeleteBan", h.AdminDeleteBan)))
+
+	// Admin audit log
+	mux.Handle("GET /v1/admin/audit", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListAuditEvents", h.AdminListAuditEvents)))
+
+	// Admin webhooks
+	mux.Handle("POST /v1/admin/webhooks", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateWebhook", h.AdminCreateWebhook)))
+	mux.Handle("GET /v1/admin/webhooks", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListWebhooks", h.AdminListWebhooks)))
+	mux.Handle("DELETE /v1/admin/webhooks/{id}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminDeleteWebhook", h.AdminDeleteWebhook)))
+	mux.Handle("GET /v1/admin/webhooks/{id}/deliveries", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListWebhookDeliveries", h.AdminListWebhookDeliveries)))
+
+	// Admin fleet statistics
+	mux.Handle("GET /v1/admin/stats", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminStats", h.AdminStats)))
+
+	// Admin auto-approval rules
+	mux.Handle("POST /v1/admin/approval-rules", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminCreateApprovalRule", h.AdminCreateApprovalRule)))
+	mux.Handle("GET /v1/admin/approval-rules", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminListApprovalRules", h.AdminListApprovalRules)))
+	mux.Handle("DELETE /v1/admin/approval-rules/{id}", APIKeyAuth(cfg.AdminAPIKey, traceHandler("AdminDeleteApprovalRule", h.AdminDeleteApprovalRule)))
+
+	// Prometheus metrics, unless served on their own listener
+	if metrics != nil && cfg.MetricsAddr == "" {
+		mux.Handle("GET /metrics", APIKeyAuth(cfg.AdminAPIKey, metrics.Handler()))
+	}
 
-	// Health
-	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
+	// Liveness and readiness
+	mux.HandleFunc("GET /healthz", h.Healthz)
+	mux.Handle("GET /readyz", traceHandler("Readyz", h.Readyz))
 
-	return LogRequests(mux)
+	handler := RateLimit(limiter, "ip", cfg.IPRateLimit, mux)
+	return ClientIP(cfg.TrustedProxies, LogRequests(mux, Trace(mux, metrics.InstrumentRoutes(mux, handler))))
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ---------------------------------------------------------------------------
+// Prometheus metrics
+// ---------------------------------------------------------------------------
+//
+// Metrics are registered on a registry owned by each Metrics value rather
+// than the global default, so several handlers (as in tests) can coexist.
+// All recording methods are no-ops on a nil *Metrics.
+
+const metricsNamespace = "openclaw_backup"
+
+// agentStatuses are the statuses reported by the agents gauge.
+var agentStatuses = []string{"pending", "active", "suspended", "rejected"}
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storeDuration   *prometheus.HistogramVec
+	storeErrors     *prometheus.CounterVec
+	s3Duration      *prometheus.HistogramVec
+	s3Errors        *prometheus.CounterVec
+	registrations   *prometheus.CounterVec
+	uploads         prometheus.Counter
+	uploadBytes     prometheus.Counter
+	uploadRejects   *prometheus.CounterVec
+	rateLimitHits   *prometheus.CounterVec
+}
+
+// NewMetrics creates the service metrics. The agents gauge is computed from
+// store at scrape time.
+func NewMetrics(store DataStore) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route and status code.",
+		}, []string{"route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "status"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "DataStore call latency by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_errors_total",
+			Help:      "DataStore calls that returned an error, by operation.",
+		}, []string{"op"}),
+		s3Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "s3_operation_duration_seconds",
+			Help:      "S3 call latency by operation (presigning included).",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op"}),
+		s3Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "s3_errors_total",
+			Help:      "S3 calls that returned an error, by operation.",
+		}, []string{"op"}),
+		registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "registrations_total",
+			Help:      "Agent registrations by initial status.",
+		}, []string{"status"}),
+		uploads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploads_total",
+			Help:      "Backup uploads accepted (upload URLs issued).",
+		}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_bytes_total",
+			Help:      "Encrypted bytes declared by accepted backup uploads.",
+		}),
+		uploadRejects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_rejections_total",
+			Help:      "Backup uploads refused, by reason (quota, org_quota, size, frequency, error).",
+		}, []string{"reason"}),
+		rateLimitHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limit_hits_total",
+			Help:      "Requests refused by a rate limit, by limit scope.",
+		}, []string{"scope"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration,
+		m.storeDuration, m.storeErrors,
+		m.s3Duration, m.s3Errors,
+		m.registrations, m.uploads, m.uploadBytes, m.uploadRejects,
+		m.rateLimitHits,
+	)
+
+	for _, status := range agentStatuses {
+		status := status
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "agents",
+			Help:        "Registered agents by status.",
+			ConstLabels: prometheus.Labels{"status": status},
+		}, func() float64 {
+			n, err := store.CountAgentsByStatus(context.Background(), status)
+			if err != nil {
+				slog.Warn("metrics: count agents", "status", status, "err", err)
+				return 0
+			}
+			return float64(n)
+		}))
+	}
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentRoutes records request counts and latency for mux. Routes are
+// labelled with the matched pattern (e.g. "GET /v1/backups/{timestamp}") so
+// label cardinality stays bounded.
+func (m *Metrics) InstrumentRoutes(mux *http.ServeMux, next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var route string
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			route = info.Route
+		} else if _, route = mux.Handler(r); route == "" {
+			route = "unmatched"
+		}
+
+		sw, ok := w.(*statusWriter)
+		if !ok {
+			sw = &statusWriter{ResponseWriter: w, status: 200}
+		}
+		next.ServeHTTP(sw, r)
+
+		status := strconv.Itoa(sw.status)
+		m.requests.WithLabelValues(route, status).Inc()
+		m.requestDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+func (m *Metrics) observeStore(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.storeDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.storeErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (m *Metrics) observeS3(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.s3Duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.s3Errors.WithLabelValues(op).Inc()
+	}
+}
+
+func (m *Metrics) registered(status string) {
+	if m == nil {
+		return
+	}
+	m.registrations.WithLabelValues(status).Inc()
+}
+
+func (m *Metrics) uploaded(bytes int64) {
+	if m == nil {
+		return
+	}
+	m.uploads.Inc()
+	m.uploadBytes.Add(float64(bytes))
+}
+
+func (m *Metrics) uploadRejected(reason string) {
+	if m == nil {
+		return
+	}
+	m.uploadRejects.WithLabelValues(reason).Inc()
+}
+
+// InstrumentLimiter counts refused requests per limit scope, taken from the
+// bucket key ("ip:...", "register:...", "agent:...").
+func (m *Metrics) InstrumentLimiter(limiter RateLimiter) RateLimiter {
+	if m == nil {
+		return limiter
+	}
+	return &instrumentedLimiter{next: limiter, m: m}
+}
+
+type instrumentedLimiter struct {
+	next RateLimiter
+	m    *Metrics
+}
+
+func (l *instrumentedLimiter) Allow(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	res, err := l.next.Allow(ctx, key, p)
+	if err == nil && !res.Allowed {
+		scope, _, _ := strings.Cut(key, ":")
+		l.m.rateLimitHits.WithLabelValues(scope).Inc()
+	}
+	return res, err
+}
@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/awslabs/aws-lambda-go-api-proxy/core"
 )
 
 type contextKey string
 
-const agentContextKey contextKey = "agent"
+const (
+	agentContextKey      contextKey = "agent"
+	adminScopeContextKey contextKey = "admin_scope"
+	clientIPContextKey   contextKey = "client_ip"
+)
 
 // AgentFromContext extracts the authenticated agent from the request context.
 func AgentFromContext(ctx context.Context) *Agent {
@@ -20,44 +25,121 @@ func AgentFromContext(ctx context.Context) *Agent {
 	return a
 }
 
+// AdminScope identifies an org-scoped admin key. Requests authenticated with
+// a global admin key carry no scope.
+type AdminScope struct {
+	OrgID string
+	KeyID string
+}
+
+// AdminScopeFromContext returns the org scope of the admin caller, or nil for
+// global admins.
+func AdminScopeFromContext(ctx context.Context) *AdminScope {
+	s, _ := ctx.Value(adminScopeContextKey).(*AdminScope)
+	return s
+}
+
+// isAdminKey reports whether key is one of the comma-separated expectedKeys.
+func isAdminKey(expectedKeys, key string) bool {
+	for _, allowed := range strings.Split(expectedKeys, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed != "" && key == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 // APIKeyAuth validates the X-API-Key header against one or more expected keys.
 // expectedKeys can be a single key or comma-separated list (for rotation).
 // If expectedKeys is empty, the check is skipped (pass-through for local dev).
 func APIKeyAuth(expectedKeys string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if expectedKeys == "" {
+		r, next, end := traceMiddleware(r, "APIKeyAuth", next)
+		defer end()
+
+		key := r.Header.Get("X-API-Key")
+		if expectedKeys == "" || isAdminKey(expectedKeys, key) {
+			setAdminIdentity(r, expectedKeys, key)
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		jsonError(w, "invalid or missing API key", http.StatusUnauthorized)
+	})
+}
+
+// OrgAdminAuth is APIKeyAuth for endpoints that org-scoped admin keys may
+// also call. A global key passes through unscoped; an org key stored in the
+// DataStore injects an AdminScope that handlers use to restrict results.
+func OrgAdminAuth(expectedKeys string, store DataStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, next, end := traceMiddleware(r, "OrgAdminAuth", next)
+		defer end()
+
 		key := r.Header.Get("X-API-Key")
-		for _, allowed := range strings.Split(expectedKeys, ",") {
-			allowed = strings.TrimSpace(allowed)
-			if allowed != "" && key == allowed {
-				next.ServeHTTP(w, r)
+		if expectedKeys != "" && isAdminKey(expectedKeys, key) {
+			setAdminIdentity(r, expectedKeys, key)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if key != "" {
+			k, err := store.LookupOrgAPIKey(r.Context(), HashToken(key))
+			if err != nil {
+				internalError(w, r, "org API key lookup failed", err)
 				return
 			}
+			if k != nil {
+				if info := requestInfoFromContext(r.Context()); info != nil {
+					info.Admin = "org:" + k.OrgID + "/" + k.ID
+				}
+				ctx := context.WithValue(r.Context(), adminScopeContextKey, &AdminScope{OrgID: k.OrgID, KeyID: k.ID})
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		if expectedKeys == "" {
+			setAdminIdentity(r, expectedKeys, key)
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`{"error":"invalid or missing API key"}`))
+		jsonError(w, "invalid or missing API key", http.StatusUnauthorized)
 	})
 }
 
+// setAdminIdentity records which global admin key authenticated the request,
+// as a short hash prefix so keys never reach the logs.
+func setAdminIdentity(r *http.Request, expectedKeys, key string) {
+	info := requestInfoFromContext(r.Context())
+	if info == nil {
+		return
+	}
+	if expectedKeys == "" {
+		info.Admin = "open"
+		return
+	}
+	info.Admin = "global:" + HashToken(key)[:8]
+}
+
 // RequireActive rejects requests from agents that are not in "active" status.
 // Must be placed after Auth middleware which sets the agent in context.
 func RequireActive(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, next, end := traceMiddleware(r, "RequireActive", next)
+		defer end()
+
 		agent := AgentFromContext(r.Context())
 		if agent == nil {
-			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			jsonError(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 		if agent.Status != "active" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprintf(w, `{"error":"agent not active","status":%q}`, agent.Status)
+			body := errorBody(w, "agent not active")
+			body["status"] = agent.Status
+			jsonResponse(w, http.StatusForbidden, body)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -67,74 +149,82 @@ func RequireActive(next http.Handler) http.Handler {
 // Auth validates the bearer token and injects the agent into the context.
 func Auth(store DataStore, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, next, end := traceMiddleware(r, "Auth", next)
+		defer end()
+
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
-			http.Error(w, `{"error":"missing Authorization header"}`, http.StatusUnauthorized)
+			jsonError(w, "missing Authorization header", http.StatusUnauthorized)
 			return
 		}
 
 		token := strings.TrimPrefix(auth, "Bearer ")
 		if token == auth {
-			http.Error(w, `{"error":"invalid Authorization format, expected Bearer token"}`, http.StatusUnauthorized)
+			jsonError(w, "invalid Authorization format, expected Bearer token", http.StatusUnauthorized)
 			return
 		}
 
-		agent, err := store.LookupAgentByToken(token)
+		agent, err := store.LookupAgentByToken(r.Context(), token)
 		if err != nil {
-			log.Printf("ERROR: token lookup failed: %v", err)
-			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			internalError(w, r, "token lookup failed", err)
 			return
 		}
 		if agent == nil {
-			http.Error(w, `{"error":"invalid token"}`, http.StatusUnauthorized)
+			jsonError(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
 
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			info.AgentID = agent.ID
+		}
 		ctx := context.WithValue(r.Context(), agentContextKey, agent)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// RateLimit applies per-IP rate limiting using the store.
-func RateLimit(maxPerMinute int, next http.Handler) http.Handler {
+// LogRequests assigns the request ID and logs each request once it is served,
+// with its route pattern in routes, status, sizes, latency and the caller's
+// identity.
+func LogRequests(routes *http.ServeMux, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := clientIP(r)
-		key := "ratelimit:" + ip
-
-		// We need a store reference — use a simple in-memory approach instead
-		// since the store is not passed here. For production, use the store.
-		// For now, we'll use a package-level rate limiter.
-		allowed, err := globalRateLimiter.Allow(key, maxPerMinute)
-		if err != nil {
-			log.Printf("ERROR: rate limit check failed: %v", err)
-			// Fail open
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		if !allowed {
-			w.Header().Set("Retry-After", "60")
-			http.Error(w, `{"error":"rate limit exceeded, try again later"}`, http.StatusTooManyRequests)
-			return
+		start := time.Now()
+		info := &requestInfo{ID: requestID(r)}
+		if _, info.Route = routes.Handler(r); info.Route == "" {
+			info.Route = "unmatched"
 		}
+		w.Header().Set(requestIDHeader, info.ID)
 
-		next.ServeHTTP(w, r)
-	})
-}
-
-// LogRequests logs each request with method, path, status, and duration.
-func LogRequests(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
 		sw := &statusWriter{ResponseWriter: w, status: 200}
-		next.ServeHTTP(sw, r)
-		log.Printf("%s %s %d %s", r.Method, r.URL.Path, sw.status, time.Since(start).Round(time.Millisecond))
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info)))
+
+		attrs := []any{
+			"request_id", info.ID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", info.Route,
+			"status", sw.status,
+			"bytes_in", max(r.ContentLength, 0),
+			"bytes_out", sw.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", clientIP(r),
+		}
+		if info.TraceID != "" {
+			attrs = append(attrs, "trace_id", info.TraceID)
+		}
+		if info.AgentID != "" {
+			attrs = append(attrs, "agent_id", info.AgentID)
+		}
+		if info.Admin != "" {
+			attrs = append(attrs, "admin", info.Admin)
+		}
+		slog.Info("request", attrs...)
 	})
 }
 
 type statusWriter struct {
 	http.ResponseWriter
 	status int
+	bytes  int64
 }
 
 func (w *statusWriter) WriteHeader(code int) {
@@ -142,49 +232,96 @@ func (w *statusWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func clientIP(r *http.Request) string {
-	// Check X-Forwarded-For / X-Real-IP for reverse proxies
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.SplitN(xff, ",", 2)
-		return strings.TrimSpace(parts[0])
-	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return host
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
 }
 
-// ---------------------------------------------------------------------------
-// In-memory rate limiter (avoids passing store into middleware)
-// ---------------------------------------------------------------------------
-
-type inMemoryRateLimiter struct {
-	windows map[string]*rateLimitWindow
+// ClientIP resolves the client address of each request once and stores it
+// in the context for clientIP. On Lambda, API Gateway's sourceIp is
+// authoritative. Otherwise forwarding headers are only honoured when the
+// direct peer is a trusted proxy, and X-Forwarded-For is walked from the
+// right so that entries prepended by the client itself are never used.
+func ClientIP(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, resolveClientIP(r, trusted))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
-type rateLimitWindow struct {
-	count    int
-	windowStart time.Time
+// clientIP returns the address resolved by the ClientIP middleware, or the
+// direct peer when the middleware did not run.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r, nil)
 }
 
-var globalRateLimiter = &inMemoryRateLimiter{
-	windows: make(map[string]*rateLimitWindow),
-}
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	if gw, ok := core.GetAPIGatewayV2ContextFromContext(r.Context()); ok && gw.HTTP.SourceIP != "" {
+		return gw.HTTP.SourceIP
+	}
 
-func (rl *inMemoryRateLimiter) Allow(key string, maxPerMinute int) (bool, error) {
-	now := time.Now()
+	// RemoteAddr has no port when set by the Lambda adapter
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !ipTrusted(peer, trusted) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 {
+		if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
+			return xri
+		}
+		return peer
+	}
 
-	w, exists := rl.windows[key]
-	if !exists || now.Sub(w.windowStart) > time.Minute {
-		rl.windows[key] = &rateLimitWindow{count: 1, windowStart: now}
-		return true, nil
+	// Each trusted proxy appends the address it received the request from;
+	// the first untrusted hop from the right is the client. A malformed entry
+	// ends the walk at the last address we could verify.
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		client = hops[i]
+		if !ipTrusted(client, trusted) {
+			break
+		}
 	}
+	return client
+}
 
-	if w.count >= maxPerMinute {
-		return false, nil
+func ipTrusted(ip string, trusted []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(addr) {
+			return true
+		}
 	}
+	return false
+}
 
-	w.count++
-	return true, nil
+// clientKey groups client addresses for rate limiting: IPv4 addresses are
+// used as is, IPv6 addresses by their /64, since a single host or customer
+// usually controls the whole prefix.
+func clientKey(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() != nil {
+		return ip
+	}
+	return addr.Mask(net.CIDRMask(64, 128)).String() + "/64"
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ---------------------------------------------------------------------------
+// Schema migrations
+//
+// The SQLite and PostgreSQL stores record each applied migration in a
+// schema_migrations table, the DynamoDB store as MIGRATION# items, and all
+// three bring the schema up to date when they open.
+// `backup-service migrate status` lists the migrations and `migrate up`
+// applies pending ones without starting the server, e.g. before a deploy.
+// ---------------------------------------------------------------------------
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// schemaVersion is the highest applied version, 0 for a new database.
+func schemaVersion(applied []appliedMigration) int {
+	if len(applied) == 0 {
+		return 0
+	}
+	return applied[len(applied)-1].Version
+}
+
+// schemaTooNewError reports a database migrated by a newer release. Running
+// against it could write rows the newer release does not expect, so the
+// store refuses to open.
+func schemaTooNewError(current, latest int) error {
+	return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade the service", current, latest)
+}
+
+// migrator is a database whose schema the migrate command manages.
+type migrator interface {
+	names() []string // of the migrations this binary knows; version = index + 1
+	applied(ctx context.Context) ([]appliedMigration, error)
+	up(ctx context.Context) error
+	Close()
+}
+
+type sqliteMigrator struct{ db *sql.DB }
+
+func (m sqliteMigrator) names() []string {
+	names := make([]string, len(sqliteMigrations))
+	for i, mig := range sqliteMigrations {
+		names[i] = mig.name
+	}
+	return names
+}
+
+func (m sqliteMigrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	return sqliteAppliedMigrations(m.db)
+}
+
+func (m sqliteMigrator) up(ctx context.Context) error { return migrateSQLite(m.db) }
+func (m sqliteMigrator) Close()                       { m.db.Close() }
+
+type postgresMigrator struct{ pool *pgxpool.Pool }
+
+func (m postgresMigrator) names() []string {
+	names := make([]string, len(postgresMigrations))
+	for i, mig := range postgresMigrations {
+		names[i] = mig.name
+	}
+	return names
+}
+
+func (m postgresMigrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	return postgresAppliedMigrations(ctx, m.pool)
+}
+
+func (m postgresMigrator) up(ctx context.Context) error { return migratePostgres(ctx, m.pool) }
+func (m postgresMigrator) Close()                       { m.pool.Close() }
+
+type dynamoMigrator struct{ s *DynamoStore }
+
+func (m dynamoMigrator) names() []string {
+	names := make([]string, len(dynamoMigrations))
+	for i, mig := range dynamoMigrations {
+		names[i] = mig.name
+	}
+	return names
+}
+
+func (m dynamoMigrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	return m.s.appliedMigrations(ctx)
+}
+
+func (m dynamoMigrator) up(ctx context.Context) error { return m.s.migrate(ctx) }
+func (m dynamoMigrator) Close()                       {}
+
+// runMigrateCommand implements `backup-service migrate status|up` for the
+// store selected by cfg.
+func runMigrateCommand(ctx context.Context, cfg *Config, args []string, out io.Writer) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return errors.New("usage: backup-service migrate status|up")
+	}
+
+	var m migrator
+	switch cfg.StoreMode {
+	case "sqlite":
+		db, err := openSQLite(cfg.DatabasePath)
+		if err != nil {
+			return err
+		}
+		m = sqliteMigrator{db}
+	case "postgres":
+		pool, err := openPostgres(ctx, cfg.DatabaseURL)
+		if err != nil {
+			return err
+		}
+		m = postgresMigrator{pool}
+	case "dynamo":
+		s, err := openDynamo(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		m = dynamoMigrator{s}
+	default:
+		return fmt.Errorf("store mode %q has no schema migrations", cfg.StoreMode)
+	}
+	defer m.Close()
+
+	if args[0] == "up" {
+		before, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		if err := m.up(ctx); err != nil {
+			return err
+		}
+		after, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "migrated from version %d to %d\n\n", schemaVersion(before), schemaVersion(after))
+	}
+	return printMigrationStatus(ctx, m, out)
+}
+
+// printMigrationStatus lists every migration known to the binary or
+// recorded in the database, with when it was applied.
+func printMigrationStatus(ctx context.Context, m migrator, out io.Writer) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	names := m.names()
+	current, latest := schemaVersion(applied), len(names)
+
+	byVersion := map[int]appliedMigration{}
+	for _, a := range applied {
+		byVersion[a.Version] = a
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for v := 1; v <= max(current, latest); v++ {
+		name, when := "", "pending"
+		if v <= latest {
+			name = names[v-1]
+		}
+		if a, ok := byVersion[v]; ok {
+			if a.Name != "" {
+				name = a.Name
+			}
+			when = a.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", v, name, when)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case current > latest:
+		fmt.Fprintf(out, "\nschema version %d is newer than this binary (%d)\n", current, latest)
+		return schemaTooNewError(current, latest)
+	case current < latest:
+		fmt.Fprintf(out, "\nschema version %d, %d pending\n", current, latest-current)
+	default:
+		fmt.Fprintf(out, "\nschema version %d, up to date\n", current)
+	}
+	return nil
+}
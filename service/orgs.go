@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Organizations
+// ---------------------------------------------------------------------------
+//
+// An organization groups agents. Agents join through an invite code carrying
+// org_id or by admin assignment. An org may set a pooled quota that caps the
+// combined used_bytes of its agents on top of each agent's own quota, and
+// org-scoped admin keys can list, approve and suspend that org's agents only.
+
+// agentInAdminScope reports whether the caller may act on agent id. Global
+// admins may act on any agent; org-scoped keys only on their org's agents.
+// Agents outside the scope are reported as not found.
+func (h *Handlers) agentInAdminScope(w http.ResponseWriter, r *http.Request, id string) bool {
+	scope := AdminScopeFromContext(r.Context())
+	if scope == nil {
+		return true
+	}
+
+	agent, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return false
+	}
+	if agent == nil || agent.OrgID != scope.OrgID {
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+type CreateOrgRequest struct {
+	Name       string `json:"name"`
+	QuotaBytes int64  `json:"quota_bytes"` // 0 = no pooled limit
+}
+
+type OrgResponse struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	QuotaBytes int64  `json:"quota_bytes"`
+	UsedBytes  *int64 `json:"used_bytes,omitempty"`
+	AgentCount *int   `json:"agent_count,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+func orgToResponse(o Organization) OrgResponse {
+	return OrgResponse{
+		ID:         o.ID,
+		Name:       o.Name,
+		QuotaBytes: o.QuotaBytes,
+		CreatedAt:  o.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/orgs
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminCreateOrg(w http.ResponseWriter, r *http.Request) {
+	var req CreateOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		jsonError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > 100 {
+		jsonError(w, "name must be 100 characters or less", http.StatusBadRequest)
+		return
+	}
+	if req.QuotaBytes < 0 {
+		jsonError(w, "quota_bytes must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	id, err := GenerateOrgID()
+	if err != nil {
+		internalError(w, r, "generate org ID", err)
+		return
+	}
+
+	org := &Organization{
+		ID:         id,
+		Name:       req.Name,
+		QuotaBytes: req.QuotaBytes,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := h.store.CreateOrg(r.Context(), org); err != nil {
+		internalError(w, r, "create org", err)
+		return
+	}
+
+	logger(r.Context()).Info("admin created org", "org_id", org.ID, "name", org.Name, "quota_bytes", org.QuotaBytes)
+	h.audit(r, "org.create", "", "org:"+org.ID, nil, orgToResponse(*org))
+	jsonResponse(w, http.StatusCreated, orgToResponse(*org))
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/orgs
+// ---------------------------------------------------------------------------
+
+type ListOrgsResponse struct {
+	Orgs       []OrgResponse `json:"orgs"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+func (h *Handlers) AdminListOrgs(w http.ResponseWriter, r *http.Request) {
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	orgs, err := h.store.ListOrgs(r.Context())
+	if err != nil {
+		internalError(w, r, "list orgs", err)
+		return
+	}
+	start, end, next, err := offsetPage(len(orgs), page)
+	if err != nil {
+		internalError(w, r, "list orgs", err)
+		return
+	}
+
+	resp := make([]OrgResponse, 0, end-start)
+	for _, o := range orgs[start:end] {
+		resp = append(resp, orgToResponse(o))
+	}
+	jsonResponse(w, http.StatusOK, ListOrgsResponse{Orgs: resp, NextCursor: next})
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/orgs/{id}
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminGetOrg(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "org id required", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.store.GetOrg(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get org", err, "org_id", id)
+		return
+	}
+	if org == nil {
+		jsonError(w, "organization not found", http.StatusNotFound)
+		return
+	}
+
+	agents, _, err := h.store.ListAgents(r.Context(), AgentFilter{OrgID: id})
+	if err != nil {
+		internalError(w, r, "list org agents", err, "org_id", id)
+		return
+	}
+	count := len(agents)
+
+	resp := orgToResponse(*org)
+	resp.UsedBytes = &org.UsedBytes
+	resp.AgentCount = &count
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/agents/{id}/org
+// ---------------------------------------------------------------------------
+
+type SetAgentOrgRequest struct {
+	OrgID string `json:"org_id"` // "" removes the agent from its org
+}
+
+func (h *Handlers) AdminSetAgentOrg(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "agent id required", http.StatusBadRequest)
+		return
+	}
+
+	var req SetAgentOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if req.OrgID != "" {
+		org, err := h.store.GetOrg(r.Context(), req.OrgID)
+		if err != nil {
+			internalError(w, r, "get org", err, "org_id", req.OrgID)
+			return
+		}
+		if org == nil {
+			jsonError(w, "organization not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	before, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return
+	}
+	if before == nil {
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.store.SetAgentOrg(r.Context(), id, req.OrgID); err != nil {
+		logger(r.Context()).Error("set agent org", "agent_id", id, "err", err)
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin set agent org", "agent_id", id, "org_id", req.OrgID)
+	h.audit(r, "agent.set_org", id, "agent:"+id, map[string]string{"org_id": before.OrgID}, map[string]string{"org_id": req.OrgID})
+	jsonResponse(w, http.StatusOK, map[string]string{"agent_id": id, "org_id": req.OrgID})
+}
+
+// ---------------------------------------------------------------------------
+// Org-scoped admin keys
+// ---------------------------------------------------------------------------
+
+type CreateOrgAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+type OrgAPIKeyResponse struct {
+	ID        string `json:"id"`
+	OrgID     string `json:"org_id"`
+	Name      string `json:"name,omitempty"`
+	Key       string `json:"key,omitempty"` // only returned on creation
+	CreatedAt string `json:"created_at"`
+}
+
+func (h *Handlers) AdminCreateOrgAPIKey(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("id")
+	if orgID == "" {
+		jsonError(w, "org id required", http.StatusBadRequest)
+		return
+	}
+
+	var req CreateOrgAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.store.GetOrg(r.Context(), orgID)
+	if err != nil {
+		internalError(w, r, "get org", err, "org_id", orgID)
+		return
+	}
+	if org == nil {
+		jsonError(w, "organization not found", http.StatusNotFound)
+		return
+	}
+
+	keyID, key, keyHash, err := GenerateOrgAPIKey()
+	if err != nil {
+		internalError(w, r, "generate org API key", err)
+		return
+	}
+
+	k := &OrgAPIKey{
+		ID:        keyID,
+		OrgID:     orgID,
+		KeyHash:   keyHash,
+		Name:      strings.TrimSpace(req.Name),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := h.store.CreateOrgAPIKey(r.Context(), k); err != nil {
+		internalError(w, r, "create org API key", err)
+		return
+	}
+
+	logger(r.Context()).Info("admin created API key", "key_id", k.ID, "org_id", orgID)
+	h.audit(r, "org_key.create", "", "org_key:"+orgID+"/"+k.ID, nil, map[string]string{"name": k.Name})
+	jsonResponse(w, http.StatusCreated, OrgAPIKeyResponse{
+		ID:        k.ID,
+		OrgID:     k.OrgID,
+		Name:      k.Name,
+		Key:       key,
+		CreatedAt: k.CreatedAt.Format(time.RFC3339),
+	})
+}
+
+type ListOrgAPIKeysResponse struct {
+	Keys       []OrgAPIKeyResponse `json:"keys"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+func (h *Handlers) AdminListOrgAPIKeys(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("id")
+	if orgID == "" {
+		jsonError(w, "org id required", http.StatusBadRequest)
+		return
+	}
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	keys, err := h.store.ListOrgAPIKeys(r.Context(), orgID)
+	if err != nil {
+		internalError(w, r, "list org API keys", err, "org_id", orgID)
+		return
+	}
+	start, end, next, err := offsetPage(len(keys), page)
+	if err != nil {
+		internalError(w, r, "list org API keys", err, "org_id", orgID)
+		return
+	}
+
+	resp := make([]OrgAPIKeyResponse, 0, end-start)
+	for _, k := range keys[start:end] {
+		resp = append(resp, OrgAPIKeyResponse{
+			ID:        k.ID,
+			OrgID:     k.OrgID,
+			Name:      k.Name,
+			CreatedAt: k.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	jsonResponse(w, http.StatusOK, ListOrgAPIKeysResponse{Keys: resp, NextCursor: next})
+}
+
+func (h *Handlers) AdminDeleteOrgAPIKey(w http.ResponseWriter, r *http.Request) {
+	orgID, keyID := r.PathValue("id"), r.PathValue("key_id")
+	if orgID == "" || keyID == "" {
+		jsonError(w, "org id and key id required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.DeleteOrgAPIKey(r.Context(), orgID, keyID); err != nil {
+		logger(r.Context()).Error("delete org API key", "key_id", keyID, "err", err)
+		jsonError(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin deleted API key", "key_id", keyID, "org_id", orgID)
+	h.audit(r, "org_key.delete", "", "org_key:"+orgID+"/"+keyID, nil, nil)
+	jsonResponse(w, http.StatusOK, map[string]string{"deleted": keyID})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Token-bucket rate limiting
+// ---------------------------------------------------------------------------
+//
+// Every bucket holds up to Burst tokens and refills at PerMinute tokens per
+// minute; each request takes one token. Buckets live in a RateLimiter: an
+// in-process sharded map for single-server deployments, or a table in the
+// SQLite/DynamoDB store so that limits hold across Lambda instances.
+
+// RateLimitPolicy configures a token bucket. A zero PerMinute disables the
+// limit.
+type RateLimitPolicy struct {
+	PerMinute int // sustained requests per minute
+	Burst     int // bucket capacity (defaults to PerMinute)
+}
+
+func (p RateLimitPolicy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.PerMinute)
+}
+
+func (p RateLimitPolicy) refillPerSecond() float64 {
+	return float64(p.PerMinute) / 60
+}
+
+// RateLimitResult reports the outcome of taking a token.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int           // bucket capacity
+	Remaining  int           // whole tokens left after this request
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, when not allowed
+}
+
+// RateLimiter takes one token from the bucket identified by key.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error)
+}
+
+// bucketState is the persisted state of one bucket.
+type bucketState struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// takeToken refills b for the time elapsed since it was last updated, then
+// takes one token if there is one. A zero bucketState is a full bucket.
+func takeToken(b bucketState, p RateLimitPolicy, now time.Time) (bucketState, RateLimitResult) {
+	capacity, rate := p.capacity(), p.refillPerSecond()
+
+	tokens := capacity
+	if !b.Updated.IsZero() {
+		elapsed := now.Sub(b.Updated).Seconds()
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+	}
+
+	res := RateLimitResult{Limit: int(capacity)}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - tokens) / rate)
+	}
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = secondsToDuration((capacity - tokens) / rate)
+
+	return bucketState{Tokens: tokens, Updated: now}, res
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// newRateLimiter picks the backend from cfg.RateLimitBackend. "store" keeps
+// buckets in the DataStore when it supports it; anything else, or a store
+// without rate limit support, uses an in-process limiter.
+func newRateLimiter(cfg *Config, store DataStore) RateLimiter {
+	if cfg.RateLimitBackend == "store" {
+		if p, ok := store.(interface{ RateLimiter() RateLimiter }); ok {
+			return p.RateLimiter()
+		}
+		slog.Warn("store does not support rate limiting, using in-memory limiter")
+	}
+	return newMemoryRateLimiter()
+}
+
+// ---------------------------------------------------------------------------
+// Middleware
+// ---------------------------------------------------------------------------
+
+// RateLimit applies a per-client token bucket, keyed by clientKey. scope
+// keeps the buckets of different limits for the same client apart.
+func RateLimit(limiter RateLimiter, scope string, p RateLimitPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, next, end := traceMiddleware(r, "RateLimit", next)
+		defer end()
+
+		if !applyRateLimit(w, r, limiter, scope+":"+clientKey(clientIP(r)), p) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitAgent applies a per-agent token bucket. Must be placed after Auth
+// middleware which sets the agent in context.
+func RateLimitAgent(limiter RateLimiter, p RateLimitPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, next, end := traceMiddleware(r, "RateLimitAgent", next)
+		defer end()
+
+		if agent := AgentFromContext(r.Context()); agent != nil {
+			if !applyRateLimit(w, r, limiter, "agent:"+agent.ID, p) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyRateLimit takes a token for key and sets the X-RateLimit-* headers.
+// When several limits apply to a request, the innermost one's headers win.
+// It writes a 429 and returns false if the bucket is empty, and fails open
+// if the limiter errors.
+func applyRateLimit(w http.ResponseWriter, r *http.Request, limiter RateLimiter, key string, p RateLimitPolicy) bool {
+	if p.PerMinute <= 0 {
+		return true
+	}
+
+	res, err := limiter.Allow(r.Context(), key, p)
+	if err != nil {
+		logger(r.Context()).Error("rate limit check failed", "key", key, "err", err)
+		return true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		jsonError(w, "rate limit exceeded, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ---------------------------------------------------------------------------
+// In-memory limiter
+// ---------------------------------------------------------------------------
+
+const rateLimitShards = 32
+
+// memoryRateLimiter keeps buckets in a sharded map. Buckets that have refilled
+// completely are equivalent to missing ones, so each shard periodically drops
+// them.
+type memoryRateLimiter struct {
+	shards [rateLimitShards]rateLimitShard
+	now    func() time.Time
+}
+
+type rateLimitShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	state  bucketState
+	fullAt time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	rl := &memoryRateLimiter{now: time.Now}
+	for i := range rl.shards {
+		rl.shards[i].buckets = make(map[string]*memoryBucket)
+	}
+	return rl
+}
+
+func (rl *memoryRateLimiter) shard(key string) *rateLimitShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &rl.shards[hash.Sum32()%rateLimitShards]
+}
+
+func (rl *memoryRateLimiter) Allow(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	shard := rl.shard(key)
+	now := rl.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if now.Sub(shard.lastSweep) > time.Minute {
+		for k, b := range shard.buckets {
+			if !now.Before(b.fullAt) {
+				delete(shard.buckets, k)
+			}
+		}
+		shard.lastSweep = now
+	}
+
+	b := shard.buckets[key]
+	if b == nil {
+		b = &memoryBucket{}
+		shard.buckets[key] = b
+	}
+	state, res := takeToken(b.state, p, now)
+	b.state = state
+	b.fullAt = now.Add(res.Reset)
+	return res, nil
+}
+
+// size returns the number of buckets held, for tests.
+func (rl *memoryRateLimiter) size() int {
+	n := 0
+	for i := range rl.shards {
+		rl.shards[i].mu.Lock()
+		n += len(rl.shards[i].buckets)
+		rl.shards[i].mu.Unlock()
+	}
+	return n
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/url"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type S3Client struct {
@@ -17,6 +20,19 @@ type S3Client struct {
 	presigner *s3.PresignClient // for presigned URLs (may use public endpoint)
 	bucket    string
 	expiry    time.Duration
+	metrics   *Metrics // optional, set by buildHandler
+}
+
+// track starts the span of an S3 call on key and returns the function, to be
+// deferred with the call's error, that ends it and records the call's metrics.
+func (c *S3Client) track(ctx context.Context, op, key string) func(*error) {
+	start := time.Now()
+	_, span := startSpan(ctx, "s3."+op,
+		attribute.String("s3.bucket", c.bucket), attribute.String("s3.key", key))
+	return func(err *error) {
+		endSpan(span, err)
+		c.metrics.observeS3(op, start, *err)
+	}
 }
 
 func NewS3Client(ctx context.Context, cfg *Config) (*S3Client, error) {
@@ -73,7 +89,9 @@ func NewS3Client(ctx context.Context, cfg *Config) (*S3Client, error) {
 }
 
 // PresignPut generates a presigned PUT URL for uploading an object.
-func (c *S3Client) PresignPut(ctx context.Context, key string, contentType string) (string, error) {
+func (c *S3Client) PresignPut(ctx context.Context, key string, contentType string) (_ string, err error) {
+	defer c.track(ctx, "PresignPut", key)(&err)
+
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(c.bucket),
 		Key:         aws.String(key),
@@ -89,7 +107,9 @@ func (c *S3Client) PresignPut(ctx context.Context, key string, contentType strin
 
 // PresignPutWithLength generates a presigned PUT URL with a fixed Content-Length.
 // S3 will reject uploads where the actual body size doesn't match.
-func (c *S3Client) PresignPutWithLength(ctx context.Context, key, contentType string, contentLength int64) (string, error) {
+func (c *S3Client) PresignPutWithLength(ctx context.Context, key, contentType string, contentLength int64) (_ string, err error) {
+	defer c.track(ctx, "PresignPut", key)(&err)
+
 	input := &s3.PutObjectInput{
 		Bucket:        aws.String(c.bucket),
 		Key:           aws.String(key),
@@ -105,7 +125,9 @@ func (c *S3Client) PresignPutWithLength(ctx context.Context, key, contentType st
 }
 
 // PresignGet generates a presigned GET URL for downloading an object.
-func (c *S3Client) PresignGet(ctx context.Context, key string) (string, error) {
+func (c *S3Client) PresignGet(ctx context.Context, key string) (_ string, err error) {
+	defer c.track(ctx, "PresignGet", key)(&err)
+
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(key),
@@ -119,20 +141,63 @@ func (c *S3Client) PresignGet(ctx context.Context, key string) (string, error) {
 }
 
 // DeleteObject removes an object from S3.
-func (c *S3Client) DeleteObject(ctx context.Context, key string) error {
-	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+func (c *S3Client) DeleteObject(ctx context.Context, key string) (err error) {
+	defer c.track(ctx, "DeleteObject", key)(&err)
+
+	_, err = c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(key),
 	})
 	return err
 }
 
+// CopyObject copies an object within the bucket. Copying onto an existing key
+// overwrites it, so the call is safe to repeat.
+func (c *S3Client) CopyObject(ctx context.Context, srcKey, dstKey string) (err error) {
+	defer c.track(ctx, "CopyObject", srcKey)(&err)
+
+	_, err = c.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(c.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String((&url.URL{Path: c.bucket + "/" + srcKey}).EscapedPath()),
+	})
+	if err != nil {
+		return fmt.Errorf("copy %s -> %s: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+// HeadBucket checks that the bucket exists and is accessible.
+func (c *S3Client) HeadBucket(ctx context.Context) (err error) {
+	defer c.track(ctx, "HeadBucket", "")(&err)
+
+	_, err = c.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(c.bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("head bucket %s: %w", c.bucket, err)
+	}
+	return nil
+}
+
+// IsNotFound reports whether err is an S3 "no such key" error.
+func IsNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteBackupObjects deletes both the backup blob and manifest from S3.
 func (c *S3Client) DeleteBackupObjects(ctx context.Context, b *Backup) {
 	if err := c.DeleteObject(ctx, b.S3Key); err != nil {
-		log.Printf("WARN: failed to delete S3 object %s: %v", b.S3Key, err)
+		logger(ctx).Warn("failed to delete S3 object", "key", b.S3Key, "err", err)
 	}
 	if err := c.DeleteObject(ctx, b.ManifestS3Key); err != nil {
-		log.Printf("WARN: failed to delete S3 object %s: %v", b.ManifestS3Key, err)
+		logger(ctx).Warn("failed to delete S3 object", "key", b.ManifestS3Key, "err", err)
 	}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Stale-agent detection
+// ---------------------------------------------------------------------------
+//
+// The client notices stale backups through its own heartbeat; nothing on
+// the server did. checkStaleAgents flags active agents whose newest backup
+// (or registration, if they never backed up) is older than their threshold
+// (Config.StaleThreshold) and clears the flag once they back up again,
+// sending an agent.stale or agent.recovered event on each change. The HTTP
+// server runs it every StaleCheckInterval; on Lambda an EventBridge
+// schedule invokes it.
+
+// StaleCheckResult summarizes one run of checkStaleAgents.
+type StaleCheckResult struct {
+	Checked   int // active agents examined
+	Stale     int // newly flagged
+	Recovered int // flag cleared
+}
+
+func checkStaleAgents(ctx context.Context, store DataStore, cfg *Config, notifier Notifier, now time.Time) (StaleCheckResult, error) {
+	var result StaleCheckResult
+
+	agents, _, err := store.ListAgents(ctx, AgentFilter{})
+	if err != nil {
+		return result, err
+	}
+	latest, err := store.LatestBackupTimes(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, a := range agents {
+		if a.Status == "active" {
+			result.Checked++
+		}
+		last, ok := latest[a.ID]
+		if !ok {
+			last = a.CreatedAt
+		}
+		threshold := cfg.StaleThreshold(&a)
+		stale := a.Status == "active" && threshold > 0 && now.Sub(last) > threshold
+
+		switch {
+		case stale && a.StaleSince == nil:
+			since := last.Add(threshold)
+			if err := store.SetAgentStale(ctx, a.ID, &since); err != nil {
+				logger(ctx).Error("flag stale agent", "agent_id", a.ID, "err", err)
+				continue
+			}
+			result.Stale++
+			notifier.Notify(ctx, newEvent(EventAgentStale, a.ID, map[string]any{
+				"last_backup_at":  lastBackupValue(last, ok),
+				"threshold_hours": int(threshold / time.Hour),
+			}))
+
+		case !stale && a.StaleSince != nil:
+			if err := store.SetAgentStale(ctx, a.ID, nil); err != nil {
+				logger(ctx).Error("clear stale agent", "agent_id", a.ID, "err", err)
+				continue
+			}
+			result.Recovered++
+			// Agents that were suspended or had their threshold raised are
+			// cleared quietly; only a new backup counts as recovery.
+			if a.Status == "active" && ok && last.After(*a.StaleSince) {
+				notifier.Notify(ctx, newEvent(EventAgentRecovered, a.ID, map[string]any{
+					"last_backup_at": last.UTC().Format(time.RFC3339),
+					"stale_since":    a.StaleSince.UTC().Format(time.RFC3339),
+				}))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// lastBackupValue is the last_backup_at of an event: nil if the agent never
+// backed up.
+func lastBackupValue(t time.Time, ok bool) any {
+	if !ok {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// runStaleChecks runs checkStaleAgents every interval until ctx is done.
+func runStaleChecks(ctx context.Context, store DataStore, cfg *Config, notifier Notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := checkStaleAgents(ctx, store, cfg, notifier, time.Now().UTC())
+			if err != nil {
+				slog.Error("stale-agent check", "err", err)
+				continue
+			}
+			slog.Info("stale-agent check", "checked", result.Checked, "stale", result.Stale, "recovered", result.Recovered)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/agents/{id}/stale-threshold
+// ---------------------------------------------------------------------------
+
+type SetStaleThresholdRequest struct {
+	Hours int `json:"hours"` // 0 falls back to the plan's threshold
+}
+
+func (h *Handlers) AdminSetStaleThreshold(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "agent id required", http.StatusBadRequest)
+		return
+	}
+
+	var req SetStaleThresholdRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Hours < 0 {
+		jsonError(w, "hours must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	before, err := h.store.GetAgent(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", id)
+		return
+	}
+	if before == nil {
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.store.SetAgentStaleThreshold(r.Context(), id, req.Hours); err != nil {
+		logger(r.Context()).Error("set stale threshold", "agent_id", id, "err", err)
+		jsonError(w, "agent not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin set stale threshold", "agent_id", id, "hours", req.Hours)
+	h.audit(r, "agent.set_stale_threshold", id, "agent:"+id,
+		map[string]int{"stale_after_hours": before.StaleAfterHours}, map[string]int{"stale_after_hours": req.Hours})
+	jsonResponse(w, http.StatusOK, map[string]any{"agent_id": id, "stale_after_hours": req.Hours})
+}
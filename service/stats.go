@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/stats
+// ---------------------------------------------------------------------------
+//
+// Fleet-wide aggregates, computed by the store in a handful of queries
+// rather than by paging through agents and their backups.
+
+const (
+	defaultStatsInactiveDays = 7
+	defaultStatsTop          = 10
+	maxStatsTop              = 100
+)
+
+type StatsResponse struct {
+	Agents       AgentStats        `json:"agents"`
+	Storage      StorageStats      `json:"storage"`
+	Backups      BackupStats       `json:"backups"`
+	TopConsumers []AgentUsageInfo  `json:"top_consumers"`
+	Distribution DistributionStats `json:"distribution"`
+}
+
+type AgentStats struct {
+	Total        int            `json:"total"`
+	ByStatus     map[string]int `json:"by_status"`
+	Inactive     int            `json:"inactive"`      // active agents with no backup in InactiveDays
+	InactiveDays int            `json:"inactive_days"` // echoes ?inactive_days=
+}
+
+type StorageStats struct {
+	UsedBytes int64            `json:"used_bytes"`
+	ByPlan    map[string]int64 `json:"by_plan"`
+}
+
+type BackupStats struct {
+	Last24h int `json:"last_24h"`
+	Last7d  int `json:"last_7d"`
+}
+
+type AgentUsageInfo struct {
+	AgentID   string `json:"agent_id"`
+	Name      string `json:"name"`
+	UsedBytes int64  `json:"used_bytes"`
+}
+
+type DistributionStats struct {
+	OS              map[string]int `json:"os"`
+	Arch            map[string]int `json:"arch"`
+	OpenClawVersion map[string]int `json:"openclaw_version"`
+}
+
+// AdminStats returns fleet statistics. ?inactive_days= (default 7) sets the
+// window for counting inactive agents and ?top= (default 10) the number of
+// top consumers.
+func (h *Handlers) AdminStats(w http.ResponseWriter, r *http.Request) {
+	inactiveDays := defaultStatsInactiveDays
+	if v := r.URL.Query().Get("inactive_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			jsonError(w, "inactive_days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		inactiveDays = n
+	}
+	top := defaultStatsTop
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxStatsTop {
+			jsonError(w, "top must be between 0 and "+strconv.Itoa(maxStatsTop), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	now := time.Now().UTC()
+	stats, err := h.store.FleetStats(r.Context(), StatsOptions{
+		Now:           now,
+		InactiveSince: now.AddDate(0, 0, -inactiveDays),
+		TopN:          top,
+	})
+	if err != nil {
+		internalError(w, r, "fleet stats", err)
+		return
+	}
+
+	resp := StatsResponse{
+		Agents: AgentStats{
+			ByStatus:     stats.AgentsByStatus,
+			Inactive:     stats.InactiveAgents,
+			InactiveDays: inactiveDays,
+		},
+		Storage: StorageStats{
+			UsedBytes: stats.UsedBytes,
+			ByPlan:    make(map[string]int64, len(stats.UsedBytesByPlan)),
+		},
+		Backups: BackupStats{
+			Last24h: stats.Backups24h,
+			Last7d:  stats.Backups7d,
+		},
+		TopConsumers: make([]AgentUsageInfo, len(stats.TopConsumers)),
+		Distribution: DistributionStats{
+			OS:              unknownKey(stats.ByOS),
+			Arch:            unknownKey(stats.ByArch),
+			OpenClawVersion: unknownKey(stats.ByVersion),
+		},
+	}
+	for _, n := range stats.AgentsByStatus {
+		resp.Agents.Total += n
+	}
+	// Agents registered without a plan are on the default plan.
+	for plan, used := range stats.UsedBytesByPlan {
+		if plan == "" {
+			plan = h.config.DefaultPlan
+		}
+		resp.Storage.ByPlan[plan] += used
+	}
+	for i, u := range stats.TopConsumers {
+		resp.TopConsumers[i] = AgentUsageInfo{AgentID: u.AgentID, Name: u.Name, UsedBytes: u.UsedBytes}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// unknownKey reports agents that did not send a value under "unknown".
+func unknownKey(m map[string]int) map[string]int {
+	out := make(map[string]int, len(m))
+	for k, n := range m {
+		if k == "" {
+			k = "unknown"
+		}
+		out[k] += n
+	}
+	return out
+}
@@ -1,55 +1,323 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"time"
 )
 
 // DataStore is the interface for agent and backup persistence.
-// Implemented by SQLiteStore (local dev) and DynamoStore (Lambda).
+// Implemented by SQLiteStore (local dev), PostgresStore (self-hosted) and
+// DynamoStore (Lambda). Create methods record the CreatedAt the caller set,
+// if any, so that imported records keep theirs. Paginated list methods also
+// return the cursor of the next page, "" after the last.
 type DataStore interface {
 	Close() error
+	Ping(ctx context.Context) error // cheap read to check the store is usable
 
 	// Agents
-	CreateAgent(a *Agent, tokenHash string) error
-	LookupAgentByToken(token string) (*Agent, error)
-	GetAgent(id string) (*Agent, error)
-	RotateAgentToken(agentID, newTokenHash string) error
-	UpdateAgentProfile(agentID, name string) error
-	UpdateUsedBytes(agentID string) error
-	ListAgents(status string) ([]Agent, error)
-	UpdateAgentStatus(id, status string) error
-	CountAgentsByStatus(status string) (int, error)
+	CreateAgent(ctx context.Context, a *Agent, tokenHash string) error
+	LookupAgentByToken(ctx context.Context, token string) (*Agent, error)
+	GetAgent(ctx context.Context, id string) (*Agent, error)
+	AgentTokenHash(ctx context.Context, agentID string) (string, error) // "" if the agent does not exist
+	RotateAgentToken(ctx context.Context, agentID, newTokenHash string) error
+	UpdateAgentProfile(ctx context.Context, agentID, name string) error
+	UpdateUsedBytes(ctx context.Context, agentID string) error
+	ListAgents(ctx context.Context, f AgentFilter) ([]Agent, string, error) // newest first
+	UpdateAgentStatus(ctx context.Context, id, status, reason string) error // reason "" clears it
+	SetAgentOrg(ctx context.Context, agentID, orgID string) error           // orgID "" removes the agent from its org
+	CountAgentsByStatus(ctx context.Context, status string) (int, error)
+	FleetStats(ctx context.Context, opts StatsOptions) (*FleetStats, error)      // aggregates over all agents and backups
+	SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) error // 0 = use the plan's threshold
+	SetAgentStale(ctx context.Context, agentID string, since *time.Time) error   // nil clears the flag
+	SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) error
 
 	// Backups
-	CreateBackup(b *Backup) error
-	ListBackups(agentID string, limit int) ([]Backup, error)
-	CountBackups(agentID string) (int, int64, error)
-	GetBackup(agentID, timestamp string) (*Backup, error)
-	DeleteBackup(agentID, timestamp string) (*Backup, error)
-	DeleteAllBackups(agentID string) ([]Backup, error)
-	UndeleteBackup(agentID, timestamp string) error
+	CreateBackup(ctx context.Context, b *Backup) error                                 // ErrQuotaExceeded or ErrOrgQuotaExceeded if the agent or its org has no room for it
+	ListBackups(ctx context.Context, agentID string, p Page) ([]Backup, string, error) // newest created first, then by timestamp
+	CountBackups(ctx context.Context, agentID string) (int, int64, error)
+	GetBackup(ctx context.Context, agentID, timestamp string) (*Backup, error)
+	DeleteBackup(ctx context.Context, agentID, timestamp string) (*Backup, error)
+	DeleteAllBackups(ctx context.Context, agentID string) ([]Backup, error)
+	UndeleteBackup(ctx context.Context, agentID, timestamp string) error
+	PutBackup(ctx context.Context, b *Backup) error                       // insert or replace, preserving CreatedAt/DeletedAt
+	PurgeBackup(ctx context.Context, agentID, timestamp string) error     // hard delete, no grace period
+	LatestBackupTimes(ctx context.Context) (map[string]time.Time, error)  // newest CreatedAt per agent, deleted backups included
+	ListAllBackups(ctx context.Context, agentID string) ([]Backup, error) // deleted backups included, oldest created first
+
+	// Backup transfers
+	PutTransfer(ctx context.Context, t *BackupTransfer) error // insert or replace
+	GetTransfer(ctx context.Context, id string) (*BackupTransfer, error)
 
 	// Invite codes
-	CreateInviteCode(code *InviteCode) error
-	UseInviteCode(code string) (valid bool, err error) // atomic: check + increment use count
-	ListInviteCodes() ([]InviteCode, error)
-	RevokeInviteCode(code string) error
+	CreateInviteCode(ctx context.Context, code *InviteCode) error
+	CreateInviteCodes(ctx context.Context, codes []*InviteCode) error // all or none
+	GetInviteCode(ctx context.Context, code string) (*InviteCode, error)
+	UseInviteCode(ctx context.Context, code string) (valid bool, err error)    // atomic: check + increment use count
+	ListInviteCodes(ctx context.Context, p Page) ([]InviteCode, string, error) // newest first
+	RevokeInviteCode(ctx context.Context, code string) error
+	RecordInviteRedemption(ctx context.Context, r *InviteRedemption) error
+	ListInviteRedemptions(ctx context.Context, code string, p Page) ([]InviteRedemption, string, error) // oldest first
+
+	// Registration bans
+	CreateBan(ctx context.Context, b *Ban) error
+	ListBans(ctx context.Context) ([]Ban, error)
+	DeleteBan(ctx context.Context, id string) error
+
+	// Organizations
+	CreateOrg(ctx context.Context, o *Organization) error
+	GetOrg(ctx context.Context, id string) (*Organization, error)
+	ListOrgs(ctx context.Context) ([]Organization, error)
+	CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) error
+	LookupOrgAPIKey(ctx context.Context, keyHash string) (*OrgAPIKey, error)
+	ListOrgAPIKeys(ctx context.Context, orgID string) ([]OrgAPIKey, error)
+	DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) error
+
+	// Auto-approval rules
+	CreateApprovalRule(ctx context.Context, r *ApprovalRule) error
+	ListApprovalRules(ctx context.Context) ([]ApprovalRule, error) // evaluation order: priority, then creation
+	DeleteApprovalRule(ctx context.Context, id string) error
+
+	// Recovery codes
+	CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) error                     // replaces any unused code for the agent
+	UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (*Agent, error) // atomic: consume code + rotate token
+
+	// Audit log (append-only; events are only removed once they expire)
+	AppendAuditEvent(ctx context.Context, e *AuditEvent) error
+	ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, string, error) // newest first, expired events excluded
+
+	// Webhooks
+	CreateWebhook(ctx context.Context, wh *Webhook) error
+	GetWebhook(ctx context.Context, id string) (*Webhook, error)
+	ListWebhooks(ctx context.Context) ([]Webhook, error) // oldest first
+	DeleteWebhook(ctx context.Context, id string) error
+	PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) error                                      // insert or replace
+	ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) ([]WebhookDelivery, string, error) // newest first
 }
 
 // ---------------------------------------------------------------------------
 // Shared model types
 // ---------------------------------------------------------------------------
 
+// Page selects one page of a list. Cursor is the next-page cursor returned
+// with the previous page, "" for the first. Cursors are opaque and only
+// valid for the list and filter that returned them.
+type Page struct {
+	Cursor string
+	Limit  int // 0 = no limit
+}
+
+// AgentFilter narrows ListAgents. Empty fields match everything.
+type AgentFilter struct {
+	Status string
+	OrgID  string
+	Stale  bool // only agents flagged by the stale-agent check
+	Page
+}
+
 type InviteCode struct {
 	Code      string
-	MaxUses   int        // 0 = unlimited
+	MaxUses   int // 0 = unlimited
 	UseCount  int
 	ExpiresAt *time.Time // nil = no expiry
 	CreatedAt time.Time
 	RevokedAt *time.Time
+
+	// Grant applied to agents registering with this code
+	Plan            string   // "" = default plan
+	QuotaBytes      int64    // 0 = quota of the plan
+	Tags            []string // initial agent tags
+	HostnamePattern string   // glob the registering hostname must match, "" = any
+	OrgID           string   // organization the agent joins, "" = none
+}
+
+// InviteRedemption records an agent that registered with an invite code.
+type InviteRedemption struct {
+	Code       string
+	AgentID    string
+	IP         string
+	RedeemedAt time.Time
+}
+
+// Ban blocks registrations by machine fingerprint, source IP range or
+// hostname pattern.
+type Ban struct {
+	ID        string
+	Kind      string // "fingerprint", "cidr" or "hostname"
+	Value     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// Organization groups agents for pooled quotas and org-scoped admin keys.
+type Organization struct {
+	ID         string
+	Name       string
+	QuotaBytes int64 // pooled across all member agents, 0 = no pooled limit
+	UsedBytes  int64 // combined used_bytes of the member agents
+	CreatedAt  time.Time
+}
+
+// OrgAPIKey is an admin key limited to one organization's agents. Only the
+// SHA-256 hash of the key is stored.
+type OrgAPIKey struct {
+	ID        string
+	OrgID     string
+	KeyHash   string
+	Name      string
+	CreatedAt time.Time
+}
+
+// ApprovalRule is evaluated by Register for registrations without an invite
+// code. A rule matches when every non-empty condition matches; the first
+// matching rule approves the agent and/or assigns it a plan.
+type ApprovalRule struct {
+	ID       string
+	Name     string
+	Priority int // lower runs first
+
+	// Conditions
+	SourceCIDRs   []string
+	HostnameRegex string
+	OS            string // case-insensitive, e.g. "Darwin"
+	Arch          string // case-insensitive, e.g. "arm64"
+	MinVersion    string // inclusive openclaw_version bounds
+	MaxVersion    string
+	Fingerprints  []string
+
+	// Actions
+	Approve bool
+	Plan    string
+
+	CreatedAt time.Time
+}
+
+// AuditEvent records a security-relevant action. Before and After hold the
+// affected state as JSON, when there is any.
+type AuditEvent struct {
+	ID        string
+	Action    string // e.g. "agent.approve", "backup.delete"
+	Actor     string // "agent:<id>", "admin:<identity>" or "system"
+	AgentID   string // agent the event concerns, "" = none
+	Target    string // object acted on, e.g. "agent:<id>", "invite_code:<code>", "ban:<id>"
+	IP        string
+	RequestID string
+	Before    json.RawMessage
+	After     json.RawMessage
+	CreatedAt time.Time
+	ExpiresAt *time.Time // nil = kept forever
+}
+
+// StatsOptions parameterizes FleetStats.
+type StatsOptions struct {
+	Now           time.Time // backup windows are measured back from Now
+	InactiveSince time.Time // active agents with no backup since then are counted as inactive
+	TopN          int       // number of top consumers to return
+}
+
+// FleetStats is an aggregate view of the fleet. Soft-deleted backups are
+// not counted; storage is the agents' used_bytes.
+type FleetStats struct {
+	AgentsByStatus  map[string]int
+	UsedBytes       int64
+	UsedBytesByPlan map[string]int64 // key "" = agents without a plan
+	Backups24h      int
+	Backups7d       int
+	InactiveAgents  int
+	TopConsumers    []AgentUsage // by used bytes, largest first
+	ByOS            map[string]int
+	ByArch          map[string]int
+	ByVersion       map[string]int
+}
+
+// AgentUsage is one agent's storage consumption.
+type AgentUsage struct {
+	AgentID   string
+	Name      string
+	UsedBytes int64
+}
+
+func newFleetStats() *FleetStats {
+	return &FleetStats{
+		AgentsByStatus:  map[string]int{},
+		UsedBytesByPlan: map[string]int64{},
+		TopConsumers:    []AgentUsage{},
+		ByOS:            map[string]int{},
+		ByArch:          map[string]int{},
+		ByVersion:       map[string]int{},
+	}
+}
+
+// AuditFilter narrows ListAuditEvents. Empty fields match everything.
+type AuditFilter struct {
+	AgentID string
+	Action  string
+	Since   time.Time // inclusive
+	Page
+}
+
+// Webhook is an admin-managed subscription to notification events. The
+// secret signs deliveries, so it is stored as is.
+type Webhook struct {
+	ID        string
+	URL       string
+	Secret    string
+	Events    []string // event types delivered; empty = all
+	CreatedAt time.Time
+}
+
+// Wants reports whether the webhook subscribes to events of type typ.
+func (wh *Webhook) Wants(typ string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records the delivery of one event to one webhook, across
+// attempts.
+type WebhookDelivery struct {
+	ID            string
+	WebhookID     string
+	EventID       string
+	EventType     string
+	Payload       json.RawMessage // the exact body sent on every attempt
+	Status        string          // "pending", "succeeded" or "failed"
+	Attempts      int
+	ResponseCode  int        // of the last attempt; 0 if no response
+	Error         string     // of the last failed attempt
+	NextAttemptAt *time.Time // set while pending
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// WebhookDeliveryFilter narrows ListWebhookDeliveries. Empty fields match
+// everything.
+type WebhookDeliveryFilter struct {
+	WebhookID string
+	Status    string
+	DueBefore time.Time // only pending deliveries whose next attempt is due by then
+	Page
+}
+
+// RecoveryCode is a single-use, admin-issued code that lets an agent that lost
+// its token obtain a new one. Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	CodeHash  string
+	AgentID   string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UsedAt    *time.Time
 }
 
 type Agent struct {
@@ -63,8 +331,17 @@ type Agent struct {
 	EncryptTool     string
 	PublicKey       string
 	Status          string
+	StatusReason    string // shown to the agent when rejected or suspended
 	QuotaBytes      int64
 	UsedBytes       int64
+	Plan            string
+	Tags            []string
+	ApprovalRuleID  string     // auto-approval rule that matched at registration, if any
+	OrgID           string     // "" = not in an organization
+	StaleAfterHours int        // overrides the plan's stale threshold; 0 = none
+	StaleSince      *time.Time // set while the agent is flagged stale
+	ContactEmail    string     // owner's address for notification emails; "" = none
+	EmailOptOuts    []string   // event types the owner does not want emailed
 	CreatedAt       time.Time
 }
 
@@ -80,6 +357,107 @@ type Backup struct {
 	DeletedAt       *time.Time
 }
 
+// BackupTransfer tracks an admin-initiated move or copy of one agent's
+// backups to another agent. It is keyed by the (source, target) pair so an
+// interrupted transfer can be resumed by re-issuing the same request.
+type BackupTransfer struct {
+	ID            string
+	SourceAgentID string
+	TargetAgentID string
+	Mode          string // "move" or "copy"
+	Status        string // "running", "failed" or "completed"
+	TotalCount    int
+	DoneCount     int
+	Error         string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// creationTime is the creation time a Create method records: the one the
+// caller set, e.g. when importing an archive, or else the current time.
+func creationTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now().UTC()
+	}
+	return t.UTC()
+}
+
+// ErrQuotaExceeded is returned by CreateBackup when the backup would take
+// the agent past its quota. Every store checks it in the same statement or
+// transaction as the insert, so concurrent uploads from several processes
+// cannot both pass.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrOrgQuotaExceeded is returned by CreateBackup when the backup would take
+// the agent's organization past its pooled quota, checked the same way.
+var ErrOrgQuotaExceeded = errors.New("organization quota exceeded")
+
+// ---------------------------------------------------------------------------
+// Cursors
+// ---------------------------------------------------------------------------
+
+// ErrInvalidCursor is returned by list methods for a cursor they did not
+// issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// pageKey is the sort key of the last entry of a page, which cursors carry
+// to resume with a keyset query.
+// Seq breaks ties where the list orders by insertion.
+type pageKey struct {
+	At  time.Time `json:"t"`
+	Key string    `json:"k,omitempty"`
+	Seq int64     `json:"s,omitempty"`
+}
+
+// encodeCursor makes an opaque cursor of v.
+func encodeCursor(v any) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads a cursor made by encodeCursor into v.
+func decodeCursor(cursor string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// keysetPage reads the cursor of p. It returns nil for the first page.
+func keysetPage(p Page) (*pageKey, error) {
+	if p.Cursor == "" {
+		return nil, nil
+	}
+	var k pageKey
+	if err := decodeCursor(p.Cursor, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// offsetPage pages a short list held in memory that has no natural sort
+// key, such as the configuration lists ordered by name or priority. Its
+// cursor is an offset, so an entry added or removed between pages shifts
+// the rest by one.
+func offsetPage(n int, p Page) (start, end int, next string, err error) {
+	if p.Cursor != "" {
+		var c struct {
+			Offset int `json:"o"`
+		}
+		if err := decodeCursor(p.Cursor, &c); err != nil || c.Offset < 0 {
+			return 0, 0, "", ErrInvalidCursor
+		}
+		start = min(c.Offset, n)
+	}
+	end = n
+	if p.Limit > 0 && start+p.Limit < n {
+		end = start + p.Limit
+		next = encodeCursor(map[string]int{"o": end})
+	}
+	return start, end, next, nil
+}
+
 // ---------------------------------------------------------------------------
 // Token helpers (shared across all store implementations)
 // ---------------------------------------------------------------------------
@@ -101,6 +479,108 @@ func HashToken(token string) string {
 	return hex.EncodeToString(h[:])
 }
 
+// GenerateRecoveryCode creates a human-friendly recovery code of the form
+// "RCVR-XXXX-XXXX-XXXX-XXXX" and returns (plaintext, sha256_hash).
+func GenerateRecoveryCode() (string, string, error) {
+	const chars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O, 1/I to avoid transcription errors
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	plain := "RCVR"
+	for i, c := range b {
+		if i%4 == 0 {
+			plain += "-"
+		}
+		plain += string(chars[int(c)%len(chars)])
+	}
+	return plain, HashToken(plain), nil
+}
+
+// GenerateBanID creates a random ban ID.
+func GenerateBanID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ban_" + hex.EncodeToString(b), nil
+}
+
+// GenerateOrgID creates a random organization ID.
+func GenerateOrgID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "org_" + hex.EncodeToString(b), nil
+}
+
+// GenerateOrgAPIKey creates an org-scoped admin key and returns
+// (key_id, plaintext, sha256_hash).
+func GenerateOrgAPIKey() (string, string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	plain := "oak_" + hex.EncodeToString(b)
+	hash := HashToken(plain)
+	return "okey_" + hash[:16], plain, hash, nil
+}
+
+// GenerateRuleID creates a random approval rule ID.
+func GenerateRuleID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "rule_" + hex.EncodeToString(b), nil
+}
+
+// GenerateAuditID creates a random audit event ID.
+func GenerateAuditID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "aud_" + hex.EncodeToString(b), nil
+}
+
+// GenerateEventID creates a random notification event ID.
+func GenerateEventID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
+
+// GenerateWebhookID creates a random webhook ID.
+func GenerateWebhookID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whk_" + hex.EncodeToString(b), nil
+}
+
+// GenerateWebhookSecret creates a random webhook signing secret.
+func GenerateWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// GenerateDeliveryID creates a random webhook delivery ID.
+func GenerateDeliveryID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "dlv_" + hex.EncodeToString(b), nil
+}
+
 // GenerateAgentID creates a random agent ID.
 func GenerateAgentID() (string, error) {
 	b := make([]byte, 12)
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -16,43 +19,230 @@ import (
 
 // DynamoStore implements DataStore using DynamoDB (for Lambda deployment).
 type DynamoStore struct {
-	client          *dynamodb.Client
-	agentsTable     string
-	backupsTable    string
-	retentionDays   int
+	client           *dynamodb.Client
+	agentsTable      string
+	backupsTable     string
+	redemptionsTable string
+	rateLimitsTable  string
+	auditTable       string
+	deliveriesTable  string
+	retentionDays    int
 	deleteGraceHours int
 }
 
+// Global secondary indexes on the agents table, both sorted by created_at.
+// Items without the key attribute are left out of an index: only agents
+// have a status. The audit and webhook deliveries tables have an
+// item-type-index too, sorted by event_key and delivery_key, that holds all
+// of their items under a single item_type so they can be listed in order
+// across agents and webhooks.
+const (
+	itemTypeIndex = "item-type-index" // item_type
+	statusIndex   = "status-index"    // status
+)
+
+// createdIndex orders the backups table's (agent_id, timestamp) items of an
+// agent by created_key, "<created_at>#<timestamp>".
+const createdIndex = "created-index"
+
+// redeemedIndex orders the redemptions table's (code, agent_id) items of a
+// code by redeemed_at.
+const redeemedIndex = "redeemed-index"
+
 // DynamoDB item schemas
 
 type dynamoAgent struct {
-	ID              string `dynamodbav:"id"`
-	Name            string `dynamodbav:"name"`
-	Hostname        string `dynamodbav:"hostname"`
-	OS              string `dynamodbav:"os"`
-	Arch            string `dynamodbav:"arch"`
-	OpenClawVersion string `dynamodbav:"openclaw_version"`
-	Fingerprint     string `dynamodbav:"fingerprint"`
-	EncryptTool     string `dynamodbav:"encrypt_tool"`
-	PublicKey       string `dynamodbav:"public_key"`
-	TokenHash       string `dynamodbav:"token_hash"`
-	Status          string `dynamodbav:"status"`
-	QuotaBytes      int64  `dynamodbav:"quota_bytes"`
-	UsedBytes       int64  `dynamodbav:"used_bytes"`
-	CreatedAt       string `dynamodbav:"created_at"`
+	ID              string   `dynamodbav:"id"`
+	ItemType        string   `dynamodbav:"item_type"` // "agent"
+	Name            string   `dynamodbav:"name"`
+	Hostname        string   `dynamodbav:"hostname"`
+	OS              string   `dynamodbav:"os"`
+	Arch            string   `dynamodbav:"arch"`
+	OpenClawVersion string   `dynamodbav:"openclaw_version"`
+	Fingerprint     string   `dynamodbav:"fingerprint"`
+	EncryptTool     string   `dynamodbav:"encrypt_tool"`
+	PublicKey       string   `dynamodbav:"public_key"`
+	TokenHash       string   `dynamodbav:"token_hash"`
+	Status          string   `dynamodbav:"status"`
+	StatusReason    string   `dynamodbav:"status_reason,omitempty"`
+	QuotaBytes      int64    `dynamodbav:"quota_bytes"`
+	UsedBytes       int64    `dynamodbav:"used_bytes"`
+	Plan            string   `dynamodbav:"plan,omitempty"`
+	Tags            []string `dynamodbav:"tags,omitempty"`
+	ApprovalRuleID  string   `dynamodbav:"approval_rule,omitempty"`
+	OrgID           string   `dynamodbav:"org_id,omitempty"`
+	StaleAfterHours int      `dynamodbav:"stale_after_hours,omitempty"`
+	StaleSince      string   `dynamodbav:"stale_since,omitempty"`
+	ContactEmail    string   `dynamodbav:"contact_email,omitempty"`
+	EmailOptOuts    []string `dynamodbav:"email_opt_outs,omitempty"`
+	CreatedAt       string   `dynamodbav:"created_at"`
 }
 
 // dynamoInviteCode is stored in the agents table with id = "INVITE#<code>"
 // and item_type = "invite_code" to distinguish from agent items.
 type dynamoInviteCode struct {
-	ID        string  `dynamodbav:"id"`       // "INVITE#<code>"
-	ItemType  string  `dynamodbav:"item_type"` // "invite_code"
-	Code      string  `dynamodbav:"code"`
-	MaxUses   int     `dynamodbav:"max_uses"`
-	UseCount  int     `dynamodbav:"use_count"`
-	ExpiresAt *int64  `dynamodbav:"expires_at_epoch,omitempty"` // Unix timestamp, nil = no expiry
-	CreatedAt string  `dynamodbav:"created_at"`
-	RevokedAt string  `dynamodbav:"revoked_at,omitempty"`
+	ID        string `dynamodbav:"id"`        // "INVITE#<code>"
+	ItemType  string `dynamodbav:"item_type"` // "invite_code"
+	Code      string `dynamodbav:"code"`
+	MaxUses   int    `dynamodbav:"max_uses"`
+	UseCount  int    `dynamodbav:"use_count"`
+	ExpiresAt *int64 `dynamodbav:"expires_at_epoch,omitempty"` // Unix timestamp, nil = no expiry
+	CreatedAt string `dynamodbav:"created_at"`
+	RevokedAt string `dynamodbav:"revoked_at,omitempty"`
+
+	Plan            string   `dynamodbav:"plan,omitempty"`
+	QuotaBytes      int64    `dynamodbav:"quota_bytes,omitempty"`
+	Tags            []string `dynamodbav:"tags,omitempty"`
+	HostnamePattern string   `dynamodbav:"hostname_pattern,omitempty"`
+	OrgID           string   `dynamodbav:"org_id,omitempty"`
+}
+
+// dynamoRedemption lives in its own table keyed by (code, agent_id) so that
+// the agents that used a code can be fetched with a single Query.
+type dynamoRedemption struct {
+	Code       string `dynamodbav:"code"`
+	AgentID    string `dynamodbav:"agent_id"`
+	IP         string `dynamodbav:"ip"`
+	RedeemedAt string `dynamodbav:"redeemed_at"`
+}
+
+// dynamoAuditEvent lives in its own table keyed by (agent_id, event_key),
+// where event_key is "<created_at>#<id>" so that an agent's trail can be
+// queried in order. Events that concern no agent use agent_id "-".
+// expires_at is the TTL attribute.
+type dynamoAuditEvent struct {
+	AgentID   string `dynamodbav:"agent_id"`
+	EventKey  string `dynamodbav:"event_key"`
+	ItemType  string `dynamodbav:"item_type"` // "audit_event"
+	EventID   string `dynamodbav:"event_id"`
+	Action    string `dynamodbav:"action"`
+	Actor     string `dynamodbav:"actor"`
+	Target    string `dynamodbav:"target,omitempty"`
+	IP        string `dynamodbav:"ip,omitempty"`
+	RequestID string `dynamodbav:"request_id,omitempty"`
+	Before    string `dynamodbav:"before_state,omitempty"`
+	After     string `dynamodbav:"after_state,omitempty"`
+	CreatedAt string `dynamodbav:"created_at"`
+	ExpiresAt int64  `dynamodbav:"expires_at,omitempty"`
+}
+
+// dynamoWebhook is stored in the agents table with id = "WEBHOOK#<id>" and
+// item_type = "webhook".
+type dynamoWebhook struct {
+	ID        string   `dynamodbav:"id"`        // "WEBHOOK#<id>"
+	ItemType  string   `dynamodbav:"item_type"` // "webhook"
+	WebhookID string   `dynamodbav:"webhook_id"`
+	URL       string   `dynamodbav:"url"`
+	Secret    string   `dynamodbav:"secret"`
+	Events    []string `dynamodbav:"events,omitempty"`
+	CreatedAt string   `dynamodbav:"created_at"`
+}
+
+// dynamoWebhookDelivery lives in its own table keyed by (webhook_id,
+// delivery_key), where delivery_key is "<created_at>#<id>" so that a
+// webhook's log can be queried in order. expires_at is the TTL attribute.
+type dynamoWebhookDelivery struct {
+	WebhookID     string `dynamodbav:"webhook_id"`
+	DeliveryKey   string `dynamodbav:"delivery_key"`
+	ItemType      string `dynamodbav:"item_type"` // "webhook_delivery"
+	DeliveryID    string `dynamodbav:"delivery_id"`
+	EventID       string `dynamodbav:"event_id"`
+	EventType     string `dynamodbav:"event_type"`
+	Payload       string `dynamodbav:"payload"`
+	Status        string `dynamodbav:"status"`
+	Attempts      int    `dynamodbav:"attempts"`
+	ResponseCode  int    `dynamodbav:"response_code,omitempty"`
+	Error         string `dynamodbav:"error,omitempty"`
+	NextAttemptAt string `dynamodbav:"next_attempt_at,omitempty"`
+	CreatedAt     string `dynamodbav:"created_at"`
+	UpdatedAt     string `dynamodbav:"updated_at"`
+	ExpiresAt     int64  `dynamodbav:"expires_at"`
+}
+
+// dynamoBan is stored in the agents table with id = "BAN#<id>" and
+// item_type = "ban".
+type dynamoBan struct {
+	ID        string `dynamodbav:"id"`        // "BAN#<id>"
+	ItemType  string `dynamodbav:"item_type"` // "ban"
+	BanID     string `dynamodbav:"ban_id"`
+	Kind      string `dynamodbav:"kind"`
+	Value     string `dynamodbav:"value"`
+	Reason    string `dynamodbav:"reason,omitempty"`
+	CreatedAt string `dynamodbav:"created_at"`
+}
+
+// dynamoOrg is stored in the agents table with id = "ORG#<id>" and
+// item_type = "org".
+type dynamoOrg struct {
+	ID         string `dynamodbav:"id"`        // "ORG#<id>"
+	ItemType   string `dynamodbav:"item_type"` // "org"
+	OrgID      string `dynamodbav:"org_id"`
+	Name       string `dynamodbav:"name"`
+	QuotaBytes int64  `dynamodbav:"quota_bytes"`
+	UsedBytes  int64  `dynamodbav:"used_bytes"` // kept in step with its agents' used_bytes
+	CreatedAt  string `dynamodbav:"created_at"`
+}
+
+// dynamoOrgAPIKey is stored in the agents table with id = "ORGKEY#<hash>"
+// and item_type = "org_key", so a presented key is resolved with GetItem.
+type dynamoOrgAPIKey struct {
+	ID        string `dynamodbav:"id"`        // "ORGKEY#<hash>"
+	ItemType  string `dynamodbav:"item_type"` // "org_key"
+	KeyID     string `dynamodbav:"key_id"`
+	OrgID     string `dynamodbav:"org_id"`
+	KeyHash   string `dynamodbav:"key_hash"`
+	Name      string `dynamodbav:"name,omitempty"`
+	CreatedAt string `dynamodbav:"created_at"`
+}
+
+// dynamoApprovalRule is stored in the agents table with id = "RULE#<id>"
+// and item_type = "approval_rule".
+type dynamoApprovalRule struct {
+	ID            string   `dynamodbav:"id"`        // "RULE#<id>"
+	ItemType      string   `dynamodbav:"item_type"` // "approval_rule"
+	RuleID        string   `dynamodbav:"rule_id"`
+	Name          string   `dynamodbav:"name,omitempty"`
+	Priority      int      `dynamodbav:"priority"`
+	SourceCIDRs   []string `dynamodbav:"source_cidrs,omitempty"`
+	HostnameRegex string   `dynamodbav:"hostname_regex,omitempty"`
+	OS            string   `dynamodbav:"os,omitempty"`
+	Arch          string   `dynamodbav:"arch,omitempty"`
+	MinVersion    string   `dynamodbav:"min_version,omitempty"`
+	MaxVersion    string   `dynamodbav:"max_version,omitempty"`
+	Fingerprints  []string `dynamodbav:"fingerprints,omitempty"`
+	Approve       bool     `dynamodbav:"approve"`
+	Plan          string   `dynamodbav:"plan,omitempty"`
+	CreatedAt     string   `dynamodbav:"created_at"`
+}
+
+// dynamoRecoveryCode is stored in the agents table with id = "RECOVERY#<hash>"
+// and item_type = "recovery_code". The agent item carries the hash of the
+// most recently issued code in recovery_hash, so issuing a new code
+// invalidates any earlier one.
+type dynamoRecoveryCode struct {
+	ID        string `dynamodbav:"id"`        // "RECOVERY#<hash>"
+	ItemType  string `dynamodbav:"item_type"` // "recovery_code"
+	AgentID   string `dynamodbav:"agent_id"`
+	ExpiresAt int64  `dynamodbav:"expires_at_epoch"`
+	CreatedAt string `dynamodbav:"created_at"`
+	UsedAt    string `dynamodbav:"used_at,omitempty"`
+}
+
+// dynamoTransfer is stored in the agents table with id = "TRANSFER#<id>"
+// and item_type = "transfer".
+type dynamoTransfer struct {
+	ID            string `dynamodbav:"id"`        // "TRANSFER#<id>"
+	ItemType      string `dynamodbav:"item_type"` // "transfer"
+	TransferID    string `dynamodbav:"transfer_id"`
+	SourceAgentID string `dynamodbav:"source_agent_id"`
+	TargetAgentID string `dynamodbav:"target_agent_id"`
+	Mode          string `dynamodbav:"mode"`
+	Status        string `dynamodbav:"transfer_status"`
+	TotalCount    int    `dynamodbav:"total_count"`
+	DoneCount     int    `dynamodbav:"done_count"`
+	Error         string `dynamodbav:"error,omitempty"`
+	CreatedAt     string `dynamodbav:"created_at"`
+	UpdatedAt     string `dynamodbav:"updated_at"`
 }
 
 type dynamoBackup struct {
@@ -64,11 +254,27 @@ type dynamoBackup struct {
 	S3Key           string `dynamodbav:"s3_key"`
 	ManifestS3Key   string `dynamodbav:"manifest_s3_key"`
 	CreatedAt       string `dynamodbav:"created_at"`
-	ExpiresAt       int64  `dynamodbav:"expires_at"`    // TTL attribute
+	CreatedKey      string `dynamodbav:"created_key"` // "<created_at>#<timestamp>"
+	ExpiresAt       int64  `dynamodbav:"expires_at"`  // TTL attribute
 	DeletedAt       string `dynamodbav:"deleted_at,omitempty"`
 }
 
+// NewDynamoStore connects to the configured tables and applies pending
+// migrations.
 func NewDynamoStore(ctx context.Context, cfg *Config) (*DynamoStore, error) {
+	s, err := openDynamo(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.migrate(ctx); err != nil {
+		return nil, fmt.Errorf("migrate DynamoDB items: %w", err)
+	}
+	return s, nil
+}
+
+// openDynamo returns a store for the configured tables without touching
+// them.
+func openDynamo(ctx context.Context, cfg *Config) (*DynamoStore, error) {
 	opts := []func(*awsconfig.LoadOptions) error{
 		awsconfig.WithRegion(cfg.S3Region),
 	}
@@ -91,6 +297,10 @@ func NewDynamoStore(ctx context.Context, cfg *Config) (*DynamoStore, error) {
 		client:           client,
 		agentsTable:      cfg.DynamoAgentsTable,
 		backupsTable:     cfg.DynamoBackupsTable,
+		redemptionsTable: cfg.DynamoRedemptionsTable,
+		rateLimitsTable:  cfg.DynamoRateLimitsTable,
+		auditTable:       cfg.DynamoAuditTable,
+		deliveriesTable:  cfg.DynamoDeliveriesTable,
 		retentionDays:    cfg.RetentionDays,
 		deleteGraceHours: cfg.DeleteGraceHours,
 	}, nil
@@ -100,11 +310,262 @@ func (s *DynamoStore) Close() error {
 	return nil // DynamoDB client doesn't need closing
 }
 
+// Ping reads a key that never exists from the agents table, which checks
+// connectivity, credentials and that the table exists for one read unit.
+func (s *DynamoStore) Ping(ctx context.Context) error {
+	_, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "PING"},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("get ping item: %w", err)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Migrations
+//
+// Rewrites of existing items that a release depends on. Each applied
+// migration is recorded as an item in the agents table with
+// id = "MIGRATION#<version>" and item_type = "migration". The steps are
+// idempotent, so Lambda instances starting at once may both run one.
+// ---------------------------------------------------------------------------
+
+type dynamoMigration struct {
+	name string
+	up   func(ctx context.Context, s *DynamoStore) error
+}
+
+var dynamoMigrations = []dynamoMigration{
+	{"index agents by item type and status", backfillAgentItemType},
+	{"index backups, audit events and webhook deliveries by time", backfillListKeys},
+	{"count organization usage", backfillOrgUsage},
+}
+
+type dynamoMigrationRecord struct {
+	ID        string `dynamodbav:"id"`        // "MIGRATION#<version>"
+	ItemType  string `dynamodbav:"item_type"` // "migration"
+	Version   int    `dynamodbav:"version"`
+	Name      string `dynamodbav:"name"`
+	CreatedAt string `dynamodbav:"created_at"` // when it was applied
+}
+
+// migrate applies pending migrations, refusing tables migrated by a newer
+// release.
+func (s *DynamoStore) migrate(ctx context.Context) error {
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	current := schemaVersion(applied)
+	if current > len(dynamoMigrations) {
+		return schemaTooNewError(current, len(dynamoMigrations))
+	}
+
+	for v := current + 1; v <= len(dynamoMigrations); v++ {
+		m := dynamoMigrations[v-1]
+		if err := m.up(ctx, s); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", v, m.name, err)
+		}
+		av, err := attributevalue.MarshalMap(dynamoMigrationRecord{
+			ID:        fmt.Sprintf("MIGRATION#%d", v),
+			ItemType:  "migration",
+			Version:   v,
+			Name:      m.name,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return fmt.Errorf("marshal migration: %w", err)
+		}
+		_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.agentsTable),
+			Item:      av,
+		})
+		if err != nil {
+			return fmt.Errorf("record migration %d: %w", v, err)
+		}
+	}
+	return nil
+}
+
+func (s *DynamoStore) appliedMigrations(ctx context.Context) ([]appliedMigration, error) {
+	items, err := s.queryItemType(ctx, "migration")
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]appliedMigration, 0, len(items))
+	for _, item := range items {
+		var r dynamoMigrationRecord
+		if err := attributevalue.UnmarshalMap(item, &r); err != nil {
+			return nil, fmt.Errorf("unmarshal migration: %w", err)
+		}
+		appliedAt, _ := time.Parse(time.RFC3339, r.CreatedAt)
+		applied = append(applied, appliedMigration{Version: r.Version, Name: r.Name, AppliedAt: appliedAt})
+	}
+	sort.Slice(applied, func(i, j int) bool {
+		return applied[i].Version < applied[j].Version
+	})
+	return applied, nil
+}
+
+// backfillAgentItemType tags agents written before agent items carried
+// item_type, so item-type-index lists them, and gives any without a status
+// the "active" that meant, so status-index does.
+func backfillAgentItemType(ctx context.Context, s *DynamoStore) error {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(s.agentsTable),
+		FilterExpression:     aws.String("attribute_not_exists(item_type)"),
+		ProjectionExpression: aws.String("id"),
+	}
+	for {
+		out, err := s.client.Scan(ctx, input)
+		if err != nil {
+			return fmt.Errorf("scan untyped items: %w", err)
+		}
+		for _, item := range out.Items {
+			_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String(s.agentsTable),
+				Key:                 map[string]types.AttributeValue{"id": item["id"]},
+				UpdateExpression:    aws.String("SET item_type = :agent, #s = if_not_exists(#s, :active)"),
+				ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(item_type)"),
+				ExpressionAttributeNames: map[string]string{
+					"#s": "status",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":agent":  &types.AttributeValueMemberS{Value: "agent"},
+					":active": &types.AttributeValueMemberS{Value: "active"},
+				},
+			})
+			var ccfe *types.ConditionalCheckFailedException
+			if err != nil && !errors.As(err, &ccfe) {
+				return fmt.Errorf("tag agent item: %w", err)
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// backfillListKeys gives backups a created_key and audit events and webhook
+// deliveries an item_type, so created-index and the item-type-index of
+// their tables cover items written before those lists were paged by index.
+func backfillListKeys(ctx context.Context, s *DynamoStore) error {
+	err := s.setMissing(ctx, s.backupsTable, []string{"agent_id", "timestamp"}, "created_key", func(item map[string]types.AttributeValue) string {
+		var b dynamoBackup
+		attributevalue.UnmarshalMap(item, &b)
+		return backupCreatedKey(b.CreatedAt, b.Timestamp)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.setMissing(ctx, s.auditTable, []string{"agent_id", "event_key"}, "item_type", func(map[string]types.AttributeValue) string {
+		return "audit_event"
+	})
+	if err != nil {
+		return err
+	}
+	return s.setMissing(ctx, s.deliveriesTable, []string{"webhook_id", "delivery_key"}, "item_type", func(map[string]types.AttributeValue) string {
+		return "webhook_delivery"
+	})
+}
+
+// backfillOrgUsage sets each org's used_bytes to the sum over its agents,
+// which CreateBackup, UpdateUsedBytes and SetAgentOrg keep in step from
+// then on.
+func backfillOrgUsage(ctx context.Context, s *DynamoStore) error {
+	agents, err := s.queryItemType(ctx, "agent")
+	if err != nil {
+		return err
+	}
+	used := map[string]int64{}
+	for _, item := range agents {
+		var a dynamoAgent
+		if err := attributevalue.UnmarshalMap(item, &a); err != nil {
+			return fmt.Errorf("unmarshal agent: %w", err)
+		}
+		if a.OrgID != "" {
+			used[a.OrgID] += a.UsedBytes
+		}
+	}
+
+	orgs, err := s.queryItemType(ctx, "org")
+	if err != nil {
+		return err
+	}
+	for _, item := range orgs {
+		var o dynamoOrg
+		if err := attributevalue.UnmarshalMap(item, &o); err != nil {
+			return fmt.Errorf("unmarshal org: %w", err)
+		}
+		_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        aws.String(s.agentsTable),
+			Key:              map[string]types.AttributeValue{"id": item["id"]},
+			UpdateExpression: aws.String("SET used_bytes = :ub"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":ub": &types.AttributeValueMemberN{Value: strconv.FormatInt(used[o.OrgID], 10)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("set org used bytes: %w", err)
+		}
+	}
+	return nil
+}
+
+// setMissing scans table for items without attr and sets it to what value
+// returns for each. keys are the table's key attributes.
+func (s *DynamoStore) setMissing(ctx context.Context, table string, keys []string, attr string, value func(item map[string]types.AttributeValue) string) error {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(table),
+		FilterExpression:         aws.String("attribute_not_exists(#a)"),
+		ExpressionAttributeNames: map[string]string{"#a": attr},
+	}
+	for {
+		out, err := s.client.Scan(ctx, input)
+		if err != nil {
+			return fmt.Errorf("scan %s for items without %s: %w", table, attr, err)
+		}
+		for _, item := range out.Items {
+			key := map[string]types.AttributeValue{}
+			for _, k := range keys {
+				key[k] = item[k]
+			}
+			_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String(table),
+				Key:                 key,
+				UpdateExpression:    aws.String("SET #a = :v"),
+				ConditionExpression: aws.String("attribute_exists(#k) AND attribute_not_exists(#a)"),
+				ExpressionAttributeNames: map[string]string{
+					"#a": attr,
+					"#k": keys[0],
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":v": &types.AttributeValueMemberS{Value: value(item)},
+				},
+			})
+			var ccfe *types.ConditionalCheckFailedException
+			if err != nil && !errors.As(err, &ccfe) {
+				return fmt.Errorf("set %s: %w", attr, err)
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Agent operations
 // ---------------------------------------------------------------------------
 
-func (s *DynamoStore) CreateAgent(a *Agent, tokenHash string) error {
+func (s *DynamoStore) CreateAgent(ctx context.Context, a *Agent, tokenHash string) error {
 	item := dynamoAgent{
 		ID:              a.ID,
 		Name:            a.Name,
@@ -114,12 +575,17 @@ func (s *DynamoStore) CreateAgent(a *Agent, tokenHash string) error {
 		OpenClawVersion: a.OpenClawVersion,
 		Fingerprint:     a.Fingerprint,
 		EncryptTool:     a.EncryptTool,
-		PublicKey:        a.PublicKey,
+		PublicKey:       a.PublicKey,
+		ItemType:        "agent",
 		TokenHash:       tokenHash,
 		Status:          a.Status,
 		QuotaBytes:      a.QuotaBytes,
 		UsedBytes:       0,
-		CreatedAt:       time.Now().UTC().Format(time.RFC3339),
+		Plan:            a.Plan,
+		Tags:            a.Tags,
+		ApprovalRuleID:  a.ApprovalRuleID,
+		OrgID:           a.OrgID,
+		CreatedAt:       creationTime(a.CreatedAt).Format(time.RFC3339),
 	}
 
 	av, err := attributevalue.MarshalMap(item)
@@ -127,18 +593,18 @@ func (s *DynamoStore) CreateAgent(a *Agent, tokenHash string) error {
 		return fmt.Errorf("marshal agent: %w", err)
 	}
 
-	_, err = s.client.PutItem(context.Background(), &dynamodb.PutItemInput{
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(s.agentsTable),
 		Item:      av,
 	})
 	return err
 }
 
-func (s *DynamoStore) LookupAgentByToken(token string) (*Agent, error) {
+func (s *DynamoStore) LookupAgentByToken(ctx context.Context, token string) (*Agent, error) {
 	h := HashToken(token)
 
 	// Query the GSI on token_hash
-	out, err := s.client.Query(context.Background(), &dynamodb.QueryInput{
+	out, err := s.client.Query(ctx, &dynamodb.QueryInput{
 		TableName:              aws.String(s.agentsTable),
 		IndexName:              aws.String("token-hash-index"),
 		KeyConditionExpression: aws.String("token_hash = :th"),
@@ -158,8 +624,31 @@ func (s *DynamoStore) LookupAgentByToken(token string) (*Agent, error) {
 	return unmarshalAgent(out.Items[0])
 }
 
-func (s *DynamoStore) GetAgent(id string) (*Agent, error) {
-	out, err := s.client.GetItem(context.Background(), &dynamodb.GetItemInput{
+func (s *DynamoStore) AgentTokenHash(ctx context.Context, agentID string) (string, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: agentID},
+		},
+		ProjectionExpression: aws.String("token_hash"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("get agent token hash: %w", err)
+	}
+	if out.Item == nil {
+		return "", nil
+	}
+	var item struct {
+		TokenHash string `dynamodbav:"token_hash"`
+	}
+	if err := attributevalue.UnmarshalMap(out.Item, &item); err != nil {
+		return "", fmt.Errorf("unmarshal agent: %w", err)
+	}
+	return item.TokenHash, nil
+}
+
+func (s *DynamoStore) GetAgent(ctx context.Context, id string) (*Agent, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
@@ -174,8 +663,8 @@ func (s *DynamoStore) GetAgent(id string) (*Agent, error) {
 	return unmarshalAgent(out.Item)
 }
 
-func (s *DynamoStore) RotateAgentToken(agentID, newTokenHash string) error {
-	_, err := s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+func (s *DynamoStore) RotateAgentToken(ctx context.Context, agentID, newTokenHash string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: agentID},
@@ -188,8 +677,8 @@ func (s *DynamoStore) RotateAgentToken(agentID, newTokenHash string) error {
 	return err
 }
 
-func (s *DynamoStore) UpdateAgentProfile(agentID, name string) error {
-	_, err := s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+func (s *DynamoStore) UpdateAgentProfile(ctx context.Context, agentID, name string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: agentID},
@@ -206,182 +695,627 @@ func (s *DynamoStore) UpdateAgentProfile(agentID, name string) error {
 	return err
 }
 
-func (s *DynamoStore) UpdateUsedBytes(agentID string) error {
-	// In DynamoDB we recalculate by querying backups
-	_, totalBytes, err := s.CountBackups(agentID)
-	if err != nil {
-		return err
+// UpdateUsedBytes recounts the agent's live backups into used_bytes and
+// moves the agent's org's used_bytes by the difference, in one transaction.
+// It only goes through if used_bytes is still what it was before the
+// count, so a backup that CreateBackup adds meanwhile is never overwritten
+// by a stale total.
+func (s *DynamoStore) UpdateUsedBytes(ctx context.Context, agentID string) error {
+	for attempt := 0; ; attempt++ {
+		a, err := s.agentUsage(ctx, agentID)
+		if err != nil || a == nil {
+			return err // like an UPDATE matching no row
+		}
+		_, totalBytes, err := s.CountBackups(ctx, agentID)
+		if err != nil {
+			return err
+		}
+		if totalBytes == a.UsedBytes {
+			return nil
+		}
+
+		items := []types.TransactWriteItem{{
+			Update: &types.Update{
+				TableName: aws.String(s.agentsTable),
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: agentID},
+				},
+				UpdateExpression:    aws.String("SET used_bytes = :ub"),
+				ConditionExpression: aws.String("used_bytes = :prev AND org_id = :org"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":ub":   &types.AttributeValueMemberN{Value: strconv.FormatInt(totalBytes, 10)},
+					":prev": &types.AttributeValueMemberN{Value: strconv.FormatInt(a.UsedBytes, 10)},
+					":org":  &types.AttributeValueMemberS{Value: a.OrgID},
+				},
+			},
+		}}
+		if a.OrgID == "" {
+			items[0].Update.ConditionExpression = aws.String("used_bytes = :prev AND attribute_not_exists(org_id)")
+			delete(items[0].Update.ExpressionAttributeValues, ":org")
+		} else {
+			items = append(items, s.addOrgUsage(a.OrgID, totalBytes-a.UsedBytes, 0))
+		}
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		var tce *types.TransactionCanceledException
+		if !errors.As(err, &tce) {
+			return err
+		}
+		if attempt+1 >= dynamoUsageRetries {
+			return fmt.Errorf("update used bytes of agent %s: too much contention", agentID)
+		}
 	}
+}
 
-	_, err = s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+// agentUsage reads an agent's used_bytes, quota_bytes and org_id with a
+// strongly consistent read. It returns nil if there is no such agent.
+func (s *DynamoStore) agentUsage(ctx context.Context, agentID string) (*dynamoAgent, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: agentID},
 		},
-		UpdateExpression: aws.String("SET used_bytes = :ub"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":ub": &types.AttributeValueMemberN{Value: strconv.FormatInt(totalBytes, 10)},
-		},
+		ProjectionExpression: aws.String("used_bytes, quota_bytes, org_id"),
+		ConsistentRead:       aws.Bool(true),
 	})
-	return err
-}
-
-func (s *DynamoStore) ListAgents(status string) ([]Agent, error) {
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(s.agentsTable),
-		// Exclude invite code items (which have item_type = "invite_code")
-		FilterExpression: aws.String("attribute_not_exists(item_type)"),
-	}
-
-	if status != "" {
-		input.FilterExpression = aws.String("attribute_not_exists(item_type) AND #s = :s")
-		input.ExpressionAttributeNames = map[string]string{
-			"#s": "status",
-		}
-		input.ExpressionAttributeValues = map[string]types.AttributeValue{
-			":s": &types.AttributeValueMemberS{Value: status},
-		}
-	}
-
-	out, err := s.client.Scan(context.Background(), input)
 	if err != nil {
-		return nil, fmt.Errorf("scan agents: %w", err)
+		return nil, fmt.Errorf("get agent usage: %w", err)
 	}
-
-	agents := make([]Agent, 0, len(out.Items))
-	for _, item := range out.Items {
-		a, err := unmarshalAgent(item)
-		if err != nil {
-			return nil, err
-		}
-		agents = append(agents, *a)
+	if out.Item == nil {
+		return nil, nil
+	}
+	var a dynamoAgent
+	if err := attributevalue.UnmarshalMap(out.Item, &a); err != nil {
+		return nil, fmt.Errorf("unmarshal agent usage: %w", err)
 	}
-	return agents, nil
+	return &a, nil
 }
 
-func (s *DynamoStore) CountAgentsByStatus(status string) (int, error) {
-	out, err := s.client.Scan(context.Background(), &dynamodb.ScanInput{
-		TableName:        aws.String(s.agentsTable),
-		FilterExpression: aws.String("attribute_not_exists(item_type) AND #s = :s"),
-		ExpressionAttributeNames: map[string]string{
-			"#s": "status",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":s": &types.AttributeValueMemberS{Value: status},
+// orgUsage reads an org's used_bytes and quota_bytes like agentUsage.
+func (s *DynamoStore) orgUsage(ctx context.Context, orgID string) (*dynamoOrg, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "ORG#" + orgID},
 		},
-		Select: types.SelectCount,
+		ProjectionExpression: aws.String("used_bytes, quota_bytes"),
+		ConsistentRead:       aws.Bool(true),
 	})
 	if err != nil {
-		return 0, fmt.Errorf("count agents by status: %w", err)
+		return nil, fmt.Errorf("get org usage: %w", err)
 	}
-	return int(out.Count), nil
+	if out.Item == nil {
+		return nil, nil
+	}
+	var o dynamoOrg
+	if err := attributevalue.UnmarshalMap(out.Item, &o); err != nil {
+		return nil, fmt.Errorf("unmarshal org usage: %w", err)
+	}
+	return &o, nil
 }
 
-func (s *DynamoStore) UpdateAgentStatus(id, status string) error {
-	_, err := s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+// addOrgUsage is the transaction item that adds delta to an org's
+// used_bytes. With a quota above 0 it only goes through while the org has
+// room for delta and the quota is unchanged; conditions cannot add, so the
+// room is the quota less delta.
+func (s *DynamoStore) addOrgUsage(orgID string, delta, quota int64) types.TransactWriteItem {
+	u := &types.Update{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: id},
-		},
-		UpdateExpression: aws.String("SET #s = :s"),
-		ExpressionAttributeNames: map[string]string{
-			"#s": "status",
+			"id": &types.AttributeValueMemberS{Value: "ORG#" + orgID},
 		},
+		UpdateExpression:    aws.String("ADD used_bytes :d"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":s": &types.AttributeValueMemberS{Value: status},
+			":d": &types.AttributeValueMemberN{Value: strconv.FormatInt(delta, 10)},
 		},
-		ConditionExpression: aws.String("attribute_exists(id)"),
-	})
-	return err
+	}
+	if quota > 0 {
+		u.ConditionExpression = aws.String("quota_bytes = :oq AND (attribute_not_exists(used_bytes) OR used_bytes <= :room)")
+		u.ExpressionAttributeValues[":oq"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(quota, 10)}
+		u.ExpressionAttributeValues[":room"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(quota-delta, 10)}
+	}
+	return types.TransactWriteItem{Update: u}
 }
 
-// ---------------------------------------------------------------------------
-// Backup operations
-// ---------------------------------------------------------------------------
-
-func (s *DynamoStore) CreateBackup(b *Backup) error {
-	now := time.Now().UTC()
-	expiresAt := now.Add(time.Duration(s.retentionDays*24) * time.Hour)
-
-	item := dynamoBackup{
-		AgentID:         b.AgentID,
-		Timestamp:       b.Timestamp,
-		EncryptedBytes:  b.EncryptedBytes,
-		SourceFileCount: b.SourceFileCount,
-		EncryptedSHA256: b.EncryptedSHA256,
-		S3Key:           b.S3Key,
-		ManifestS3Key:   b.ManifestS3Key,
-		CreatedAt:       now.Format(time.RFC3339),
-		ExpiresAt:       expiresAt.Unix(),
+// ListAgents queries status-index for one status and item-type-index for
+// all agents, newest first. The indexes order by created_at only, to the
+// second; agents created in the same second come in index order, which is
+// the same from page to page.
+func (s *DynamoStore) ListAgents(ctx context.Context, f AgentFilter) ([]Agent, string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.agentsTable),
+		IndexName:              aws.String(itemTypeIndex),
+		KeyConditionExpression: aws.String("item_type = :t"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: "agent"},
+		},
+		ScanIndexForward: aws.Bool(false),
 	}
-
-	av, err := attributevalue.MarshalMap(item)
-	if err != nil {
-		return fmt.Errorf("marshal backup: %w", err)
+	keys := []string{"item_type", "created_at", "id"}
+	if f.Status != "" {
+		keys[0] = "status"
+		input.IndexName = aws.String(statusIndex)
+		input.KeyConditionExpression = aws.String("#s = :s")
+		input.ExpressionAttributeNames = map[string]string{"#s": "status"}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":s": &types.AttributeValueMemberS{Value: f.Status},
+		}
 	}
-
-	_, err = s.client.PutItem(context.Background(), &dynamodb.PutItemInput{
-		TableName: aws.String(s.backupsTable),
-		Item:      av,
-	})
-	if err != nil {
-		return err
+	var filter []string
+	if f.OrgID != "" {
+		filter = append(filter, "org_id = :org")
+		input.ExpressionAttributeValues[":org"] = &types.AttributeValueMemberS{Value: f.OrgID}
 	}
-
-	return s.UpdateUsedBytes(b.AgentID)
-}
-
-func (s *DynamoStore) ListBackups(agentID string, limit int) ([]Backup, error) {
-	if limit <= 0 {
-		limit = 100
+	if f.Stale {
+		filter = append(filter, "attribute_exists(stale_since)")
+	}
+	if len(filter) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filter, " AND "))
 	}
 
-	out, err := s.client.Query(context.Background(), &dynamodb.QueryInput{
-		TableName:              aws.String(s.backupsTable),
-		KeyConditionExpression: aws.String("agent_id = :aid"),
-		FilterExpression:       aws.String("attribute_not_exists(deleted_at) OR deleted_at = :empty"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":aid":   &types.AttributeValueMemberS{Value: agentID},
-			":empty": &types.AttributeValueMemberS{Value: ""},
-		},
-		ScanIndexForward: aws.Bool(false), // newest first
-		Limit:            aws.Int32(int32(limit)),
-	})
+	items, next, err := s.queryPage(ctx, input, f.Page, keys...)
 	if err != nil {
-		return nil, fmt.Errorf("query backups: %w", err)
+		return nil, "", fmt.Errorf("query agents: %w", err)
 	}
-
-	backups := make([]Backup, 0, len(out.Items))
-	for _, item := range out.Items {
-		b, err := unmarshalBackup(item)
+	agents := make([]Agent, 0, len(items))
+	for _, item := range items {
+		a, err := unmarshalAgent(item)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		backups = append(backups, *b)
+		agents = append(agents, *a)
 	}
-	return backups, nil
+	return agents, next, nil
 }
 
-func (s *DynamoStore) CountBackups(agentID string) (int, int64, error) {
-	// Query all non-deleted backups for this agent to sum bytes
-	out, err := s.client.Query(context.Background(), &dynamodb.QueryInput{
-		TableName:              aws.String(s.backupsTable),
-		KeyConditionExpression: aws.String("agent_id = :aid"),
-		FilterExpression:       aws.String("attribute_not_exists(deleted_at) OR deleted_at = :empty"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":aid":   &types.AttributeValueMemberS{Value: agentID},
-			":empty": &types.AttributeValueMemberS{Value: ""},
+// SetAgentOrg moves the agent's used_bytes from its old org's used_bytes
+// to the new org's in the same transaction. The new org's quota is not
+// checked; like a lowered quota, it only refuses later backups.
+func (s *DynamoStore) SetAgentOrg(ctx context.Context, agentID, orgID string) error {
+	for attempt := 0; ; attempt++ {
+		a, err := s.agentUsage(ctx, agentID)
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			return fmt.Errorf("set org for agent %s: agent not found", agentID)
+		}
+		if a.OrgID == orgID {
+			return nil
+		}
+
+		update := &types.Update{
+			TableName: aws.String(s.agentsTable),
+			Key: map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{Value: agentID},
+			},
+			UpdateExpression:    aws.String("REMOVE org_id"),
+			ConditionExpression: aws.String("used_bytes = :ub"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":ub": &types.AttributeValueMemberN{Value: strconv.FormatInt(a.UsedBytes, 10)},
+			},
+		}
+		if orgID != "" {
+			update.UpdateExpression = aws.String("SET org_id = :org")
+			update.ExpressionAttributeValues[":org"] = &types.AttributeValueMemberS{Value: orgID}
+		}
+		if a.OrgID != "" {
+			update.ConditionExpression = aws.String("used_bytes = :ub AND org_id = :prev")
+			update.ExpressionAttributeValues[":prev"] = &types.AttributeValueMemberS{Value: a.OrgID}
+		} else {
+			update.ConditionExpression = aws.String("used_bytes = :ub AND attribute_not_exists(org_id)")
+		}
+
+		items := []types.TransactWriteItem{{Update: update}}
+		if a.OrgID != "" {
+			items = append(items, s.addOrgUsage(a.OrgID, -a.UsedBytes, 0))
+		}
+		if orgID != "" {
+			items = append(items, s.addOrgUsage(orgID, a.UsedBytes, 0))
+		}
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		var tce *types.TransactionCanceledException
+		if !errors.As(err, &tce) {
+			if err != nil {
+				return fmt.Errorf("set org for agent %s: %w", agentID, err)
+			}
+			return nil
+		}
+		if attempt+1 >= dynamoUsageRetries {
+			return fmt.Errorf("set org for agent %s: too much contention", agentID)
+		}
+	}
+}
+
+func (s *DynamoStore) SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: agentID},
+		},
+		UpdateExpression:    aws.String("REMOVE stale_after_hours"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	}
+	if hours != 0 {
+		input.UpdateExpression = aws.String("SET stale_after_hours = :h")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":h": &types.AttributeValueMemberN{Value: strconv.Itoa(hours)},
+		}
+	}
+
+	if _, err := s.client.UpdateItem(ctx, input); err != nil {
+		return fmt.Errorf("set stale threshold for agent %s: %w", agentID, err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) SetAgentStale(ctx context.Context, agentID string, since *time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: agentID},
+		},
+		UpdateExpression:    aws.String("REMOVE stale_since"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	}
+	if since != nil {
+		input.UpdateExpression = aws.String("SET stale_since = :s")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":s": &types.AttributeValueMemberS{Value: since.UTC().Format(time.RFC3339)},
+		}
+	}
+
+	if _, err := s.client.UpdateItem(ctx, input); err != nil {
+		return fmt.Errorf("set stale flag for agent %s: %w", agentID, err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) error {
+	var set, remove []string
+	values := map[string]types.AttributeValue{}
+	if email != "" {
+		set = append(set, "contact_email = :e")
+		values[":e"] = &types.AttributeValueMemberS{Value: email}
+	} else {
+		remove = append(remove, "contact_email")
+	}
+	if len(optOuts) > 0 {
+		av, err := attributevalue.Marshal(optOuts)
+		if err != nil {
+			return fmt.Errorf("marshal opt-outs: %w", err)
+		}
+		set = append(set, "email_opt_outs = :o")
+		values[":o"] = av
+	} else {
+		remove = append(remove, "email_opt_outs")
+	}
+
+	var expr []string
+	if len(set) > 0 {
+		expr = append(expr, "SET "+strings.Join(set, ", "))
+	}
+	if len(remove) > 0 {
+		expr = append(expr, "REMOVE "+strings.Join(remove, ", "))
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: agentID},
+		},
+		UpdateExpression:    aws.String(strings.Join(expr, " ")),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+
+	if _, err := s.client.UpdateItem(ctx, input); err != nil {
+		return fmt.Errorf("set contact for agent %s: %w", agentID, err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) CountAgentsByStatus(ctx context.Context, status string) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.agentsTable),
+		IndexName:              aws.String(statusIndex),
+		KeyConditionExpression: aws.String("#s = :s"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":s": &types.AttributeValueMemberS{Value: status},
+		},
+		Select: types.SelectCount,
+	}
+	count := 0
+	for {
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return 0, fmt.Errorf("count agents by status: %w", err)
+		}
+		count += int(out.Count)
+		if len(out.LastEvaluatedKey) == 0 {
+			return count, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// FleetStats reads every agent from item-type-index and scans the backups
+// table, projecting only the attributes it aggregates, and folds them up in
+// memory.
+func (s *DynamoStore) FleetStats(ctx context.Context, opts StatsOptions) (*FleetStats, error) {
+	stats := newFleetStats()
+
+	type agentRow struct {
+		ID              string `dynamodbav:"id"`
+		Name            string `dynamodbav:"name"`
+		OS              string `dynamodbav:"os"`
+		Arch            string `dynamodbav:"arch"`
+		OpenClawVersion string `dynamodbav:"openclaw_version"`
+		Status          string `dynamodbav:"status"`
+		UsedBytes       int64  `dynamodbav:"used_bytes"`
+		Plan            string `dynamodbav:"plan"`
+	}
+	var agents []agentRow
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.agentsTable),
+		IndexName:              aws.String(itemTypeIndex),
+		KeyConditionExpression: aws.String("item_type = :t"),
+		ProjectionExpression:   aws.String("id, #n, os, arch, openclaw_version, #s, used_bytes, #p"),
+		ExpressionAttributeNames: map[string]string{
+			"#n": "name",
+			"#s": "status",
+			"#p": "plan",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: "agent"},
+		},
+	}
+	for {
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("query agents: %w", err)
+		}
+		var page []agentRow
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("unmarshal agents: %w", err)
+		}
+		agents = append(agents, page...)
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	// Each agent's live backups created since the earlier of the week and
+	// InactiveSince, through created-index
+	day := opts.Now.Add(-24 * time.Hour).UTC().Format(time.RFC3339)
+	week := opts.Now.Add(-7 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	inactiveSince := opts.InactiveSince.UTC().Format(time.RFC3339)
+	recent := map[string]bool{} // agents with a backup since InactiveSince
+	for _, a := range agents {
+		created, err := s.backupsCreatedSince(ctx, a.ID, min(week, inactiveSince))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range created {
+			if c >= day {
+				stats.Backups24h++
+			}
+			if c >= week {
+				stats.Backups7d++
+			}
+			if c >= inactiveSince {
+				recent[a.ID] = true
+			}
+		}
+	}
+
+	for _, a := range agents {
+		if a.Status == "" {
+			a.Status = "active"
+		}
+		stats.AgentsByStatus[a.Status]++
+		stats.UsedBytes += a.UsedBytes
+		stats.UsedBytesByPlan[a.Plan] += a.UsedBytes
+		stats.ByOS[a.OS]++
+		stats.ByArch[a.Arch]++
+		stats.ByVersion[a.OpenClawVersion]++
+		if a.Status == "active" && !recent[a.ID] {
+			stats.InactiveAgents++
+		}
+	}
+
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].UsedBytes != agents[j].UsedBytes {
+			return agents[i].UsedBytes > agents[j].UsedBytes
+		}
+		return agents[i].ID < agents[j].ID
+	})
+	for _, a := range agents {
+		if len(stats.TopConsumers) >= opts.TopN || a.UsedBytes <= 0 {
+			break
+		}
+		stats.TopConsumers = append(stats.TopConsumers, AgentUsage{AgentID: a.ID, Name: a.Name, UsedBytes: a.UsedBytes})
+	}
+
+	return stats, nil
+}
+
+func (s *DynamoStore) UpdateAgentStatus(ctx context.Context, id, status, reason string) error {
+	update := "SET #s = :s REMOVE status_reason"
+	values := map[string]types.AttributeValue{
+		":s": &types.AttributeValueMemberS{Value: status},
+	}
+	if reason != "" {
+		update = "SET #s = :s, status_reason = :r"
+		values[":r"] = &types.AttributeValueMemberS{Value: reason}
+	}
+
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String(update),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "status",
 		},
-		ProjectionExpression: aws.String("encrypted_bytes"),
+		ExpressionAttributeValues: values,
+		ConditionExpression:       aws.String("attribute_exists(id)"),
 	})
+	return err
+}
+
+// ---------------------------------------------------------------------------
+// Backup operations
+// ---------------------------------------------------------------------------
+
+// dynamoUsageRetries bounds the optimistic-locking retries on an agent's
+// used_bytes when uploads and deletions change it at once.
+const dynamoUsageRetries = 5
+
+// CreateBackup writes the backup and adds its size to the agent's and its
+// org's used_bytes in one transaction. Conditions cannot do arithmetic, so
+// the room is checked against the usage and quotas read just before, and
+// the transaction only goes through if they still leave room; otherwise it
+// reads them again.
+func (s *DynamoStore) CreateBackup(ctx context.Context, b *Backup) error {
+	now := time.Now().UTC()
+	expiresAt := now.Add(time.Duration(s.retentionDays*24) * time.Hour)
+
+	item := dynamoBackup{
+		AgentID:         b.AgentID,
+		Timestamp:       b.Timestamp,
+		EncryptedBytes:  b.EncryptedBytes,
+		SourceFileCount: b.SourceFileCount,
+		EncryptedSHA256: b.EncryptedSHA256,
+		S3Key:           b.S3Key,
+		ManifestS3Key:   b.ManifestS3Key,
+		CreatedAt:       now.Format(time.RFC3339),
+		CreatedKey:      backupCreatedKey(now.Format(time.RFC3339), b.Timestamp),
+		ExpiresAt:       expiresAt.Unix(),
+	}
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("marshal backup: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		a, err := s.agentUsage(ctx, b.AgentID)
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			return fmt.Errorf("agent %s not found", b.AgentID)
+		}
+		if a.UsedBytes+b.EncryptedBytes > a.QuotaBytes {
+			return ErrQuotaExceeded
+		}
+
+		items := []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName:           aws.String(s.backupsTable),
+					Item:                av,
+					ConditionExpression: aws.String("attribute_not_exists(agent_id)"),
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.agentsTable),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: b.AgentID},
+					},
+					UpdateExpression:    aws.String("SET used_bytes = :ub"),
+					ConditionExpression: aws.String("used_bytes = :used AND quota_bytes = :quota"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":ub":    &types.AttributeValueMemberN{Value: strconv.FormatInt(a.UsedBytes+b.EncryptedBytes, 10)},
+						":used":  &types.AttributeValueMemberN{Value: strconv.FormatInt(a.UsedBytes, 10)},
+						":quota": &types.AttributeValueMemberN{Value: strconv.FormatInt(a.QuotaBytes, 10)},
+					},
+				},
+			},
+		}
+		if a.OrgID != "" {
+			org, err := s.orgUsage(ctx, a.OrgID)
+			if err != nil {
+				return err
+			}
+			if org != nil {
+				if org.QuotaBytes > 0 && org.UsedBytes+b.EncryptedBytes > org.QuotaBytes {
+					return ErrOrgQuotaExceeded
+				}
+				items = append(items, s.addOrgUsage(a.OrgID, b.EncryptedBytes, org.QuotaBytes))
+			}
+		}
+
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if err == nil {
+			return nil
+		}
+		var tce *types.TransactionCanceledException
+		if !errors.As(err, &tce) {
+			return fmt.Errorf("create backup: %w", err)
+		}
+		if len(tce.CancellationReasons) > 0 && aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return fmt.Errorf("backup %s of agent %s already exists", b.Timestamp, b.AgentID)
+		}
+		// Another write changed the agent's or org's usage or quota; check again
+		if attempt+1 >= dynamoUsageRetries {
+			return fmt.Errorf("create backup for agent %s: too much contention", b.AgentID)
+		}
+	}
+}
+
+// backupCreatedKey is the created_key of a backup. created_at is RFC 3339
+// in UTC, which has a fixed width, so the keys sort by creation time and
+// then by timestamp like the SQL stores' lists.
+func backupCreatedKey(createdAt, timestamp string) string {
+	return createdAt + "#" + timestamp
+}
+
+// ListBackups queries created-index, newest first, skipping soft-deleted
+// backups.
+func (s *DynamoStore) ListBackups(ctx context.Context, agentID string, p Page) ([]Backup, string, error) {
+	items, next, err := s.queryPage(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.backupsTable),
+		IndexName:              aws.String(createdIndex),
+		KeyConditionExpression: aws.String("agent_id = :aid"),
+		FilterExpression:       aws.String("attribute_not_exists(deleted_at) OR deleted_at = :empty"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":aid":   &types.AttributeValueMemberS{Value: agentID},
+			":empty": &types.AttributeValueMemberS{Value: ""},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}, p, "agent_id", "created_key", "timestamp")
+	if err != nil {
+		return nil, "", fmt.Errorf("query backups: %w", err)
+	}
+
+	backups := make([]Backup, 0, len(items))
+	for _, item := range items {
+		b, err := unmarshalBackup(item)
+		if err != nil {
+			return nil, "", err
+		}
+		backups = append(backups, *b)
+	}
+	return backups, next, nil
+}
+
+func (s *DynamoStore) CountBackups(ctx context.Context, agentID string) (int, int64, error) {
+	items, err := s.queryBackups(ctx, agentID, false, "encrypted_bytes")
 	if err != nil {
-		return 0, 0, fmt.Errorf("count backups: %w", err)
+		return 0, 0, err
 	}
 
 	var totalBytes int64
-	count := 0
-	for _, item := range out.Items {
-		count++
+	for _, item := range items {
 		if v, ok := item["encrypted_bytes"]; ok {
 			if n, ok := v.(*types.AttributeValueMemberN); ok {
 				b, _ := strconv.ParseInt(n.Value, 10, 64)
@@ -390,11 +1324,46 @@ func (s *DynamoStore) CountBackups(agentID string) (int, int64, error) {
 		}
 	}
 
-	return count, totalBytes, nil
+	return len(items), totalBytes, nil
+}
+
+// queryBackups returns every backup of the agent, soft-deleted ones only
+// with includeDeleted, following pagination. projection "" reads whole
+// items.
+func (s *DynamoStore) queryBackups(ctx context.Context, agentID string, includeDeleted bool, projection string) ([]map[string]types.AttributeValue, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.backupsTable),
+		KeyConditionExpression: aws.String("agent_id = :aid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":aid": &types.AttributeValueMemberS{Value: agentID},
+		},
+		// UpdateUsedBytes must count a backup CreateBackup just committed
+		ConsistentRead: aws.Bool(true),
+	}
+	if !includeDeleted {
+		input.FilterExpression = aws.String("attribute_not_exists(deleted_at) OR deleted_at = :empty")
+		input.ExpressionAttributeValues[":empty"] = &types.AttributeValueMemberS{Value: ""}
+	}
+	if projection != "" {
+		input.ProjectionExpression = aws.String(projection)
+	}
+
+	var items []map[string]types.AttributeValue
+	for {
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("query backups: %w", err)
+		}
+		items = append(items, out.Items...)
+		if len(out.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
 }
 
-func (s *DynamoStore) GetBackup(agentID, timestamp string) (*Backup, error) {
-	out, err := s.client.GetItem(context.Background(), &dynamodb.GetItemInput{
+func (s *DynamoStore) GetBackup(ctx context.Context, agentID, timestamp string) (*Backup, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.backupsTable),
 		Key: map[string]types.AttributeValue{
 			"agent_id":  &types.AttributeValueMemberS{Value: agentID},
@@ -417,9 +1386,9 @@ func (s *DynamoStore) GetBackup(agentID, timestamp string) (*Backup, error) {
 	return b, nil
 }
 
-func (s *DynamoStore) DeleteBackup(agentID, timestamp string) (*Backup, error) {
+func (s *DynamoStore) DeleteBackup(ctx context.Context, agentID, timestamp string) (*Backup, error) {
 	// Get first so we can return the deleted item
-	b, err := s.GetBackup(agentID, timestamp)
+	b, err := s.GetBackup(ctx, agentID, timestamp)
 	if err != nil || b == nil {
 		return nil, err
 	}
@@ -427,7 +1396,7 @@ func (s *DynamoStore) DeleteBackup(agentID, timestamp string) (*Backup, error) {
 	now := time.Now().UTC()
 	graceExpiry := now.Add(time.Duration(s.deleteGraceHours) * time.Hour)
 
-	_, err = s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(s.backupsTable),
 		Key: map[string]types.AttributeValue{
 			"agent_id":  &types.AttributeValueMemberS{Value: agentID},
@@ -443,12 +1412,12 @@ func (s *DynamoStore) DeleteBackup(agentID, timestamp string) (*Backup, error) {
 		return nil, err
 	}
 
-	_ = s.UpdateUsedBytes(agentID)
+	_ = s.UpdateUsedBytes(ctx, agentID)
 	return b, nil
 }
 
-func (s *DynamoStore) DeleteAllBackups(agentID string) ([]Backup, error) {
-	backups, err := s.ListBackups(agentID, 10000)
+func (s *DynamoStore) DeleteAllBackups(ctx context.Context, agentID string) ([]Backup, error) {
+	backups, _, err := s.ListBackups(ctx, agentID, Page{})
 	if err != nil {
 		return nil, err
 	}
@@ -458,7 +1427,7 @@ func (s *DynamoStore) DeleteAllBackups(agentID string) ([]Backup, error) {
 
 	// Soft-delete each backup
 	for _, b := range backups {
-		_, _ = s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+		_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 			TableName: aws.String(s.backupsTable),
 			Key: map[string]types.AttributeValue{
 				"agent_id":  &types.AttributeValueMemberS{Value: b.AgentID},
@@ -470,15 +1439,18 @@ func (s *DynamoStore) DeleteAllBackups(agentID string) ([]Backup, error) {
 				":ea": &types.AttributeValueMemberN{Value: strconv.FormatInt(graceExpiry.Unix(), 10)},
 			},
 		})
+		if err != nil {
+			return nil, fmt.Errorf("soft-delete backup %s: %w", b.Timestamp, err)
+		}
 	}
 
-	_ = s.UpdateUsedBytes(agentID)
+	_ = s.UpdateUsedBytes(ctx, agentID)
 	return backups, nil
 }
 
-func (s *DynamoStore) UndeleteBackup(agentID, timestamp string) error {
+func (s *DynamoStore) UndeleteBackup(ctx context.Context, agentID, timestamp string) error {
 	// Get the raw item (including soft-deleted)
-	out, err := s.client.GetItem(context.Background(), &dynamodb.GetItemInput{
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.backupsTable),
 		Key: map[string]types.AttributeValue{
 			"agent_id":  &types.AttributeValueMemberS{Value: agentID},
@@ -503,7 +1475,7 @@ func (s *DynamoStore) UndeleteBackup(agentID, timestamp string) error {
 
 	// Restore: remove deleted_at, reset expires_at to original retention
 	newExpiry := time.Now().UTC().Add(time.Duration(s.retentionDays*24) * time.Hour)
-	_, err = s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(s.backupsTable),
 		Key: map[string]types.AttributeValue{
 			"agent_id":  &types.AttributeValueMemberS{Value: agentID},
@@ -518,168 +1490,1399 @@ func (s *DynamoStore) UndeleteBackup(agentID, timestamp string) error {
 		return err
 	}
 
-	_ = s.UpdateUsedBytes(agentID)
+	_ = s.UpdateUsedBytes(ctx, agentID)
 	return nil
 }
 
-// ---------------------------------------------------------------------------
-// Invite code operations
-// ---------------------------------------------------------------------------
+func (s *DynamoStore) PutBackup(ctx context.Context, b *Backup) error {
+	createdAt := b.CreatedAt.UTC()
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
 
-func (s *DynamoStore) CreateInviteCode(code *InviteCode) error {
-	item := dynamoInviteCode{
-		ID:        "INVITE#" + code.Code,
-		ItemType:  "invite_code",
-		Code:      code.Code,
-		MaxUses:   code.MaxUses,
-		UseCount:  0,
-		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	item := dynamoBackup{
+		AgentID:         b.AgentID,
+		Timestamp:       b.Timestamp,
+		EncryptedBytes:  b.EncryptedBytes,
+		SourceFileCount: b.SourceFileCount,
+		EncryptedSHA256: b.EncryptedSHA256,
+		S3Key:           b.S3Key,
+		ManifestS3Key:   b.ManifestS3Key,
+		CreatedAt:       createdAt.Format(time.RFC3339),
+		CreatedKey:      backupCreatedKey(createdAt.Format(time.RFC3339), b.Timestamp),
+		ExpiresAt:       createdAt.Add(time.Duration(s.retentionDays*24) * time.Hour).Unix(),
 	}
-	if code.ExpiresAt != nil {
-		epoch := code.ExpiresAt.Unix()
-		item.ExpiresAt = &epoch
+	if b.DeletedAt != nil {
+		item.DeletedAt = b.DeletedAt.UTC().Format(time.RFC3339)
+		item.ExpiresAt = b.DeletedAt.Add(time.Duration(s.deleteGraceHours) * time.Hour).Unix()
 	}
 
 	av, err := attributevalue.MarshalMap(item)
 	if err != nil {
-		return fmt.Errorf("marshal invite code: %w", err)
+		return fmt.Errorf("marshal backup: %w", err)
 	}
 
-	_, err = s.client.PutItem(context.Background(), &dynamodb.PutItemInput{
-		TableName: aws.String(s.agentsTable),
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.backupsTable),
 		Item:      av,
 	})
 	return err
 }
 
-func (s *DynamoStore) UseInviteCode(code string) (bool, error) {
-	key := "INVITE#" + code
-
-	// First, fetch the item to check validity
-	out, err := s.client.GetItem(context.Background(), &dynamodb.GetItemInput{
-		TableName: aws.String(s.agentsTable),
+func (s *DynamoStore) PurgeBackup(ctx context.Context, agentID, timestamp string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.backupsTable),
 		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: key},
+			"agent_id":  &types.AttributeValueMemberS{Value: agentID},
+			"timestamp": &types.AttributeValueMemberS{Value: timestamp},
 		},
 	})
-	if err != nil {
-		return false, fmt.Errorf("get invite code: %w", err)
-	}
-	if out.Item == nil {
-		return false, nil
-	}
-
-	var ic dynamoInviteCode
-	if err := attributevalue.UnmarshalMap(out.Item, &ic); err != nil {
-		return false, fmt.Errorf("unmarshal invite code: %w", err)
-	}
-
-	// Check revoked
-	if ic.RevokedAt != "" {
-		return false, nil
-	}
+	return err
+}
 
-	// Check expiry
-	if ic.ExpiresAt != nil && time.Now().Unix() > *ic.ExpiresAt {
-		return false, nil
+// backupsCreatedSince returns the created_at of the agent's live backups
+// created at or after since, an RFC 3339 time.
+func (s *DynamoStore) backupsCreatedSince(ctx context.Context, agentID, since string) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.backupsTable),
+		IndexName:              aws.String(createdIndex),
+		KeyConditionExpression: aws.String("agent_id = :aid AND created_key >= :since"),
+		FilterExpression:       aws.String("attribute_not_exists(deleted_at) OR deleted_at = :empty"),
+		ProjectionExpression:   aws.String("created_at"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":aid":   &types.AttributeValueMemberS{Value: agentID},
+			":since": &types.AttributeValueMemberS{Value: since},
+			":empty": &types.AttributeValueMemberS{Value: ""},
+		},
+	}
+	var created []string
+	for {
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("query backups: %w", err)
+		}
+		var page []struct {
+			CreatedAt string `dynamodbav:"created_at"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("unmarshal backups: %w", err)
+		}
+		for _, b := range page {
+			created = append(created, b.CreatedAt)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return created, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// LatestBackupTimes reads each agent's newest backup from created-index, one
+// item per agent.
+func (s *DynamoStore) LatestBackupTimes(ctx context.Context) (map[string]time.Time, error) {
+	agentsInput := &dynamodb.QueryInput{
+		TableName:              aws.String(s.agentsTable),
+		IndexName:              aws.String(itemTypeIndex),
+		KeyConditionExpression: aws.String("item_type = :t"),
+		ProjectionExpression:   aws.String("id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: "agent"},
+		},
+	}
+	var agentIDs []string
+	for {
+		out, err := s.client.Query(ctx, agentsInput)
+		if err != nil {
+			return nil, fmt.Errorf("query agents: %w", err)
+		}
+		for _, item := range out.Items {
+			if id, ok := item["id"].(*types.AttributeValueMemberS); ok {
+				agentIDs = append(agentIDs, id.Value)
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		agentsInput.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	times := make(map[string]time.Time, len(agentIDs))
+	for _, agentID := range agentIDs {
+		out, err := s.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(s.backupsTable),
+			IndexName:              aws.String(createdIndex),
+			KeyConditionExpression: aws.String("agent_id = :aid"),
+			ProjectionExpression:   aws.String("created_at"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":aid": &types.AttributeValueMemberS{Value: agentID},
+			},
+			ScanIndexForward: aws.Bool(false),
+			Limit:            aws.Int32(1),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("query latest backup: %w", err)
+		}
+		if len(out.Items) == 0 {
+			continue
+		}
+		var b struct {
+			CreatedAt string `dynamodbav:"created_at"`
+		}
+		if err := attributevalue.UnmarshalMap(out.Items[0], &b); err != nil {
+			return nil, fmt.Errorf("unmarshal backup: %w", err)
+		}
+		times[agentID], _ = time.Parse(time.RFC3339, b.CreatedAt)
+	}
+	return times, nil
+}
+
+func (s *DynamoStore) ListAllBackups(ctx context.Context, agentID string) ([]Backup, error) {
+	items, err := s.queryBackups(ctx, agentID, true, "")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, 0, len(items))
+	for _, item := range items {
+		b, err := unmarshalBackup(item)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, *b)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if !backups[i].CreatedAt.Equal(backups[j].CreatedAt) {
+			return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+		}
+		return backups[i].Timestamp < backups[j].Timestamp
+	})
+	return backups, nil
+}
+
+// ---------------------------------------------------------------------------
+// Backup transfer operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) PutTransfer(ctx context.Context, t *BackupTransfer) error {
+	now := time.Now().UTC()
+	createdAt := t.CreatedAt.UTC()
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+
+	item := dynamoTransfer{
+		ID:            "TRANSFER#" + t.ID,
+		ItemType:      "transfer",
+		TransferID:    t.ID,
+		SourceAgentID: t.SourceAgentID,
+		TargetAgentID: t.TargetAgentID,
+		Mode:          t.Mode,
+		Status:        t.Status,
+		TotalCount:    t.TotalCount,
+		DoneCount:     t.DoneCount,
+		Error:         t.Error,
+		CreatedAt:     createdAt.Format(time.RFC3339),
+		UpdatedAt:     now.Format(time.RFC3339),
+	}
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("marshal transfer: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.agentsTable),
+		Item:      av,
+	})
+	return err
+}
+
+func (s *DynamoStore) GetTransfer(ctx context.Context, id string) (*BackupTransfer, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "TRANSFER#" + id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get transfer: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var dt dynamoTransfer
+	if err := attributevalue.UnmarshalMap(out.Item, &dt); err != nil {
+		return nil, fmt.Errorf("unmarshal transfer: %w", err)
+	}
+
+	t := &BackupTransfer{
+		ID:            dt.TransferID,
+		SourceAgentID: dt.SourceAgentID,
+		TargetAgentID: dt.TargetAgentID,
+		Mode:          dt.Mode,
+		Status:        dt.Status,
+		TotalCount:    dt.TotalCount,
+		DoneCount:     dt.DoneCount,
+		Error:         dt.Error,
+	}
+	t.CreatedAt, _ = time.Parse(time.RFC3339, dt.CreatedAt)
+	t.UpdatedAt, _ = time.Parse(time.RFC3339, dt.UpdatedAt)
+	return t, nil
+}
+
+// ---------------------------------------------------------------------------
+// Invite code operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) CreateInviteCode(ctx context.Context, code *InviteCode) error {
+	av, err := marshalInviteCode(code)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.agentsTable),
+		Item:      av,
+	})
+	return err
+}
+
+// CreateInviteCodes writes codes in one transaction, which holds at most
+// 100 items.
+func (s *DynamoStore) CreateInviteCodes(ctx context.Context, codes []*InviteCode) error {
+	items := make([]types.TransactWriteItem, 0, len(codes))
+	for _, code := range codes {
+		av, err := marshalInviteCode(code)
+		if err != nil {
+			return err
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:           aws.String(s.agentsTable),
+				Item:                av,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+	if _, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		return fmt.Errorf("create invite codes: %w", err)
+	}
+	return nil
+}
+
+func marshalInviteCode(code *InviteCode) (map[string]types.AttributeValue, error) {
+	item := dynamoInviteCode{
+		ID:        "INVITE#" + code.Code,
+		ItemType:  "invite_code",
+		Code:      code.Code,
+		MaxUses:   code.MaxUses,
+		UseCount:  code.UseCount,
+		CreatedAt: creationTime(code.CreatedAt).Format(time.RFC3339),
+
+		Plan:            code.Plan,
+		QuotaBytes:      code.QuotaBytes,
+		Tags:            code.Tags,
+		HostnamePattern: code.HostnamePattern,
+		OrgID:           code.OrgID,
+	}
+	if code.ExpiresAt != nil {
+		epoch := code.ExpiresAt.Unix()
+		item.ExpiresAt = &epoch
+	}
+	if code.RevokedAt != nil {
+		item.RevokedAt = code.RevokedAt.UTC().Format(time.RFC3339)
+	}
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return nil, fmt.Errorf("marshal invite code: %w", err)
+	}
+	return av, nil
+}
+
+func (s *DynamoStore) GetInviteCode(ctx context.Context, code string) (*InviteCode, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "INVITE#" + code},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get invite code: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	return unmarshalInviteCode(out.Item)
+}
+
+// UseInviteCode checks and increments the use count in one conditional
+// update, so concurrent uses of a limited code succeed until it runs out.
+func (s *DynamoStore) UseInviteCode(ctx context.Context, code string) (bool, error) {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "INVITE#" + code},
+		},
+		UpdateExpression: aws.String("SET use_count = use_count + :inc"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(revoked_at)" +
+			" AND (attribute_not_exists(expires_at_epoch) OR expires_at_epoch >= :now)" +
+			" AND (max_uses = :unlimited OR use_count < max_uses)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inc":       &types.AttributeValueMemberN{Value: "1"},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			":unlimited": &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	if err != nil {
+		// The code is missing, revoked, expired or used up
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return false, nil
+		}
+		return false, fmt.Errorf("update invite code use_count: %w", err)
+	}
+
+	return true, nil
+}
+
+// ListInviteCodes queries item-type-index, newest first; codes created in
+// the same second come in index order.
+func (s *DynamoStore) ListInviteCodes(ctx context.Context, p Page) ([]InviteCode, string, error) {
+	items, next, err := s.queryPage(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.agentsTable),
+		IndexName:              aws.String(itemTypeIndex),
+		KeyConditionExpression: aws.String("item_type = :t"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: "invite_code"},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}, p, "item_type", "created_at", "id")
+	if err != nil {
+		return nil, "", fmt.Errorf("query invite codes: %w", err)
+	}
+
+	codes := make([]InviteCode, 0, len(items))
+	for _, item := range items {
+		ic, err := unmarshalInviteCode(item)
+		if err != nil {
+			return nil, "", err
+		}
+		codes = append(codes, *ic)
+	}
+	return codes, next, nil
+}
+
+func (s *DynamoStore) RevokeInviteCode(ctx context.Context, code string) error {
+	key := "INVITE#" + code
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression:    aws.String("SET revoked_at = :ra"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(revoked_at)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":ra": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("revoke invite code %s: %w", code, err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) RecordInviteRedemption(ctx context.Context, r *InviteRedemption) error {
+	redeemedAt := r.RedeemedAt
+	if redeemedAt.IsZero() {
+		redeemedAt = time.Now().UTC()
+	}
+	av, err := attributevalue.MarshalMap(dynamoRedemption{
+		Code:       r.Code,
+		AgentID:    r.AgentID,
+		IP:         r.IP,
+		RedeemedAt: redeemedAt.Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal redemption: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.redemptionsTable),
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("put redemption: %w", err)
+	}
+	return nil
+}
+
+// ListInviteRedemptions queries redeemed-index, oldest first; redemptions
+// of the same second come in index order.
+func (s *DynamoStore) ListInviteRedemptions(ctx context.Context, code string, p Page) ([]InviteRedemption, string, error) {
+	items, next, err := s.queryPage(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.redemptionsTable),
+		IndexName:              aws.String(redeemedIndex),
+		KeyConditionExpression: aws.String("code = :code"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":code": &types.AttributeValueMemberS{Value: code},
+		},
+	}, p, "code", "redeemed_at", "agent_id")
+	if err != nil {
+		return nil, "", fmt.Errorf("query redemptions: %w", err)
+	}
+
+	redemptions := make([]InviteRedemption, 0, len(items))
+	for _, item := range items {
+		var dr dynamoRedemption
+		if err := attributevalue.UnmarshalMap(item, &dr); err != nil {
+			return nil, "", fmt.Errorf("unmarshal redemption: %w", err)
+		}
+		redeemedAt, _ := time.Parse(time.RFC3339, dr.RedeemedAt)
+		redemptions = append(redemptions, InviteRedemption{
+			Code:       dr.Code,
+			AgentID:    dr.AgentID,
+			IP:         dr.IP,
+			RedeemedAt: redeemedAt,
+		})
+	}
+	return redemptions, next, nil
+}
+
+// ---------------------------------------------------------------------------
+// Organization operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) CreateOrg(ctx context.Context, o *Organization) error {
+	av, err := attributevalue.MarshalMap(dynamoOrg{
+		ID:         "ORG#" + o.ID,
+		ItemType:   "org",
+		OrgID:      o.ID,
+		Name:       o.Name,
+		QuotaBytes: o.QuotaBytes,
+		CreatedAt:  creationTime(o.CreatedAt).Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal org: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.agentsTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("put org: %w", err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) GetOrg(ctx context.Context, id string) (*Organization, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "ORG#" + id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get org: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	return unmarshalOrg(out.Item)
+}
+
+func (s *DynamoStore) ListOrgs(ctx context.Context) ([]Organization, error) {
+	items, err := s.queryItemType(ctx, "org")
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := make([]Organization, 0, len(items))
+	for _, item := range items {
+		o, err := unmarshalOrg(item)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, *o)
+	}
+	sort.SliceStable(orgs, func(i, j int) bool {
+		return orgs[i].CreatedAt.Before(orgs[j].CreatedAt)
+	})
+	return orgs, nil
+}
+
+func (s *DynamoStore) CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) error {
+	av, err := attributevalue.MarshalMap(dynamoOrgAPIKey{
+		ID:        "ORGKEY#" + k.KeyHash,
+		ItemType:  "org_key",
+		KeyID:     k.ID,
+		OrgID:     k.OrgID,
+		KeyHash:   k.KeyHash,
+		Name:      k.Name,
+		CreatedAt: creationTime(k.CreatedAt).Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal org API key: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.agentsTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("put org API key: %w", err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) LookupOrgAPIKey(ctx context.Context, keyHash string) (*OrgAPIKey, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "ORGKEY#" + keyHash},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get org API key: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	return unmarshalOrgAPIKey(out.Item)
+}
+
+func (s *DynamoStore) ListOrgAPIKeys(ctx context.Context, orgID string) ([]OrgAPIKey, error) {
+	items, err := s.queryItemType(ctx, "org_key")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []OrgAPIKey
+	for _, item := range items {
+		k, err := unmarshalOrgAPIKey(item)
+		if err != nil {
+			return nil, err
+		}
+		if k.OrgID == orgID {
+			keys = append(keys, *k)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (s *DynamoStore) DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) error {
+	// Items are keyed by hash, so resolve the public key ID first
+	keys, err := s.ListOrgAPIKeys(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.ID != keyID {
+			continue
+		}
+		_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(s.agentsTable),
+			Key: map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{Value: "ORGKEY#" + k.KeyHash},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("delete org API key %s: %w", keyID, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("org API key not found: %s", keyID)
+}
+
+// queryItemType returns every item of one item_type in the agents table
+// from item-type-index, oldest first.
+func (s *DynamoStore) queryItemType(ctx context.Context, itemType string) ([]map[string]types.AttributeValue, error) {
+	items, _, err := s.queryPage(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.agentsTable),
+		IndexName:              aws.String(itemTypeIndex),
+		KeyConditionExpression: aws.String("item_type = :t"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: itemType},
+		},
+	}, Page{})
+	if err != nil {
+		return nil, fmt.Errorf("query %s items: %w", itemType, err)
+	}
+	return items, nil
+}
+
+// queryPage runs input from the cursor of p, following LastEvaluatedKey
+// until it has p.Limit items or reaches the end, and returns them with the
+// cursor of the next page, "" after the last. keys are the key attributes
+// of the table or index queried; the cursor holds them as the
+// ExclusiveStartKey of the next page.
+func (s *DynamoStore) queryPage(ctx context.Context, input *dynamodb.QueryInput, p Page, keys ...string) ([]map[string]types.AttributeValue, string, error) {
+	if p.Cursor != "" {
+		var start map[string]string
+		if err := decodeCursor(p.Cursor, &start); err != nil || len(start) != len(keys) {
+			return nil, "", ErrInvalidCursor
+		}
+		input.ExclusiveStartKey = map[string]types.AttributeValue{}
+		for _, k := range keys {
+			v, ok := start[k]
+			if !ok {
+				return nil, "", ErrInvalidCursor
+			}
+			input.ExclusiveStartKey[k] = &types.AttributeValueMemberS{Value: v}
+		}
+	}
+	if p.Limit > 0 {
+		input.Limit = aws.Int32(int32(p.Limit + 1)) // one more tells whether there is a next page
+	}
+
+	var items []map[string]types.AttributeValue
+	for {
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, out.Items...)
+		if p.Limit > 0 && len(items) > p.Limit {
+			items = items[:p.Limit]
+			next := map[string]string{}
+			for _, k := range keys {
+				if v, ok := items[p.Limit-1][k].(*types.AttributeValueMemberS); ok {
+					next[k] = v.Value
+				}
+			}
+			return items, encodeCursor(next), nil
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return items, "", nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Ban operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) CreateBan(ctx context.Context, b *Ban) error {
+	av, err := attributevalue.MarshalMap(dynamoBan{
+		ID:        "BAN#" + b.ID,
+		ItemType:  "ban",
+		BanID:     b.ID,
+		Kind:      b.Kind,
+		Value:     b.Value,
+		Reason:    b.Reason,
+		CreatedAt: creationTime(b.CreatedAt).Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal ban: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.agentsTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("put ban: %w", err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) ListBans(ctx context.Context) ([]Ban, error) {
+	items, err := s.queryItemType(ctx, "ban")
+	if err != nil {
+		return nil, err
+	}
+
+	var bans []Ban
+	for _, item := range items {
+		var dban dynamoBan
+		if err := attributevalue.UnmarshalMap(item, &dban); err != nil {
+			return nil, fmt.Errorf("unmarshal ban: %w", err)
+		}
+		createdAt, _ := time.Parse(time.RFC3339, dban.CreatedAt)
+		bans = append(bans, Ban{
+			ID:        dban.BanID,
+			Kind:      dban.Kind,
+			Value:     dban.Value,
+			Reason:    dban.Reason,
+			CreatedAt: createdAt,
+		})
 	}
 
-	// Check max uses (0 = unlimited)
-	if ic.MaxUses > 0 && ic.UseCount >= ic.MaxUses {
-		return false, nil
+	sort.SliceStable(bans, func(i, j int) bool {
+		return bans[i].CreatedAt.Before(bans[j].CreatedAt)
+	})
+	return bans, nil
+}
+
+func (s *DynamoStore) DeleteBan(ctx context.Context, id string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "BAN#" + id},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("delete ban %s: %w", id, err)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Auto-approval rule operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) CreateApprovalRule(ctx context.Context, r *ApprovalRule) error {
+	av, err := attributevalue.MarshalMap(dynamoApprovalRule{
+		ID:            "RULE#" + r.ID,
+		ItemType:      "approval_rule",
+		RuleID:        r.ID,
+		Name:          r.Name,
+		Priority:      r.Priority,
+		SourceCIDRs:   r.SourceCIDRs,
+		HostnameRegex: r.HostnameRegex,
+		OS:            r.OS,
+		Arch:          r.Arch,
+		MinVersion:    r.MinVersion,
+		MaxVersion:    r.MaxVersion,
+		Fingerprints:  r.Fingerprints,
+		Approve:       r.Approve,
+		Plan:          r.Plan,
+		CreatedAt:     creationTime(r.CreatedAt).Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal approval rule: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.agentsTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("put approval rule: %w", err)
 	}
+	return nil
+}
 
-	// Atomic increment with condition: use_count must still be same value (optimistic lock)
-	// Also re-check max_uses and expiry in condition
-	condExpr := "attribute_exists(id) AND attribute_not_exists(revoked_at)"
-	exprAttrValues := map[string]types.AttributeValue{
-		":inc":      &types.AttributeValueMemberN{Value: "1"},
-		":cur":      &types.AttributeValueMemberN{Value: strconv.Itoa(ic.UseCount)},
+func (s *DynamoStore) ListApprovalRules(ctx context.Context) ([]ApprovalRule, error) {
+	items, err := s.queryItemType(ctx, "approval_rule")
+	if err != nil {
+		return nil, err
 	}
 
-	if ic.MaxUses > 0 {
-		condExpr += " AND use_count = :cur"
+	var rules []ApprovalRule
+	for _, item := range items {
+		var dr dynamoApprovalRule
+		if err := attributevalue.UnmarshalMap(item, &dr); err != nil {
+			return nil, fmt.Errorf("unmarshal approval rule: %w", err)
+		}
+		createdAt, _ := time.Parse(time.RFC3339, dr.CreatedAt)
+		rules = append(rules, ApprovalRule{
+			ID:            dr.RuleID,
+			Name:          dr.Name,
+			Priority:      dr.Priority,
+			SourceCIDRs:   dr.SourceCIDRs,
+			HostnameRegex: dr.HostnameRegex,
+			OS:            dr.OS,
+			Arch:          dr.Arch,
+			MinVersion:    dr.MinVersion,
+			MaxVersion:    dr.MaxVersion,
+			Fingerprints:  dr.Fingerprints,
+			Approve:       dr.Approve,
+			Plan:          dr.Plan,
+			CreatedAt:     createdAt,
+		})
 	}
 
-	_, err = s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules, nil
+}
+
+func (s *DynamoStore) DeleteApprovalRule(ctx context.Context, id string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: key},
+			"id": &types.AttributeValueMemberS{Value: "RULE#" + id},
 		},
-		UpdateExpression:    aws.String("SET use_count = use_count + :inc"),
-		ConditionExpression: aws.String(condExpr),
-		ExpressionAttributeValues: exprAttrValues,
+		ConditionExpression: aws.String("attribute_exists(id)"),
 	})
 	if err != nil {
-		// ConditionalCheckFailedException means the code was used concurrently
-		var ccfe *types.ConditionalCheckFailedException
-		if errors.As(err, &ccfe) {
-			return false, nil
-		}
-		return false, fmt.Errorf("update invite code use_count: %w", err)
+		return fmt.Errorf("delete approval rule %s: %w", id, err)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Recovery code operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) error {
+	item := dynamoRecoveryCode{
+		ID:        "RECOVERY#" + rc.CodeHash,
+		ItemType:  "recovery_code",
+		AgentID:   rc.AgentID,
+		ExpiresAt: rc.ExpiresAt.Unix(),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
 	}
 
-	return true, nil
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("marshal recovery code: %w", err)
+	}
+
+	// Write the code and point the agent at it in one transaction
+	_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName: aws.String(s.agentsTable),
+					Item:      av,
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.agentsTable),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: rc.AgentID},
+					},
+					UpdateExpression:    aws.String("SET recovery_hash = :rh"),
+					ConditionExpression: aws.String("attribute_exists(id)"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":rh": &types.AttributeValueMemberS{Value: rc.CodeHash},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create recovery code: %w", err)
+	}
+	return nil
 }
 
-func (s *DynamoStore) ListInviteCodes() ([]InviteCode, error) {
-	out, err := s.client.Scan(context.Background(), &dynamodb.ScanInput{
-		TableName:        aws.String(s.agentsTable),
-		FilterExpression: aws.String("item_type = :t"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":t": &types.AttributeValueMemberS{Value: "invite_code"},
+func (s *DynamoStore) UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (*Agent, error) {
+	key := "RECOVERY#" + codeHash
+
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: key},
 		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("scan invite codes: %w", err)
+		return nil, fmt.Errorf("get recovery code: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
 	}
 
-	codes := make([]InviteCode, 0, len(out.Items))
-	for _, item := range out.Items {
-		var ic dynamoInviteCode
-		if err := attributevalue.UnmarshalMap(item, &ic); err != nil {
-			return nil, fmt.Errorf("unmarshal invite code: %w", err)
-		}
-		result := InviteCode{
-			Code:     ic.Code,
-			MaxUses:  ic.MaxUses,
-			UseCount: ic.UseCount,
-		}
-		result.CreatedAt, _ = time.Parse(time.RFC3339, ic.CreatedAt)
-		if ic.ExpiresAt != nil {
-			t := time.Unix(*ic.ExpiresAt, 0).UTC()
-			result.ExpiresAt = &t
+	var rc dynamoRecoveryCode
+	if err := attributevalue.UnmarshalMap(out.Item, &rc); err != nil {
+		return nil, fmt.Errorf("unmarshal recovery code: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if rc.UsedAt != "" || now.Unix() > rc.ExpiresAt {
+		return nil, nil
+	}
+
+	// Consume the code and swap the token hash atomically. The conditions
+	// guard against concurrent use and against codes superseded by a newer one.
+	_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.agentsTable),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: key},
+					},
+					UpdateExpression:    aws.String("SET used_at = :ua"),
+					ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(used_at)"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":ua": &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+					},
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName: aws.String(s.agentsTable),
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: rc.AgentID},
+					},
+					UpdateExpression:    aws.String("SET token_hash = :th REMOVE recovery_hash"),
+					ConditionExpression: aws.String("recovery_hash = :rh"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":th": &types.AttributeValueMemberS{Value: newTokenHash},
+						":rh": &types.AttributeValueMemberS{Value: codeHash},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return nil, nil
 		}
-		if ic.RevokedAt != "" {
-			t, err := time.Parse(time.RFC3339, ic.RevokedAt)
-			if err == nil {
-				result.RevokedAt = &t
-			}
+		return nil, fmt.Errorf("use recovery code: %w", err)
+	}
+
+	return s.GetAgent(ctx, rc.AgentID)
+}
+
+// ---------------------------------------------------------------------------
+// Audit log
+// ---------------------------------------------------------------------------
+
+// auditKeyLayout is a fixed-width UTC layout, so event keys sort by time.
+const auditKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// auditNoAgent is the partition of events that concern no agent.
+const auditNoAgent = "-"
+
+func (s *DynamoStore) AppendAuditEvent(ctx context.Context, e *AuditEvent) error {
+	createdAt := e.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	item := dynamoAuditEvent{
+		AgentID:   e.AgentID,
+		EventKey:  createdAt.UTC().Format(auditKeyLayout) + "#" + e.ID,
+		ItemType:  "audit_event",
+		EventID:   e.ID,
+		Action:    e.Action,
+		Actor:     e.Actor,
+		Target:    e.Target,
+		IP:        e.IP,
+		RequestID: e.RequestID,
+		Before:    string(e.Before),
+		After:     string(e.After),
+		CreatedAt: createdAt.UTC().Format(time.RFC3339Nano),
+	}
+	if item.AgentID == "" {
+		item.AgentID = auditNoAgent
+	}
+	if e.ExpiresAt != nil {
+		item.ExpiresAt = e.ExpiresAt.Unix()
+	}
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("marshal audit event: %w", err)
+	}
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.auditTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(event_key)"),
+	})
+	if err != nil {
+		return fmt.Errorf("put audit event: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEvents queries one agent's partition when f.AgentID is set and
+// item-type-index otherwise, newest first either way. DynamoDB deletes
+// expired items lazily, so they are also filtered out here.
+func (s *DynamoStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, string, error) {
+	filter := []string{"(attribute_not_exists(expires_at) OR expires_at > :now)"}
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	if f.Action != "" {
+		filter = append(filter, "#action = :action")
+		names["#action"] = "action"
+		values[":action"] = &types.AttributeValueMemberS{Value: f.Action}
+	}
+	since := ""
+	if !f.Since.IsZero() {
+		since = f.Since.UTC().Format(auditKeyLayout)
+		values[":since"] = &types.AttributeValueMemberS{Value: since}
+	}
+	if len(names) == 0 {
+		names = nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.auditTable),
+		KeyConditionExpression:    aws.String("agent_id = :agent"),
+		FilterExpression:          aws.String(strings.Join(filter, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+	}
+	keys := []string{"agent_id", "event_key"}
+	if f.AgentID != "" {
+		values[":agent"] = &types.AttributeValueMemberS{Value: f.AgentID}
+	} else {
+		input.IndexName = aws.String(itemTypeIndex)
+		input.KeyConditionExpression = aws.String("item_type = :t")
+		values[":t"] = &types.AttributeValueMemberS{Value: "audit_event"}
+		keys = append(keys, "item_type")
+	}
+	if since != "" {
+		input.KeyConditionExpression = aws.String(*input.KeyConditionExpression + " AND event_key >= :since")
+	}
+	items, next, err := s.queryPage(ctx, input, f.Page, keys...)
+	if err != nil {
+		return nil, "", fmt.Errorf("query audit events: %w", err)
+	}
+
+	events := make([]AuditEvent, 0, len(items))
+	for _, item := range items {
+		var de dynamoAuditEvent
+		if err := attributevalue.UnmarshalMap(item, &de); err != nil {
+			return nil, "", fmt.Errorf("unmarshal audit event: %w", err)
 		}
-		codes = append(codes, result)
+		events = append(events, auditEventFromDynamo(de))
 	}
-	return codes, nil
+	return events, next, nil
 }
 
-func (s *DynamoStore) RevokeInviteCode(code string) error {
-	key := "INVITE#" + code
-	_, err := s.client.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+func auditEventFromDynamo(de dynamoAuditEvent) AuditEvent {
+	e := AuditEvent{
+		ID:        de.EventID,
+		Action:    de.Action,
+		Actor:     de.Actor,
+		AgentID:   de.AgentID,
+		Target:    de.Target,
+		IP:        de.IP,
+		RequestID: de.RequestID,
+	}
+	if e.AgentID == auditNoAgent {
+		e.AgentID = ""
+	}
+	if de.Before != "" {
+		e.Before = json.RawMessage(de.Before)
+	}
+	if de.After != "" {
+		e.After = json.RawMessage(de.After)
+	}
+	e.CreatedAt, _ = time.Parse(time.RFC3339Nano, de.CreatedAt)
+	if de.ExpiresAt != 0 {
+		t := time.Unix(de.ExpiresAt, 0).UTC()
+		e.ExpiresAt = &t
+	}
+	return e
+}
+
+// ---------------------------------------------------------------------------
+// Webhook operations
+// ---------------------------------------------------------------------------
+
+func (s *DynamoStore) CreateWebhook(ctx context.Context, wh *Webhook) error {
+	av, err := attributevalue.MarshalMap(dynamoWebhook{
+		ID:        "WEBHOOK#" + wh.ID,
+		ItemType:  "webhook",
+		WebhookID: wh.ID,
+		URL:       wh.URL,
+		Secret:    wh.Secret,
+		Events:    wh.Events,
+		CreatedAt: creationTime(wh.CreatedAt).Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal webhook: %w", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.agentsTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("put webhook: %w", err)
+	}
+	return nil
+}
+
+func webhookFromDynamo(dw dynamoWebhook) Webhook {
+	createdAt, _ := time.Parse(time.RFC3339, dw.CreatedAt)
+	return Webhook{
+		ID:        dw.WebhookID,
+		URL:       dw.URL,
+		Secret:    dw.Secret,
+		Events:    dw.Events,
+		CreatedAt: createdAt,
+	}
+}
+
+func (s *DynamoStore) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(s.agentsTable),
 		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: key},
+			"id": &types.AttributeValueMemberS{Value: "WEBHOOK#" + id},
 		},
-		UpdateExpression:    aws.String("SET revoked_at = :ra"),
-		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(revoked_at)"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":ra": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get webhook: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var dw dynamoWebhook
+	if err := attributevalue.UnmarshalMap(out.Item, &dw); err != nil {
+		return nil, fmt.Errorf("unmarshal webhook: %w", err)
+	}
+	wh := webhookFromDynamo(dw)
+	return &wh, nil
+}
+
+func (s *DynamoStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	items, err := s.queryItemType(ctx, "webhook")
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks []Webhook
+	for _, item := range items {
+		var dw dynamoWebhook
+		if err := attributevalue.UnmarshalMap(item, &dw); err != nil {
+			return nil, fmt.Errorf("unmarshal webhook: %w", err)
+		}
+		webhooks = append(webhooks, webhookFromDynamo(dw))
+	}
+
+	sort.SliceStable(webhooks, func(i, j int) bool {
+		return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+	})
+	return webhooks, nil
+}
+
+// DeleteWebhook removes the subscription. Its delivery log expires with the
+// table's TTL.
+func (s *DynamoStore) DeleteWebhook(ctx context.Context, id string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.agentsTable),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: "WEBHOOK#" + id},
 		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
 	})
 	if err != nil {
-		return fmt.Errorf("revoke invite code %s: %w", code, err)
+		return fmt.Errorf("delete webhook %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *DynamoStore) PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	item := dynamoWebhookDelivery{
+		WebhookID:    d.WebhookID,
+		DeliveryKey:  d.CreatedAt.UTC().Format(auditKeyLayout) + "#" + d.ID,
+		ItemType:     "webhook_delivery",
+		DeliveryID:   d.ID,
+		EventID:      d.EventID,
+		EventType:    d.EventType,
+		Payload:      string(d.Payload),
+		Status:       d.Status,
+		Attempts:     d.Attempts,
+		ResponseCode: d.ResponseCode,
+		Error:        d.Error,
+		CreatedAt:    d.CreatedAt.UTC().Format(time.RFC3339Nano),
+		UpdatedAt:    d.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		ExpiresAt:    d.CreatedAt.Add(webhookDeliveryRetention).Unix(),
+	}
+	if d.NextAttemptAt != nil {
+		item.NextAttemptAt = d.NextAttemptAt.UTC().Format(auditKeyLayout)
+	}
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("marshal webhook delivery: %w", err)
+	}
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.deliveriesTable),
+		Item:      av,
+	})
+	if err != nil {
+		return fmt.Errorf("put webhook delivery: %w", err)
 	}
 	return nil
 }
 
+// ListWebhookDeliveries queries one webhook's partition when f.WebhookID is
+// set and item-type-index otherwise, newest first either way.
+func (s *DynamoStore) ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) ([]WebhookDelivery, string, error) {
+	var filter []string
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	if f.Status != "" {
+		filter = append(filter, "#s = :s")
+		names["#s"] = "status"
+		values[":s"] = &types.AttributeValueMemberS{Value: f.Status}
+	}
+	if !f.DueBefore.IsZero() {
+		filter = append(filter, "#s = :pending AND next_attempt_at <= :due")
+		names["#s"] = "status"
+		values[":pending"] = &types.AttributeValueMemberS{Value: "pending"}
+		values[":due"] = &types.AttributeValueMemberS{Value: f.DueBefore.UTC().Format(auditKeyLayout)}
+	}
+	if len(names) == 0 {
+		names = nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.deliveriesTable),
+		KeyConditionExpression:    aws.String("webhook_id = :wh"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+	}
+	if len(filter) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filter, " AND "))
+	}
+	keys := []string{"webhook_id", "delivery_key"}
+	if f.WebhookID != "" {
+		values[":wh"] = &types.AttributeValueMemberS{Value: f.WebhookID}
+	} else {
+		input.IndexName = aws.String(itemTypeIndex)
+		input.KeyConditionExpression = aws.String("item_type = :t")
+		values[":t"] = &types.AttributeValueMemberS{Value: "webhook_delivery"}
+		keys = append(keys, "item_type")
+	}
+	items, next, err := s.queryPage(ctx, input, f.Page, keys...)
+	if err != nil {
+		return nil, "", fmt.Errorf("query webhook deliveries: %w", err)
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(items))
+	for _, item := range items {
+		var dd dynamoWebhookDelivery
+		if err := attributevalue.UnmarshalMap(item, &dd); err != nil {
+			return nil, "", fmt.Errorf("unmarshal webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, webhookDeliveryFromDynamo(dd))
+	}
+	return deliveries, next, nil
+}
+
+func webhookDeliveryFromDynamo(dd dynamoWebhookDelivery) WebhookDelivery {
+	d := WebhookDelivery{
+		ID:           dd.DeliveryID,
+		WebhookID:    dd.WebhookID,
+		EventID:      dd.EventID,
+		EventType:    dd.EventType,
+		Payload:      json.RawMessage(dd.Payload),
+		Status:       dd.Status,
+		Attempts:     dd.Attempts,
+		ResponseCode: dd.ResponseCode,
+		Error:        dd.Error,
+	}
+	if dd.NextAttemptAt != "" {
+		t, _ := time.Parse(auditKeyLayout, dd.NextAttemptAt)
+		d.NextAttemptAt = &t
+	}
+	d.CreatedAt, _ = time.Parse(time.RFC3339Nano, dd.CreatedAt)
+	d.UpdatedAt, _ = time.Parse(time.RFC3339Nano, dd.UpdatedAt)
+	return d
+}
+
+// ---------------------------------------------------------------------------
+// Rate limiting
+// ---------------------------------------------------------------------------
+
+// dynamoRateLimitRetries bounds the optimistic-locking retries when several
+// instances update the same bucket at once.
+const dynamoRateLimitRetries = 3
+
+type dynamoRateLimit struct {
+	Key       string  `dynamodbav:"key"`
+	Tokens    float64 `dynamodbav:"tokens"`
+	UpdatedAt int64   `dynamodbav:"updated_at"` // unix nanoseconds
+	ExpiresAt int64   `dynamodbav:"expires_at"` // TTL attribute: bucket is full again
+}
+
+// RateLimiter returns a RateLimiter that keeps its buckets in the rate
+// limits table, shared by every Lambda instance. Full buckets expire through
+// the table's TTL.
+func (s *DynamoStore) RateLimiter() RateLimiter {
+	return &dynamoRateLimiter{store: s, now: time.Now}
+}
+
+type dynamoRateLimiter struct {
+	store *DynamoStore
+	now   func() time.Time
+}
+
+func (rl *dynamoRateLimiter) Allow(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	s := rl.store
+	for attempt := 0; ; attempt++ {
+		out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(s.rateLimitsTable),
+			Key: map[string]types.AttributeValue{
+				"key": &types.AttributeValueMemberS{Value: key},
+			},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("get rate limit: %w", err)
+		}
+
+		var state bucketState
+		var cur dynamoRateLimit
+		if out.Item != nil {
+			if err := attributevalue.UnmarshalMap(out.Item, &cur); err != nil {
+				return RateLimitResult{}, fmt.Errorf("unmarshal rate limit: %w", err)
+			}
+			state = bucketState{Tokens: cur.Tokens, Updated: time.Unix(0, cur.UpdatedAt)}
+		}
+
+		now := rl.now()
+		state, res := takeToken(state, p, now)
+		item, err := attributevalue.MarshalMap(dynamoRateLimit{
+			Key:       key,
+			Tokens:    state.Tokens,
+			UpdatedAt: now.UnixNano(),
+			ExpiresAt: now.Add(res.Reset).Unix() + 1,
+		})
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("marshal rate limit: %w", err)
+		}
+
+		// Only write if nobody else updated the bucket since we read it
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(s.rateLimitsTable),
+			Item:      item,
+		}
+		if out.Item == nil {
+			input.ConditionExpression = aws.String("attribute_not_exists(#k)")
+			input.ExpressionAttributeNames = map[string]string{"#k": "key"}
+		} else {
+			input.ConditionExpression = aws.String("updated_at = :prev")
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":prev": &types.AttributeValueMemberN{Value: strconv.FormatInt(cur.UpdatedAt, 10)},
+			}
+		}
+
+		_, err = s.client.PutItem(ctx, input)
+		if err == nil {
+			return res, nil
+		}
+		var ccfe *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccfe) {
+			return RateLimitResult{}, fmt.Errorf("put rate limit: %w", err)
+		}
+		if attempt+1 >= dynamoRateLimitRetries {
+			return RateLimitResult{}, fmt.Errorf("rate limit %s: too much contention", key)
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Unmarshal helpers
 // ---------------------------------------------------------------------------
@@ -698,6 +2901,12 @@ func unmarshalAgent(item map[string]types.AttributeValue) (*Agent, error) {
 		status = "active"
 	}
 
+	var staleSince *time.Time
+	if da.StaleSince != "" {
+		t, _ := time.Parse(time.RFC3339, da.StaleSince)
+		staleSince = &t
+	}
+
 	return &Agent{
 		ID:              da.ID,
 		Name:            da.Name,
@@ -707,14 +2916,83 @@ func unmarshalAgent(item map[string]types.AttributeValue) (*Agent, error) {
 		OpenClawVersion: da.OpenClawVersion,
 		Fingerprint:     da.Fingerprint,
 		EncryptTool:     da.EncryptTool,
-		PublicKey:        da.PublicKey,
+		PublicKey:       da.PublicKey,
 		Status:          status,
+		StatusReason:    da.StatusReason,
 		QuotaBytes:      da.QuotaBytes,
 		UsedBytes:       da.UsedBytes,
+		Plan:            da.Plan,
+		Tags:            da.Tags,
+		ApprovalRuleID:  da.ApprovalRuleID,
+		OrgID:           da.OrgID,
+		StaleAfterHours: da.StaleAfterHours,
+		StaleSince:      staleSince,
+		ContactEmail:    da.ContactEmail,
+		EmailOptOuts:    da.EmailOptOuts,
 		CreatedAt:       createdAt,
 	}, nil
 }
 
+func unmarshalOrg(item map[string]types.AttributeValue) (*Organization, error) {
+	var do dynamoOrg
+	if err := attributevalue.UnmarshalMap(item, &do); err != nil {
+		return nil, fmt.Errorf("unmarshal org: %w", err)
+	}
+	o := &Organization{
+		ID:         do.OrgID,
+		Name:       do.Name,
+		QuotaBytes: do.QuotaBytes,
+		UsedBytes:  do.UsedBytes,
+	}
+	o.CreatedAt, _ = time.Parse(time.RFC3339, do.CreatedAt)
+	return o, nil
+}
+
+func unmarshalOrgAPIKey(item map[string]types.AttributeValue) (*OrgAPIKey, error) {
+	var dk dynamoOrgAPIKey
+	if err := attributevalue.UnmarshalMap(item, &dk); err != nil {
+		return nil, fmt.Errorf("unmarshal org API key: %w", err)
+	}
+	k := &OrgAPIKey{
+		ID:      dk.KeyID,
+		OrgID:   dk.OrgID,
+		KeyHash: dk.KeyHash,
+		Name:    dk.Name,
+	}
+	k.CreatedAt, _ = time.Parse(time.RFC3339, dk.CreatedAt)
+	return k, nil
+}
+
+func unmarshalInviteCode(item map[string]types.AttributeValue) (*InviteCode, error) {
+	var ic dynamoInviteCode
+	if err := attributevalue.UnmarshalMap(item, &ic); err != nil {
+		return nil, fmt.Errorf("unmarshal invite code: %w", err)
+	}
+
+	result := &InviteCode{
+		Code:            ic.Code,
+		MaxUses:         ic.MaxUses,
+		UseCount:        ic.UseCount,
+		Plan:            ic.Plan,
+		QuotaBytes:      ic.QuotaBytes,
+		Tags:            ic.Tags,
+		HostnamePattern: ic.HostnamePattern,
+		OrgID:           ic.OrgID,
+	}
+	result.CreatedAt, _ = time.Parse(time.RFC3339, ic.CreatedAt)
+	if ic.ExpiresAt != nil {
+		t := time.Unix(*ic.ExpiresAt, 0).UTC()
+		result.ExpiresAt = &t
+	}
+	if ic.RevokedAt != "" {
+		t, err := time.Parse(time.RFC3339, ic.RevokedAt)
+		if err == nil {
+			result.RevokedAt = &t
+		}
+	}
+	return result, nil
+}
+
 func unmarshalBackup(item map[string]types.AttributeValue) (*Backup, error) {
 	var db dynamoBackup
 	if err := attributevalue.UnmarshalMap(item, &db); err != nil {
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// instrumentedStore wraps a DataStore and records the latency and errors of
+// every call in Metrics.
+type instrumentedStore struct {
+	next DataStore
+	m    *Metrics
+}
+
+// InstrumentStore returns store wrapped with metrics, or store itself when m
+// is nil.
+func (m *Metrics) InstrumentStore(store DataStore) DataStore {
+	if m == nil {
+		return store
+	}
+	return &instrumentedStore{next: store, m: m}
+}
+
+func (s *instrumentedStore) observe(op string, start time.Time, err *error) {
+	s.m.observeStore(op, start, *err)
+}
+
+func (s *instrumentedStore) Close() error {
+	return s.next.Close()
+}
+
+func (s *instrumentedStore) Ping(ctx context.Context) (err error) {
+	defer s.observe("Ping", time.Now(), &err)
+	return s.next.Ping(ctx)
+}
+
+// Agents
+
+func (s *instrumentedStore) CreateAgent(ctx context.Context, a *Agent, tokenHash string) (err error) {
+	defer s.observe("CreateAgent", time.Now(), &err)
+	return s.next.CreateAgent(ctx, a, tokenHash)
+}
+
+func (s *instrumentedStore) LookupAgentByToken(ctx context.Context, token string) (a *Agent, err error) {
+	defer s.observe("LookupAgentByToken", time.Now(), &err)
+	return s.next.LookupAgentByToken(ctx, token)
+}
+
+func (s *instrumentedStore) GetAgent(ctx context.Context, id string) (a *Agent, err error) {
+	defer s.observe("GetAgent", time.Now(), &err)
+	return s.next.GetAgent(ctx, id)
+}
+
+func (s *instrumentedStore) AgentTokenHash(ctx context.Context, agentID string) (tokenHash string, err error) {
+	defer s.observe("AgentTokenHash", time.Now(), &err)
+	return s.next.AgentTokenHash(ctx, agentID)
+}
+
+func (s *instrumentedStore) RotateAgentToken(ctx context.Context, agentID, newTokenHash string) (err error) {
+	defer s.observe("RotateAgentToken", time.Now(), &err)
+	return s.next.RotateAgentToken(ctx, agentID, newTokenHash)
+}
+
+func (s *instrumentedStore) UpdateAgentProfile(ctx context.Context, agentID, name string) (err error) {
+	defer s.observe("UpdateAgentProfile", time.Now(), &err)
+	return s.next.UpdateAgentProfile(ctx, agentID, name)
+}
+
+func (s *instrumentedStore) UpdateUsedBytes(ctx context.Context, agentID string) (err error) {
+	defer s.observe("UpdateUsedBytes", time.Now(), &err)
+	return s.next.UpdateUsedBytes(ctx, agentID)
+}
+
+func (s *instrumentedStore) ListAgents(ctx context.Context, f AgentFilter) (agents []Agent, next string, err error) {
+	defer s.observe("ListAgents", time.Now(), &err)
+	return s.next.ListAgents(ctx, f)
+}
+
+func (s *instrumentedStore) FleetStats(ctx context.Context, opts StatsOptions) (stats *FleetStats, err error) {
+	defer s.observe("FleetStats", time.Now(), &err)
+	return s.next.FleetStats(ctx, opts)
+}
+
+func (s *instrumentedStore) SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) (err error) {
+	defer s.observe("SetAgentStaleThreshold", time.Now(), &err)
+	return s.next.SetAgentStaleThreshold(ctx, agentID, hours)
+}
+
+func (s *instrumentedStore) SetAgentStale(ctx context.Context, agentID string, since *time.Time) (err error) {
+	defer s.observe("SetAgentStale", time.Now(), &err)
+	return s.next.SetAgentStale(ctx, agentID, since)
+}
+
+func (s *instrumentedStore) SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) (err error) {
+	defer s.observe("SetAgentContact", time.Now(), &err)
+	return s.next.SetAgentContact(ctx, agentID, email, optOuts)
+}
+
+func (s *instrumentedStore) UpdateAgentStatus(ctx context.Context, id, status, reason string) (err error) {
+	defer s.observe("UpdateAgentStatus", time.Now(), &err)
+	return s.next.UpdateAgentStatus(ctx, id, status, reason)
+}
+
+func (s *instrumentedStore) SetAgentOrg(ctx context.Context, agentID, orgID string) (err error) {
+	defer s.observe("SetAgentOrg", time.Now(), &err)
+	return s.next.SetAgentOrg(ctx, agentID, orgID)
+}
+
+func (s *instrumentedStore) CountAgentsByStatus(ctx context.Context, status string) (n int, err error) {
+	defer s.observe("CountAgentsByStatus", time.Now(), &err)
+	return s.next.CountAgentsByStatus(ctx, status)
+}
+
+// Backups
+
+func (s *instrumentedStore) CreateBackup(ctx context.Context, b *Backup) (err error) {
+	defer s.observe("CreateBackup", time.Now(), &err)
+	return s.next.CreateBackup(ctx, b)
+}
+
+func (s *instrumentedStore) ListBackups(ctx context.Context, agentID string, p Page) (backups []Backup, next string, err error) {
+	defer s.observe("ListBackups", time.Now(), &err)
+	return s.next.ListBackups(ctx, agentID, p)
+}
+
+func (s *instrumentedStore) CountBackups(ctx context.Context, agentID string) (count int, bytes int64, err error) {
+	defer s.observe("CountBackups", time.Now(), &err)
+	return s.next.CountBackups(ctx, agentID)
+}
+
+func (s *instrumentedStore) GetBackup(ctx context.Context, agentID, timestamp string) (b *Backup, err error) {
+	defer s.observe("GetBackup", time.Now(), &err)
+	return s.next.GetBackup(ctx, agentID, timestamp)
+}
+
+func (s *instrumentedStore) DeleteBackup(ctx context.Context, agentID, timestamp string) (b *Backup, err error) {
+	defer s.observe("DeleteBackup", time.Now(), &err)
+	return s.next.DeleteBackup(ctx, agentID, timestamp)
+}
+
+func (s *instrumentedStore) DeleteAllBackups(ctx context.Context, agentID string) (backups []Backup, err error) {
+	defer s.observe("DeleteAllBackups", time.Now(), &err)
+	return s.next.DeleteAllBackups(ctx, agentID)
+}
+
+func (s *instrumentedStore) UndeleteBackup(ctx context.Context, agentID, timestamp string) (err error) {
+	defer s.observe("UndeleteBackup", time.Now(), &err)
+	return s.next.UndeleteBackup(ctx, agentID, timestamp)
+}
+
+func (s *instrumentedStore) PutBackup(ctx context.Context, b *Backup) (err error) {
+	defer s.observe("PutBackup", time.Now(), &err)
+	return s.next.PutBackup(ctx, b)
+}
+
+func (s *instrumentedStore) PurgeBackup(ctx context.Context, agentID, timestamp string) (err error) {
+	defer s.observe("PurgeBackup", time.Now(), &err)
+	return s.next.PurgeBackup(ctx, agentID, timestamp)
+}
+
+func (s *instrumentedStore) LatestBackupTimes(ctx context.Context) (times map[string]time.Time, err error) {
+	defer s.observe("LatestBackupTimes", time.Now(), &err)
+	return s.next.LatestBackupTimes(ctx)
+}
+
+func (s *instrumentedStore) ListAllBackups(ctx context.Context, agentID string) (backups []Backup, err error) {
+	defer s.observe("ListAllBackups", time.Now(), &err)
+	return s.next.ListAllBackups(ctx, agentID)
+}
+
+// Backup transfers
+
+func (s *instrumentedStore) PutTransfer(ctx context.Context, t *BackupTransfer) (err error) {
+	defer s.observe("PutTransfer", time.Now(), &err)
+	return s.next.PutTransfer(ctx, t)
+}
+
+func (s *instrumentedStore) GetTransfer(ctx context.Context, id string) (t *BackupTransfer, err error) {
+	defer s.observe("GetTransfer", time.Now(), &err)
+	return s.next.GetTransfer(ctx, id)
+}
+
+// Invite codes
+
+func (s *instrumentedStore) CreateInviteCode(ctx context.Context, code *InviteCode) (err error) {
+	defer s.observe("CreateInviteCode", time.Now(), &err)
+	return s.next.CreateInviteCode(ctx, code)
+}
+
+func (s *instrumentedStore) CreateInviteCodes(ctx context.Context, codes []*InviteCode) (err error) {
+	defer s.observe("CreateInviteCodes", time.Now(), &err)
+	return s.next.CreateInviteCodes(ctx, codes)
+}
+
+func (s *instrumentedStore) GetInviteCode(ctx context.Context, code string) (ic *InviteCode, err error) {
+	defer s.observe("GetInviteCode", time.Now(), &err)
+	return s.next.GetInviteCode(ctx, code)
+}
+
+func (s *instrumentedStore) UseInviteCode(ctx context.Context, code string) (valid bool, err error) {
+	defer s.observe("UseInviteCode", time.Now(), &err)
+	return s.next.UseInviteCode(ctx, code)
+}
+
+func (s *instrumentedStore) ListInviteCodes(ctx context.Context, p Page) (codes []InviteCode, next string, err error) {
+	defer s.observe("ListInviteCodes", time.Now(), &err)
+	return s.next.ListInviteCodes(ctx, p)
+}
+
+func (s *instrumentedStore) RevokeInviteCode(ctx context.Context, code string) (err error) {
+	defer s.observe("RevokeInviteCode", time.Now(), &err)
+	return s.next.RevokeInviteCode(ctx, code)
+}
+
+func (s *instrumentedStore) RecordInviteRedemption(ctx context.Context, r *InviteRedemption) (err error) {
+	defer s.observe("RecordInviteRedemption", time.Now(), &err)
+	return s.next.RecordInviteRedemption(ctx, r)
+}
+
+func (s *instrumentedStore) ListInviteRedemptions(ctx context.Context, code string, p Page) (redemptions []InviteRedemption, next string, err error) {
+	defer s.observe("ListInviteRedemptions", time.Now(), &err)
+	return s.next.ListInviteRedemptions(ctx, code, p)
+}
+
+// Registration bans
+
+func (s *instrumentedStore) CreateBan(ctx context.Context, b *Ban) (err error) {
+	defer s.observe("CreateBan", time.Now(), &err)
+	return s.next.CreateBan(ctx, b)
+}
+
+func (s *instrumentedStore) ListBans(ctx context.Context) (bans []Ban, err error) {
+	defer s.observe("ListBans", time.Now(), &err)
+	return s.next.ListBans(ctx)
+}
+
+func (s *instrumentedStore) DeleteBan(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteBan", time.Now(), &err)
+	return s.next.DeleteBan(ctx, id)
+}
+
+// Organizations
+
+func (s *instrumentedStore) CreateOrg(ctx context.Context, o *Organization) (err error) {
+	defer s.observe("CreateOrg", time.Now(), &err)
+	return s.next.CreateOrg(ctx, o)
+}
+
+func (s *instrumentedStore) GetOrg(ctx context.Context, id string) (o *Organization, err error) {
+	defer s.observe("GetOrg", time.Now(), &err)
+	return s.next.GetOrg(ctx, id)
+}
+
+func (s *instrumentedStore) ListOrgs(ctx context.Context) (orgs []Organization, err error) {
+	defer s.observe("ListOrgs", time.Now(), &err)
+	return s.next.ListOrgs(ctx)
+}
+
+func (s *instrumentedStore) CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) (err error) {
+	defer s.observe("CreateOrgAPIKey", time.Now(), &err)
+	return s.next.CreateOrgAPIKey(ctx, k)
+}
+
+func (s *instrumentedStore) LookupOrgAPIKey(ctx context.Context, keyHash string) (k *OrgAPIKey, err error) {
+	defer s.observe("LookupOrgAPIKey", time.Now(), &err)
+	return s.next.LookupOrgAPIKey(ctx, keyHash)
+}
+
+func (s *instrumentedStore) ListOrgAPIKeys(ctx context.Context, orgID string) (keys []OrgAPIKey, err error) {
+	defer s.observe("ListOrgAPIKeys", time.Now(), &err)
+	return s.next.ListOrgAPIKeys(ctx, orgID)
+}
+
+func (s *instrumentedStore) DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) (err error) {
+	defer s.observe("DeleteOrgAPIKey", time.Now(), &err)
+	return s.next.DeleteOrgAPIKey(ctx, orgID, keyID)
+}
+
+// Auto-approval rules
+
+func (s *instrumentedStore) CreateApprovalRule(ctx context.Context, r *ApprovalRule) (err error) {
+	defer s.observe("CreateApprovalRule", time.Now(), &err)
+	return s.next.CreateApprovalRule(ctx, r)
+}
+
+func (s *instrumentedStore) ListApprovalRules(ctx context.Context) (rules []ApprovalRule, err error) {
+	defer s.observe("ListApprovalRules", time.Now(), &err)
+	return s.next.ListApprovalRules(ctx)
+}
+
+func (s *instrumentedStore) DeleteApprovalRule(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteApprovalRule", time.Now(), &err)
+	return s.next.DeleteApprovalRule(ctx, id)
+}
+
+// Recovery codes
+
+func (s *instrumentedStore) CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) (err error) {
+	defer s.observe("CreateRecoveryCode", time.Now(), &err)
+	return s.next.CreateRecoveryCode(ctx, rc)
+}
+
+func (s *instrumentedStore) UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (a *Agent, err error) {
+	defer s.observe("UseRecoveryCode", time.Now(), &err)
+	return s.next.UseRecoveryCode(ctx, codeHash, newTokenHash)
+}
+
+// Audit log
+
+func (s *instrumentedStore) AppendAuditEvent(ctx context.Context, e *AuditEvent) (err error) {
+	defer s.observe("AppendAuditEvent", time.Now(), &err)
+	return s.next.AppendAuditEvent(ctx, e)
+}
+
+func (s *instrumentedStore) ListAuditEvents(ctx context.Context, f AuditFilter) (events []AuditEvent, next string, err error) {
+	defer s.observe("ListAuditEvents", time.Now(), &err)
+	return s.next.ListAuditEvents(ctx, f)
+}
+
+// Webhooks
+
+func (s *instrumentedStore) CreateWebhook(ctx context.Context, wh *Webhook) (err error) {
+	defer s.observe("CreateWebhook", time.Now(), &err)
+	return s.next.CreateWebhook(ctx, wh)
+}
+
+func (s *instrumentedStore) GetWebhook(ctx context.Context, id string) (wh *Webhook, err error) {
+	defer s.observe("GetWebhook", time.Now(), &err)
+	return s.next.GetWebhook(ctx, id)
+}
+
+func (s *instrumentedStore) ListWebhooks(ctx context.Context) (webhooks []Webhook, err error) {
+	defer s.observe("ListWebhooks", time.Now(), &err)
+	return s.next.ListWebhooks(ctx)
+}
+
+func (s *instrumentedStore) DeleteWebhook(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteWebhook", time.Now(), &err)
+	return s.next.DeleteWebhook(ctx, id)
+}
+
+func (s *instrumentedStore) PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) (err error) {
+	defer s.observe("PutWebhookDelivery", time.Now(), &err)
+	return s.next.PutWebhookDelivery(ctx, d)
+}
+
+func (s *instrumentedStore) ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) (deliveries []WebhookDelivery, next string, err error) {
+	defer s.observe("ListWebhookDeliveries", time.Now(), &err)
+	return s.next.ListWebhookDeliveries(ctx, f)
+}
@@ -0,0 +1,1796 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore implements DataStore using PostgreSQL (for self-hosted
+// deployments that run more than one API process).
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore connects to the database at url (a postgres:// URL or
+// key=value DSN) and applies any pending migrations.
+func NewPostgresStore(ctx context.Context, url string) (*PostgresStore, error) {
+	pool, err := openPostgres(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	return &PostgresStore{pool: pool}, nil
+}
+
+// openPostgres connects without migrating.
+func openPostgres(ctx context.Context, url string) (*pgxpool.Pool, error) {
+	if url == "" {
+		return nil, errors.New("DATABASE_URL is required")
+	}
+
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("connect db: %w", err)
+	}
+	return pool, nil
+}
+
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+// Ping reads from the agents table, which fails if the database is
+// unreachable or missing its schema.
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	var n int
+	return s.pool.QueryRow(ctx, `SELECT COUNT(*) FROM (SELECT 1 FROM agents LIMIT 1) AS t`).Scan(&n)
+}
+
+// ---------------------------------------------------------------------------
+// Migrations
+// ---------------------------------------------------------------------------
+
+// postgresMigration is one numbered step of the schema. Its version is its
+// index in postgresMigrations plus one.
+type postgresMigration struct {
+	name string
+	sql  string
+}
+
+// postgresMigrations are applied in order, each in its own transaction.
+// Applied migrations must never be edited: append a new one instead.
+var postgresMigrations = []postgresMigration{
+	{"initial schema", `
+	CREATE TABLE agents (
+		id                TEXT PRIMARY KEY,
+		name              TEXT NOT NULL,
+		hostname          TEXT NOT NULL DEFAULT '',
+		os                TEXT NOT NULL DEFAULT '',
+		arch              TEXT NOT NULL DEFAULT '',
+		openclaw_version  TEXT NOT NULL DEFAULT '',
+		fingerprint       TEXT NOT NULL DEFAULT '',
+		encrypt_tool      TEXT NOT NULL DEFAULT 'age',
+		public_key        TEXT NOT NULL DEFAULT '',
+		token_hash        TEXT NOT NULL,
+		status            TEXT NOT NULL DEFAULT 'active',
+		status_reason     TEXT NOT NULL DEFAULT '',
+		quota_bytes       BIGINT NOT NULL DEFAULT 524288000,
+		used_bytes        BIGINT NOT NULL DEFAULT 0,
+		plan              TEXT NOT NULL DEFAULT '',
+		tags              TEXT[] NOT NULL DEFAULT '{}',
+		approval_rule     TEXT NOT NULL DEFAULT '',
+		org_id            TEXT NOT NULL DEFAULT '',
+		stale_after_hours INTEGER NOT NULL DEFAULT 0,
+		stale_since       TIMESTAMPTZ,
+		contact_email     TEXT NOT NULL DEFAULT '',
+		email_opt_outs    TEXT[] NOT NULL DEFAULT '{}',
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX idx_agents_token_hash ON agents(token_hash);
+	CREATE INDEX idx_agents_status ON agents(status);
+	CREATE INDEX idx_agents_org ON agents(org_id);
+
+	CREATE TABLE backups (
+		agent_id          TEXT NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+		timestamp         TEXT NOT NULL,
+		encrypted_bytes   BIGINT NOT NULL DEFAULT 0,
+		source_file_count BIGINT NOT NULL DEFAULT 0,
+		encrypted_sha256  TEXT NOT NULL DEFAULT '',
+		s3_key            TEXT NOT NULL,
+		manifest_s3_key   TEXT NOT NULL,
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+		deleted_at        TIMESTAMPTZ,
+		PRIMARY KEY (agent_id, timestamp)
+	);
+
+	CREATE INDEX idx_backups_agent_created ON backups(agent_id, created_at);
+	CREATE INDEX idx_backups_created ON backups(created_at);
+
+	CREATE TABLE backup_transfers (
+		id              TEXT PRIMARY KEY,
+		source_agent_id TEXT NOT NULL,
+		target_agent_id TEXT NOT NULL,
+		mode            TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		total_count     INTEGER NOT NULL DEFAULT 0,
+		done_count      INTEGER NOT NULL DEFAULT 0,
+		error           TEXT NOT NULL DEFAULT '',
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE invite_codes (
+		code             TEXT PRIMARY KEY,
+		max_uses         INTEGER NOT NULL DEFAULT 0,
+		use_count        INTEGER NOT NULL DEFAULT 0,
+		expires_at       TIMESTAMPTZ,
+		created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+		revoked_at       TIMESTAMPTZ,
+		plan             TEXT NOT NULL DEFAULT '',
+		quota_bytes      BIGINT NOT NULL DEFAULT 0,
+		tags             TEXT[] NOT NULL DEFAULT '{}',
+		hostname_pattern TEXT NOT NULL DEFAULT '',
+		org_id           TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE invite_redemptions (
+		code        TEXT NOT NULL,
+		agent_id    TEXT NOT NULL,
+		ip          TEXT NOT NULL DEFAULT '',
+		redeemed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (code, agent_id)
+	);
+
+	CREATE TABLE bans (
+		id         TEXT PRIMARY KEY,
+		kind       TEXT NOT NULL,
+		value      TEXT NOT NULL,
+		reason     TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE orgs (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		quota_bytes BIGINT NOT NULL DEFAULT 0,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE org_api_keys (
+		id         TEXT PRIMARY KEY,
+		org_id     TEXT NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+		key_hash   TEXT NOT NULL UNIQUE,
+		name       TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX idx_org_api_keys_org ON org_api_keys(org_id);
+
+	CREATE TABLE approval_rules (
+		id             TEXT PRIMARY KEY,
+		name           TEXT NOT NULL DEFAULT '',
+		priority       INTEGER NOT NULL DEFAULT 0,
+		source_cidrs   TEXT[] NOT NULL DEFAULT '{}',
+		hostname_regex TEXT NOT NULL DEFAULT '',
+		os             TEXT NOT NULL DEFAULT '',
+		arch           TEXT NOT NULL DEFAULT '',
+		min_version    TEXT NOT NULL DEFAULT '',
+		max_version    TEXT NOT NULL DEFAULT '',
+		fingerprints   TEXT[] NOT NULL DEFAULT '{}',
+		approve        BOOLEAN NOT NULL DEFAULT false,
+		plan           TEXT NOT NULL DEFAULT '',
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE recovery_codes (
+		code_hash  TEXT PRIMARY KEY,
+		agent_id   TEXT NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		used_at    TIMESTAMPTZ
+	);
+
+	CREATE INDEX idx_recovery_codes_agent ON recovery_codes(agent_id);
+
+	-- Bucket times are unix nanoseconds since buckets refill continuously.
+	CREATE TABLE rate_limits (
+		key        TEXT PRIMARY KEY,
+		tokens     DOUBLE PRECISION NOT NULL,
+		updated_at BIGINT NOT NULL,
+		full_at    BIGINT NOT NULL
+	);
+
+	CREATE INDEX idx_rate_limits_full ON rate_limits(full_at);
+
+	-- seq orders events appended within the same microsecond.
+	CREATE TABLE audit_log (
+		seq          BIGSERIAL NOT NULL,
+		id           TEXT PRIMARY KEY,
+		action       TEXT NOT NULL,
+		actor        TEXT NOT NULL,
+		agent_id     TEXT NOT NULL DEFAULT '',
+		target       TEXT NOT NULL DEFAULT '',
+		ip           TEXT NOT NULL DEFAULT '',
+		request_id   TEXT NOT NULL DEFAULT '',
+		before_state JSONB,
+		after_state  JSONB,
+		created_at   TIMESTAMPTZ NOT NULL,
+		expires_at   TIMESTAMPTZ
+	);
+
+	CREATE INDEX idx_audit_log_agent ON audit_log(agent_id, created_at);
+	CREATE INDEX idx_audit_log_created ON audit_log(created_at);
+	CREATE INDEX idx_audit_log_expires ON audit_log(expires_at);
+
+	CREATE FUNCTION audit_log_append_only() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' AND OLD.expires_at IS NOT NULL AND OLD.expires_at <= now() THEN
+			RETURN OLD;
+		END IF;
+		RAISE EXCEPTION 'audit log is append-only';
+	END;
+	$$;
+
+	CREATE TRIGGER audit_log_append_only
+		BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+	CREATE TABLE webhooks (
+		id         TEXT PRIMARY KEY,
+		url        TEXT NOT NULL,
+		secret     TEXT NOT NULL,
+		events     TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	-- payload is TEXT rather than JSONB so that retries send the exact
+	-- bytes that were signed the first time.
+	CREATE TABLE webhook_deliveries (
+		seq             BIGSERIAL NOT NULL,
+		id              TEXT PRIMARY KEY,
+		webhook_id      TEXT NOT NULL,
+		event_id        TEXT NOT NULL,
+		event_type      TEXT NOT NULL,
+		payload         TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		response_code   INTEGER NOT NULL DEFAULT 0,
+		error           TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ,
+		created_at      TIMESTAMPTZ NOT NULL,
+		updated_at      TIMESTAMPTZ NOT NULL
+	);
+
+	CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, created_at);
+	CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+	CREATE INDEX idx_webhook_deliveries_created ON webhook_deliveries(created_at);
+	`},
+}
+
+// postgresMigrationLock is the advisory lock key held while migrating, so
+// that replicas starting at the same time apply migrations one at a time.
+const postgresMigrationLock = 0x6f636273 // "ocbs"
+
+// migratePostgres applies the migrations newer than the database's schema
+// version. It refuses to touch a schema newer than this binary knows.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL DEFAULT '',
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := postgresAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	current := schemaVersion(applied)
+	if current > len(postgresMigrations) {
+		return schemaTooNewError(current, len(postgresMigrations))
+	}
+
+	for v := current + 1; v <= len(postgresMigrations); v++ {
+		m := postgresMigrations[v-1]
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.sql); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, v, m.name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", v, m.name, err)
+		}
+	}
+	return nil
+}
+
+// postgresAppliedMigrations lists schema_migrations, oldest first. A
+// database without the table has none.
+func postgresAppliedMigrations(ctx context.Context, q pgQuerier) ([]appliedMigration, error) {
+	var exists bool
+	if err := q.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+
+	rows, err := q.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		m.AppliedAt = m.AppliedAt.UTC()
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// ---------------------------------------------------------------------------
+// Helpers
+// ---------------------------------------------------------------------------
+
+// pgExecer and pgQuerier are satisfied by *pgxpool.Pool, *pgxpool.Conn and
+// pgx.Tx.
+type pgExecer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+type pgQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// pgStrings maps a nil list to an empty one, since TEXT[] columns are NOT
+// NULL.
+func pgStrings(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// pgStringsOut maps an empty list to nil, as the other stores return it.
+func pgStringsOut(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+func utcPtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// placeholder appends v to args and returns its $n placeholder.
+func placeholder(args *[]any, v any) string {
+	*args = append(*args, v)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// ---------------------------------------------------------------------------
+// Agent operations
+// ---------------------------------------------------------------------------
+
+// postgresAgentColumns is the column list read by scanPostgresAgent.
+const postgresAgentColumns = `id, name, hostname, os, arch, openclaw_version,
+	fingerprint, encrypt_tool, public_key, status, status_reason, quota_bytes,
+	used_bytes, plan, tags, approval_rule, org_id, stale_after_hours, stale_since,
+	contact_email, email_opt_outs, created_at`
+
+func scanPostgresAgent(row rowScanner) (*Agent, error) {
+	a := &Agent{}
+	err := row.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch,
+		&a.OpenClawVersion, &a.Fingerprint, &a.EncryptTool, &a.PublicKey,
+		&a.Status, &a.StatusReason, &a.QuotaBytes, &a.UsedBytes, &a.Plan, &a.Tags, &a.ApprovalRuleID, &a.OrgID,
+		&a.StaleAfterHours, &a.StaleSince, &a.ContactEmail, &a.EmailOptOuts, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.Tags = pgStringsOut(a.Tags)
+	a.EmailOptOuts = pgStringsOut(a.EmailOptOuts)
+	a.StaleSince = utcPtr(a.StaleSince)
+	a.CreatedAt = a.CreatedAt.UTC()
+	return a, nil
+}
+
+func (s *PostgresStore) CreateAgent(ctx context.Context, a *Agent, tokenHash string) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO agents (id, name, hostname, os, arch, openclaw_version,
+			fingerprint, encrypt_tool, public_key, token_hash, status, quota_bytes,
+			plan, tags, approval_rule, org_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+		a.ID, a.Name, a.Hostname, a.OS, a.Arch, a.OpenClawVersion,
+		a.Fingerprint, a.EncryptTool, a.PublicKey, tokenHash, a.Status, a.QuotaBytes,
+		a.Plan, pgStrings(a.Tags), a.ApprovalRuleID, a.OrgID, creationTime(a.CreatedAt),
+	)
+	return err
+}
+
+func (s *PostgresStore) LookupAgentByToken(ctx context.Context, token string) (*Agent, error) {
+	a, err := scanPostgresAgent(s.pool.QueryRow(ctx, `
+		SELECT `+postgresAgentColumns+`
+		FROM agents WHERE token_hash = $1`, HashToken(token)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return a, err
+}
+
+func (s *PostgresStore) AgentTokenHash(ctx context.Context, agentID string) (string, error) {
+	var tokenHash string
+	err := s.pool.QueryRow(ctx, `SELECT token_hash FROM agents WHERE id = $1`, agentID).Scan(&tokenHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return tokenHash, err
+}
+
+func (s *PostgresStore) GetAgent(ctx context.Context, id string) (*Agent, error) {
+	return getPostgresAgent(ctx, s.pool, id)
+}
+
+func getPostgresAgent(ctx context.Context, q pgQuerier, id string) (*Agent, error) {
+	a, err := scanPostgresAgent(q.QueryRow(ctx, `
+		SELECT `+postgresAgentColumns+`
+		FROM agents WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return a, err
+}
+
+func (s *PostgresStore) RotateAgentToken(ctx context.Context, agentID, newTokenHash string) error {
+	_, err := s.pool.Exec(ctx, `UPDATE agents SET token_hash = $1 WHERE id = $2`, newTokenHash, agentID)
+	return err
+}
+
+func (s *PostgresStore) UpdateAgentProfile(ctx context.Context, agentID, name string) error {
+	_, err := s.pool.Exec(ctx, `UPDATE agents SET name = $1 WHERE id = $2`, name, agentID)
+	return err
+}
+
+func (s *PostgresStore) UpdateUsedBytes(ctx context.Context, agentID string) error {
+	return updatePostgresUsedBytes(ctx, s.pool, agentID)
+}
+
+func updatePostgresUsedBytes(ctx context.Context, q pgExecer, agentID string) error {
+	_, err := q.Exec(ctx, `
+		UPDATE agents SET used_bytes = (
+			SELECT COALESCE(SUM(encrypted_bytes), 0) FROM backups WHERE agent_id = $1 AND deleted_at IS NULL
+		) WHERE id = $1`, agentID)
+	return err
+}
+
+// lockPostgresAgent locks the agent's row until tx ends. Backup writes take
+// it before recomputing used_bytes, so that concurrent writes for the same
+// agent account one after the other and each sees the other's backups.
+func lockPostgresAgent(ctx context.Context, tx pgx.Tx, agentID string) error {
+	_, err := tx.Exec(ctx, `SELECT 1 FROM agents WHERE id = $1 FOR UPDATE`, agentID)
+	return err
+}
+
+func (s *PostgresStore) ListAgents(ctx context.Context, f AgentFilter) ([]Agent, string, error) {
+	after, err := keysetPage(f.Page)
+	if err != nil {
+		return nil, "", err
+	}
+	var where []string
+	var args []any
+	if after != nil {
+		where = append(where, "(created_at, id) < ("+placeholder(&args, after.At)+", "+placeholder(&args, after.Key)+")")
+	}
+	if f.Status != "" {
+		where = append(where, "status = "+placeholder(&args, f.Status))
+	}
+	if f.OrgID != "" {
+		where = append(where, "org_id = "+placeholder(&args, f.OrgID))
+	}
+	if f.Stale {
+		where = append(where, "stale_since IS NOT NULL")
+	}
+
+	query := `SELECT ` + postgresAgentColumns + ` FROM agents`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY created_at DESC, id DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ` + placeholder(&args, f.Limit+1) // one more tells whether there is a next page
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var agents []Agent
+	for rows.Next() {
+		a, err := scanPostgresAgent(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		agents = append(agents, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if f.Limit > 0 && len(agents) > f.Limit {
+		agents = agents[:f.Limit]
+		last := agents[f.Limit-1]
+		next = encodeCursor(pageKey{At: last.CreatedAt, Key: last.ID})
+	}
+	return agents, next, nil
+}
+
+func (s *PostgresStore) SetAgentOrg(ctx context.Context, agentID, orgID string) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE agents SET org_id = $1 WHERE id = $2`, orgID, agentID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE agents SET stale_after_hours = $1 WHERE id = $2`, hours, agentID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetAgentStale(ctx context.Context, agentID string, since *time.Time) error {
+	_, err := s.pool.Exec(ctx, `UPDATE agents SET stale_since = $1 WHERE id = $2`, since, agentID)
+	return err
+}
+
+func (s *PostgresStore) SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE agents SET contact_email = $1, email_opt_outs = $2 WHERE id = $3`,
+		email, pgStrings(optOuts), agentID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) CountAgentsByStatus(ctx context.Context, status string) (int, error) {
+	var count int
+	err := s.pool.QueryRow(ctx, `SELECT COUNT(*) FROM agents WHERE status = $1`, status).Scan(&count)
+	return count, err
+}
+
+func (s *PostgresStore) FleetStats(ctx context.Context, opts StatsOptions) (*FleetStats, error) {
+	stats := newFleetStats()
+
+	// One pass over the agents, grouped by every dimension reported.
+	rows, err := s.pool.Query(ctx, `
+		SELECT status, plan, os, arch, openclaw_version, COUNT(*), COALESCE(SUM(used_bytes), 0)
+		FROM agents
+		GROUP BY status, plan, os, arch, openclaw_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status, plan, osName, arch, version string
+		var count int
+		var used int64
+		if err := rows.Scan(&status, &plan, &osName, &arch, &version, &count, &used); err != nil {
+			return nil, err
+		}
+		stats.AgentsByStatus[status] += count
+		stats.UsedBytes += used
+		stats.UsedBytesByPlan[plan] += used
+		stats.ByOS[osName] += count
+		stats.ByArch[arch] += count
+		stats.ByVersion[version] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = s.pool.QueryRow(ctx, `
+		SELECT COUNT(*) FILTER (WHERE created_at >= $1), COUNT(*)
+		FROM backups WHERE created_at >= $2 AND deleted_at IS NULL`,
+		opts.Now.Add(-24*time.Hour), opts.Now.Add(-7*24*time.Hour)).Scan(&stats.Backups24h, &stats.Backups7d)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM agents a
+		WHERE a.status = 'active' AND NOT EXISTS (
+			SELECT 1 FROM backups b WHERE b.agent_id = a.id AND b.created_at >= $1 AND b.deleted_at IS NULL)`,
+		opts.InactiveSince).Scan(&stats.InactiveAgents)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.TopN > 0 {
+		rows, err := s.pool.Query(ctx, `
+			SELECT id, name, used_bytes FROM agents
+			WHERE used_bytes > 0
+			ORDER BY used_bytes DESC, id LIMIT $1`, opts.TopN)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var u AgentUsage
+			if err := rows.Scan(&u.AgentID, &u.Name, &u.UsedBytes); err != nil {
+				return nil, err
+			}
+			stats.TopConsumers = append(stats.TopConsumers, u)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *PostgresStore) UpdateAgentStatus(ctx context.Context, id, status, reason string) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE agents SET status = $1, status_reason = $2 WHERE id = $3`, status, reason, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("agent not found: %s", id)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Backup operations
+// ---------------------------------------------------------------------------
+
+const postgresBackupColumns = `agent_id, timestamp, encrypted_bytes, source_file_count,
+	encrypted_sha256, s3_key, manifest_s3_key, created_at`
+
+func scanPostgresBackup(row rowScanner) (*Backup, error) {
+	b := &Backup{}
+	if err := row.Scan(&b.AgentID, &b.Timestamp, &b.EncryptedBytes,
+		&b.SourceFileCount, &b.EncryptedSHA256, &b.S3Key,
+		&b.ManifestS3Key, &b.CreatedAt); err != nil {
+		return nil, err
+	}
+	b.CreatedAt = b.CreatedAt.UTC()
+	return b, nil
+}
+
+func collectPostgresBackups(rows pgx.Rows) ([]Backup, error) {
+	defer rows.Close()
+	var backups []Backup
+	for rows.Next() {
+		b, err := scanPostgresBackup(rows)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, *b)
+	}
+	return backups, rows.Err()
+}
+
+// CreateBackup checks the agent's quota and its org's pooled quota, inserts
+// b and updates the agent's used_bytes in one transaction, under the
+// agent's and the org's row locks.
+func (s *PostgresStore) CreateBackup(ctx context.Context, b *Backup) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := lockPostgresAgent(ctx, tx, b.AgentID); err != nil {
+			return err
+		}
+		var used, quota int64
+		var orgID string
+		err := tx.QueryRow(ctx, `SELECT used_bytes, quota_bytes, org_id FROM agents WHERE id = $1`, b.AgentID).Scan(&used, &quota, &orgID)
+		if err != nil {
+			return err
+		}
+		if used+b.EncryptedBytes > quota {
+			return ErrQuotaExceeded
+		}
+		if orgID != "" {
+			// Locking the org serializes uploads of all its agents
+			var orgQuota, orgUsed int64
+			err := tx.QueryRow(ctx, `SELECT quota_bytes FROM orgs WHERE id = $1 FOR UPDATE`, orgID).Scan(&orgQuota)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+			if orgQuota > 0 {
+				err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(used_bytes), 0) FROM agents WHERE org_id = $1`, orgID).Scan(&orgUsed)
+				if err != nil {
+					return err
+				}
+				if orgUsed+b.EncryptedBytes > orgQuota {
+					return ErrOrgQuotaExceeded
+				}
+			}
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO backups (agent_id, timestamp, encrypted_bytes, source_file_count,
+				encrypted_sha256, s3_key, manifest_s3_key)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			b.AgentID, b.Timestamp, b.EncryptedBytes, b.SourceFileCount,
+			b.EncryptedSHA256, b.S3Key, b.ManifestS3Key,
+		)
+		if err != nil {
+			return err
+		}
+		return updatePostgresUsedBytes(ctx, tx, b.AgentID)
+	})
+}
+
+func (s *PostgresStore) ListBackups(ctx context.Context, agentID string, p Page) ([]Backup, string, error) {
+	after, err := keysetPage(p)
+	if err != nil {
+		return nil, "", err
+	}
+	args := []any{agentID}
+	query := `SELECT ` + postgresBackupColumns + ` FROM backups WHERE agent_id = $1 AND deleted_at IS NULL`
+	if after != nil {
+		query += ` AND (created_at, timestamp) < (` + placeholder(&args, after.At) + `, ` + placeholder(&args, after.Key) + `)`
+	}
+	query += ` ORDER BY created_at DESC, timestamp DESC`
+	if p.Limit > 0 {
+		query += ` LIMIT ` + placeholder(&args, p.Limit+1)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	backups, err := collectPostgresBackups(rows)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if p.Limit > 0 && len(backups) > p.Limit {
+		backups = backups[:p.Limit]
+		last := backups[p.Limit-1]
+		next = encodeCursor(pageKey{At: last.CreatedAt, Key: last.Timestamp})
+	}
+	return backups, next, nil
+}
+
+func (s *PostgresStore) CountBackups(ctx context.Context, agentID string) (int, int64, error) {
+	var count int
+	var totalBytes int64
+	err := s.pool.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(encrypted_bytes), 0)
+		FROM backups WHERE agent_id = $1 AND deleted_at IS NULL`, agentID).Scan(&count, &totalBytes)
+	return count, totalBytes, err
+}
+
+func (s *PostgresStore) GetBackup(ctx context.Context, agentID, timestamp string) (*Backup, error) {
+	b, err := scanPostgresBackup(s.pool.QueryRow(ctx, `
+		SELECT `+postgresBackupColumns+`
+		FROM backups WHERE agent_id = $1 AND timestamp = $2 AND deleted_at IS NULL`, agentID, timestamp))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// DeleteBackup soft-deletes the backup and updates the agent's used_bytes in
+// one transaction.
+func (s *PostgresStore) DeleteBackup(ctx context.Context, agentID, timestamp string) (*Backup, error) {
+	var deleted *Backup
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := lockPostgresAgent(ctx, tx, agentID); err != nil {
+			return err
+		}
+		b, err := scanPostgresBackup(tx.QueryRow(ctx, `
+			UPDATE backups SET deleted_at = now()
+			WHERE agent_id = $1 AND timestamp = $2 AND deleted_at IS NULL
+			RETURNING `+postgresBackupColumns, agentID, timestamp))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		deleted = b
+		return updatePostgresUsedBytes(ctx, tx, agentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// DeleteAllBackups soft-deletes every backup of the agent and updates its
+// used_bytes in one transaction.
+func (s *PostgresStore) DeleteAllBackups(ctx context.Context, agentID string) ([]Backup, error) {
+	var backups []Backup
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := lockPostgresAgent(ctx, tx, agentID); err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx, `
+			UPDATE backups SET deleted_at = now()
+			WHERE agent_id = $1 AND deleted_at IS NULL
+			RETURNING `+postgresBackupColumns, agentID)
+		if err != nil {
+			return err
+		}
+		if backups, err = collectPostgresBackups(rows); err != nil {
+			return err
+		}
+		return updatePostgresUsedBytes(ctx, tx, agentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Newest first, like ListBackups
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+func (s *PostgresStore) UndeleteBackup(ctx context.Context, agentID, timestamp string) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := lockPostgresAgent(ctx, tx, agentID); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `
+			UPDATE backups SET deleted_at = NULL
+			WHERE agent_id = $1 AND timestamp = $2 AND deleted_at IS NOT NULL`, agentID, timestamp)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("backup not found or not deleted")
+		}
+		return updatePostgresUsedBytes(ctx, tx, agentID)
+	})
+}
+
+func (s *PostgresStore) PutBackup(ctx context.Context, b *Backup) error {
+	createdAt := b.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO backups (agent_id, timestamp, encrypted_bytes, source_file_count,
+			encrypted_sha256, s3_key, manifest_s3_key, created_at, deleted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (agent_id, timestamp) DO UPDATE SET
+			encrypted_bytes = excluded.encrypted_bytes, source_file_count = excluded.source_file_count,
+			encrypted_sha256 = excluded.encrypted_sha256, s3_key = excluded.s3_key,
+			manifest_s3_key = excluded.manifest_s3_key, created_at = excluded.created_at,
+			deleted_at = excluded.deleted_at`,
+		b.AgentID, b.Timestamp, b.EncryptedBytes, b.SourceFileCount,
+		b.EncryptedSHA256, b.S3Key, b.ManifestS3Key, createdAt, b.DeletedAt,
+	)
+	return err
+}
+
+func (s *PostgresStore) PurgeBackup(ctx context.Context, agentID, timestamp string) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM backups WHERE agent_id = $1 AND timestamp = $2`, agentID, timestamp)
+	return err
+}
+
+func (s *PostgresStore) LatestBackupTimes(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := s.pool.Query(ctx, `SELECT agent_id, MAX(created_at) FROM backups GROUP BY agent_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := map[string]time.Time{}
+	for rows.Next() {
+		var agentID string
+		var createdAt time.Time
+		if err := rows.Scan(&agentID, &createdAt); err != nil {
+			return nil, err
+		}
+		times[agentID] = createdAt.UTC()
+	}
+	return times, rows.Err()
+}
+
+func (s *PostgresStore) ListAllBackups(ctx context.Context, agentID string) ([]Backup, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+postgresBackupColumns+`, deleted_at
+		FROM backups WHERE agent_id = $1
+		ORDER BY created_at, timestamp`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var backups []Backup
+	for rows.Next() {
+		var b Backup
+		if err := rows.Scan(&b.AgentID, &b.Timestamp, &b.EncryptedBytes,
+			&b.SourceFileCount, &b.EncryptedSHA256, &b.S3Key,
+			&b.ManifestS3Key, &b.CreatedAt, &b.DeletedAt); err != nil {
+			return nil, err
+		}
+		b.CreatedAt, b.DeletedAt = b.CreatedAt.UTC(), utcPtr(b.DeletedAt)
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+// ---------------------------------------------------------------------------
+// Backup transfer operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) PutTransfer(ctx context.Context, t *BackupTransfer) error {
+	createdAt := t.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO backup_transfers (id, source_agent_id, target_agent_id, mode, status,
+			total_count, done_count, error, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+		ON CONFLICT (id) DO UPDATE SET
+			mode = excluded.mode, status = excluded.status,
+			total_count = excluded.total_count, done_count = excluded.done_count,
+			error = excluded.error, created_at = excluded.created_at,
+			updated_at = excluded.updated_at`,
+		t.ID, t.SourceAgentID, t.TargetAgentID, t.Mode, t.Status,
+		t.TotalCount, t.DoneCount, t.Error, createdAt,
+	)
+	return err
+}
+
+func (s *PostgresStore) GetTransfer(ctx context.Context, id string) (*BackupTransfer, error) {
+	t := &BackupTransfer{}
+	err := s.pool.QueryRow(ctx, `
+		SELECT id, source_agent_id, target_agent_id, mode, status,
+			total_count, done_count, error, created_at, updated_at
+		FROM backup_transfers WHERE id = $1`, id).Scan(&t.ID, &t.SourceAgentID, &t.TargetAgentID, &t.Mode, &t.Status,
+		&t.TotalCount, &t.DoneCount, &t.Error, &t.CreatedAt, &t.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	t.UpdatedAt = t.UpdatedAt.UTC()
+	return t, nil
+}
+
+// ---------------------------------------------------------------------------
+// Invite code operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) CreateInviteCode(ctx context.Context, code *InviteCode) error {
+	return insertPostgresInviteCode(ctx, s.pool, code)
+}
+
+// CreateInviteCodes inserts codes in one transaction.
+func (s *PostgresStore) CreateInviteCodes(ctx context.Context, codes []*InviteCode) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		for _, code := range codes {
+			if err := insertPostgresInviteCode(ctx, tx, code); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func insertPostgresInviteCode(ctx context.Context, db pgExecer, code *InviteCode) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO invite_codes (code, max_uses, use_count, expires_at,
+			plan, quota_bytes, tags, hostname_pattern, org_id, created_at, revoked_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		code.Code, code.MaxUses, code.UseCount, code.ExpiresAt,
+		code.Plan, code.QuotaBytes, pgStrings(code.Tags), code.HostnamePattern, code.OrgID,
+		creationTime(code.CreatedAt), code.RevokedAt,
+	)
+	return err
+}
+
+// postgresInviteCodeColumns is the column list read by scanPostgresInviteCode.
+const postgresInviteCodeColumns = `code, max_uses, use_count, expires_at, created_at, revoked_at,
+	plan, quota_bytes, tags, hostname_pattern, org_id`
+
+func scanPostgresInviteCode(row rowScanner) (*InviteCode, error) {
+	ic := &InviteCode{}
+	if err := row.Scan(&ic.Code, &ic.MaxUses, &ic.UseCount, &ic.ExpiresAt, &ic.CreatedAt, &ic.RevokedAt,
+		&ic.Plan, &ic.QuotaBytes, &ic.Tags, &ic.HostnamePattern, &ic.OrgID); err != nil {
+		return nil, err
+	}
+	ic.Tags = pgStringsOut(ic.Tags)
+	ic.CreatedAt = ic.CreatedAt.UTC()
+	ic.ExpiresAt = utcPtr(ic.ExpiresAt)
+	ic.RevokedAt = utcPtr(ic.RevokedAt)
+	return ic, nil
+}
+
+func (s *PostgresStore) GetInviteCode(ctx context.Context, code string) (*InviteCode, error) {
+	ic, err := scanPostgresInviteCode(s.pool.QueryRow(ctx, `
+		SELECT `+postgresInviteCodeColumns+`
+		FROM invite_codes WHERE code = $1`, code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return ic, err
+}
+
+// UseInviteCode locks the code's row while checking it, so concurrent
+// registrations cannot together exceed max_uses.
+func (s *PostgresStore) UseInviteCode(ctx context.Context, code string) (bool, error) {
+	valid := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var maxUses, useCount int
+		var expiresAt, revokedAt *time.Time
+		err := tx.QueryRow(ctx, `
+			SELECT max_uses, use_count, expires_at, revoked_at
+			FROM invite_codes WHERE code = $1 FOR UPDATE`, code).Scan(&maxUses, &useCount, &expiresAt, &revokedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Check revoked
+		if revokedAt != nil {
+			return nil
+		}
+
+		// Check expiry
+		if expiresAt != nil && time.Now().After(*expiresAt) {
+			return nil
+		}
+
+		// Check max uses (0 = unlimited)
+		if maxUses > 0 && useCount >= maxUses {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE invite_codes SET use_count = use_count + 1 WHERE code = $1`, code); err != nil {
+			return err
+		}
+		valid = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return valid, nil
+}
+
+func (s *PostgresStore) ListInviteCodes(ctx context.Context, p Page) ([]InviteCode, string, error) {
+	after, err := keysetPage(p)
+	if err != nil {
+		return nil, "", err
+	}
+	var args []any
+	query := `SELECT ` + postgresInviteCodeColumns + ` FROM invite_codes`
+	if after != nil {
+		query += ` WHERE (created_at, code) < (` + placeholder(&args, after.At) + `, ` + placeholder(&args, after.Key) + `)`
+	}
+	query += ` ORDER BY created_at DESC, code DESC`
+	if p.Limit > 0 {
+		query += ` LIMIT ` + placeholder(&args, p.Limit+1)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var codes []InviteCode
+	for rows.Next() {
+		ic, err := scanPostgresInviteCode(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		codes = append(codes, *ic)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if p.Limit > 0 && len(codes) > p.Limit {
+		codes = codes[:p.Limit]
+		last := codes[p.Limit-1]
+		next = encodeCursor(pageKey{At: last.CreatedAt, Key: last.Code})
+	}
+	return codes, next, nil
+}
+
+func (s *PostgresStore) RevokeInviteCode(ctx context.Context, code string) error {
+	tag, err := s.pool.Exec(ctx, `
+		UPDATE invite_codes SET revoked_at = now()
+		WHERE code = $1 AND revoked_at IS NULL`, code)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("invite code not found or already revoked: %s", code)
+	}
+	return nil
+}
+
+func (s *PostgresStore) RecordInviteRedemption(ctx context.Context, r *InviteRedemption) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO invite_redemptions (code, agent_id, ip, redeemed_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`,
+		r.Code, r.AgentID, r.IP, creationTime(r.RedeemedAt),
+	)
+	return err
+}
+
+func (s *PostgresStore) ListInviteRedemptions(ctx context.Context, code string, p Page) ([]InviteRedemption, string, error) {
+	after, err := keysetPage(p)
+	if err != nil {
+		return nil, "", err
+	}
+	args := []any{code}
+	query := `
+		SELECT code, agent_id, ip, redeemed_at
+		FROM invite_redemptions WHERE code = $1`
+	if after != nil {
+		query += ` AND (redeemed_at, agent_id) > (` + placeholder(&args, after.At) + `, ` + placeholder(&args, after.Key) + `)`
+	}
+	query += ` ORDER BY redeemed_at, agent_id`
+	if p.Limit > 0 {
+		query += ` LIMIT ` + placeholder(&args, p.Limit+1)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var redemptions []InviteRedemption
+	for rows.Next() {
+		var r InviteRedemption
+		if err := rows.Scan(&r.Code, &r.AgentID, &r.IP, &r.RedeemedAt); err != nil {
+			return nil, "", err
+		}
+		r.RedeemedAt = r.RedeemedAt.UTC()
+		redemptions = append(redemptions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if p.Limit > 0 && len(redemptions) > p.Limit {
+		redemptions = redemptions[:p.Limit]
+		last := redemptions[p.Limit-1]
+		next = encodeCursor(pageKey{At: last.RedeemedAt, Key: last.AgentID})
+	}
+	return redemptions, next, nil
+}
+
+// ---------------------------------------------------------------------------
+// Organization operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) CreateOrg(ctx context.Context, o *Organization) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO orgs (id, name, quota_bytes, created_at)
+		VALUES ($1, $2, $3, $4)`,
+		o.ID, o.Name, o.QuotaBytes, creationTime(o.CreatedAt),
+	)
+	return err
+}
+
+func (s *PostgresStore) GetOrg(ctx context.Context, id string) (*Organization, error) {
+	o := &Organization{}
+	err := s.pool.QueryRow(ctx, `
+		SELECT id, name, quota_bytes,
+			(SELECT COALESCE(SUM(used_bytes), 0) FROM agents WHERE org_id = orgs.id), created_at
+		FROM orgs WHERE id = $1`, id).Scan(&o.ID, &o.Name, &o.QuotaBytes, &o.UsedBytes, &o.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.CreatedAt = o.CreatedAt.UTC()
+	return o, nil
+}
+
+func (s *PostgresStore) ListOrgs(ctx context.Context) ([]Organization, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, name, quota_bytes,
+			(SELECT COALESCE(SUM(used_bytes), 0) FROM agents WHERE org_id = orgs.id), created_at
+		FROM orgs ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []Organization
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.QuotaBytes, &o.UsedBytes, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		o.CreatedAt = o.CreatedAt.UTC()
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *PostgresStore) CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO org_api_keys (id, org_id, key_hash, name, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		k.ID, k.OrgID, k.KeyHash, k.Name, creationTime(k.CreatedAt),
+	)
+	return err
+}
+
+func (s *PostgresStore) LookupOrgAPIKey(ctx context.Context, keyHash string) (*OrgAPIKey, error) {
+	k := &OrgAPIKey{}
+	err := s.pool.QueryRow(ctx, `
+		SELECT id, org_id, key_hash, name, created_at
+		FROM org_api_keys WHERE key_hash = $1`, keyHash).Scan(&k.ID, &k.OrgID, &k.KeyHash, &k.Name, &k.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.CreatedAt = k.CreatedAt.UTC()
+	return k, nil
+}
+
+func (s *PostgresStore) ListOrgAPIKeys(ctx context.Context, orgID string) ([]OrgAPIKey, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, org_id, key_hash, name, created_at
+		FROM org_api_keys WHERE org_id = $1 ORDER BY created_at, id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []OrgAPIKey
+	for rows.Next() {
+		var k OrgAPIKey
+		if err := rows.Scan(&k.ID, &k.OrgID, &k.KeyHash, &k.Name, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		k.CreatedAt = k.CreatedAt.UTC()
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM org_api_keys WHERE org_id = $1 AND id = $2`, orgID, keyID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("org API key not found: %s", keyID)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Ban operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) CreateBan(ctx context.Context, b *Ban) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO bans (id, kind, value, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		b.ID, b.Kind, b.Value, b.Reason, creationTime(b.CreatedAt),
+	)
+	return err
+}
+
+func (s *PostgresStore) ListBans(ctx context.Context) ([]Ban, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, kind, value, reason, created_at
+		FROM bans ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.Kind, &b.Value, &b.Reason, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		b.CreatedAt = b.CreatedAt.UTC()
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (s *PostgresStore) DeleteBan(ctx context.Context, id string) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM bans WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("ban not found: %s", id)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Auto-approval rule operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) CreateApprovalRule(ctx context.Context, r *ApprovalRule) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO approval_rules (id, name, priority, source_cidrs, hostname_regex,
+			os, arch, min_version, max_version, fingerprints, approve, plan, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		r.ID, r.Name, r.Priority, pgStrings(r.SourceCIDRs), r.HostnameRegex,
+		r.OS, r.Arch, r.MinVersion, r.MaxVersion, pgStrings(r.Fingerprints), r.Approve, r.Plan,
+		creationTime(r.CreatedAt),
+	)
+	return err
+}
+
+func (s *PostgresStore) ListApprovalRules(ctx context.Context) ([]ApprovalRule, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, name, priority, source_cidrs, hostname_regex, os, arch,
+			min_version, max_version, fingerprints, approve, plan, created_at
+		FROM approval_rules ORDER BY priority, created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []ApprovalRule
+	for rows.Next() {
+		var r ApprovalRule
+		if err := rows.Scan(&r.ID, &r.Name, &r.Priority, &r.SourceCIDRs, &r.HostnameRegex, &r.OS, &r.Arch,
+			&r.MinVersion, &r.MaxVersion, &r.Fingerprints, &r.Approve, &r.Plan, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.SourceCIDRs = pgStringsOut(r.SourceCIDRs)
+		r.Fingerprints = pgStringsOut(r.Fingerprints)
+		r.CreatedAt = r.CreatedAt.UTC()
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *PostgresStore) DeleteApprovalRule(ctx context.Context, id string) error {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM approval_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("approval rule not found: %s", id)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Recovery code operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		// Only the most recently issued code is valid
+		if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE agent_id = $1 AND used_at IS NULL`, rc.AgentID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO recovery_codes (code_hash, agent_id, expires_at)
+			VALUES ($1, $2, $3)`,
+			rc.CodeHash, rc.AgentID, rc.ExpiresAt,
+		)
+		return err
+	})
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (*Agent, error) {
+	var agent *Agent
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var agentID string
+		var expiresAt time.Time
+		var usedAt *time.Time
+		err := tx.QueryRow(ctx, `
+			SELECT agent_id, expires_at, used_at
+			FROM recovery_codes WHERE code_hash = $1 FOR UPDATE`, codeHash).Scan(&agentID, &expiresAt, &usedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Check already used and expiry
+		if usedAt != nil || time.Now().After(expiresAt) {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE recovery_codes SET used_at = now() WHERE code_hash = $1`, codeHash); err != nil {
+			return err
+		}
+
+		// Replacing the token hash revokes every previously issued token
+		if _, err := tx.Exec(ctx, `UPDATE agents SET token_hash = $1 WHERE id = $2`, newTokenHash, agentID); err != nil {
+			return err
+		}
+
+		agent, err = getPostgresAgent(ctx, tx, agentID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// ---------------------------------------------------------------------------
+// Audit log
+// ---------------------------------------------------------------------------
+
+// AppendAuditEvent inserts e and drops events whose retention has run out.
+func (s *PostgresStore) AppendAuditEvent(ctx context.Context, e *AuditEvent) error {
+	createdAt := e.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO audit_log (id, action, actor, agent_id, target, ip, request_id,
+			before_state, after_state, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		e.ID, e.Action, e.Actor, e.AgentID, e.Target, e.IP, e.RequestID,
+		nullableJSON(e.Before), nullableJSON(e.After), createdAt, e.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pool.Exec(ctx, `DELETE FROM audit_log WHERE expires_at <= now()`)
+	return err
+}
+
+func (s *PostgresStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, string, error) {
+	after, err := keysetPage(f.Page)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `
+		SELECT seq, id, action, actor, agent_id, target, ip, request_id, before_state,
+			after_state, created_at, expires_at
+		FROM audit_log
+		WHERE (expires_at IS NULL OR expires_at > now())`
+	var args []any
+	if f.AgentID != "" {
+		query += " AND agent_id = " + placeholder(&args, f.AgentID)
+	}
+	if f.Action != "" {
+		query += " AND action = " + placeholder(&args, f.Action)
+	}
+	if !f.Since.IsZero() {
+		query += " AND created_at >= " + placeholder(&args, f.Since)
+	}
+	if after != nil {
+		query += " AND (created_at, seq) < (" + placeholder(&args, after.At) + ", " + placeholder(&args, after.Seq) + ")"
+	}
+	query += " ORDER BY created_at DESC, seq DESC"
+	if f.Limit > 0 {
+		query += " LIMIT " + placeholder(&args, f.Limit+1)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	var seqs []int64
+	for rows.Next() {
+		var e AuditEvent
+		var seq int64
+		var beforeState, afterState []byte
+		if err := rows.Scan(&seq, &e.ID, &e.Action, &e.Actor, &e.AgentID, &e.Target, &e.IP, &e.RequestID,
+			&beforeState, &afterState, &e.CreatedAt, &e.ExpiresAt); err != nil {
+			return nil, "", err
+		}
+		if beforeState != nil {
+			e.Before = json.RawMessage(beforeState)
+		}
+		if afterState != nil {
+			e.After = json.RawMessage(afterState)
+		}
+		e.CreatedAt = e.CreatedAt.UTC()
+		e.ExpiresAt = utcPtr(e.ExpiresAt)
+		events = append(events, e)
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[:f.Limit]
+		next = encodeCursor(pageKey{At: events[f.Limit-1].CreatedAt, Seq: seqs[f.Limit-1]})
+	}
+	return events, next, nil
+}
+
+// ---------------------------------------------------------------------------
+// Webhook operations
+// ---------------------------------------------------------------------------
+
+func (s *PostgresStore) CreateWebhook(ctx context.Context, wh *Webhook) error {
+	_, err := s.pool.Exec(ctx, `INSERT INTO webhooks (id, url, secret, events, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		wh.ID, wh.URL, wh.Secret, pgStrings(wh.Events), creationTime(wh.CreatedAt))
+	return err
+}
+
+func scanPostgresWebhook(row rowScanner) (*Webhook, error) {
+	var wh Webhook
+	if err := row.Scan(&wh.ID, &wh.URL, &wh.Secret, &wh.Events, &wh.CreatedAt); err != nil {
+		return nil, err
+	}
+	wh.Events = pgStringsOut(wh.Events)
+	wh.CreatedAt = wh.CreatedAt.UTC()
+	return &wh, nil
+}
+
+func (s *PostgresStore) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	wh, err := scanPostgresWebhook(s.pool.QueryRow(ctx, `
+		SELECT id, url, secret, events, created_at FROM webhooks WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return wh, err
+}
+
+func (s *PostgresStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, url, secret, events, created_at
+		FROM webhooks ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		wh, err := scanPostgresWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes the webhook and its delivery log.
+func (s *PostgresStore) DeleteWebhook(ctx context.Context, id string) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("webhook not found: %s", id)
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = $1`, id)
+		return err
+	})
+}
+
+// PutWebhookDelivery also prunes finished deliveries older than
+// webhookDeliveryRetention.
+func (s *PostgresStore) PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO webhook_deliveries (id, webhook_id, event_id, event_type, payload,
+			status, attempts, response_code, error, next_attempt_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (id) DO UPDATE SET
+			webhook_id = excluded.webhook_id, event_id = excluded.event_id,
+			event_type = excluded.event_type, payload = excluded.payload,
+			status = excluded.status, attempts = excluded.attempts,
+			response_code = excluded.response_code, error = excluded.error,
+			next_attempt_at = excluded.next_attempt_at, created_at = excluded.created_at,
+			updated_at = excluded.updated_at`,
+		d.ID, d.WebhookID, d.EventID, d.EventType, string(d.Payload),
+		d.Status, d.Attempts, d.ResponseCode, d.Error, d.NextAttemptAt,
+		d.CreatedAt, d.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pool.Exec(ctx, `DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < $1`,
+		time.Now().Add(-webhookDeliveryRetention))
+	return err
+}
+
+func (s *PostgresStore) ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) ([]WebhookDelivery, string, error) {
+	after, err := keysetPage(f.Page)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `
+		SELECT seq, id, webhook_id, event_id, event_type, payload, status, attempts,
+			response_code, error, next_attempt_at, created_at, updated_at
+		FROM webhook_deliveries WHERE true`
+	var args []any
+	if f.WebhookID != "" {
+		query += " AND webhook_id = " + placeholder(&args, f.WebhookID)
+	}
+	if f.Status != "" {
+		query += " AND status = " + placeholder(&args, f.Status)
+	}
+	if !f.DueBefore.IsZero() {
+		query += " AND status = 'pending' AND next_attempt_at <= " + placeholder(&args, f.DueBefore)
+	}
+	if after != nil {
+		query += " AND (created_at, seq) < (" + placeholder(&args, after.At) + ", " + placeholder(&args, after.Seq) + ")"
+	}
+	query += " ORDER BY created_at DESC, seq DESC"
+	if f.Limit > 0 {
+		query += " LIMIT " + placeholder(&args, f.Limit+1)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	var seqs []int64
+	for rows.Next() {
+		var d WebhookDelivery
+		var seq int64
+		var payload string
+		if err := rows.Scan(&seq, &d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+			&d.ResponseCode, &d.Error, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, "", err
+		}
+		d.Payload = json.RawMessage(payload)
+		d.NextAttemptAt = utcPtr(d.NextAttemptAt)
+		d.CreatedAt = d.CreatedAt.UTC()
+		d.UpdatedAt = d.UpdatedAt.UTC()
+		deliveries = append(deliveries, d)
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if f.Limit > 0 && len(deliveries) > f.Limit {
+		deliveries = deliveries[:f.Limit]
+		next = encodeCursor(pageKey{At: deliveries[f.Limit-1].CreatedAt, Seq: seqs[f.Limit-1]})
+	}
+	return deliveries, next, nil
+}
+
+// ---------------------------------------------------------------------------
+// Rate limiting
+// ---------------------------------------------------------------------------
+
+// RateLimiter returns a RateLimiter that keeps its buckets in this database,
+// so limits are shared by every API process.
+func (s *PostgresStore) RateLimiter() RateLimiter {
+	return &postgresRateLimiter{pool: s.pool, now: time.Now}
+}
+
+type postgresRateLimiter struct {
+	pool *pgxpool.Pool
+	now  func() time.Time
+
+	mu        sync.Mutex // guards lastSweep
+	lastSweep time.Time
+}
+
+func (rl *postgresRateLimiter) Allow(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	now := rl.now()
+
+	// Buckets that have refilled completely are equivalent to missing ones
+	rl.mu.Lock()
+	sweep := now.Sub(rl.lastSweep) > time.Minute
+	if sweep {
+		rl.lastSweep = now
+	}
+	rl.mu.Unlock()
+	if sweep {
+		if _, err := rl.pool.Exec(ctx, `DELETE FROM rate_limits WHERE full_at <= $1`, now.UnixNano()); err != nil {
+			return RateLimitResult{}, fmt.Errorf("sweep rate limits: %w", err)
+		}
+	}
+
+	var res RateLimitResult
+	err := pgx.BeginFunc(ctx, rl.pool, func(tx pgx.Tx) error {
+		// Serialize requests for the same bucket across processes; a row
+		// lock would not cover a bucket that does not exist yet.
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+			return err
+		}
+
+		var state bucketState
+		var updated int64
+		err := tx.QueryRow(ctx, `SELECT tokens, updated_at FROM rate_limits WHERE key = $1`, key).Scan(&state.Tokens, &updated)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+		case err != nil:
+			return err
+		default:
+			state.Updated = time.Unix(0, updated)
+		}
+
+		state, res = takeToken(state, p, now)
+		_, err = tx.Exec(ctx, `
+			INSERT INTO rate_limits (key, tokens, updated_at, full_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (key) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at, full_at = excluded.full_at`,
+			key, state.Tokens, now.UnixNano(), now.Add(res.Reset).UnixNano())
+		return err
+	})
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return res, nil
+}
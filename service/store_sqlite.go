@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -15,14 +19,9 @@ type SQLiteStore struct {
 }
 
 func NewSQLiteStore(path string) (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite", path)
+	db, err := openSQLite(path)
 	if err != nil {
-		return nil, fmt.Errorf("open db: %w", err)
-	}
-
-	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("set WAL mode: %w", err)
+		return nil, err
 	}
 
 	if err := migrateSQLite(db); err != nil {
@@ -33,12 +32,53 @@ func NewSQLiteStore(path string) (*SQLiteStore, error) {
 	return &SQLiteStore{db: db}, nil
 }
 
+// openSQLite opens the database without migrating it.
+func openSQLite(path string) (*sql.DB, error) {
+	// Webhook deliveries are written from background goroutines, so
+	// writers wait for the lock rather than failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("set WAL mode: %w", err)
+	}
+	return db, nil
+}
+
 func (s *SQLiteStore) Close() error {
 	return s.db.Close()
 }
 
-func migrateSQLite(db *sql.DB) error {
-	_, err := db.Exec(`
+// Ping reads from the agents table, which fails if the database is locked,
+// unreadable or missing its schema.
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	var n int
+	return s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (SELECT 1 FROM agents LIMIT 1)`).Scan(&n)
+}
+
+// ---------------------------------------------------------------------------
+// Migrations
+// ---------------------------------------------------------------------------
+
+// sqliteMigration is one numbered step of the schema. Its version is its
+// index in sqliteMigrations plus one.
+type sqliteMigration struct {
+	name string
+	up   func(tx *sql.Tx) error
+}
+
+// sqliteMigrations are applied in order, each in its own transaction.
+// Applied migrations must never be edited: append a new one instead.
+//
+// Databases created before migrations were versioned have no
+// schema_migrations table and start at version 0, so every step must also
+// succeed on a schema that already has its changes: tables, indexes and
+// triggers are created IF NOT EXISTS and columns with addSQLiteColumn.
+var sqliteMigrations = []sqliteMigration{
+	{"initial schema", sqliteExec(`
 		CREATE TABLE IF NOT EXISTS agents (
 			id               TEXT PRIMARY KEY,
 			name             TEXT NOT NULL,
@@ -70,19 +110,35 @@ func migrateSQLite(db *sql.DB) error {
 
 		CREATE INDEX IF NOT EXISTS idx_backups_agent_created
 			ON backups(agent_id, created_at);
-	`)
-	if err != nil {
-		return err
-	}
+	`)},
+
+	{"agent status", addSQLiteColumn("agents", "status", "TEXT NOT NULL DEFAULT 'active'")},
+
+	{"backup soft delete", addSQLiteColumn("backups", "deleted_at", "TEXT")},
+
+	{"agent plan and tags", sqliteSteps(
+		addSQLiteColumn("agents", "plan", "TEXT NOT NULL DEFAULT ''"),
+		addSQLiteColumn("agents", "tags", "TEXT NOT NULL DEFAULT ''"),
+	)},
 
-	// Migration: add status column to existing databases
-	_, _ = db.Exec(`ALTER TABLE agents ADD COLUMN status TEXT NOT NULL DEFAULT 'active'`)
+	{"agent status reason", addSQLiteColumn("agents", "status_reason", "TEXT NOT NULL DEFAULT ''")},
 
-	// Migration: add deleted_at column for soft-delete
-	_, _ = db.Exec(`ALTER TABLE backups ADD COLUMN deleted_at TEXT`)
+	{"agent approval rule", addSQLiteColumn("agents", "approval_rule", "TEXT NOT NULL DEFAULT ''")},
 
-	// Migration: invite codes table
-	_, err = db.Exec(`
+	{"agent organization", addSQLiteColumn("agents", "org_id", "TEXT NOT NULL DEFAULT ''")},
+
+	{"stale agents", sqliteSteps(
+		addSQLiteColumn("agents", "stale_after_hours", "INTEGER NOT NULL DEFAULT 0"),
+		addSQLiteColumn("agents", "stale_since", "TEXT"),
+		sqliteExec(`CREATE INDEX IF NOT EXISTS idx_agents_org ON agents(org_id)`),
+	)},
+
+	{"agent contact email", sqliteSteps(
+		addSQLiteColumn("agents", "contact_email", "TEXT NOT NULL DEFAULT ''"),
+		addSQLiteColumn("agents", "email_opt_outs", "TEXT NOT NULL DEFAULT ''"),
+	)},
+
+	{"invite codes", sqliteExec(`
 		CREATE TABLE IF NOT EXISTS invite_codes (
 			code       TEXT PRIMARY KEY,
 			max_uses   INTEGER NOT NULL DEFAULT 0,
@@ -91,134 +147,602 @@ func migrateSQLite(db *sql.DB) error {
 			created_at TEXT NOT NULL DEFAULT (datetime('now')),
 			revoked_at TEXT
 		)
-	`)
+	`)},
+
+	{"invite code grants", sqliteSteps(
+		addSQLiteColumn("invite_codes", "plan", "TEXT NOT NULL DEFAULT ''"),
+		addSQLiteColumn("invite_codes", "quota_bytes", "INTEGER NOT NULL DEFAULT 0"),
+		addSQLiteColumn("invite_codes", "tags", "TEXT NOT NULL DEFAULT ''"),
+		addSQLiteColumn("invite_codes", "hostname_pattern", "TEXT NOT NULL DEFAULT ''"),
+		addSQLiteColumn("invite_codes", "org_id", "TEXT NOT NULL DEFAULT ''"),
+	)},
+
+	{"organizations", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS orgs (
+			id          TEXT PRIMARY KEY,
+			name        TEXT NOT NULL,
+			quota_bytes INTEGER NOT NULL DEFAULT 0,
+			created_at  TEXT NOT NULL DEFAULT (datetime('now'))
+		);
+
+		CREATE TABLE IF NOT EXISTS org_api_keys (
+			id         TEXT PRIMARY KEY,
+			org_id     TEXT NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+			key_hash   TEXT NOT NULL UNIQUE,
+			name       TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL DEFAULT (datetime('now'))
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_org_api_keys_org
+			ON org_api_keys(org_id);
+	`)},
+
+	{"invite redemptions", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS invite_redemptions (
+			code        TEXT NOT NULL,
+			agent_id    TEXT NOT NULL,
+			ip          TEXT NOT NULL DEFAULT '',
+			redeemed_at TEXT NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (code, agent_id)
+		)
+	`)},
+
+	{"registration bans", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS bans (
+			id         TEXT PRIMARY KEY,
+			kind       TEXT NOT NULL,
+			value      TEXT NOT NULL,
+			reason     TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL DEFAULT (datetime('now'))
+		)
+	`)},
+
+	{"auto-approval rules", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS approval_rules (
+			id             TEXT PRIMARY KEY,
+			name           TEXT NOT NULL DEFAULT '',
+			priority       INTEGER NOT NULL DEFAULT 0,
+			source_cidrs   TEXT NOT NULL DEFAULT '',
+			hostname_regex TEXT NOT NULL DEFAULT '',
+			os             TEXT NOT NULL DEFAULT '',
+			arch           TEXT NOT NULL DEFAULT '',
+			min_version    TEXT NOT NULL DEFAULT '',
+			max_version    TEXT NOT NULL DEFAULT '',
+			fingerprints   TEXT NOT NULL DEFAULT '',
+			approve        INTEGER NOT NULL DEFAULT 0,
+			plan           TEXT NOT NULL DEFAULT '',
+			created_at     TEXT NOT NULL DEFAULT (datetime('now'))
+		)
+	`)},
+
+	{"recovery codes", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			code_hash  TEXT PRIMARY KEY,
+			agent_id   TEXT NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+			expires_at TEXT NOT NULL,
+			created_at TEXT NOT NULL DEFAULT (datetime('now')),
+			used_at    TEXT
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_recovery_codes_agent
+			ON recovery_codes(agent_id);
+	`)},
+
+	{"backup transfers", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS backup_transfers (
+			id              TEXT PRIMARY KEY,
+			source_agent_id TEXT NOT NULL,
+			target_agent_id TEXT NOT NULL,
+			mode            TEXT NOT NULL,
+			status          TEXT NOT NULL,
+			total_count     INTEGER NOT NULL DEFAULT 0,
+			done_count      INTEGER NOT NULL DEFAULT 0,
+			error           TEXT NOT NULL DEFAULT '',
+			created_at      TEXT NOT NULL DEFAULT (datetime('now')),
+			updated_at      TEXT NOT NULL DEFAULT (datetime('now'))
+		)
+	`)},
+
+	// Times are unix nanoseconds since buckets refill continuously.
+	{"rate limit buckets", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS rate_limits (
+			key        TEXT PRIMARY KEY,
+			tokens     REAL NOT NULL,
+			updated_at INTEGER NOT NULL,
+			full_at    INTEGER NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_rate_limits_full
+			ON rate_limits(full_at);
+	`)},
+
+	// Times are unix nanoseconds so that events order exactly; triggers
+	// keep the table append-only except for expired rows.
+	{"audit log", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id           TEXT PRIMARY KEY,
+			action       TEXT NOT NULL,
+			actor        TEXT NOT NULL,
+			agent_id     TEXT NOT NULL DEFAULT '',
+			target       TEXT NOT NULL DEFAULT '',
+			ip           TEXT NOT NULL DEFAULT '',
+			request_id   TEXT NOT NULL DEFAULT '',
+			before_state TEXT,
+			after_state  TEXT,
+			created_at   INTEGER NOT NULL,
+			expires_at   INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_audit_log_agent
+			ON audit_log(agent_id, created_at);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_created
+			ON audit_log(created_at);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_expires
+			ON audit_log(expires_at);
+
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_update
+			BEFORE UPDATE ON audit_log
+			BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_delete
+			BEFORE DELETE ON audit_log
+			WHEN OLD.expires_at IS NULL OR OLD.expires_at > CAST(strftime('%s', 'now') AS INTEGER) * 1000000000
+			BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+	`)},
+
+	// Delivery times are unix nanoseconds, like the audit log's.
+	{"webhooks", sqliteExec(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id         TEXT PRIMARY KEY,
+			url        TEXT NOT NULL,
+			secret     TEXT NOT NULL,
+			events     TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL DEFAULT (datetime('now'))
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id              TEXT PRIMARY KEY,
+			webhook_id      TEXT NOT NULL,
+			event_id        TEXT NOT NULL,
+			event_type      TEXT NOT NULL,
+			payload         TEXT NOT NULL,
+			status          TEXT NOT NULL,
+			attempts        INTEGER NOT NULL DEFAULT 0,
+			response_code   INTEGER NOT NULL DEFAULT 0,
+			error           TEXT NOT NULL DEFAULT '',
+			next_attempt_at INTEGER,
+			created_at      INTEGER NOT NULL,
+			updated_at      INTEGER NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook
+			ON webhook_deliveries(webhook_id, created_at);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due
+			ON webhook_deliveries(status, next_attempt_at);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_created
+			ON webhook_deliveries(created_at);
+	`)},
+
+	{"backup creation time index", sqliteExec(`
+		CREATE INDEX IF NOT EXISTS idx_backups_created
+			ON backups(created_at);
+	`)},
+}
+
+func sqliteExec(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+func sqliteSteps(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addSQLiteColumn adds a column unless the table already has it. SQLite has
+// no ADD COLUMN IF NOT EXISTS, and any other failure must not be mistaken
+// for the column existing.
+func addSQLiteColumn(table, column, decl string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+		if err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+		return err
+	}
+}
+
+// migrateSQLite applies the migrations newer than the database's schema
+// version. It refuses to touch a schema newer than this binary knows.
+func migrateSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL DEFAULT '',
+			applied_at TEXT NOT NULL DEFAULT (datetime('now'))
+		)`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := sqliteAppliedMigrations(db)
 	if err != nil {
 		return err
 	}
+	current := schemaVersion(applied)
+	if current > len(sqliteMigrations) {
+		return schemaTooNewError(current, len(sqliteMigrations))
+	}
 
+	for v := current + 1; v <= len(sqliteMigrations); v++ {
+		m := sqliteMigrations[v-1]
+		if err := applySQLiteMigration(db, v, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", v, m.name, err)
+		}
+	}
 	return nil
 }
 
+func applySQLiteMigration(db *sql.DB, version int, m sqliteMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteAppliedMigrations lists schema_migrations, oldest first. A database
+// without the table has none.
+func sqliteAppliedMigrations(db *sql.DB) ([]appliedMigration, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&n); err != nil || n == 0 {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var m appliedMigration
+		var appliedAt string
+		if err := rows.Scan(&m.Version, &m.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		m.AppliedAt, _ = time.Parse("2006-01-02 15:04:05", appliedAt)
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
 // ---------------------------------------------------------------------------
 // Agent operations
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteStore) CreateAgent(a *Agent, tokenHash string) error {
-	_, err := s.db.Exec(`
-		INSERT INTO agents (id, name, hostname, os, arch, openclaw_version,
-			fingerprint, encrypt_tool, public_key, token_hash, status, quota_bytes)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		a.ID, a.Name, a.Hostname, a.OS, a.Arch, a.OpenClawVersion,
-		a.Fingerprint, a.EncryptTool, a.PublicKey, tokenHash, a.Status, a.QuotaBytes,
-	)
-	return err
+// sqliteAgentColumns is the column list read by scanSQLiteAgent.
+const sqliteAgentColumns = `id, name, hostname, os, arch, openclaw_version,
+	fingerprint, encrypt_tool, public_key, status, status_reason, quota_bytes,
+	used_bytes, plan, tags, approval_rule, org_id, stale_after_hours, stale_since,
+	contact_email, email_opt_outs, created_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func (s *SQLiteStore) LookupAgentByToken(token string) (*Agent, error) {
-	h := HashToken(token)
-	row := s.db.QueryRow(`
-		SELECT id, name, hostname, os, arch, openclaw_version,
-			fingerprint, encrypt_tool, public_key, status, quota_bytes, used_bytes, created_at
-		FROM agents WHERE token_hash = ?`, h)
+// sqliteExecer is satisfied by *sql.DB and *sql.Tx.
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
 
+func scanSQLiteAgent(row rowScanner) (*Agent, error) {
 	a := &Agent{}
-	var createdAt string
+	var tags, optOuts, createdAt string
+	var staleSince sql.NullString
 	err := row.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch,
 		&a.OpenClawVersion, &a.Fingerprint, &a.EncryptTool, &a.PublicKey,
-		&a.Status, &a.QuotaBytes, &a.UsedBytes, &createdAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+		&a.Status, &a.StatusReason, &a.QuotaBytes, &a.UsedBytes, &a.Plan, &tags, &a.ApprovalRuleID, &a.OrgID,
+		&a.StaleAfterHours, &staleSince, &a.ContactEmail, &optOuts, &createdAt)
 	if err != nil {
 		return nil, err
 	}
+	a.Tags = decodeStrings(tags)
+	a.EmailOptOuts = decodeStrings(optOuts)
+	if staleSince.Valid {
+		t, _ := time.Parse("2006-01-02 15:04:05", staleSince.String)
+		a.StaleSince = &t
+	}
 	a.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
 	return a, nil
 }
 
-func (s *SQLiteStore) GetAgent(id string) (*Agent, error) {
-	row := s.db.QueryRow(`
-		SELECT id, name, hostname, os, arch, openclaw_version,
-			fingerprint, encrypt_tool, public_key, status, quota_bytes, used_bytes, created_at
-		FROM agents WHERE id = ?`, id)
+// encodeStrings stores a string list as a JSON array ("" for none).
+func encodeStrings(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
 
-	a := &Agent{}
-	var createdAt string
-	err := row.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch,
-		&a.OpenClawVersion, &a.Fingerprint, &a.EncryptTool, &a.PublicKey,
-		&a.Status, &a.QuotaBytes, &a.UsedBytes, &createdAt)
+func decodeStrings(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var list []string
+	_ = json.Unmarshal([]byte(s), &list)
+	return list
+}
+
+func (s *SQLiteStore) CreateAgent(ctx context.Context, a *Agent, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO agents (id, name, hostname, os, arch, openclaw_version,
+			fingerprint, encrypt_tool, public_key, token_hash, status, quota_bytes,
+			plan, tags, approval_rule, org_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.Name, a.Hostname, a.OS, a.Arch, a.OpenClawVersion,
+		a.Fingerprint, a.EncryptTool, a.PublicKey, tokenHash, a.Status, a.QuotaBytes,
+		a.Plan, encodeStrings(a.Tags), a.ApprovalRuleID, a.OrgID,
+		creationTime(a.CreatedAt).Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) LookupAgentByToken(ctx context.Context, token string) (*Agent, error) {
+	h := HashToken(token)
+	a, err := scanSQLiteAgent(s.db.QueryRowContext(ctx, `
+		SELECT `+sqliteAgentColumns+`
+		FROM agents WHERE token_hash = ?`, h))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
+	return a, err
+}
+
+func (s *SQLiteStore) AgentTokenHash(ctx context.Context, agentID string) (string, error) {
+	var tokenHash string
+	err := s.db.QueryRowContext(ctx, `SELECT token_hash FROM agents WHERE id = ?`, agentID).Scan(&tokenHash)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	a.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
-	return a, nil
+	return tokenHash, err
+}
+
+func (s *SQLiteStore) GetAgent(ctx context.Context, id string) (*Agent, error) {
+	a, err := scanSQLiteAgent(s.db.QueryRowContext(ctx, `
+		SELECT `+sqliteAgentColumns+`
+		FROM agents WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
 }
 
-func (s *SQLiteStore) RotateAgentToken(agentID, newTokenHash string) error {
-	_, err := s.db.Exec(`UPDATE agents SET token_hash = ? WHERE id = ?`, newTokenHash, agentID)
+func (s *SQLiteStore) RotateAgentToken(ctx context.Context, agentID, newTokenHash string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE agents SET token_hash = ? WHERE id = ?`, newTokenHash, agentID)
 	return err
 }
 
-func (s *SQLiteStore) UpdateAgentProfile(agentID, name string) error {
-	_, err := s.db.Exec(`UPDATE agents SET name = ? WHERE id = ?`, name, agentID)
+func (s *SQLiteStore) UpdateAgentProfile(ctx context.Context, agentID, name string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE agents SET name = ? WHERE id = ?`, name, agentID)
 	return err
 }
 
-func (s *SQLiteStore) UpdateUsedBytes(agentID string) error {
-	_, err := s.db.Exec(`
+func (s *SQLiteStore) UpdateUsedBytes(ctx context.Context, agentID string) error {
+	_, err := s.db.ExecContext(ctx, `
 		UPDATE agents SET used_bytes = (
 			SELECT COALESCE(SUM(encrypted_bytes), 0) FROM backups WHERE agent_id = ? AND deleted_at IS NULL
 		) WHERE id = ?`, agentID, agentID)
 	return err
 }
 
-func (s *SQLiteStore) ListAgents(status string) ([]Agent, error) {
-	var rows *sql.Rows
-	var err error
+func (s *SQLiteStore) ListAgents(ctx context.Context, f AgentFilter) ([]Agent, string, error) {
+	after, err := keysetPage(f.Page)
+	if err != nil {
+		return nil, "", err
+	}
+	var where []string
+	var args []interface{}
+	if after != nil {
+		where = append(where, "(created_at, id) < (?, ?)")
+		args = append(args, after.At.UTC().Format("2006-01-02 15:04:05"), after.Key)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.OrgID != "" {
+		where = append(where, "org_id = ?")
+		args = append(args, f.OrgID)
+	}
+	if f.Stale {
+		where = append(where, "stale_since IS NOT NULL")
+	}
 
-	if status != "" {
-		rows, err = s.db.Query(`
-			SELECT id, name, hostname, os, arch, openclaw_version,
-				fingerprint, encrypt_tool, public_key, status, quota_bytes, used_bytes, created_at
-			FROM agents WHERE status = ? ORDER BY created_at DESC`, status)
-	} else {
-		rows, err = s.db.Query(`
-			SELECT id, name, hostname, os, arch, openclaw_version,
-				fingerprint, encrypt_tool, public_key, status, quota_bytes, used_bytes, created_at
-			FROM agents ORDER BY created_at DESC`)
+	query := `SELECT ` + sqliteAgentColumns + ` FROM agents`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
 	}
+	query += ` ORDER BY created_at DESC, id DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit+1) // one more tells whether there is a next page
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
 	var agents []Agent
 	for rows.Next() {
-		var a Agent
-		var createdAt string
-		if err := rows.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch,
-			&a.OpenClawVersion, &a.Fingerprint, &a.EncryptTool, &a.PublicKey,
-			&a.Status, &a.QuotaBytes, &a.UsedBytes, &createdAt); err != nil {
-			return nil, err
+		a, err := scanSQLiteAgent(rows)
+		if err != nil {
+			return nil, "", err
 		}
-		a.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
-		agents = append(agents, a)
+		agents = append(agents, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if f.Limit > 0 && len(agents) > f.Limit {
+		agents = agents[:f.Limit]
+		last := agents[f.Limit-1]
+		next = encodeCursor(pageKey{At: last.CreatedAt, Key: last.ID})
+	}
+	return agents, next, nil
+}
+
+func (s *SQLiteStore) SetAgentOrg(ctx context.Context, agentID, orgID string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE agents SET org_id = ? WHERE id = ?`, orgID, agentID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE agents SET stale_after_hours = ? WHERE id = ?`, hours, agentID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentStale(ctx context.Context, agentID string, since *time.Time) error {
+	var staleSince interface{}
+	if since != nil {
+		staleSince = since.UTC().Format("2006-01-02 15:04:05")
+	}
+	_, err := s.db.ExecContext(ctx, `UPDATE agents SET stale_since = ? WHERE id = ?`, staleSince, agentID)
+	return err
+}
+
+func (s *SQLiteStore) SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE agents SET contact_email = ?, email_opt_outs = ? WHERE id = ?`,
+		email, encodeStrings(optOuts), agentID)
+	if err != nil {
+		return err
 	}
-	return agents, rows.Err()
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	return nil
 }
 
-func (s *SQLiteStore) CountAgentsByStatus(status string) (int, error) {
-	row := s.db.QueryRow(`SELECT COUNT(*) FROM agents WHERE status = ?`, status)
+func (s *SQLiteStore) CountAgentsByStatus(ctx context.Context, status string) (int, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM agents WHERE status = ?`, status)
 	var count int
 	err := row.Scan(&count)
 	return count, err
 }
 
-func (s *SQLiteStore) UpdateAgentStatus(id, status string) error {
-	res, err := s.db.Exec(`UPDATE agents SET status = ? WHERE id = ?`, status, id)
+func (s *SQLiteStore) FleetStats(ctx context.Context, opts StatsOptions) (*FleetStats, error) {
+	stats := newFleetStats()
+
+	// One pass over the agents, grouped by every dimension reported.
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT status, plan, os, arch, openclaw_version, COUNT(*), COALESCE(SUM(used_bytes), 0)
+		FROM agents
+		GROUP BY status, plan, os, arch, openclaw_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status, plan, osName, arch, version string
+		var count int
+		var used int64
+		if err := rows.Scan(&status, &plan, &osName, &arch, &version, &count, &used); err != nil {
+			return nil, err
+		}
+		stats.AgentsByStatus[status] += count
+		stats.UsedBytes += used
+		stats.UsedBytesByPlan[plan] += used
+		stats.ByOS[osName] += count
+		stats.ByArch[arch] += count
+		stats.ByVersion[version] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	day := opts.Now.Add(-24 * time.Hour).UTC().Format("2006-01-02 15:04:05")
+	week := opts.Now.Add(-7 * 24 * time.Hour).UTC().Format("2006-01-02 15:04:05")
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(created_at >= ?), 0), COUNT(*)
+		FROM backups WHERE created_at >= ? AND deleted_at IS NULL`, day, week).Scan(&stats.Backups24h, &stats.Backups7d)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM agents a
+		WHERE a.status = 'active' AND NOT EXISTS (
+			SELECT 1 FROM backups b WHERE b.agent_id = a.id AND b.created_at >= ? AND b.deleted_at IS NULL)`,
+		opts.InactiveSince.UTC().Format("2006-01-02 15:04:05")).Scan(&stats.InactiveAgents)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.TopN > 0 {
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT id, name, used_bytes FROM agents
+			WHERE used_bytes > 0
+			ORDER BY used_bytes DESC, id LIMIT ?`, opts.TopN)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var u AgentUsage
+			if err := rows.Scan(&u.AgentID, &u.Name, &u.UsedBytes); err != nil {
+				return nil, err
+			}
+			stats.TopConsumers = append(stats.TopConsumers, u)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *SQLiteStore) UpdateAgentStatus(ctx context.Context, id, status, reason string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE agents SET status = ?, status_reason = ? WHERE id = ?`, status, reason, id)
 	if err != nil {
 		return err
 	}
@@ -233,31 +757,62 @@ func (s *SQLiteStore) UpdateAgentStatus(id, status string) error {
 // Backup operations
 // ---------------------------------------------------------------------------
 
-func (s *SQLiteStore) CreateBackup(b *Backup) error {
-	_, err := s.db.Exec(`
+// CreateBackup inserts b only if the agent and its org have room for it;
+// the checks and the insert are one statement.
+func (s *SQLiteStore) CreateBackup(ctx context.Context, b *Backup) error {
+	res, err := s.db.ExecContext(ctx, `
 		INSERT INTO backups (agent_id, timestamp, encrypted_bytes, source_file_count,
 			encrypted_sha256, s3_key, manifest_s3_key)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT used_bytes + ? <= quota_bytes FROM agents WHERE id = ?)
+		AND NOT EXISTS (
+			SELECT 1 FROM agents a JOIN orgs o ON o.id = a.org_id
+			WHERE a.id = ? AND o.quota_bytes > 0
+			AND (SELECT SUM(used_bytes) FROM agents WHERE org_id = o.id) + ? > o.quota_bytes)`,
 		b.AgentID, b.Timestamp, b.EncryptedBytes, b.SourceFileCount,
 		b.EncryptedSHA256, b.S3Key, b.ManifestS3Key,
+		b.EncryptedBytes, b.AgentID,
+		b.AgentID, b.EncryptedBytes,
 	)
 	if err != nil {
 		return err
 	}
-	return s.UpdateUsedBytes(b.AgentID)
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// SQLite serializes writes, so the usage is still what refused it
+		var agentFull bool
+		err := s.db.QueryRowContext(ctx, `SELECT used_bytes + ? > quota_bytes FROM agents WHERE id = ?`,
+			b.EncryptedBytes, b.AgentID).Scan(&agentFull)
+		if err == nil && !agentFull {
+			return ErrOrgQuotaExceeded
+		}
+		return ErrQuotaExceeded
+	}
+	return s.UpdateUsedBytes(ctx, b.AgentID)
 }
 
-func (s *SQLiteStore) ListBackups(agentID string, limit int) ([]Backup, error) {
-	if limit <= 0 {
-		limit = 100
+func (s *SQLiteStore) ListBackups(ctx context.Context, agentID string, p Page) ([]Backup, string, error) {
+	after, err := keysetPage(p)
+	if err != nil {
+		return nil, "", err
 	}
-	rows, err := s.db.Query(`
+	query := `
 		SELECT agent_id, timestamp, encrypted_bytes, source_file_count,
 			encrypted_sha256, s3_key, manifest_s3_key, created_at
-		FROM backups WHERE agent_id = ? AND deleted_at IS NULL
-		ORDER BY created_at DESC LIMIT ?`, agentID, limit)
+		FROM backups WHERE agent_id = ? AND deleted_at IS NULL`
+	args := []any{agentID}
+	if after != nil {
+		query += ` AND (created_at, timestamp) < (?, ?)`
+		args = append(args, after.At.UTC().Format("2006-01-02 15:04:05"), after.Key)
+	}
+	query += ` ORDER BY created_at DESC, timestamp DESC`
+	if p.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, p.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
@@ -268,16 +823,25 @@ func (s *SQLiteStore) ListBackups(agentID string, limit int) ([]Backup, error) {
 		if err := rows.Scan(&b.AgentID, &b.Timestamp, &b.EncryptedBytes,
 			&b.SourceFileCount, &b.EncryptedSHA256, &b.S3Key,
 			&b.ManifestS3Key, &createdAt); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		b.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
 		backups = append(backups, b)
 	}
-	return backups, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if p.Limit > 0 && len(backups) > p.Limit {
+		backups = backups[:p.Limit]
+		last := backups[p.Limit-1]
+		next = encodeCursor(pageKey{At: last.CreatedAt, Key: last.Timestamp})
+	}
+	return backups, next, nil
 }
 
-func (s *SQLiteStore) CountBackups(agentID string) (int, int64, error) {
-	row := s.db.QueryRow(`
+func (s *SQLiteStore) CountBackups(ctx context.Context, agentID string) (int, int64, error) {
+	row := s.db.QueryRowContext(ctx, `
 		SELECT COUNT(*), COALESCE(SUM(encrypted_bytes), 0)
 		FROM backups WHERE agent_id = ? AND deleted_at IS NULL`, agentID)
 	var count int
@@ -286,8 +850,8 @@ func (s *SQLiteStore) CountBackups(agentID string) (int, int64, error) {
 	return count, totalBytes, err
 }
 
-func (s *SQLiteStore) GetBackup(agentID, timestamp string) (*Backup, error) {
-	row := s.db.QueryRow(`
+func (s *SQLiteStore) GetBackup(ctx context.Context, agentID, timestamp string) (*Backup, error) {
+	row := s.db.QueryRowContext(ctx, `
 		SELECT agent_id, timestamp, encrypted_bytes, source_file_count,
 			encrypted_sha256, s3_key, manifest_s3_key, created_at
 		FROM backups WHERE agent_id = ? AND timestamp = ? AND deleted_at IS NULL`, agentID, timestamp)
@@ -307,34 +871,34 @@ func (s *SQLiteStore) GetBackup(agentID, timestamp string) (*Backup, error) {
 	return b, nil
 }
 
-func (s *SQLiteStore) DeleteBackup(agentID, timestamp string) (*Backup, error) {
-	b, err := s.GetBackup(agentID, timestamp)
+func (s *SQLiteStore) DeleteBackup(ctx context.Context, agentID, timestamp string) (*Backup, error) {
+	b, err := s.GetBackup(ctx, agentID, timestamp)
 	if err != nil || b == nil {
 		return nil, err
 	}
-	_, err = s.db.Exec(`UPDATE backups SET deleted_at = datetime('now') WHERE agent_id = ? AND timestamp = ? AND deleted_at IS NULL`, agentID, timestamp)
+	_, err = s.db.ExecContext(ctx, `UPDATE backups SET deleted_at = datetime('now') WHERE agent_id = ? AND timestamp = ? AND deleted_at IS NULL`, agentID, timestamp)
 	if err != nil {
 		return nil, err
 	}
-	_ = s.UpdateUsedBytes(agentID)
+	_ = s.UpdateUsedBytes(ctx, agentID)
 	return b, nil
 }
 
-func (s *SQLiteStore) DeleteAllBackups(agentID string) ([]Backup, error) {
-	backups, err := s.ListBackups(agentID, 10000)
+func (s *SQLiteStore) DeleteAllBackups(ctx context.Context, agentID string) ([]Backup, error) {
+	backups, _, err := s.ListBackups(ctx, agentID, Page{})
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.db.Exec(`UPDATE backups SET deleted_at = datetime('now') WHERE agent_id = ? AND deleted_at IS NULL`, agentID)
+	_, err = s.db.ExecContext(ctx, `UPDATE backups SET deleted_at = datetime('now') WHERE agent_id = ? AND deleted_at IS NULL`, agentID)
 	if err != nil {
 		return nil, err
 	}
-	_ = s.UpdateUsedBytes(agentID)
+	_ = s.UpdateUsedBytes(ctx, agentID)
 	return backups, nil
 }
 
-func (s *SQLiteStore) UndeleteBackup(agentID, timestamp string) error {
-	res, err := s.db.Exec(`UPDATE backups SET deleted_at = NULL WHERE agent_id = ? AND timestamp = ? AND deleted_at IS NOT NULL`, agentID, timestamp)
+func (s *SQLiteStore) UndeleteBackup(ctx context.Context, agentID, timestamp string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE backups SET deleted_at = NULL WHERE agent_id = ? AND timestamp = ? AND deleted_at IS NOT NULL`, agentID, timestamp)
 	if err != nil {
 		return err
 	}
@@ -342,119 +906,966 @@ func (s *SQLiteStore) UndeleteBackup(agentID, timestamp string) error {
 	if n == 0 {
 		return fmt.Errorf("backup not found or not deleted")
 	}
-	_ = s.UpdateUsedBytes(agentID)
+	_ = s.UpdateUsedBytes(ctx, agentID)
 	return nil
 }
 
-// ---------------------------------------------------------------------------
-// Invite code operations
-// ---------------------------------------------------------------------------
-
-func (s *SQLiteStore) CreateInviteCode(code *InviteCode) error {
-	var expiresAt interface{}
-	if code.ExpiresAt != nil {
-		expiresAt = code.ExpiresAt.UTC().Format("2006-01-02 15:04:05")
+func (s *SQLiteStore) PutBackup(ctx context.Context, b *Backup) error {
+	createdAt := b.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	var deletedAt interface{}
+	if b.DeletedAt != nil {
+		deletedAt = b.DeletedAt.UTC().Format("2006-01-02 15:04:05")
 	}
-	_, err := s.db.Exec(`
-		INSERT INTO invite_codes (code, max_uses, use_count, expires_at)
-		VALUES (?, ?, 0, ?)`,
-		code.Code, code.MaxUses, expiresAt,
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO backups (agent_id, timestamp, encrypted_bytes, source_file_count,
+			encrypted_sha256, s3_key, manifest_s3_key, created_at, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.AgentID, b.Timestamp, b.EncryptedBytes, b.SourceFileCount,
+		b.EncryptedSHA256, b.S3Key, b.ManifestS3Key,
+		createdAt.UTC().Format("2006-01-02 15:04:05"), deletedAt,
 	)
 	return err
 }
 
-func (s *SQLiteStore) UseInviteCode(code string) (bool, error) {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return false, err
+func (s *SQLiteStore) PurgeBackup(ctx context.Context, agentID, timestamp string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM backups WHERE agent_id = ? AND timestamp = ?`, agentID, timestamp)
+	return err
+}
+
+func (s *SQLiteStore) LatestBackupTimes(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT agent_id, MAX(created_at) FROM backups GROUP BY agent_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := map[string]time.Time{}
+	for rows.Next() {
+		var agentID, createdAt string
+		if err := rows.Scan(&agentID, &createdAt); err != nil {
+			return nil, err
+		}
+		times[agentID], _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	}
+	return times, rows.Err()
+}
+
+func (s *SQLiteStore) ListAllBackups(ctx context.Context, agentID string) ([]Backup, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT agent_id, timestamp, encrypted_bytes, source_file_count,
+			encrypted_sha256, s3_key, manifest_s3_key, created_at, deleted_at
+		FROM backups WHERE agent_id = ?
+		ORDER BY created_at, timestamp`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var backups []Backup
+	for rows.Next() {
+		var b Backup
+		var createdAt string
+		var deletedAt *string
+		if err := rows.Scan(&b.AgentID, &b.Timestamp, &b.EncryptedBytes,
+			&b.SourceFileCount, &b.EncryptedSHA256, &b.S3Key,
+			&b.ManifestS3Key, &createdAt, &deletedAt); err != nil {
+			return nil, err
+		}
+		b.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+		if deletedAt != nil {
+			t, err := time.Parse("2006-01-02 15:04:05", *deletedAt)
+			if err == nil {
+				b.DeletedAt = &t
+			}
+		}
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+// ---------------------------------------------------------------------------
+// Backup transfer operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) PutTransfer(ctx context.Context, t *BackupTransfer) error {
+	createdAt := t.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO backup_transfers (id, source_agent_id, target_agent_id, mode, status,
+			total_count, done_count, error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))
+		ON CONFLICT(id) DO UPDATE SET
+			mode = excluded.mode, status = excluded.status,
+			total_count = excluded.total_count, done_count = excluded.done_count,
+			error = excluded.error, created_at = excluded.created_at,
+			updated_at = excluded.updated_at`,
+		t.ID, t.SourceAgentID, t.TargetAgentID, t.Mode, t.Status,
+		t.TotalCount, t.DoneCount, t.Error, createdAt.UTC().Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetTransfer(ctx context.Context, id string) (*BackupTransfer, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, source_agent_id, target_agent_id, mode, status,
+			total_count, done_count, error, created_at, updated_at
+		FROM backup_transfers WHERE id = ?`, id)
+
+	t := &BackupTransfer{}
+	var createdAt, updatedAt string
+	err := row.Scan(&t.ID, &t.SourceAgentID, &t.TargetAgentID, &t.Mode, &t.Status,
+		&t.TotalCount, &t.DoneCount, &t.Error, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	t.UpdatedAt, _ = time.Parse("2006-01-02 15:04:05", updatedAt)
+	return t, nil
+}
+
+// ---------------------------------------------------------------------------
+// Invite code operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) CreateInviteCode(ctx context.Context, code *InviteCode) error {
+	return insertSQLiteInviteCode(ctx, s.db, code)
+}
+
+// CreateInviteCodes inserts codes in one transaction.
+func (s *SQLiteStore) CreateInviteCodes(ctx context.Context, codes []*InviteCode) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
 	defer tx.Rollback()
 
-	row := tx.QueryRow(`
-		SELECT max_uses, use_count, expires_at, revoked_at
-		FROM invite_codes WHERE code = ?`, code)
+	for _, code := range codes {
+		if err := insertSQLiteInviteCode(ctx, tx, code); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-	var maxUses, useCount int
-	var expiresAtStr, revokedAtStr *string
-	if err := row.Scan(&maxUses, &useCount, &expiresAtStr, &revokedAtStr); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
+func insertSQLiteInviteCode(ctx context.Context, db sqliteExecer, code *InviteCode) error {
+	var expiresAt, revokedAt interface{}
+	if code.ExpiresAt != nil {
+		expiresAt = code.ExpiresAt.UTC().Format("2006-01-02 15:04:05")
+	}
+	if code.RevokedAt != nil {
+		revokedAt = code.RevokedAt.UTC().Format("2006-01-02 15:04:05")
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO invite_codes (code, max_uses, use_count, expires_at,
+			plan, quota_bytes, tags, hostname_pattern, org_id, created_at, revoked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		code.Code, code.MaxUses, code.UseCount, expiresAt,
+		code.Plan, code.QuotaBytes, encodeStrings(code.Tags), code.HostnamePattern, code.OrgID,
+		creationTime(code.CreatedAt).Format("2006-01-02 15:04:05"), revokedAt,
+	)
+	return err
+}
+
+// sqliteInviteCodeColumns is the column list read by scanSQLiteInviteCode.
+const sqliteInviteCodeColumns = `code, max_uses, use_count, expires_at, created_at, revoked_at,
+	plan, quota_bytes, tags, hostname_pattern, org_id`
+
+func scanSQLiteInviteCode(row rowScanner) (*InviteCode, error) {
+	ic := &InviteCode{}
+	var createdAtStr, tags string
+	var expiresAtPtr, revokedAtPtr *string
+	if err := row.Scan(&ic.Code, &ic.MaxUses, &ic.UseCount, &expiresAtPtr, &createdAtStr, &revokedAtPtr,
+		&ic.Plan, &ic.QuotaBytes, &tags, &ic.HostnamePattern, &ic.OrgID); err != nil {
+		return nil, err
+	}
+	ic.Tags = decodeStrings(tags)
+	ic.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+	if expiresAtPtr != nil {
+		t, err := time.Parse("2006-01-02 15:04:05", *expiresAtPtr)
+		if err == nil {
+			ic.ExpiresAt = &t
+		}
+	}
+	if revokedAtPtr != nil {
+		t, err := time.Parse("2006-01-02 15:04:05", *revokedAtPtr)
+		if err == nil {
+			ic.RevokedAt = &t
 		}
+	}
+	return ic, nil
+}
+
+func (s *SQLiteStore) GetInviteCode(ctx context.Context, code string) (*InviteCode, error) {
+	ic, err := scanSQLiteInviteCode(s.db.QueryRowContext(ctx, `
+		SELECT `+sqliteInviteCodeColumns+`
+		FROM invite_codes WHERE code = ?`, code))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ic, err
+}
+
+// UseInviteCode checks and increments the use count in one statement: a
+// transaction that reads first cannot take the write lock once another
+// connection has written, and would fail with SQLITE_BUSY.
+func (s *SQLiteStore) UseInviteCode(ctx context.Context, code string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE invite_codes SET use_count = use_count + 1
+		WHERE code = ? AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at >= ?)
+			AND (max_uses = 0 OR use_count < max_uses)`,
+		code, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
 		return false, err
 	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
 
-	// Check revoked
-	if revokedAtStr != nil {
-		return false, nil
+func (s *SQLiteStore) ListInviteCodes(ctx context.Context, p Page) ([]InviteCode, string, error) {
+	after, err := keysetPage(p)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `SELECT ` + sqliteInviteCodeColumns + ` FROM invite_codes`
+	var args []any
+	if after != nil {
+		query += ` WHERE (created_at, code) < (?, ?)`
+		args = append(args, after.At.UTC().Format("2006-01-02 15:04:05"), after.Key)
+	}
+	query += ` ORDER BY created_at DESC, code DESC`
+	if p.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, p.Limit+1)
 	}
 
-	// Check expiry
-	if expiresAtStr != nil {
-		exp, err := time.Parse("2006-01-02 15:04:05", *expiresAtStr)
-		if err == nil && time.Now().UTC().After(exp) {
-			return false, nil
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var codes []InviteCode
+	for rows.Next() {
+		ic, err := scanSQLiteInviteCode(rows)
+		if err != nil {
+			return nil, "", err
 		}
+		codes = append(codes, *ic)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if p.Limit > 0 && len(codes) > p.Limit {
+		codes = codes[:p.Limit]
+		last := codes[p.Limit-1]
+		next = encodeCursor(pageKey{At: last.CreatedAt, Key: last.Code})
 	}
+	return codes, next, nil
+}
+
+func (s *SQLiteStore) RevokeInviteCode(ctx context.Context, code string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE invite_codes SET revoked_at = datetime('now')
+		WHERE code = ? AND revoked_at IS NULL`, code)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("invite code not found or already revoked: %s", code)
+	}
+	return nil
+}
 
-	// Check max uses (0 = unlimited)
-	if maxUses > 0 && useCount >= maxUses {
-		return false, nil
+func (s *SQLiteStore) RecordInviteRedemption(ctx context.Context, r *InviteRedemption) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO invite_redemptions (code, agent_id, ip, redeemed_at)
+		VALUES (?, ?, ?, ?)`,
+		r.Code, r.AgentID, r.IP, creationTime(r.RedeemedAt).Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) ListInviteRedemptions(ctx context.Context, code string, p Page) ([]InviteRedemption, string, error) {
+	after, err := keysetPage(p)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `
+		SELECT code, agent_id, ip, redeemed_at
+		FROM invite_redemptions WHERE code = ?`
+	args := []any{code}
+	if after != nil {
+		query += ` AND (redeemed_at, agent_id) > (?, ?)`
+		args = append(args, after.At.UTC().Format("2006-01-02 15:04:05"), after.Key)
+	}
+	query += ` ORDER BY redeemed_at, agent_id`
+	if p.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, p.Limit+1)
 	}
 
-	// Atomic increment
-	_, err = tx.Exec(`UPDATE invite_codes SET use_count = use_count + 1 WHERE code = ?`, code)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return false, err
+		return nil, "", err
 	}
+	defer rows.Close()
 
-	return true, tx.Commit()
+	var redemptions []InviteRedemption
+	for rows.Next() {
+		var r InviteRedemption
+		var redeemedAtStr string
+		if err := rows.Scan(&r.Code, &r.AgentID, &r.IP, &redeemedAtStr); err != nil {
+			return nil, "", err
+		}
+		r.RedeemedAt, _ = time.Parse("2006-01-02 15:04:05", redeemedAtStr)
+		redemptions = append(redemptions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if p.Limit > 0 && len(redemptions) > p.Limit {
+		redemptions = redemptions[:p.Limit]
+		last := redemptions[p.Limit-1]
+		next = encodeCursor(pageKey{At: last.RedeemedAt, Key: last.AgentID})
+	}
+	return redemptions, next, nil
 }
 
-func (s *SQLiteStore) ListInviteCodes() ([]InviteCode, error) {
-	rows, err := s.db.Query(`
-		SELECT code, max_uses, use_count, expires_at, created_at, revoked_at
-		FROM invite_codes ORDER BY created_at DESC`)
+// ---------------------------------------------------------------------------
+// Organization operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) CreateOrg(ctx context.Context, o *Organization) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO orgs (id, name, quota_bytes, created_at)
+		VALUES (?, ?, ?, ?)`,
+		o.ID, o.Name, o.QuotaBytes, creationTime(o.CreatedAt).Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetOrg(ctx context.Context, id string) (*Organization, error) {
+	o := &Organization{}
+	var createdAtStr string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, name, quota_bytes,
+			(SELECT COALESCE(SUM(used_bytes), 0) FROM agents WHERE org_id = orgs.id), created_at
+		FROM orgs WHERE id = ?`, id).Scan(&o.ID, &o.Name, &o.QuotaBytes, &o.UsedBytes, &createdAtStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+	return o, nil
+}
+
+func (s *SQLiteStore) ListOrgs(ctx context.Context) ([]Organization, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, quota_bytes,
+			(SELECT COALESCE(SUM(used_bytes), 0) FROM agents WHERE org_id = orgs.id), created_at
+		FROM orgs ORDER BY created_at, id`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var codes []InviteCode
+	var orgs []Organization
 	for rows.Next() {
-		var ic InviteCode
+		var o Organization
 		var createdAtStr string
-		var expiresAtPtr, revokedAtPtr *string
-		if err := rows.Scan(&ic.Code, &ic.MaxUses, &ic.UseCount, &expiresAtPtr, &createdAtStr, &revokedAtPtr); err != nil {
+		if err := rows.Scan(&o.ID, &o.Name, &o.QuotaBytes, &o.UsedBytes, &createdAtStr); err != nil {
 			return nil, err
 		}
-		ic.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
-		if expiresAtPtr != nil {
-			t, err := time.Parse("2006-01-02 15:04:05", *expiresAtPtr)
-			if err == nil {
-				ic.ExpiresAt = &t
-			}
+		o.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *SQLiteStore) CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO org_api_keys (id, org_id, key_hash, name, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		k.ID, k.OrgID, k.KeyHash, k.Name, creationTime(k.CreatedAt).Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) LookupOrgAPIKey(ctx context.Context, keyHash string) (*OrgAPIKey, error) {
+	k := &OrgAPIKey{}
+	var createdAtStr string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, org_id, key_hash, name, created_at
+		FROM org_api_keys WHERE key_hash = ?`, keyHash).Scan(&k.ID, &k.OrgID, &k.KeyHash, &k.Name, &createdAtStr)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+	return k, nil
+}
+
+func (s *SQLiteStore) ListOrgAPIKeys(ctx context.Context, orgID string) ([]OrgAPIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, org_id, key_hash, name, created_at
+		FROM org_api_keys WHERE org_id = ? ORDER BY created_at, id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []OrgAPIKey
+	for rows.Next() {
+		var k OrgAPIKey
+		var createdAtStr string
+		if err := rows.Scan(&k.ID, &k.OrgID, &k.KeyHash, &k.Name, &createdAtStr); err != nil {
+			return nil, err
 		}
-		if revokedAtPtr != nil {
-			t, err := time.Parse("2006-01-02 15:04:05", *revokedAtPtr)
-			if err == nil {
-				ic.RevokedAt = &t
-			}
+		k.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM org_api_keys WHERE org_id = ? AND id = ?`, orgID, keyID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("org API key not found: %s", keyID)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Ban operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) CreateBan(ctx context.Context, b *Ban) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO bans (id, kind, value, reason, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		b.ID, b.Kind, b.Value, b.Reason, creationTime(b.CreatedAt).Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) ListBans(ctx context.Context) ([]Ban, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, kind, value, reason, created_at
+		FROM bans ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		var createdAtStr string
+		if err := rows.Scan(&b.ID, &b.Kind, &b.Value, &b.Reason, &createdAtStr); err != nil {
+			return nil, err
 		}
-		codes = append(codes, ic)
+		b.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		bans = append(bans, b)
 	}
-	return codes, rows.Err()
+	return bans, rows.Err()
 }
 
-func (s *SQLiteStore) RevokeInviteCode(code string) error {
-	res, err := s.db.Exec(`
-		UPDATE invite_codes SET revoked_at = datetime('now')
-		WHERE code = ? AND revoked_at IS NULL`, code)
+func (s *SQLiteStore) DeleteBan(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM bans WHERE id = ?`, id)
 	if err != nil {
 		return err
 	}
 	n, _ := res.RowsAffected()
 	if n == 0 {
-		return fmt.Errorf("invite code not found or already revoked: %s", code)
+		return fmt.Errorf("ban not found: %s", id)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Auto-approval rule operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) CreateApprovalRule(ctx context.Context, r *ApprovalRule) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO approval_rules (id, name, priority, source_cidrs, hostname_regex,
+			os, arch, min_version, max_version, fingerprints, approve, plan, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.Name, r.Priority, encodeStrings(r.SourceCIDRs), r.HostnameRegex,
+		r.OS, r.Arch, r.MinVersion, r.MaxVersion, encodeStrings(r.Fingerprints), r.Approve, r.Plan,
+		creationTime(r.CreatedAt).Format("2006-01-02 15:04:05"),
+	)
+	return err
+}
+
+func (s *SQLiteStore) ListApprovalRules(ctx context.Context) ([]ApprovalRule, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, priority, source_cidrs, hostname_regex, os, arch,
+			min_version, max_version, fingerprints, approve, plan, created_at
+		FROM approval_rules ORDER BY priority, created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []ApprovalRule
+	for rows.Next() {
+		var r ApprovalRule
+		var cidrs, fingerprints, createdAtStr string
+		if err := rows.Scan(&r.ID, &r.Name, &r.Priority, &cidrs, &r.HostnameRegex, &r.OS, &r.Arch,
+			&r.MinVersion, &r.MaxVersion, &fingerprints, &r.Approve, &r.Plan, &createdAtStr); err != nil {
+			return nil, err
+		}
+		r.SourceCIDRs = decodeStrings(cidrs)
+		r.Fingerprints = decodeStrings(fingerprints)
+		r.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteApprovalRule(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM approval_rules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("approval rule not found: %s", id)
 	}
 	return nil
 }
+
+// ---------------------------------------------------------------------------
+// Recovery code operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the most recently issued code is valid
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE agent_id = ? AND used_at IS NULL`, rc.AgentID); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO recovery_codes (code_hash, agent_id, expires_at)
+		VALUES (?, ?, ?)`,
+		rc.CodeHash, rc.AgentID, rc.ExpiresAt.UTC().Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (*Agent, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT agent_id, expires_at, used_at
+		FROM recovery_codes WHERE code_hash = ?`, codeHash)
+
+	var agentID, expiresAtStr string
+	var usedAtStr *string
+	if err := row.Scan(&agentID, &expiresAtStr, &usedAtStr); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Check already used
+	if usedAtStr != nil {
+		return nil, nil
+	}
+
+	// Check expiry
+	exp, err := time.Parse("2006-01-02 15:04:05", expiresAtStr)
+	if err != nil || time.Now().UTC().After(exp) {
+		return nil, nil
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE recovery_codes SET used_at = datetime('now') WHERE code_hash = ? AND used_at IS NULL`, codeHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+
+	// Replacing the token hash revokes every previously issued token
+	if _, err := tx.ExecContext(ctx, `UPDATE agents SET token_hash = ? WHERE id = ?`, newTokenHash, agentID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetAgent(ctx, agentID)
+}
+
+// ---------------------------------------------------------------------------
+// Audit log
+// ---------------------------------------------------------------------------
+
+// AppendAuditEvent inserts e and drops events whose retention has run out.
+func (s *SQLiteStore) AppendAuditEvent(ctx context.Context, e *AuditEvent) error {
+	createdAt := e.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	var expiresAt *int64
+	if e.ExpiresAt != nil {
+		n := e.ExpiresAt.UnixNano()
+		expiresAt = &n
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_log (id, action, actor, agent_id, target, ip, request_id,
+			before_state, after_state, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, e.Action, e.Actor, e.AgentID, e.Target, e.IP, e.RequestID,
+		nullableJSON(e.Before), nullableJSON(e.After), createdAt.UnixNano(), expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `DELETE FROM audit_log WHERE expires_at <= ?`, time.Now().UnixNano())
+	return err
+}
+
+func (s *SQLiteStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, string, error) {
+	after, err := keysetPage(f.Page)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `
+		SELECT rowid, id, action, actor, agent_id, target, ip, request_id, before_state,
+			after_state, created_at, expires_at
+		FROM audit_log
+		WHERE (expires_at IS NULL OR expires_at > ?)`
+	args := []any{time.Now().UnixNano()}
+	if f.AgentID != "" {
+		query += " AND agent_id = ?"
+		args = append(args, f.AgentID)
+	}
+	if f.Action != "" {
+		query += " AND action = ?"
+		args = append(args, f.Action)
+	}
+	if !f.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, f.Since.UnixNano())
+	}
+	if after != nil {
+		query += " AND (created_at, rowid) < (?, ?)"
+		args = append(args, after.At.UnixNano(), after.Seq)
+	}
+	query += " ORDER BY created_at DESC, rowid DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	var seqs []int64
+	for rows.Next() {
+		var e AuditEvent
+		var seq int64
+		var beforeState, afterState sql.NullString
+		var createdAt int64
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&seq, &e.ID, &e.Action, &e.Actor, &e.AgentID, &e.Target, &e.IP, &e.RequestID,
+			&beforeState, &afterState, &createdAt, &expiresAt); err != nil {
+			return nil, "", err
+		}
+		if beforeState.Valid {
+			e.Before = json.RawMessage(beforeState.String)
+		}
+		if afterState.Valid {
+			e.After = json.RawMessage(afterState.String)
+		}
+		e.CreatedAt = time.Unix(0, createdAt).UTC()
+		if expiresAt.Valid {
+			t := time.Unix(0, expiresAt.Int64).UTC()
+			e.ExpiresAt = &t
+		}
+		events = append(events, e)
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[:f.Limit]
+		next = encodeCursor(pageKey{At: events[f.Limit-1].CreatedAt, Seq: seqs[f.Limit-1]})
+	}
+	return events, next, nil
+}
+
+func nullableJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+// ---------------------------------------------------------------------------
+// Webhook operations
+// ---------------------------------------------------------------------------
+
+func (s *SQLiteStore) CreateWebhook(ctx context.Context, wh *Webhook) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO webhooks (id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)`,
+		wh.ID, wh.URL, wh.Secret, encodeStrings(wh.Events), creationTime(wh.CreatedAt).Format("2006-01-02 15:04:05"))
+	return err
+}
+
+func scanSQLiteWebhook(row rowScanner) (*Webhook, error) {
+	var wh Webhook
+	var events, createdAt string
+	if err := row.Scan(&wh.ID, &wh.URL, &wh.Secret, &events, &createdAt); err != nil {
+		return nil, err
+	}
+	wh.Events = decodeStrings(events)
+	wh.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	return &wh, nil
+}
+
+func (s *SQLiteStore) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	wh, err := scanSQLiteWebhook(s.db.QueryRowContext(ctx, `
+		SELECT id, url, secret, events, created_at FROM webhooks WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return wh, err
+}
+
+func (s *SQLiteStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, url, secret, events, created_at
+		FROM webhooks ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		wh, err := scanSQLiteWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes the webhook and its delivery log.
+func (s *SQLiteStore) DeleteWebhook(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("webhook not found: %s", id)
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id)
+	return err
+}
+
+// PutWebhookDelivery also prunes finished deliveries older than
+// webhookDeliveryRetention.
+func (s *SQLiteStore) PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	var nextAttemptAt *int64
+	if d.NextAttemptAt != nil {
+		n := d.NextAttemptAt.UnixNano()
+		nextAttemptAt = &n
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO webhook_deliveries (id, webhook_id, event_id, event_type, payload,
+			status, attempts, response_code, error, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.WebhookID, d.EventID, d.EventType, string(d.Payload),
+		d.Status, d.Attempts, d.ResponseCode, d.Error, nextAttemptAt,
+		d.CreatedAt.UnixNano(), d.UpdatedAt.UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < ?`,
+		time.Now().Add(-webhookDeliveryRetention).UnixNano())
+	return err
+}
+
+func (s *SQLiteStore) ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) ([]WebhookDelivery, string, error) {
+	after, err := keysetPage(f.Page)
+	if err != nil {
+		return nil, "", err
+	}
+	query := `
+		SELECT rowid, id, webhook_id, event_id, event_type, payload, status, attempts,
+			response_code, error, next_attempt_at, created_at, updated_at
+		FROM webhook_deliveries WHERE 1 = 1`
+	var args []any
+	if f.WebhookID != "" {
+		query += " AND webhook_id = ?"
+		args = append(args, f.WebhookID)
+	}
+	if f.Status != "" {
+		query += " AND status = ?"
+		args = append(args, f.Status)
+	}
+	if !f.DueBefore.IsZero() {
+		query += " AND status = 'pending' AND next_attempt_at <= ?"
+		args = append(args, f.DueBefore.UnixNano())
+	}
+	if after != nil {
+		query += " AND (created_at, rowid) < (?, ?)"
+		args = append(args, after.At.UnixNano(), after.Seq)
+	}
+	query += " ORDER BY created_at DESC, rowid DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	var seqs []int64
+	for rows.Next() {
+		var d WebhookDelivery
+		var seq int64
+		var payload string
+		var nextAttemptAt sql.NullInt64
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&seq, &d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+			&d.ResponseCode, &d.Error, &nextAttemptAt, &createdAt, &updatedAt); err != nil {
+			return nil, "", err
+		}
+		d.Payload = json.RawMessage(payload)
+		if nextAttemptAt.Valid {
+			t := time.Unix(0, nextAttemptAt.Int64).UTC()
+			d.NextAttemptAt = &t
+		}
+		d.CreatedAt = time.Unix(0, createdAt).UTC()
+		d.UpdatedAt = time.Unix(0, updatedAt).UTC()
+		deliveries = append(deliveries, d)
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if f.Limit > 0 && len(deliveries) > f.Limit {
+		deliveries = deliveries[:f.Limit]
+		next = encodeCursor(pageKey{At: deliveries[f.Limit-1].CreatedAt, Seq: seqs[f.Limit-1]})
+	}
+	return deliveries, next, nil
+}
+
+// ---------------------------------------------------------------------------
+// Rate limiting
+// ---------------------------------------------------------------------------
+
+// RateLimiter returns a RateLimiter that keeps its buckets in this database,
+// so limits survive restarts and are shared by processes using the same file.
+func (s *SQLiteStore) RateLimiter() RateLimiter {
+	return &sqliteRateLimiter{db: s.db, now: time.Now}
+}
+
+type sqliteRateLimiter struct {
+	db  *sql.DB
+	now func() time.Time
+
+	// mu serializes updates within this process; SQLite allows a single
+	// writer anyway and this avoids SQLITE_BUSY between our own requests.
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func (rl *sqliteRateLimiter) Allow(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+
+	// Buckets that have refilled completely are equivalent to missing ones
+	if now.Sub(rl.lastSweep) > time.Minute {
+		if _, err := rl.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE full_at <= ?`, now.UnixNano()); err != nil {
+			return RateLimitResult{}, fmt.Errorf("sweep rate limits: %w", err)
+		}
+		rl.lastSweep = now
+	}
+
+	tx, err := rl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer tx.Rollback()
+
+	var state bucketState
+	var updated int64
+	err = tx.QueryRowContext(ctx, `SELECT tokens, updated_at FROM rate_limits WHERE key = ?`, key).Scan(&state.Tokens, &updated)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return RateLimitResult{}, err
+	default:
+		state.Updated = time.Unix(0, updated)
+	}
+
+	state, res := takeToken(state, p, now)
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limits (key, tokens, updated_at, full_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at, full_at = excluded.full_at`,
+		key, state.Tokens, now.UnixNano(), now.Add(res.Reset).UnixNano())
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return res, tx.Commit()
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store calls whose context ends first fail with an error wrapping one of
+// these, whatever the backend reports, so that callers can tell them apart
+// from store failures.
+var (
+	ErrStoreCanceled = errors.New("store call canceled")  // the caller went away
+	ErrStoreTimeout  = errors.New("store call timed out") // StoreTimeout or the caller's deadline passed
+)
+
+// timeoutStore wraps a DataStore, bounds every call by a timeout and
+// classifies errors of calls cut short by their context.
+type timeoutStore struct {
+	next    DataStore
+	timeout time.Duration // 0 = only the caller's deadline applies
+}
+
+func withStoreTimeout(store DataStore, timeout time.Duration) DataStore {
+	return &timeoutStore{next: store, timeout: timeout}
+}
+
+// start derives the call's context. The returned func, meant to be
+// deferred, releases it and classifies *err.
+func (s *timeoutStore) start(ctx context.Context) (context.Context, func(err *error)) {
+	cancel := context.CancelFunc(func() {})
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	}
+	return ctx, func(err *error) {
+		*err = storeContextError(ctx, *err)
+		cancel()
+	}
+}
+
+// storeContextError wraps err in ErrStoreTimeout or ErrStoreCanceled when
+// ctx ended before the call returned it.
+func storeContextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrStoreTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrStoreCanceled, err)
+}
+
+func (s *timeoutStore) Close() error {
+	return s.next.Close()
+}
+
+func (s *timeoutStore) Ping(ctx context.Context) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.Ping(ctx)
+}
+
+// Agents
+
+func (s *timeoutStore) CreateAgent(ctx context.Context, a *Agent, tokenHash string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateAgent(ctx, a, tokenHash)
+}
+
+func (s *timeoutStore) LookupAgentByToken(ctx context.Context, token string) (a *Agent, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.LookupAgentByToken(ctx, token)
+}
+
+func (s *timeoutStore) GetAgent(ctx context.Context, id string) (a *Agent, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.GetAgent(ctx, id)
+}
+
+func (s *timeoutStore) AgentTokenHash(ctx context.Context, agentID string) (tokenHash string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.AgentTokenHash(ctx, agentID)
+}
+
+func (s *timeoutStore) RotateAgentToken(ctx context.Context, agentID, newTokenHash string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.RotateAgentToken(ctx, agentID, newTokenHash)
+}
+
+func (s *timeoutStore) UpdateAgentProfile(ctx context.Context, agentID, name string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.UpdateAgentProfile(ctx, agentID, name)
+}
+
+func (s *timeoutStore) UpdateUsedBytes(ctx context.Context, agentID string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.UpdateUsedBytes(ctx, agentID)
+}
+
+func (s *timeoutStore) ListAgents(ctx context.Context, f AgentFilter) (agents []Agent, next string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListAgents(ctx, f)
+}
+
+func (s *timeoutStore) FleetStats(ctx context.Context, opts StatsOptions) (stats *FleetStats, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.FleetStats(ctx, opts)
+}
+
+func (s *timeoutStore) SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.SetAgentStaleThreshold(ctx, agentID, hours)
+}
+
+func (s *timeoutStore) SetAgentStale(ctx context.Context, agentID string, since *time.Time) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.SetAgentStale(ctx, agentID, since)
+}
+
+func (s *timeoutStore) SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.SetAgentContact(ctx, agentID, email, optOuts)
+}
+
+func (s *timeoutStore) UpdateAgentStatus(ctx context.Context, id, status, reason string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.UpdateAgentStatus(ctx, id, status, reason)
+}
+
+func (s *timeoutStore) SetAgentOrg(ctx context.Context, agentID, orgID string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.SetAgentOrg(ctx, agentID, orgID)
+}
+
+func (s *timeoutStore) CountAgentsByStatus(ctx context.Context, status string) (n int, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CountAgentsByStatus(ctx, status)
+}
+
+// Backups
+
+func (s *timeoutStore) CreateBackup(ctx context.Context, b *Backup) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateBackup(ctx, b)
+}
+
+func (s *timeoutStore) ListBackups(ctx context.Context, agentID string, p Page) (backups []Backup, next string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListBackups(ctx, agentID, p)
+}
+
+func (s *timeoutStore) CountBackups(ctx context.Context, agentID string) (count int, bytes int64, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CountBackups(ctx, agentID)
+}
+
+func (s *timeoutStore) GetBackup(ctx context.Context, agentID, timestamp string) (b *Backup, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.GetBackup(ctx, agentID, timestamp)
+}
+
+func (s *timeoutStore) DeleteBackup(ctx context.Context, agentID, timestamp string) (b *Backup, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.DeleteBackup(ctx, agentID, timestamp)
+}
+
+func (s *timeoutStore) DeleteAllBackups(ctx context.Context, agentID string) (backups []Backup, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.DeleteAllBackups(ctx, agentID)
+}
+
+func (s *timeoutStore) UndeleteBackup(ctx context.Context, agentID, timestamp string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.UndeleteBackup(ctx, agentID, timestamp)
+}
+
+func (s *timeoutStore) PutBackup(ctx context.Context, b *Backup) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.PutBackup(ctx, b)
+}
+
+func (s *timeoutStore) PurgeBackup(ctx context.Context, agentID, timestamp string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.PurgeBackup(ctx, agentID, timestamp)
+}
+
+func (s *timeoutStore) LatestBackupTimes(ctx context.Context) (times map[string]time.Time, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.LatestBackupTimes(ctx)
+}
+
+func (s *timeoutStore) ListAllBackups(ctx context.Context, agentID string) (backups []Backup, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListAllBackups(ctx, agentID)
+}
+
+// Backup transfers
+
+func (s *timeoutStore) PutTransfer(ctx context.Context, t *BackupTransfer) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.PutTransfer(ctx, t)
+}
+
+func (s *timeoutStore) GetTransfer(ctx context.Context, id string) (t *BackupTransfer, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.GetTransfer(ctx, id)
+}
+
+// Invite codes
+
+func (s *timeoutStore) CreateInviteCode(ctx context.Context, code *InviteCode) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateInviteCode(ctx, code)
+}
+
+func (s *timeoutStore) CreateInviteCodes(ctx context.Context, codes []*InviteCode) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateInviteCodes(ctx, codes)
+}
+
+func (s *timeoutStore) GetInviteCode(ctx context.Context, code string) (ic *InviteCode, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.GetInviteCode(ctx, code)
+}
+
+func (s *timeoutStore) UseInviteCode(ctx context.Context, code string) (valid bool, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.UseInviteCode(ctx, code)
+}
+
+func (s *timeoutStore) ListInviteCodes(ctx context.Context, p Page) (codes []InviteCode, next string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListInviteCodes(ctx, p)
+}
+
+func (s *timeoutStore) RevokeInviteCode(ctx context.Context, code string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.RevokeInviteCode(ctx, code)
+}
+
+func (s *timeoutStore) RecordInviteRedemption(ctx context.Context, r *InviteRedemption) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.RecordInviteRedemption(ctx, r)
+}
+
+func (s *timeoutStore) ListInviteRedemptions(ctx context.Context, code string, p Page) (redemptions []InviteRedemption, next string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListInviteRedemptions(ctx, code, p)
+}
+
+// Registration bans
+
+func (s *timeoutStore) CreateBan(ctx context.Context, b *Ban) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateBan(ctx, b)
+}
+
+func (s *timeoutStore) ListBans(ctx context.Context) (bans []Ban, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListBans(ctx)
+}
+
+func (s *timeoutStore) DeleteBan(ctx context.Context, id string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.DeleteBan(ctx, id)
+}
+
+// Organizations
+
+func (s *timeoutStore) CreateOrg(ctx context.Context, o *Organization) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateOrg(ctx, o)
+}
+
+func (s *timeoutStore) GetOrg(ctx context.Context, id string) (o *Organization, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.GetOrg(ctx, id)
+}
+
+func (s *timeoutStore) ListOrgs(ctx context.Context) (orgs []Organization, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListOrgs(ctx)
+}
+
+func (s *timeoutStore) CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateOrgAPIKey(ctx, k)
+}
+
+func (s *timeoutStore) LookupOrgAPIKey(ctx context.Context, keyHash string) (k *OrgAPIKey, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.LookupOrgAPIKey(ctx, keyHash)
+}
+
+func (s *timeoutStore) ListOrgAPIKeys(ctx context.Context, orgID string) (keys []OrgAPIKey, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListOrgAPIKeys(ctx, orgID)
+}
+
+func (s *timeoutStore) DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.DeleteOrgAPIKey(ctx, orgID, keyID)
+}
+
+// Auto-approval rules
+
+func (s *timeoutStore) CreateApprovalRule(ctx context.Context, r *ApprovalRule) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateApprovalRule(ctx, r)
+}
+
+func (s *timeoutStore) ListApprovalRules(ctx context.Context) (rules []ApprovalRule, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListApprovalRules(ctx)
+}
+
+func (s *timeoutStore) DeleteApprovalRule(ctx context.Context, id string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.DeleteApprovalRule(ctx, id)
+}
+
+// Recovery codes
+
+func (s *timeoutStore) CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateRecoveryCode(ctx, rc)
+}
+
+func (s *timeoutStore) UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (a *Agent, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.UseRecoveryCode(ctx, codeHash, newTokenHash)
+}
+
+// Audit log
+
+func (s *timeoutStore) AppendAuditEvent(ctx context.Context, e *AuditEvent) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.AppendAuditEvent(ctx, e)
+}
+
+func (s *timeoutStore) ListAuditEvents(ctx context.Context, f AuditFilter) (events []AuditEvent, next string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListAuditEvents(ctx, f)
+}
+
+// Webhooks
+
+func (s *timeoutStore) CreateWebhook(ctx context.Context, wh *Webhook) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.CreateWebhook(ctx, wh)
+}
+
+func (s *timeoutStore) GetWebhook(ctx context.Context, id string) (wh *Webhook, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.GetWebhook(ctx, id)
+}
+
+func (s *timeoutStore) ListWebhooks(ctx context.Context) (webhooks []Webhook, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListWebhooks(ctx)
+}
+
+func (s *timeoutStore) DeleteWebhook(ctx context.Context, id string) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.DeleteWebhook(ctx, id)
+}
+
+func (s *timeoutStore) PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) (err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.PutWebhookDelivery(ctx, d)
+}
+
+func (s *timeoutStore) ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) (deliveries []WebhookDelivery, next string, err error) {
+	ctx, done := s.start(ctx)
+	defer done(&err)
+	return s.next.ListWebhookDeliveries(ctx, f)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedStore wraps a DataStore and records a span, as a child of the span
+// in the call's context, around every call.
+type tracedStore struct {
+	next DataStore
+}
+
+// traceStore returns store wrapped with tracing.
+func traceStore(store DataStore) DataStore {
+	return &tracedStore{next: store}
+}
+
+// start starts the span for op. When the span in ctx is not recorded
+// (tracing disabled or not sampled) it returns ctx and a no-op span, so
+// that untraced calls cost nothing.
+func (s *tracedStore) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	return startSpan(ctx, "store."+op)
+}
+
+func (s *tracedStore) Close() error {
+	return s.next.Close()
+}
+
+func (s *tracedStore) Ping(ctx context.Context) (err error) {
+	ctx, span := s.start(ctx, "Ping")
+	defer endSpan(span, &err)
+	return s.next.Ping(ctx)
+}
+
+// Agents
+
+func (s *tracedStore) CreateAgent(ctx context.Context, a *Agent, tokenHash string) (err error) {
+	ctx, span := s.start(ctx, "CreateAgent")
+	defer endSpan(span, &err)
+	return s.next.CreateAgent(ctx, a, tokenHash)
+}
+
+func (s *tracedStore) LookupAgentByToken(ctx context.Context, token string) (a *Agent, err error) {
+	ctx, span := s.start(ctx, "LookupAgentByToken")
+	defer endSpan(span, &err)
+	return s.next.LookupAgentByToken(ctx, token)
+}
+
+func (s *tracedStore) GetAgent(ctx context.Context, id string) (a *Agent, err error) {
+	ctx, span := s.start(ctx, "GetAgent")
+	defer endSpan(span, &err)
+	return s.next.GetAgent(ctx, id)
+}
+
+func (s *tracedStore) AgentTokenHash(ctx context.Context, agentID string) (tokenHash string, err error) {
+	ctx, span := s.start(ctx, "AgentTokenHash")
+	defer endSpan(span, &err)
+	return s.next.AgentTokenHash(ctx, agentID)
+}
+
+func (s *tracedStore) RotateAgentToken(ctx context.Context, agentID, newTokenHash string) (err error) {
+	ctx, span := s.start(ctx, "RotateAgentToken")
+	defer endSpan(span, &err)
+	return s.next.RotateAgentToken(ctx, agentID, newTokenHash)
+}
+
+func (s *tracedStore) UpdateAgentProfile(ctx context.Context, agentID, name string) (err error) {
+	ctx, span := s.start(ctx, "UpdateAgentProfile")
+	defer endSpan(span, &err)
+	return s.next.UpdateAgentProfile(ctx, agentID, name)
+}
+
+func (s *tracedStore) UpdateUsedBytes(ctx context.Context, agentID string) (err error) {
+	ctx, span := s.start(ctx, "UpdateUsedBytes")
+	defer endSpan(span, &err)
+	return s.next.UpdateUsedBytes(ctx, agentID)
+}
+
+func (s *tracedStore) ListAgents(ctx context.Context, f AgentFilter) (agents []Agent, next string, err error) {
+	ctx, span := s.start(ctx, "ListAgents")
+	defer endSpan(span, &err)
+	return s.next.ListAgents(ctx, f)
+}
+
+func (s *tracedStore) FleetStats(ctx context.Context, opts StatsOptions) (stats *FleetStats, err error) {
+	ctx, span := s.start(ctx, "FleetStats")
+	defer endSpan(span, &err)
+	return s.next.FleetStats(ctx, opts)
+}
+
+func (s *tracedStore) SetAgentStaleThreshold(ctx context.Context, agentID string, hours int) (err error) {
+	ctx, span := s.start(ctx, "SetAgentStaleThreshold")
+	defer endSpan(span, &err)
+	return s.next.SetAgentStaleThreshold(ctx, agentID, hours)
+}
+
+func (s *tracedStore) SetAgentStale(ctx context.Context, agentID string, since *time.Time) (err error) {
+	ctx, span := s.start(ctx, "SetAgentStale")
+	defer endSpan(span, &err)
+	return s.next.SetAgentStale(ctx, agentID, since)
+}
+
+func (s *tracedStore) SetAgentContact(ctx context.Context, agentID, email string, optOuts []string) (err error) {
+	ctx, span := s.start(ctx, "SetAgentContact")
+	defer endSpan(span, &err)
+	return s.next.SetAgentContact(ctx, agentID, email, optOuts)
+}
+
+func (s *tracedStore) UpdateAgentStatus(ctx context.Context, id, status, reason string) (err error) {
+	ctx, span := s.start(ctx, "UpdateAgentStatus")
+	defer endSpan(span, &err)
+	return s.next.UpdateAgentStatus(ctx, id, status, reason)
+}
+
+func (s *tracedStore) SetAgentOrg(ctx context.Context, agentID, orgID string) (err error) {
+	ctx, span := s.start(ctx, "SetAgentOrg")
+	defer endSpan(span, &err)
+	return s.next.SetAgentOrg(ctx, agentID, orgID)
+}
+
+func (s *tracedStore) CountAgentsByStatus(ctx context.Context, status string) (n int, err error) {
+	ctx, span := s.start(ctx, "CountAgentsByStatus")
+	defer endSpan(span, &err)
+	return s.next.CountAgentsByStatus(ctx, status)
+}
+
+// Backups
+
+func (s *tracedStore) CreateBackup(ctx context.Context, b *Backup) (err error) {
+	ctx, span := s.start(ctx, "CreateBackup")
+	defer endSpan(span, &err)
+	return s.next.CreateBackup(ctx, b)
+}
+
+func (s *tracedStore) ListBackups(ctx context.Context, agentID string, p Page) (backups []Backup, next string, err error) {
+	ctx, span := s.start(ctx, "ListBackups")
+	defer endSpan(span, &err)
+	return s.next.ListBackups(ctx, agentID, p)
+}
+
+func (s *tracedStore) CountBackups(ctx context.Context, agentID string) (count int, bytes int64, err error) {
+	ctx, span := s.start(ctx, "CountBackups")
+	defer endSpan(span, &err)
+	return s.next.CountBackups(ctx, agentID)
+}
+
+func (s *tracedStore) GetBackup(ctx context.Context, agentID, timestamp string) (b *Backup, err error) {
+	ctx, span := s.start(ctx, "GetBackup")
+	defer endSpan(span, &err)
+	return s.next.GetBackup(ctx, agentID, timestamp)
+}
+
+func (s *tracedStore) DeleteBackup(ctx context.Context, agentID, timestamp string) (b *Backup, err error) {
+	ctx, span := s.start(ctx, "DeleteBackup")
+	defer endSpan(span, &err)
+	return s.next.DeleteBackup(ctx, agentID, timestamp)
+}
+
+func (s *tracedStore) DeleteAllBackups(ctx context.Context, agentID string) (backups []Backup, err error) {
+	ctx, span := s.start(ctx, "DeleteAllBackups")
+	defer endSpan(span, &err)
+	return s.next.DeleteAllBackups(ctx, agentID)
+}
+
+func (s *tracedStore) UndeleteBackup(ctx context.Context, agentID, timestamp string) (err error) {
+	ctx, span := s.start(ctx, "UndeleteBackup")
+	defer endSpan(span, &err)
+	return s.next.UndeleteBackup(ctx, agentID, timestamp)
+}
+
+func (s *tracedStore) PutBackup(ctx context.Context, b *Backup) (err error) {
+	ctx, span := s.start(ctx, "PutBackup")
+	defer endSpan(span, &err)
+	return s.next.PutBackup(ctx, b)
+}
+
+func (s *tracedStore) PurgeBackup(ctx context.Context, agentID, timestamp string) (err error) {
+	ctx, span := s.start(ctx, "PurgeBackup")
+	defer endSpan(span, &err)
+	return s.next.PurgeBackup(ctx, agentID, timestamp)
+}
+
+func (s *tracedStore) LatestBackupTimes(ctx context.Context) (times map[string]time.Time, err error) {
+	ctx, span := s.start(ctx, "LatestBackupTimes")
+	defer endSpan(span, &err)
+	return s.next.LatestBackupTimes(ctx)
+}
+
+func (s *tracedStore) ListAllBackups(ctx context.Context, agentID string) (backups []Backup, err error) {
+	ctx, span := s.start(ctx, "ListAllBackups")
+	defer endSpan(span, &err)
+	return s.next.ListAllBackups(ctx, agentID)
+}
+
+// Backup transfers
+
+func (s *tracedStore) PutTransfer(ctx context.Context, t *BackupTransfer) (err error) {
+	ctx, span := s.start(ctx, "PutTransfer")
+	defer endSpan(span, &err)
+	return s.next.PutTransfer(ctx, t)
+}
+
+func (s *tracedStore) GetTransfer(ctx context.Context, id string) (t *BackupTransfer, err error) {
+	ctx, span := s.start(ctx, "GetTransfer")
+	defer endSpan(span, &err)
+	return s.next.GetTransfer(ctx, id)
+}
+
+// Invite codes
+
+func (s *tracedStore) CreateInviteCode(ctx context.Context, code *InviteCode) (err error) {
+	ctx, span := s.start(ctx, "CreateInviteCode")
+	defer endSpan(span, &err)
+	return s.next.CreateInviteCode(ctx, code)
+}
+
+func (s *tracedStore) CreateInviteCodes(ctx context.Context, codes []*InviteCode) (err error) {
+	ctx, span := s.start(ctx, "CreateInviteCodes")
+	defer endSpan(span, &err)
+	return s.next.CreateInviteCodes(ctx, codes)
+}
+
+func (s *tracedStore) GetInviteCode(ctx context.Context, code string) (ic *InviteCode, err error) {
+	ctx, span := s.start(ctx, "GetInviteCode")
+	defer endSpan(span, &err)
+	return s.next.GetInviteCode(ctx, code)
+}
+
+func (s *tracedStore) UseInviteCode(ctx context.Context, code string) (valid bool, err error) {
+	ctx, span := s.start(ctx, "UseInviteCode")
+	defer endSpan(span, &err)
+	return s.next.UseInviteCode(ctx, code)
+}
+
+func (s *tracedStore) ListInviteCodes(ctx context.Context, p Page) (codes []InviteCode, next string, err error) {
+	ctx, span := s.start(ctx, "ListInviteCodes")
+	defer endSpan(span, &err)
+	return s.next.ListInviteCodes(ctx, p)
+}
+
+func (s *tracedStore) RevokeInviteCode(ctx context.Context, code string) (err error) {
+	ctx, span := s.start(ctx, "RevokeInviteCode")
+	defer endSpan(span, &err)
+	return s.next.RevokeInviteCode(ctx, code)
+}
+
+func (s *tracedStore) RecordInviteRedemption(ctx context.Context, r *InviteRedemption) (err error) {
+	ctx, span := s.start(ctx, "RecordInviteRedemption")
+	defer endSpan(span, &err)
+	return s.next.RecordInviteRedemption(ctx, r)
+}
+
+func (s *tracedStore) ListInviteRedemptions(ctx context.Context, code string, p Page) (redemptions []InviteRedemption, next string, err error) {
+	ctx, span := s.start(ctx, "ListInviteRedemptions")
+	defer endSpan(span, &err)
+	return s.next.ListInviteRedemptions(ctx, code, p)
+}
+
+// Registration bans
+
+func (s *tracedStore) CreateBan(ctx context.Context, b *Ban) (err error) {
+	ctx, span := s.start(ctx, "CreateBan")
+	defer endSpan(span, &err)
+	return s.next.CreateBan(ctx, b)
+}
+
+func (s *tracedStore) ListBans(ctx context.Context) (bans []Ban, err error) {
+	ctx, span := s.start(ctx, "ListBans")
+	defer endSpan(span, &err)
+	return s.next.ListBans(ctx)
+}
+
+func (s *tracedStore) DeleteBan(ctx context.Context, id string) (err error) {
+	ctx, span := s.start(ctx, "DeleteBan")
+	defer endSpan(span, &err)
+	return s.next.DeleteBan(ctx, id)
+}
+
+// Organizations
+
+func (s *tracedStore) CreateOrg(ctx context.Context, o *Organization) (err error) {
+	ctx, span := s.start(ctx, "CreateOrg")
+	defer endSpan(span, &err)
+	return s.next.CreateOrg(ctx, o)
+}
+
+func (s *tracedStore) GetOrg(ctx context.Context, id string) (o *Organization, err error) {
+	ctx, span := s.start(ctx, "GetOrg")
+	defer endSpan(span, &err)
+	return s.next.GetOrg(ctx, id)
+}
+
+func (s *tracedStore) ListOrgs(ctx context.Context) (orgs []Organization, err error) {
+	ctx, span := s.start(ctx, "ListOrgs")
+	defer endSpan(span, &err)
+	return s.next.ListOrgs(ctx)
+}
+
+func (s *tracedStore) CreateOrgAPIKey(ctx context.Context, k *OrgAPIKey) (err error) {
+	ctx, span := s.start(ctx, "CreateOrgAPIKey")
+	defer endSpan(span, &err)
+	return s.next.CreateOrgAPIKey(ctx, k)
+}
+
+func (s *tracedStore) LookupOrgAPIKey(ctx context.Context, keyHash string) (k *OrgAPIKey, err error) {
+	ctx, span := s.start(ctx, "LookupOrgAPIKey")
+	defer endSpan(span, &err)
+	return s.next.LookupOrgAPIKey(ctx, keyHash)
+}
+
+func (s *tracedStore) ListOrgAPIKeys(ctx context.Context, orgID string) (keys []OrgAPIKey, err error) {
+	ctx, span := s.start(ctx, "ListOrgAPIKeys")
+	defer endSpan(span, &err)
+	return s.next.ListOrgAPIKeys(ctx, orgID)
+}
+
+func (s *tracedStore) DeleteOrgAPIKey(ctx context.Context, orgID, keyID string) (err error) {
+	ctx, span := s.start(ctx, "DeleteOrgAPIKey")
+	defer endSpan(span, &err)
+	return s.next.DeleteOrgAPIKey(ctx, orgID, keyID)
+}
+
+// Auto-approval rules
+
+func (s *tracedStore) CreateApprovalRule(ctx context.Context, r *ApprovalRule) (err error) {
+	ctx, span := s.start(ctx, "CreateApprovalRule")
+	defer endSpan(span, &err)
+	return s.next.CreateApprovalRule(ctx, r)
+}
+
+func (s *tracedStore) ListApprovalRules(ctx context.Context) (rules []ApprovalRule, err error) {
+	ctx, span := s.start(ctx, "ListApprovalRules")
+	defer endSpan(span, &err)
+	return s.next.ListApprovalRules(ctx)
+}
+
+func (s *tracedStore) DeleteApprovalRule(ctx context.Context, id string) (err error) {
+	ctx, span := s.start(ctx, "DeleteApprovalRule")
+	defer endSpan(span, &err)
+	return s.next.DeleteApprovalRule(ctx, id)
+}
+
+// Recovery codes
+
+func (s *tracedStore) CreateRecoveryCode(ctx context.Context, rc *RecoveryCode) (err error) {
+	ctx, span := s.start(ctx, "CreateRecoveryCode")
+	defer endSpan(span, &err)
+	return s.next.CreateRecoveryCode(ctx, rc)
+}
+
+func (s *tracedStore) UseRecoveryCode(ctx context.Context, codeHash, newTokenHash string) (a *Agent, err error) {
+	ctx, span := s.start(ctx, "UseRecoveryCode")
+	defer endSpan(span, &err)
+	return s.next.UseRecoveryCode(ctx, codeHash, newTokenHash)
+}
+
+// Audit log
+
+func (s *tracedStore) AppendAuditEvent(ctx context.Context, e *AuditEvent) (err error) {
+	ctx, span := s.start(ctx, "AppendAuditEvent")
+	defer endSpan(span, &err)
+	return s.next.AppendAuditEvent(ctx, e)
+}
+
+func (s *tracedStore) ListAuditEvents(ctx context.Context, f AuditFilter) (events []AuditEvent, next string, err error) {
+	ctx, span := s.start(ctx, "ListAuditEvents")
+	defer endSpan(span, &err)
+	return s.next.ListAuditEvents(ctx, f)
+}
+
+// Webhooks
+
+func (s *tracedStore) CreateWebhook(ctx context.Context, wh *Webhook) (err error) {
+	ctx, span := s.start(ctx, "CreateWebhook")
+	defer endSpan(span, &err)
+	return s.next.CreateWebhook(ctx, wh)
+}
+
+func (s *tracedStore) GetWebhook(ctx context.Context, id string) (wh *Webhook, err error) {
+	ctx, span := s.start(ctx, "GetWebhook")
+	defer endSpan(span, &err)
+	return s.next.GetWebhook(ctx, id)
+}
+
+func (s *tracedStore) ListWebhooks(ctx context.Context) (webhooks []Webhook, err error) {
+	ctx, span := s.start(ctx, "ListWebhooks")
+	defer endSpan(span, &err)
+	return s.next.ListWebhooks(ctx)
+}
+
+func (s *tracedStore) DeleteWebhook(ctx context.Context, id string) (err error) {
+	ctx, span := s.start(ctx, "DeleteWebhook")
+	defer endSpan(span, &err)
+	return s.next.DeleteWebhook(ctx, id)
+}
+
+func (s *tracedStore) PutWebhookDelivery(ctx context.Context, d *WebhookDelivery) (err error) {
+	ctx, span := s.start(ctx, "PutWebhookDelivery")
+	defer endSpan(span, &err)
+	return s.next.PutWebhookDelivery(ctx, d)
+}
+
+func (s *tracedStore) ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) (deliveries []WebhookDelivery, next string, err error) {
+	ctx, span := s.start(ctx, "ListWebhookDeliveries")
+	defer endSpan(span, &err)
+	return s.next.ListWebhookDeliveries(ctx, f)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------------------------------------------------------------------------
+// OpenTelemetry tracing
+// ---------------------------------------------------------------------------
+//
+// Each request gets a server span, continued from an inbound traceparent
+// header when there is one. Under it, every middleware, the handler, and
+// each DataStore and S3 call get their own span. Middleware spans end when
+// the middleware hands over to the next handler, so a span's duration is
+// the time spent in that layer alone.
+//
+// Spans go to the global tracer provider. Without an OTLP endpoint it is
+// the no-op provider, and tracing costs next to nothing.
+
+const tracerName = "github.com/openclaw/backup-service"
+
+// tracePropagator reads W3C trace context and baggage from inbound requests.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracerProvider builds a provider that batches spans to the OTLP/HTTP
+// collector at cfg.OTLPEndpoint. It returns nil when no endpoint is set.
+func newTracerProvider(ctx context.Context, cfg *Config) (*sdktrace.TracerProvider, error) {
+	if cfg.OTLPEndpoint == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(cfg.OTLPEndpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(cfg.TraceServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("build trace resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	), nil
+}
+
+// startSpan starts an internal span as a child of the span in ctx. The
+// tracer is looked up on every call so that a provider installed later
+// (as in tests) takes effect.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records *err, if any, on span and ends it. It is meant to be
+// deferred by functions with a named error result.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// ---------------------------------------------------------------------------
+// HTTP
+// ---------------------------------------------------------------------------
+
+// Trace starts the server span of each request, named after the matched
+// route. Must be placed inside LogRequests so the request's trace ID can be
+// logged.
+func Trace(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		info := requestInfoFromContext(r.Context())
+		if info != nil {
+			route = info.Route
+		} else if _, pattern := routes.Handler(r); pattern != "" {
+			route = pattern
+		}
+
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.HTTPRoute(route),
+				semconv.ClientAddress(clientIP(r)),
+			),
+		)
+		defer span.End()
+
+		if info != nil {
+			span.SetAttributes(attribute.String("request_id", info.ID))
+			if sc := span.SpanContext(); sc.IsValid() {
+				info.TraceID = sc.TraceID().String()
+			}
+		}
+
+		sw, ok := w.(*statusWriter)
+		if !ok {
+			sw = &statusWriter{ResponseWriter: w, status: 200}
+		}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+		if info != nil && info.AgentID != "" {
+			span.SetAttributes(attribute.String("agent_id", info.AgentID))
+		}
+	})
+}
+
+// traceMiddleware starts the span of a middleware serving r. It returns r
+// carrying the span, for the middleware's own calls, and a next that ends
+// the span and restores the parent span before passing the request on. The
+// middleware must also defer end, which is a no-op once next has run, for
+// the paths where it answers the request itself.
+func traceMiddleware(r *http.Request, name string, next http.Handler) (_ *http.Request, _ http.Handler, end func()) {
+	parent := trace.SpanFromContext(r.Context())
+	ctx, span := startSpan(r.Context(), "middleware."+name)
+	return r.WithContext(ctx), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span.End()
+		next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(r.Context(), parent)))
+	}), func() { span.End() }
+}
+
+// traceHandler wraps a route handler in a span named "handler.<name>".
+func traceHandler(name string, fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := startSpan(r.Context(), "handler."+name)
+		defer span.End()
+		fn(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/agents/{id}/transfer
+// ---------------------------------------------------------------------------
+//
+// Moves or copies every live backup of agent {id} to another agent. Each
+// backup is processed in idempotent steps (copy S3 objects, write the target
+// row, then — for moves — drop the source row and objects), and progress is
+// recorded in a BackupTransfer keyed by the (source, target) pair. If the
+// request is interrupted, re-issuing it resumes where it stopped. A request
+// works for at most transferTimeBudget and then answers 202 with the
+// transfer still running, so that it ends within the Lambda timeout; the
+// client re-issues it until the transfer completes.
+
+// transferTimeBudget bounds the time a transfer request spends moving
+// backups, leaving room within the 30 s Lambda timeout to record progress.
+var transferTimeBudget = 20 * time.Second
+
+type TransferRequest struct {
+	TargetAgentID string `json:"target_agent_id"`
+	Mode          string `json:"mode"` // "move" (default) or "copy"
+}
+
+type TransferResponse struct {
+	TransferID    string `json:"transfer_id"`
+	SourceAgentID string `json:"source_agent_id"`
+	TargetAgentID string `json:"target_agent_id"`
+	Mode          string `json:"mode"`
+	Status        string `json:"status"`
+	TotalCount    int    `json:"total_count"`
+	DoneCount     int    `json:"done_count"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+}
+
+func transferToResponse(t *BackupTransfer) TransferResponse {
+	return TransferResponse{
+		TransferID:    t.ID,
+		SourceAgentID: t.SourceAgentID,
+		TargetAgentID: t.TargetAgentID,
+		Mode:          t.Mode,
+		Status:        t.Status,
+		TotalCount:    t.TotalCount,
+		DoneCount:     t.DoneCount,
+		Error:         t.Error,
+		CreatedAt:     t.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:     t.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// transferID derives a stable ID from the agent pair so that a retried
+// request finds the transfer it interrupted.
+func transferID(sourceAgentID, targetAgentID string) string {
+	sum := sha256.Sum256([]byte(sourceAgentID + ">" + targetAgentID))
+	return "tr_" + hex.EncodeToString(sum[:12])
+}
+
+// rekeyObject maps an S3 key under the source agent's prefix to the same
+// relative path under the target agent's prefix.
+func rekeyObject(key, sourceAgentID, targetAgentID, timestamp string) string {
+	if rel := strings.TrimPrefix(key, sourceAgentID+"/"); rel != key {
+		return targetAgentID + "/" + rel
+	}
+	return targetAgentID + "/" + timestamp + "/" + path.Base(key)
+}
+
+func (h *Handlers) AdminTransferBackups(w http.ResponseWriter, r *http.Request) {
+	sourceID := r.PathValue("id")
+	if sourceID == "" {
+		jsonError(w, "agent id required", http.StatusBadRequest)
+		return
+	}
+
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.TargetAgentID == "" {
+		jsonError(w, "target_agent_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.TargetAgentID == sourceID {
+		jsonError(w, "source and target agent must differ", http.StatusBadRequest)
+		return
+	}
+	if req.Mode != "" && req.Mode != "move" && req.Mode != "copy" {
+		jsonError(w, "mode must be \"move\" or \"copy\"", http.StatusBadRequest)
+		return
+	}
+
+	source, err := h.store.GetAgent(r.Context(), sourceID)
+	if err != nil {
+		internalError(w, r, "get agent", err, "agent_id", sourceID)
+		return
+	}
+	if source == nil {
+		jsonError(w, "source agent not found", http.StatusNotFound)
+		return
+	}
+	target, err := h.store.GetAgent(r.Context(), req.TargetAgentID)
+	if err != nil {
+		internalError(w, r, "get agent", err, "target_agent_id", req.TargetAgentID)
+		return
+	}
+	if target == nil {
+		jsonError(w, "target agent not found", http.StatusNotFound)
+		return
+	}
+	// A pending, rejected or suspended agent cannot use what it would receive
+	if target.Status != "active" {
+		jsonError(w, fmt.Sprintf("target agent is %s, not active", target.Status), http.StatusConflict)
+		return
+	}
+
+	// Resume an unfinished transfer for this pair, or start a new one
+	t, err := h.store.GetTransfer(r.Context(), transferID(source.ID, target.ID))
+	if err != nil {
+		internalError(w, r, "get transfer", err)
+		return
+	}
+	resuming := t != nil && t.Status != "completed"
+	if resuming {
+		if req.Mode != "" && req.Mode != t.Mode {
+			jsonError(w, fmt.Sprintf("an unfinished %s transfer exists for these agents, re-run it with the same mode", t.Mode), http.StatusConflict)
+			return
+		}
+	} else {
+		mode := req.Mode
+		if mode == "" {
+			mode = "move"
+		}
+		t = &BackupTransfer{
+			ID:            transferID(source.ID, target.ID),
+			SourceAgentID: source.ID,
+			TargetAgentID: target.ID,
+			Mode:          mode,
+			CreatedAt:     time.Now().UTC(),
+		}
+	}
+
+	backups, _, err := h.store.ListBackups(r.Context(), source.ID, Page{})
+	if err != nil {
+		internalError(w, r, "list backups", err, "source_agent_id", source.ID)
+		return
+	}
+
+	// Work out what is left to do and how many bytes will land on the target.
+	// A backup already present on the target with the same checksum was
+	// written by an earlier, interrupted run.
+	var pending []Backup
+	var incomingBytes int64
+	for _, b := range backups {
+		existing, err := h.store.GetBackup(r.Context(), target.ID, b.Timestamp)
+		if err != nil {
+			internalError(w, r, "get backup", err, "target_agent_id", target.ID, "timestamp", b.Timestamp)
+			return
+		}
+		if existing != nil && existing.EncryptedSHA256 != b.EncryptedSHA256 {
+			jsonError(w, fmt.Sprintf("target agent already has a different backup at %s", b.Timestamp), http.StatusConflict)
+			return
+		}
+		if existing == nil {
+			incomingBytes += b.EncryptedBytes
+		}
+		if existing == nil || t.Mode == "move" {
+			pending = append(pending, b)
+		}
+	}
+
+	// Enforce the target agent's quota before touching anything
+	_, targetUsed, err := h.store.CountBackups(r.Context(), target.ID)
+	if err != nil {
+		internalError(w, r, "count backups", err, "target_agent_id", target.ID)
+		return
+	}
+	if targetUsed+incomingBytes > target.QuotaBytes {
+		jsonError(w, fmt.Sprintf("target quota exceeded: used %d + incoming %d > quota %d bytes",
+			targetUsed, incomingBytes, target.QuotaBytes), http.StatusForbidden)
+		return
+	}
+
+	// and the pooled quota of its organization, unless a move keeps the
+	// bytes inside it
+	if target.OrgID != "" && (t.Mode != "move" || source.OrgID != target.OrgID) {
+		org, err := h.store.GetOrg(r.Context(), target.OrgID)
+		if err != nil {
+			internalError(w, r, "get org", err, "org_id", target.OrgID)
+			return
+		}
+		if org != nil && org.QuotaBytes > 0 && org.UsedBytes+incomingBytes > org.QuotaBytes {
+			jsonError(w, fmt.Sprintf("target organization quota exceeded: used %d + incoming %d > quota %d bytes",
+				org.UsedBytes, incomingBytes, org.QuotaBytes), http.StatusForbidden)
+			return
+		}
+	}
+
+	if !resuming {
+		t.TotalCount = len(pending)
+	}
+	t.Status = "running"
+	t.Error = ""
+	if err := h.store.PutTransfer(r.Context(), t); err != nil {
+		internalError(w, r, "save transfer", err, "transfer_id", t.ID)
+		return
+	}
+
+	start := time.Now()
+	logger(r.Context()).Info("admin transfer", "transfer_id", t.ID, "mode", t.Mode, "backups", len(pending), "source_agent_id", source.ID, "target_agent_id", target.ID, "resume", resuming)
+
+	for i := range pending {
+		if err := h.transferBackup(r.Context(), t, &pending[i]); err != nil {
+			logger(r.Context()).Error("transfer backup", "transfer_id", t.ID, "timestamp", pending[i].Timestamp, "err", err)
+			t.Status = "failed"
+			t.Error = err.Error()
+			// Recorded even when the client has gone away
+			if err := h.store.PutTransfer(context.WithoutCancel(r.Context()), t); err != nil {
+				logger(r.Context()).Error("save transfer", "transfer_id", t.ID, "err", err)
+			}
+			jsonError(w, "transfer interrupted, re-run the request to resume", http.StatusInternalServerError)
+			return
+		}
+		if t.DoneCount < t.TotalCount {
+			t.DoneCount++
+		}
+		if err := h.store.PutTransfer(r.Context(), t); err != nil {
+			logger(r.Context()).Warn("save transfer progress", "transfer_id", t.ID, "err", err)
+		}
+		if i+1 < len(pending) && time.Since(start) > transferTimeBudget {
+			h.updateTransferUsage(r, t)
+			logger(r.Context()).Info("admin transfer paused", "transfer_id", t.ID, "done", t.DoneCount, "total", t.TotalCount)
+			jsonResponse(w, http.StatusAccepted, transferToResponse(t))
+			return
+		}
+	}
+
+	h.updateTransferUsage(r, t)
+
+	t.Status = "completed"
+	t.DoneCount = t.TotalCount
+	if err := h.store.PutTransfer(r.Context(), t); err != nil {
+		internalError(w, r, "save transfer", err, "transfer_id", t.ID)
+		return
+	}
+
+	logger(r.Context()).Info("admin transfer completed", "transfer_id", t.ID, "backups", t.TotalCount)
+	h.audit(r, "backup.transfer", source.ID, "agent:"+target.ID, nil, transferToResponse(t))
+	jsonResponse(w, http.StatusOK, transferToResponse(t))
+}
+
+// updateTransferUsage recounts used_bytes of both agents of t.
+func (h *Handlers) updateTransferUsage(r *http.Request, t *BackupTransfer) {
+	if err := h.store.UpdateUsedBytes(r.Context(), t.SourceAgentID); err != nil {
+		logger(r.Context()).Warn("update used bytes", "source_agent_id", t.SourceAgentID, "err", err)
+	}
+	if err := h.store.UpdateUsedBytes(r.Context(), t.TargetAgentID); err != nil {
+		logger(r.Context()).Warn("update used bytes", "target_agent_id", t.TargetAgentID, "err", err)
+	}
+}
+
+// transferBackup copies one backup to the target agent and, in move mode,
+// removes it from the source. Every step is safe to repeat.
+func (h *Handlers) transferBackup(ctx context.Context, t *BackupTransfer, b *Backup) error {
+	dst := *b
+	dst.AgentID = t.TargetAgentID
+	dst.S3Key = rekeyObject(b.S3Key, t.SourceAgentID, t.TargetAgentID, b.Timestamp)
+	dst.ManifestS3Key = rekeyObject(b.ManifestS3Key, t.SourceAgentID, t.TargetAgentID, b.Timestamp)
+
+	for _, pair := range [][2]string{{b.S3Key, dst.S3Key}, {b.ManifestS3Key, dst.ManifestS3Key}} {
+		if err := h.s3.CopyObject(ctx, pair[0], pair[1]); err != nil {
+			if IsNotFound(err) {
+				// The agent requested an upload URL but never uploaded
+				logger(ctx).Warn("transfer source object missing, skipping", "transfer_id", t.ID, "key", pair[0])
+				continue
+			}
+			return err
+		}
+	}
+
+	if err := h.store.PutBackup(ctx, &dst); err != nil {
+		return fmt.Errorf("write target backup: %w", err)
+	}
+
+	if t.Mode == "move" {
+		if err := h.store.PurgeBackup(ctx, t.SourceAgentID, b.Timestamp); err != nil {
+			return fmt.Errorf("purge source backup: %w", err)
+		}
+		h.s3.DeleteBackupObjects(ctx, b)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/transfers/{id}
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminGetTransfer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "transfer id required", http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.store.GetTransfer(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get transfer", err, "transfer_id", id)
+		return
+	}
+	if t == nil {
+		jsonError(w, "transfer not found", http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, transferToResponse(t))
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Outbound webhooks
+// ---------------------------------------------------------------------------
+//
+// Admins subscribe URLs to notification events. For each event, the
+// WebhookDispatcher records a WebhookDelivery per subscribed webhook and
+// POSTs the event to it in the background, signed with the webhook's
+// secret. Failed attempts are retried with exponential backoff, and the
+// delivery log keeps the outcome of each. The HTTP server waits out the
+// backoff in process and runs RetryDue every minute for deliveries left
+// pending by a restart. On Lambda, where an idle instance is frozen, only
+// the first attempt is made in process and a schedule runs RetryDue.
+// Delivery is at least once: receivers should deduplicate on the delivery
+// ID.
+
+const (
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+	webhookMaxRetryDelay     = time.Hour
+)
+
+// Headers sent with every delivery.
+const (
+	webhookEventHeader     = "X-OpenClaw-Event"
+	webhookDeliveryHeader  = "X-OpenClaw-Delivery"
+	webhookTimestampHeader = "X-OpenClaw-Timestamp"
+	webhookSignatureHeader = "X-OpenClaw-Signature"
+)
+
+// signWebhook returns the signature header of a delivery: "sha256=" and the
+// hex HMAC-SHA256, keyed by the webhook secret, of "<timestamp>.<body>".
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher is the Notifier that delivers events to webhooks.
+type WebhookDispatcher struct {
+	store       DataStore
+	client      *http.Client
+	maxAttempts int
+	retryBase   time.Duration
+	inProcess   bool // wait out the backoff in process rather than leave it to RetryDue
+
+	mu       sync.Mutex
+	inflight map[string]bool // delivery IDs being worked on in this process
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewWebhookDispatcher(store DataStore, cfg *Config) *WebhookDispatcher {
+	maxAttempts := cfg.WebhookMaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &WebhookDispatcher{
+		store: store,
+		client: &http.Client{
+			Timeout: cfg.WebhookTimeout,
+			// A redirect is a failed delivery, not a reason to resend the
+			// body elsewhere.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		maxAttempts: maxAttempts,
+		retryBase:   cfg.WebhookRetryBase,
+		inProcess:   !cfg.IsLambda(),
+		inflight:    map[string]bool{},
+		stop:        make(chan struct{}),
+	}
+}
+
+// Notify records a pending delivery for each webhook subscribed to e before
+// it returns and makes the attempts in the background. A Lambda instance may
+// be frozen once the response is returned; the recorded deliveries are then
+// left to RetryDue rather than lost.
+func (d *WebhookDispatcher) Notify(ctx context.Context, e Event) {
+	d.dispatch(context.WithoutCancel(ctx), e)
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context, e Event) {
+	webhooks, err := d.store.ListWebhooks(ctx)
+	if err != nil {
+		logger(ctx).Error("list webhooks", "event_id", e.ID, "err", err)
+		return
+	}
+
+	var payload []byte
+	for i := range webhooks {
+		wh := &webhooks[i]
+		if !wh.Wants(e.Type) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(e); err != nil {
+				logger(ctx).Error("marshal event", "event_id", e.ID, "err", err)
+				return
+			}
+		}
+
+		id, err := GenerateDeliveryID()
+		if err != nil {
+			logger(ctx).Error("generate delivery ID", "err", err)
+			return
+		}
+		now := time.Now().UTC()
+		del := &WebhookDelivery{
+			ID:            id,
+			WebhookID:     wh.ID,
+			EventID:       e.ID,
+			EventType:     e.Type,
+			Payload:       payload,
+			Status:        "pending",
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if err := d.store.PutWebhookDelivery(ctx, del); err != nil {
+			logger(ctx).Error("record webhook delivery", "webhook_id", wh.ID, "event_id", e.ID, "err", err)
+			continue
+		}
+
+		d.claim(del.ID)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			defer d.release(del.ID)
+			d.deliver(ctx, wh, del)
+		}()
+	}
+}
+
+// deliver makes attempts until one succeeds or they run out. If retries are
+// not made in process, or the dispatcher is closed in between, the delivery
+// stays pending for RetryDue.
+func (d *WebhookDispatcher) deliver(ctx context.Context, wh *Webhook, del *WebhookDelivery) {
+	for {
+		delay, done := d.step(ctx, wh, del)
+		if done || !d.inProcess {
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// step makes one attempt and records its outcome. It returns the delay
+// before the next attempt, or done once the delivery has succeeded or
+// failed for good.
+func (d *WebhookDispatcher) step(ctx context.Context, wh *Webhook, del *WebhookDelivery) (delay time.Duration, done bool) {
+	code, err := d.attempt(ctx, wh, del)
+
+	now := time.Now().UTC()
+	del.Attempts++
+	del.ResponseCode = code
+	del.UpdatedAt = now
+	del.NextAttemptAt = nil
+	switch {
+	case err == nil:
+		del.Status = "succeeded"
+		del.Error = ""
+	case del.Attempts >= d.maxAttempts:
+		del.Status = "failed"
+		del.Error = err.Error()
+		logger(ctx).Warn("webhook delivery failed", "webhook_id", wh.ID, "delivery_id", del.ID, "attempts", del.Attempts, "err", err)
+	default:
+		del.Error = err.Error()
+		delay = d.backoff(del.Attempts)
+		next := now.Add(delay)
+		del.NextAttemptAt = &next
+	}
+
+	if err := d.store.PutWebhookDelivery(ctx, del); err != nil {
+		logger(ctx).Error("record webhook delivery", "webhook_id", wh.ID, "delivery_id", del.ID, "err", err)
+	}
+	return delay, del.Status != "pending"
+}
+
+// attempt POSTs the delivery's payload once. Any 2xx response is success.
+func (d *WebhookDispatcher) attempt(ctx context.Context, wh *Webhook, del *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "openclaw-backup-webhooks")
+	req.Header.Set(webhookEventHeader, del.EventType)
+	req.Header.Set(webhookDeliveryHeader, del.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(wh.Secret, timestamp, del.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff is the delay after the given number of failed attempts:
+// retryBase, doubling each time, up to webhookMaxRetryDelay.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	if attempts > 30 {
+		return webhookMaxRetryDelay
+	}
+	delay := d.retryBase << (attempts - 1)
+	if delay <= 0 || delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	return delay
+}
+
+// RetryDue makes one attempt at each pending delivery whose next attempt is
+// due and that no goroutine of this process is already working on. It
+// returns the number of attempts made.
+func (d *WebhookDispatcher) RetryDue(ctx context.Context) (int, error) {
+	due, _, err := d.store.ListWebhookDeliveries(ctx, WebhookDeliveryFilter{
+		DueBefore: time.Now().UTC(),
+		Page:      Page{Limit: maxPageSize}, // per run; the rest wait for the next
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	attempted := 0
+	webhooks := map[string]*Webhook{}
+	for i := range due {
+		del := &due[i]
+		if !d.claim(del.ID) {
+			continue
+		}
+
+		wh, ok := webhooks[del.WebhookID]
+		if !ok {
+			if wh, err = d.store.GetWebhook(ctx, del.WebhookID); err != nil {
+				d.release(del.ID)
+				return attempted, err
+			}
+			webhooks[del.WebhookID] = wh
+		}
+		if wh == nil {
+			del.Status = "failed"
+			del.Error = "webhook deleted"
+			del.NextAttemptAt = nil
+			del.UpdatedAt = time.Now().UTC()
+			if err := d.store.PutWebhookDelivery(ctx, del); err != nil {
+				logger(ctx).Error("record webhook delivery", "delivery_id", del.ID, "err", err)
+			}
+			d.release(del.ID)
+			continue
+		}
+
+		d.step(ctx, wh, del)
+		d.release(del.ID)
+		attempted++
+	}
+	return attempted, nil
+}
+
+// claim marks a delivery as being worked on, reporting false if it already
+// was.
+func (d *WebhookDispatcher) claim(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inflight[id] {
+		return false
+	}
+	d.inflight[id] = true
+	return true
+}
+
+func (d *WebhookDispatcher) release(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inflight, id)
+}
+
+// Close stops waiting retries and waits, until ctx is done, for attempts in
+// progress.
+func (d *WebhookDispatcher) Close(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.stop) })
+	return d.Wait(ctx)
+}
+
+// Wait waits, until ctx is done, for deliveries in progress, including
+// retries waiting out their backoff.
+func (d *WebhookDispatcher) Wait(ctx context.Context) error {
+	return waitGroup(ctx, &d.wg)
+}
+
+// runWebhookRetries runs RetryDue every interval until ctx is done.
+func runWebhookRetries(ctx context.Context, d *WebhookDispatcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.RetryDue(ctx); err != nil {
+				logger(ctx).Error("webhook retries", "err", err)
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Admin API
+// ---------------------------------------------------------------------------
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // empty = all events
+}
+
+type WebhookResponse struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"` // only returned on creation
+	CreatedAt string   `json:"created_at"`
+}
+
+func webhookToResponse(wh Webhook) WebhookResponse {
+	events := wh.Events
+	if events == nil {
+		events = []string{}
+	}
+	return WebhookResponse{
+		ID:        wh.ID,
+		URL:       wh.URL,
+		Events:    events,
+		CreatedAt: wh.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+type WebhookDeliveryResponse struct {
+	ID            string          `json:"id"`
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"response_code,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	NextAttemptAt string          `json:"next_attempt_at,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     string          `json:"created_at"`
+	UpdatedAt     string          `json:"updated_at"`
+}
+
+type ListWebhookDeliveriesResponse struct {
+	Deliveries []WebhookDeliveryResponse `json:"deliveries"`
+	NextCursor string                    `json:"next_cursor,omitempty"`
+}
+
+func webhookDeliveryToResponse(d WebhookDelivery) WebhookDeliveryResponse {
+	resp := WebhookDeliveryResponse{
+		ID:           d.ID,
+		EventID:      d.EventID,
+		EventType:    d.EventType,
+		Status:       d.Status,
+		Attempts:     d.Attempts,
+		ResponseCode: d.ResponseCode,
+		Error:        d.Error,
+		Payload:      d.Payload,
+		CreatedAt:    d.CreatedAt.Format(time.RFC3339Nano),
+		UpdatedAt:    d.UpdatedAt.Format(time.RFC3339Nano),
+	}
+	if d.NextAttemptAt != nil {
+		resp.NextAttemptAt = d.NextAttemptAt.Format(time.RFC3339)
+	}
+	return resp
+}
+
+// validWebhookURL accepts absolute http and https URLs.
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func validEventType(typ string) bool {
+	for _, t := range eventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------
+// POST /v1/admin/webhooks
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !validWebhookURL(req.URL) {
+		jsonError(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	for _, e := range req.Events {
+		if !validEventType(e) {
+			jsonError(w, "unknown event type: "+e, http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := GenerateWebhookID()
+	if err != nil {
+		internalError(w, r, "generate webhook ID", err)
+		return
+	}
+	secret, err := GenerateWebhookSecret()
+	if err != nil {
+		internalError(w, r, "generate webhook secret", err)
+		return
+	}
+
+	wh := &Webhook{
+		ID:        id,
+		URL:       req.URL,
+		Secret:    secret,
+		Events:    req.Events,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := h.store.CreateWebhook(r.Context(), wh); err != nil {
+		internalError(w, r, "create webhook", err)
+		return
+	}
+
+	logger(r.Context()).Info("admin created webhook", "webhook_id", wh.ID, "url", wh.URL)
+	h.audit(r, "webhook.create", "", "webhook:"+wh.ID, nil, webhookToResponse(*wh))
+	resp := webhookToResponse(*wh)
+	resp.Secret = wh.Secret
+	jsonResponse(w, http.StatusCreated, resp)
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/webhooks
+// ---------------------------------------------------------------------------
+
+type ListWebhooksResponse struct {
+	Webhooks   []WebhookResponse `json:"webhooks"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+func (h *Handlers) AdminListWebhooks(w http.ResponseWriter, r *http.Request) {
+	page, msg := parsePage(r)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	webhooks, err := h.store.ListWebhooks(r.Context())
+	if err != nil {
+		internalError(w, r, "list webhooks", err)
+		return
+	}
+	start, end, next, err := offsetPage(len(webhooks), page)
+	if err != nil {
+		internalError(w, r, "list webhooks", err)
+		return
+	}
+
+	resp := make([]WebhookResponse, 0, end-start)
+	for _, wh := range webhooks[start:end] {
+		resp = append(resp, webhookToResponse(wh))
+	}
+	jsonResponse(w, http.StatusOK, ListWebhooksResponse{Webhooks: resp, NextCursor: next})
+}
+
+// ---------------------------------------------------------------------------
+// DELETE /v1/admin/webhooks/{id}
+// ---------------------------------------------------------------------------
+
+func (h *Handlers) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		jsonError(w, "webhook id required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.DeleteWebhook(r.Context(), id); err != nil {
+		logger(r.Context()).Error("delete webhook", "webhook_id", id, "err", err)
+		jsonError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("admin deleted webhook", "webhook_id", id)
+	h.audit(r, "webhook.delete", "", "webhook:"+id, nil, nil)
+	jsonResponse(w, http.StatusOK, map[string]string{"deleted": id})
+}
+
+// ---------------------------------------------------------------------------
+// GET /v1/admin/webhooks/{id}/deliveries
+// ---------------------------------------------------------------------------
+
+// AdminListWebhookDeliveries returns a webhook's delivery log, newest first,
+// optionally filtered by ?status= and paged by ?cursor= and ?limit=
+// (default 100).
+func (h *Handlers) AdminListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	f := WebhookDeliveryFilter{WebhookID: id, Status: r.URL.Query().Get("status")}
+	if f.Status != "" && f.Status != "pending" && f.Status != "succeeded" && f.Status != "failed" {
+		jsonError(w, "status must be \"pending\", \"succeeded\" or \"failed\"", http.StatusBadRequest)
+		return
+	}
+	var msg string
+	if f.Page, msg = parsePage(r); msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	wh, err := h.store.GetWebhook(r.Context(), id)
+	if err != nil {
+		internalError(w, r, "get webhook", err, "webhook_id", id)
+		return
+	}
+	if wh == nil {
+		jsonError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	deliveries, next, err := h.store.ListWebhookDeliveries(r.Context(), f)
+	if err != nil {
+		internalError(w, r, "list webhook deliveries", err, "webhook_id", id)
+		return
+	}
+
+	resp := make([]WebhookDeliveryResponse, len(deliveries))
+	for i, d := range deliveries {
+		resp[i] = webhookDeliveryToResponse(d)
+	}
+	jsonResponse(w, http.StatusOK, ListWebhookDeliveriesResponse{Deliveries: resp, NextCursor: next})
+}
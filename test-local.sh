@@ -276,7 +276,7 @@ TOKEN="$NEW_TOKEN"
 info "16. Admin list agents"
 do_admin_curl "$BASE_URL/v1/admin/agents"
 assert_status "GET /v1/admin/agents" "200" "$RESP_STATUS"
-assert_json "at least 1 agent" '. | length > 0' "true" "$RESP_BODY"
+assert_json "at least 1 agent" '.agents | length > 0' "true" "$RESP_BODY"
 
 # Filter by status
 do_admin_curl "$BASE_URL/v1/admin/agents?status=active"